@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"tp1-distribuidos/shared/health"
+)
+
+const usage = `Uso: admin [flags] <comando> [argumentos]
+
+Comandos:
+  sessions                     sesiones activas de todas las instancias del server
+  cleanups                     clientes terminados con nodos que no confirmaron el borrado
+  progress [nodo...]           mensajes procesados por nodo y por cliente
+  finish [-orphan] <client_id> termina un cliente y avisa ClientsFinished
+  state [-ids n] <nodo> [client_id]
+                               archivos Processed y commit persistidos del nodo
+  queues                       mensajes y consumidores de cada cola de rabbit
+
+Flags:
+`
+
+func main() {
+	flags := flag.NewFlagSet("admin", flag.ExitOnError)
+	nodesFile := flags.String("nodes", "./name_ip.csv", "archivo con los nodos del cluster")
+	port := flags.Int("port", health.DEFAULT_PORT, "puerto de health y admin de los nodos")
+	timeout := flags.Duration("timeout", 5*time.Second, "timeout de cada request")
+	rabbit := flags.String("rabbit", "http://rabbitmq:15672", "API de management de rabbit")
+	rabbitUser := flags.String("rabbit-user", "guest", "usuario de rabbit")
+	rabbitPassword := flags.String("rabbit-password", "guest", "password de rabbit")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	command, args := flags.Arg(0), flags.Args()[1:]
+	if command == "queues" {
+		exit(queues(&Rabbit{url: *rabbit, user: *rabbitUser, password: *rabbitPassword, client: &http.Client{Timeout: *timeout}}))
+	}
+
+	cluster, err := NewCluster(*nodesFile, *port, *timeout)
+	if err != nil {
+		exit(err)
+	}
+
+	switch command {
+	case "sessions":
+		err = sessions(cluster)
+	case "cleanups":
+		err = cleanups(cluster)
+	case "progress":
+		err = progress(cluster, args)
+	case "finish":
+		err = finish(cluster, args)
+	case "state":
+		err = state(cluster, args)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	exit(err)
+}
+
+func exit(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func table() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+// failed junta los errores de los nodos que no contestaron, el resto de la
+// salida se muestra igual
+func failed(errs map[string]error) error {
+	nodes := make([]string, 0, len(errs))
+	for node := range errs {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	joined := []error{}
+	for _, node := range nodes {
+		joined = append(joined, fmt.Errorf("%s: %w", node, errs[node]))
+	}
+	return errors.Join(joined...)
+}
+
+type Session struct {
+	Id              string    `json:"id"`
+	Owner           int       `json:"owner"`
+	Priority        int       `json:"priority"`
+	State           string    `json:"state"`
+	Connected       bool      `json:"connected"`
+	Games           int       `json:"games"`
+	Reviews         int       `json:"reviews"`
+	ReviewBatches   int       `json:"review_batches"`
+	FinishedQueries int       `json:"finished_queries"`
+	PendingResults  int       `json:"pending_results"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+func sessions(cluster *Cluster) error {
+	errs := map[string]error{}
+	out := table()
+	fmt.Fprintln(out, "NODE\tCLIENT\tOWNER\tPRIORITY\tSTATE\tCONNECTED\tGAMES\tREVIEWS\tBATCHES\tQUERIES\tPENDING\tUPDATED")
+	for _, node := range cluster.Nodes("server-") {
+		list := []Session{}
+		if err := cluster.Get(node, "/admin/sessions", &list); err != nil {
+			errs[node] = err
+			continue
+		}
+		for _, session := range list {
+			fmt.Fprintf(out, "%s\t%s\t%d\t%d\t%s\t%t\t%d\t%d\t%d\t%05b\t%d\t%s\n",
+				node, session.Id, session.Owner, session.Priority, session.State, session.Connected,
+				session.Games, session.Reviews, session.ReviewBatches, session.FinishedQueries,
+				session.PendingResults, time.Since(session.UpdatedAt).Round(time.Second))
+		}
+	}
+	out.Flush()
+	return failed(errs)
+}
+
+type Cleanup struct {
+	ClientId  string    `json:"client_id"`
+	StartedAt time.Time `json:"started_at"`
+	Retries   int       `json:"retries"`
+	Missing   []string  `json:"missing"`
+}
+
+func cleanups(cluster *Cluster) error {
+	errs := map[string]error{}
+	out := table()
+	fmt.Fprintln(out, "NODE\tCLIENT\tSTARTED\tRETRIES\tMISSING")
+	for _, node := range cluster.Nodes("server-") {
+		list := []Cleanup{}
+		if err := cluster.Get(node, "/admin/cleanups", &list); err != nil {
+			errs[node] = err
+			continue
+		}
+		for _, cleanup := range list {
+			fmt.Fprintf(out, "%s\t%s\t%s\t%d\t%s\n",
+				node, cleanup.ClientId, time.Since(cleanup.StartedAt).Round(time.Second), cleanup.Retries, strings.Join(cleanup.Missing, ","))
+		}
+	}
+	out.Flush()
+	return failed(errs)
+}
+
+func progress(cluster *Cluster, nodes []string) error {
+	if len(nodes) == 0 {
+		nodes = cluster.Nodes("")
+	}
+
+	errs := map[string]error{}
+	out := table()
+	fmt.Fprintln(out, "NODE\tMETRIC\tCLIENT\tVALUE")
+	for _, node := range nodes {
+		text, err := cluster.GetText(node, "/metrics")
+		if err != nil {
+			errs[node] = err
+			continue
+		}
+		for _, sample := range ParseMetrics(text) {
+			switch sample.Name {
+			case "processed_total", "processed_rate":
+				fmt.Fprintf(out, "%s\t%s (%s)\t-\t%g\n", node, sample.Labels["metric"], sample.Name, sample.Value)
+			case "client_processed_total":
+				fmt.Fprintf(out, "%s\t%s\t%s\t%g\n", node, sample.Labels["metric"], sample.Labels["client"], sample.Value)
+			case "messages_in_flight":
+				fmt.Fprintf(out, "%s\tin flight\t-\t%g\n", node, sample.Value)
+			}
+		}
+	}
+	out.Flush()
+	return failed(errs)
+}
+
+// finish le pide el cliente a cada instancia del server, la que tenga la
+// sesion la termina. Con -orphan, si ninguna la tiene, la primera que conteste
+// avisa ClientsFinished igual.
+func finish(cluster *Cluster, args []string) error {
+	flags := flag.NewFlagSet("finish", flag.ExitOnError)
+	orphan := flags.Bool("orphan", false, "avisar aunque ningun server tenga la sesion")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: finish [-orphan] <client_id>")
+	}
+	clientId := flags.Arg(0)
+	if _, err := strconv.ParseUint(clientId, 10, 64); err != nil {
+		return fmt.Errorf("invalid client id %s", clientId)
+	}
+
+	servers := cluster.Nodes("server-")
+	errs := map[string]error{}
+	for _, query := range []string{"", "?orphan=true"} {
+		if query != "" && !*orphan {
+			break
+		}
+		for _, node := range servers {
+			result := map[string]string{}
+			err := cluster.Post(node, "/admin/clients/"+clientId+"/finish"+query, &result)
+			var status *StatusError
+			if errors.As(err, &status) && status.Code == http.StatusNotFound {
+				continue
+			}
+			if err != nil {
+				errs[node] = err
+				continue
+			}
+			fmt.Printf("client %s finished by %s (state: %s)\n", clientId, node, result["state"])
+			return nil
+		}
+	}
+
+	if len(errs) > 0 {
+		return failed(errs)
+	}
+	return fmt.Errorf("no server owns client %s, use -orphan to notify the nodes anyway", clientId)
+}
+
+func state(cluster *Cluster, args []string) error {
+	flags := flag.NewFlagSet("state", flag.ExitOnError)
+	ids := flags.Int("ids", 20, "cuantos ids de cada Processed mostrar")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("usage: state [-ids n] <node> [client_id]")
+	}
+
+	path := "/admin/state?ids=" + strconv.Itoa(*ids)
+	if flags.NArg() == 2 {
+		path += "&client=" + flags.Arg(1)
+	}
+
+	result := map[string]any{}
+	if err := cluster.Get(flags.Arg(0), path, &result); err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
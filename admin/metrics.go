@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Sample es una linea del formato de texto de Prometheus
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// ParseMetrics lee lo que sirve /metrics. Solo entiende lo que escribe
+// shared/metrics: sin timestamps y con los valores de los labels entre
+// comillas.
+func ParseMetrics(text string) []Sample {
+	samples := []Sample{}
+	for _, line := range strings.Split(text, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		space := strings.LastIndexByte(line, ' ')
+		if space < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[space+1:], 64)
+		if err != nil {
+			continue
+		}
+
+		sample := Sample{Name: line[:space], Labels: map[string]string{}, Value: value}
+		if open := strings.IndexByte(sample.Name, '{'); open >= 0 {
+			sample.Labels = parseLabels(sample.Name[open+1 : len(sample.Name)-1])
+			sample.Name = sample.Name[:open]
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+func parseLabels(text string) map[string]string {
+	labels := map[string]string{}
+	for len(text) > 0 {
+		equals := strings.IndexByte(text, '=')
+		if equals < 0 || equals+1 >= len(text) || text[equals+1] != '"' {
+			return labels
+		}
+		name := text[:equals]
+
+		value := strings.Builder{}
+		i := equals + 2
+		for ; i < len(text) && text[i] != '"'; i++ {
+			if text[i] == '\\' && i+1 < len(text) {
+				i++
+				if text[i] == 'n' {
+					value.WriteByte('\n')
+					continue
+				}
+			}
+			value.WriteByte(text[i])
+		}
+		labels[name] = value.String()
+
+		text = strings.TrimPrefix(text[min(i+1, len(text)):], ",")
+	}
+	return labels
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMetrics(t *testing.T) {
+	samples := ParseMetrics(`# HELP client_processed_total Messages processed per client.
+# TYPE client_processed_total counter
+client_processed_total{metric="query3_stats",client="42"} 1500
+messages_in_total{queue="re\"views"} 3
+messages_in_flight 2
+`)
+
+	assert.Equal(t, []Sample{
+		{Name: "client_processed_total", Labels: map[string]string{"metric": "query3_stats", "client": "42"}, Value: 1500},
+		{Name: "messages_in_total", Labels: map[string]string{"queue": `re"views`}, Value: 3},
+		{Name: "messages_in_flight", Labels: map[string]string{}, Value: 2},
+	}, samples)
+}
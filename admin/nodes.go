@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Cluster son los nodos de name_ip.csv, el mismo archivo que usa el reviver.
+// Los endpoints de admin estan en el puerto de health de cada nodo y se
+// llega por el nombre del container, asi que el comando corre dentro de la
+// red de docker.
+type Cluster struct {
+	nodes  []string
+	port   int
+	client *http.Client
+}
+
+func NewCluster(path string, port int, timeout time.Duration) (*Cluster, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]string, 0, len(records))
+	for _, record := range records {
+		nodes = append(nodes, record[0])
+	}
+
+	return &Cluster{nodes: nodes, port: port, client: &http.Client{Timeout: timeout}}, nil
+}
+
+// Nodes devuelve los nodos cuyo nombre empieza con prefix, todos si es ""
+func (c *Cluster) Nodes(prefix string) []string {
+	nodes := []string{}
+	for _, node := range c.nodes {
+		if strings.HasPrefix(node, prefix) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func (c *Cluster) url(node string, path string) string {
+	return fmt.Sprintf("http://%s:%d%s", node, c.port, path)
+}
+
+// Get hace un GET al nodo y decodifica la respuesta JSON en value
+func (c *Cluster) Get(node string, path string, value any) error {
+	response, err := c.client.Get(c.url(node, path))
+	if err != nil {
+		return err
+	}
+	return decode(response, value)
+}
+
+func (c *Cluster) Post(node string, path string, value any) error {
+	response, err := c.client.Post(c.url(node, path), "application/json", nil)
+	if err != nil {
+		return err
+	}
+	return decode(response, value)
+}
+
+// GetText devuelve el cuerpo de la respuesta, para /metrics
+func (c *Cluster) GetText(node string, path string) (string, error) {
+	response, err := c.client.Get(c.url(node, path))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
+
+// StatusError es una respuesta que no es 200, con el error que mando el nodo
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
+
+func decode(response *http.Response, value any) error {
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		failure := struct {
+			Error string `json:"error"`
+		}{}
+		json.NewDecoder(response.Body).Decode(&failure)
+		return &StatusError{Code: response.StatusCode, Message: failure.Error}
+	}
+	return json.NewDecoder(response.Body).Decode(value)
+}
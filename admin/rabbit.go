@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Rabbit habla con la API HTTP del plugin de management (rabbitmq:4-management)
+type Rabbit struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+}
+
+type Queue struct {
+	Name      string `json:"name"`
+	Messages  int    `json:"messages"`
+	Ready     int    `json:"messages_ready"`
+	Unacked   int    `json:"messages_unacknowledged"`
+	Consumers int    `json:"consumers"`
+}
+
+func (r *Rabbit) Queues() ([]Queue, error) {
+	request, err := http.NewRequest("GET", r.url+"/api/queues", nil)
+	if err != nil {
+		return nil, err
+	}
+	request.SetBasicAuth(r.user, r.password)
+
+	response, err := r.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("management api answered %s", response.Status)
+	}
+
+	queues := []Queue{}
+	if err := json.NewDecoder(response.Body).Decode(&queues); err != nil {
+		return nil, err
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].Name < queues[j].Name })
+	return queues, nil
+}
+
+func queues(rabbit *Rabbit) error {
+	queues, err := rabbit.Queues()
+	if err != nil {
+		return err
+	}
+
+	out := table()
+	fmt.Fprintln(out, "QUEUE\tMESSAGES\tREADY\tUNACKED\tCONSUMERS")
+	for _, queue := range queues {
+		fmt.Fprintf(out, "%s\t%d\t%d\t%d\t%d\n", queue.Name, queue.Messages, queue.Ready, queue.Unacked, queue.Consumers)
+	}
+	return out.Flush()
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"sync"
 	"time"
 	"tp1-distribuidos/shared/protocol"
 )
@@ -15,7 +17,8 @@ type ServerConfig struct {
 }
 
 type LogConfig struct {
-	Level string `mapstructure:"level"`
+	Level  string `mapstructure:"level"`
+	Format string `mapstructure:"format"`
 }
 
 type BatchConfig struct {
@@ -27,39 +30,215 @@ type ResultsConfig struct {
 }
 
 type Config struct {
-	Server  ServerConfig  `mapstructure:"server"`
-	Log     LogConfig     `mapstructure:"log"`
-	Batch   BatchConfig   `mapstructure:"batch"`
-	Results ResultsConfig `mapstructure:"results"`
+	Server   ServerConfig  `mapstructure:"server"`
+	Log      LogConfig     `mapstructure:"log"`
+	Batch    BatchConfig   `mapstructure:"batch"`
+	Results  ResultsConfig `mapstructure:"results"`
+	Priority string        `mapstructure:"priority"` // low (batch), normal o high (interactivo)
 }
 
 type Client struct {
-	config Config
-	conn   net.Conn
+	config     Config
+	conn       net.Conn
+	id         string
+	lock       sync.Mutex
+	sendLock   sync.Mutex
+	cancelled  bool
+	receiving  bool       // ReceiveResponse es el que lee de la conexion
+	cancelDone chan error // nil cuando llega Cancelled
 }
 
+const RECONNECT_ATTEMPTS = 10
+const RECONNECT_BACKOFF = 2 * time.Second
+const CANCEL_TIMEOUT = 15 * time.Second
+
+var ErrCancelled = errors.New("session cancelled")
+
 // NewClient Initializes a new client receiving the configuration
-// as a parameter
+// as a parameter. If the server is busy it waits the hinted time and
+// tries again.
 func NewClient(config Config) *Client {
-	conn, err := net.Dial("tcp", config.Server.Address)
+	client := &Client{
+		config:     config,
+		cancelDone: make(chan error, 1),
+	}
+
+	for {
+		conn, err := net.Dial("tcp", config.Server.Address)
+		if err != nil {
+			log.Criticalf(
+				"action: connect | result: fail| error: %v",
+				err,
+			)
+			return nil
+		}
+		client.conn = conn
+
+		id, err := client.handshake(&protocol.Hello{Priority: config.Priority})
+		var busy *busyError
+		if errors.As(err, &busy) {
+			conn.Close()
+			log.Infof("action: handshake | result: busy | retry_after: %s", busy.retryAfter)
+			time.Sleep(busy.retryAfter)
+			continue
+		}
+		if err != nil {
+			log.Criticalf("action: handshake | result: fail | error: %v", err)
+			conn.Close()
+			return nil
+		}
+		client.id = id
+
+		log.Infof("action: handshake | result: success | client_id: %s", id)
+		return client
+	}
+}
+
+// busyError es el rechazo del servidor cuando no admite mas clientes
+type busyError struct {
+	retryAfter time.Duration
+}
+
+func (e *busyError) Error() string {
+	return fmt.Sprintf("server busy, retry after %s", e.retryAfter)
+}
+
+func (c *Client) handshake(msg protocol.Message) (string, error) {
+	if err := protocol.Send(c.conn, msg); err != nil {
+		return "", err
+	}
+
+	response, err := protocol.Receive(c.conn)
 	if err != nil {
-		log.Criticalf(
-			"action: connect | result: fail| error: %v",
-			err,
-		)
-		return nil
+		return "", err
+	}
+	if response.MessageType == protocol.MessageTypeBusy {
+		busy := protocol.Busy{}
+		if err := busy.Decode(response.Data); err != nil {
+			return "", err
+		}
+		retryAfter := time.Duration(busy.RetryAfter) * time.Second
+		if retryAfter <= 0 {
+			retryAfter = RECONNECT_BACKOFF
+		}
+		return "", &busyError{retryAfter: retryAfter}
+	}
+	if response.MessageType != protocol.MessageTypeSessionInfo {
+		return "", fmt.Errorf("unexpected handshake response: %d", response.MessageType)
 	}
 
-	client := &Client{
-		config: config,
-		conn:   conn,
+	info := protocol.SessionInfo{}
+	info.Decode(response.Data)
+	if info.ClientId == "" {
+		return "", fmt.Errorf("session rejected")
 	}
-	return client
+	return info.ClientId, nil
 }
 
+// reconnect retoma la sesion despues de perder la conexion mientras se
+// esperaban resultados (por ejemplo si se reinicio el servidor)
+func (c *Client) reconnect() error {
+	c.conn.Close()
+
+	var err error
+	for attempt := 1; attempt <= RECONNECT_ATTEMPTS && !c.isCancelled(); attempt++ {
+		time.Sleep(RECONNECT_BACKOFF)
+
+		var conn net.Conn
+		conn, err = net.Dial("tcp", c.config.Server.Address)
+		if err != nil {
+			log.Infof("action: reconnect | result: fail | attempt: %d | error: %v", attempt, err)
+			continue
+		}
+		c.conn = conn
+
+		if _, err = c.handshake(&protocol.Resume{ClientId: c.id}); err != nil {
+			conn.Close()
+			log.Infof("action: reconnect | result: fail | attempt: %d | error: %v", attempt, err)
+			continue
+		}
+
+		log.Infof("action: reconnect | result: success | client_id: %s", c.id)
+		return nil
+	}
+
+	return fmt.Errorf("could not resume session %s: %w", c.id, err)
+}
+
+// Cancel le pide al servidor que termine la sesion y espera, como mucho
+// CANCEL_TIMEOUT, la confirmacion de que ningun nodo tiene estado del cliente
 func (c *Client) Cancel() {
-	log.Debugf("action: cerrar_conexion | result: success")
-	c.Close()
+	c.lock.Lock()
+	if c.cancelled {
+		c.lock.Unlock()
+		return
+	}
+	c.cancelled = true
+	receiving := c.receiving
+	c.lock.Unlock()
+
+	defer c.Close()
+
+	log.Infof("action: cancel | result: in_progress | client_id: %s", c.id)
+	if err := c.send(&protocol.Cancel{}); err != nil {
+		log.Errorf("action: cancel | result: fail | client_id: %s | error: %v", c.id, err)
+		return
+	}
+	if !receiving {
+		go c.receiveCancel()
+	}
+
+	select {
+	case err := <-c.cancelDone:
+		if err != nil {
+			log.Errorf("action: cancel | result: fail | client_id: %s | error: %v", c.id, err)
+			return
+		}
+		log.Infof("action: cancel | result: success | client_id: %s", c.id)
+	case <-time.After(CANCEL_TIMEOUT):
+		log.Errorf("action: cancel | result: fail | client_id: %s | error: sin confirmacion despues de %s", c.id, CANCEL_TIMEOUT)
+	}
+}
+
+func (c *Client) isCancelled() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.cancelled
+}
+
+// receiveCancel lee la respuesta al Cancel cuando todavia se estaban subiendo
+// datos y nadie mas lee de la conexion
+func (c *Client) receiveCancel() {
+	for {
+		response, err := protocol.Receive(c.conn)
+		if err != nil {
+			c.cancelDone <- err
+			return
+		}
+		if c.handleCancelResponse(response) {
+			c.cancelDone <- nil
+			return
+		}
+	}
+}
+
+// handleCancelResponse devuelve true cuando llega la confirmacion final
+func (c *Client) handleCancelResponse(response *protocol.ReceivedMessage) bool {
+	switch response.MessageType {
+	case protocol.MessageTypeCancelAck:
+		ack := protocol.CancelAck{}
+		ack.Decode(response.Data)
+		log.Infof("action: cancel | result: acknowledged | client_id: %s | nodes: %d", c.id, ack.Nodes)
+	case protocol.MessageTypeCancelled:
+		return true
+	}
+	return false
+}
+
+func (c *Client) send(message protocol.Message) error {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	return protocol.Send(c.conn, message)
 }
 
 func (c *Client) Close() {
@@ -76,7 +255,7 @@ func (c *Client) SendGames(file *os.File) error {
 	reader := bufio.NewReader(file)
 	reader.ReadString('\n')
 
-	for {
+	for !c.isCancelled() {
 		batch := protocol.ClientGame{
 			Lines: make([]string, 0),
 		}
@@ -98,7 +277,7 @@ func (c *Client) SendGames(file *os.File) error {
 			break
 		}
 
-		err := protocol.Send(c.conn, &batch)
+		err := c.send(&batch)
 		if err != nil {
 			log.Errorf("action: enviar_juegos | result: fail | error: %v", err)
 			return err
@@ -108,6 +287,9 @@ func (c *Client) SendGames(file *os.File) error {
 
 	}
 
+	if c.isCancelled() {
+		return ErrCancelled
+	}
 	return nil
 }
 
@@ -118,7 +300,7 @@ func (c *Client) SendReviews(file *os.File) error {
 	reader := bufio.NewReader(file)
 	reader.ReadString('\n')
 
-	for {
+	for !c.isCancelled() {
 		batch := protocol.ClientReview{
 			Lines: make([]string, 0),
 		}
@@ -140,7 +322,7 @@ func (c *Client) SendReviews(file *os.File) error {
 			break
 		}
 
-		err := protocol.Send(c.conn, &batch)
+		err := c.send(&batch)
 		if err != nil {
 			log.Errorf("action: enviar_reviews | result: fail | error: %v", err)
 			return err
@@ -148,14 +330,28 @@ func (c *Client) SendReviews(file *os.File) error {
 		time.Sleep(5 * time.Millisecond)
 	}
 
+	if c.isCancelled() {
+		return ErrCancelled
+	}
 	return nil
 }
 
 func (c *Client) SendAllSent() error {
-	return protocol.Send(c.conn, &protocol.AllSent{})
+	if c.isCancelled() {
+		return ErrCancelled
+	}
+	return c.send(&protocol.AllSent{})
 }
 
 func (c *Client) ReceiveResponse() error {
+	c.lock.Lock()
+	if c.cancelled {
+		c.lock.Unlock()
+		return ErrCancelled
+	}
+	c.receiving = true
+	c.lock.Unlock()
+
 	resultsFile, err := os.Create(c.config.Results.Path)
 	if err != nil {
 		return err
@@ -176,10 +372,23 @@ func (c *Client) ReceiveResponse() error {
 
 		response, err := protocol.Receive(c.conn)
 		if err != nil {
-			return err
+			if c.isCancelled() {
+				c.cancelDone <- err
+				return err
+			}
+			log.Errorf("action: receive_response | result: fail | error: %v", err)
+			if err := c.reconnect(); err != nil {
+				return err
+			}
+			continue
 		}
 
 		switch response.MessageType {
+		case protocol.MessageTypeCancelAck, protocol.MessageTypeCancelled:
+			if c.handleCancelResponse(response) {
+				c.cancelDone <- nil
+				return ErrCancelled
+			}
 		case protocol.MessageTypeClientResponse1:
 			var response1 protocol.ClientResponse1
 			response1.Decode(response.Data)
@@ -203,13 +412,20 @@ func (c *Client) ReceiveResponse() error {
 		case protocol.MessageTypeClientResponse3:
 			var response3 protocol.ClientResponse3
 			response3.Decode(response.Data)
+			if queriesFinished[2] {
+				continue
+			}
+			if !response3.Last {
+				for i, game := range response3.TopStats {
+					logResults(writer, fmt.Sprintf("[QUERY 3 - PARCIAL]: Top Game %d: %v (%d)", i+1, game.Name, game.Count))
+				}
+				continue
+			}
 			for i, game := range response3.TopStats {
 				logResults(writer, fmt.Sprintf("[QUERY 3]: Top Game %d: %v (%d)", i+1, game.Name, game.Count))
 			}
-			if !queriesFinished[2] {
-				queriesFinished[2] = true
-				queriesCompleted++
-			}
+			queriesFinished[2] = true
+			queriesCompleted++
 		case protocol.MessageTypeClientResponse4:
 			var response4 protocol.ClientResponse4
 			response4.Decode(response.Data)
@@ -231,6 +447,18 @@ func (c *Client) ReceiveResponse() error {
 				queriesFinished[4] = true
 				queriesCompleted++
 			}
+		case protocol.MessageTypeClientApproximate:
+			var approximate protocol.ClientApproximate
+			approximate.Decode(response.Data)
+			if approximate.QueryId < 1 || approximate.QueryId > 5 || queriesFinished[approximate.QueryId-1] {
+				continue
+			}
+			if approximate.QueryId == 5 {
+				logResults(writer, fmt.Sprintf("[QUERY 5 - APROXIMADO]: percentil 90 ~ %d negativas", approximate.Cutoff))
+			}
+			for i, game := range approximate.TopStats {
+				logResults(writer, fmt.Sprintf("[QUERY %d - APROXIMADO]: Top Game %d: %v (~%d)", approximate.QueryId, i+1, game.Name, game.Count))
+			}
 		}
 
 	}
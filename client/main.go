@@ -2,19 +2,17 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"math"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
-	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/logs"
 
-	"github.com/op/go-logging"
 	"github.com/spf13/viper"
 )
 
-var log = logging.MustGetLogger("log")
+var log = logs.Get("client")
 
 func InitConfig() (*Config, error) {
 	v := viper.New()
@@ -23,12 +21,14 @@ func InitConfig() (*Config, error) {
 	v.BindEnv("id", "CLI_ID")
 	v.BindEnv("server.address", "CLI_SERVER_ADDRESS")
 	v.BindEnv("log.level", "CLI_LOG_LEVEL")
+	v.BindEnv("log.format", "CLI_LOG_FORMAT")
 	v.BindEnv("batch.amount", "CLI_BATCH_AMOUNT")
 	v.BindEnv("results.path", "CLI_RESULTS_PATH")
+	v.BindEnv("priority", "CLI_PRIORITY")
 
 	v.SetConfigFile("./config.yml")
 	if err := v.ReadInConfig(); err != nil {
-		fmt.Printf("Configuration could not be read from config file. Using env variables instead")
+		log.Infof("action: read_config | result: fail | error: %s | using env variables instead", err)
 	}
 
 	config := Config{}
@@ -53,7 +53,7 @@ func main() {
 		log.Criticalf("%s", err)
 	}
 
-	if err := shared.InitLogger(config.Log.Level); err != nil {
+	if err := logs.Init(logs.Options{Node: "client", Level: config.Log.Level, Format: config.Log.Format}); err != nil {
 		log.Criticalf("%s", err)
 	}
 
@@ -82,9 +82,17 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGKILL)
 	defer stop()
 
+	cancelled := make(chan struct{})
 	go func() {
 		<-ctx.Done()
 		client.Cancel()
+		close(cancelled)
+	}()
+	// con una señal se espera la confirmacion del cancel antes de salir
+	defer func() {
+		if ctx.Err() != nil {
+			<-cancelled
+		}
 	}()
 
 	startTime := time.Now()
@@ -2,32 +2,104 @@ package config
 
 import (
 	"fmt"
+	"tp1-distribuidos/shared/logs"
 
-	"github.com/op/go-logging"
 	"github.com/spf13/viper"
 )
 
-var log = logging.MustGetLogger("DEBUG")
+var log = logs.Get("config")
 
 type ServerConfig struct {
-	Address            string `mapstructure:"address"`
-	GamesBatchAmount   int    `mapstructure:"gamesBatchAmount"`
-	ReviewsBatchAmount int    `mapstructure:"reviewsBatchAmount"`
+	Address             string `mapstructure:"address"`
+	GamesBatchAmount    int    `mapstructure:"gamesBatchAmount"`
+	ReviewsBatchAmount  int    `mapstructure:"reviewsBatchAmount"`
+	Instance            int    `mapstructure:"instance"`
+	Replicas            int    `mapstructure:"replicas"`
+	SessionsDir         string `mapstructure:"sessionsDir"`
+	IdleTimeout         int    `mapstructure:"idleTimeout"` // segundos
+	MaxSessions         int    `mapstructure:"maxSessions"`
+	MaxInFlightBatches  int    `mapstructure:"maxInFlightBatches"`
+	MaxOutstandingStats int    `mapstructure:"maxOutstandingStats"` // stats publicados y sin consumir por alguna query
+	BusyRetryAfter      int    `mapstructure:"busyRetryAfter"`      // segundos
 }
 
+// LogConfig es el nivel por defecto, el formato ("text" o "json") y los
+// niveles por modulo ("middleware=DEBUG,tracing=ERROR")
 type LogConfig struct {
-	Level string `mapstructure:"level"`
+	Level   string `mapstructure:"level"`
+	Format  string `mapstructure:"format"`
+	Modules string `mapstructure:"modules"`
 }
 
+// MappersConfig con Partitioned reparte los juegos y las reviews entre los
+// mappers por AppId, cada mapper guarda solo los juegos de su particion y
+// consume las reviews de su cola
 type MappersConfig struct {
-	Id     int `mapstructure:"id"`
-	Amount int `mapstructure:"amount"`
+	Id          int  `mapstructure:"id"`
+	Amount      int  `mapstructure:"amount"`
+	Partitioned bool `mapstructure:"partitioned"`
 }
 
 type ShardingConfig struct {
 	Amount int `mapstructure:"amount"`
 }
 
+type LanguageConfig struct {
+	Detector  string   `mapstructure:"detector"`
+	Targets   []string `mapstructure:"targets"`
+	Workers   int      `mapstructure:"workers"`
+	CacheSize int      `mapstructure:"cache-size"`
+	InMapper  bool     `mapstructure:"in-mapper"`
+}
+
+// JanitorConfig controla la limpieza de clientes abandonados, con TTL 0 no se
+// borra nada
+type JanitorConfig struct {
+	TTL      int `mapstructure:"ttl"`      // segundos
+	Interval int `mapstructure:"interval"` // segundos
+}
+
+// CleanupConfig es cada cuanto el server le reenvia el ClientsFinished a los
+// nodos que no confirmaron el borrado de un cliente y cuantas veces lo intenta
+// antes de alertar y dejar de esperar
+type CleanupConfig struct {
+	RetryInterval int `mapstructure:"retryInterval"` // segundos
+	MaxRetries    int `mapstructure:"maxRetries"`
+}
+
+// TombstonesConfig es cuanto recuerda cada nodo a un cliente terminado para
+// ignorar sus mensajes tardios y cada cuanto compacta el archivo
+type TombstonesConfig struct {
+	Retention       int `mapstructure:"retention"`       // segundos
+	CompactInterval int `mapstructure:"compactInterval"` // segundos
+}
+
+// FairnessConfig es cuantos mensajes de un cliente se procesan por turno en
+// los consumidores de mappers y queries
+type FairnessConfig struct {
+	Quantum int `mapstructure:"quantum"`
+}
+
+// LifecycleConfig es cuanto espera un nodo a terminar lo que esta procesando
+// al apagarse, tiene que ser menor al timeout de `docker compose stop`
+type LifecycleConfig struct {
+	DrainTimeout int `mapstructure:"drainTimeout"` // segundos
+}
+
+// HealthConfig es el puerto de /healthz y /readyz y cuanto puede estar un
+// consumidor con deliveries pendientes sin terminar ninguna
+type HealthConfig struct {
+	Port         int `mapstructure:"port"`
+	StallTimeout int `mapstructure:"stallTimeout"` // segundos
+}
+
+// TracingConfig elige a donde se exportan los spans: "none", "stdout" (un
+// JSON por linea) u "otlp" (OTLP/HTTP a endpoint)
+type TracingConfig struct {
+	Exporter string `mapstructure:"exporter"`
+	Endpoint string `mapstructure:"endpoint"`
+}
+
 type ReviverConfig struct {
 	Amount int `mapstructure:"amount"`
 }
@@ -36,7 +108,11 @@ type QueryConfig struct {
 	Id             int  `mapstructure:"id"`
 	Shard          int  `mapstructure:"shard"`
 	ResultInterval int  `mapstructure:"query1-result-interval"`
+	TopInterval    int  `mapstructure:"query3-result-interval"`
 	MinNegatives   int  `mapstructure:"query4-min-negatives"`
+	Approximate    bool `mapstructure:"approximate"`
+	SketchInterval int  `mapstructure:"sketch-interval"`
+	SketchTopK     int  `mapstructure:"sketch-top-k"`
 	Query1         bool `mapstructure:"query-1"`
 	Query2         bool `mapstructure:"query-2"`
 	Query3         bool `mapstructure:"query-3"`
@@ -45,12 +121,20 @@ type QueryConfig struct {
 }
 
 type Config struct {
-	Server   ServerConfig   `mapstructure:"server"`
-	Log      LogConfig      `mapstructure:"log"`
-	Mappers  MappersConfig  `mapstructure:"mappers"`
-	Sharding ShardingConfig `mapstructure:"sharding"`
-	Query    QueryConfig    `mapstructure:"query"`
-	Reviver  ReviverConfig  `mapstructure:"reviver"`
+	Server     ServerConfig     `mapstructure:"server"`
+	Log        LogConfig        `mapstructure:"log"`
+	Mappers    MappersConfig    `mapstructure:"mappers"`
+	Sharding   ShardingConfig   `mapstructure:"sharding"`
+	Query      QueryConfig      `mapstructure:"query"`
+	Language   LanguageConfig   `mapstructure:"language"`
+	Reviver    ReviverConfig    `mapstructure:"reviver"`
+	Janitor    JanitorConfig    `mapstructure:"janitor"`
+	Cleanup    CleanupConfig    `mapstructure:"cleanup"`
+	Tombstones TombstonesConfig `mapstructure:"tombstones"`
+	Fairness   FairnessConfig   `mapstructure:"fairness"`
+	Lifecycle  LifecycleConfig  `mapstructure:"lifecycle"`
+	Health     HealthConfig     `mapstructure:"health"`
+	Tracing    TracingConfig    `mapstructure:"tracing"`
 }
 
 func InitConfig() (*Config, error) {
@@ -60,32 +144,79 @@ func InitConfig() (*Config, error) {
 	v.BindEnv("id", "CLI_ID")
 	v.BindEnv("server.address", "CLI_SERVER_ADDRESS")
 	v.BindEnv("log.level", "CLI_LOG_LEVEL")
+	v.BindEnv("log.format", "CLI_LOG_FORMAT")
+	v.BindEnv("log.modules", "CLI_LOG_MODULES")
 	v.BindEnv("server.gamesBatchAmount", "CLI_GAMES_BATCH_AMOUNT")
 	v.BindEnv("server.reviewsBatchAmount", "CLI_REVIEWS_BATCH_AMOUNT")
+	v.BindEnv("server.instance", "CLI_SERVER_INSTANCE")
+	v.BindEnv("server.replicas", "CLI_SERVER_REPLICAS")
+	v.BindEnv("server.sessionsDir", "CLI_SERVER_SESSIONS_DIR")
+	v.BindEnv("server.idleTimeout", "CLI_SERVER_IDLE_TIMEOUT")
+	v.BindEnv("server.maxSessions", "CLI_SERVER_MAX_SESSIONS")
+	v.BindEnv("server.maxInFlightBatches", "CLI_SERVER_MAX_IN_FLIGHT_BATCHES")
+	v.BindEnv("server.maxOutstandingStats", "CLI_SERVER_MAX_OUTSTANDING_STATS")
+	v.BindEnv("server.busyRetryAfter", "CLI_SERVER_BUSY_RETRY_AFTER")
 	v.BindEnv("mappers.id", "CLI_MAPPER_ID")
 	v.BindEnv("mappers.amount", "CLI_MAPPER_AMOUNT")
+	v.BindEnv("mappers.partitioned", "CLI_MAPPER_PARTITIONED")
 	v.BindEnv("sharding.amount", "CLI_SHARDING_AMOUNT")
 	v.BindEnv("query.query1-result-interval", "CLI_QUERY1_RESULT_INTERVAL")
+	v.BindEnv("query.query3-result-interval", "CLI_QUERY3_RESULT_INTERVAL")
 	v.BindEnv("query.query4-min-negatives", "CLI_QUERY4_MIN_NEGATIVES")
+	v.BindEnv("query.approximate", "CLI_QUERY_APPROXIMATE")
+	v.BindEnv("query.sketch-interval", "CLI_QUERY_SKETCH_INTERVAL")
+	v.BindEnv("query.sketch-top-k", "CLI_QUERY_SKETCH_TOP_K")
 	v.BindEnv("query.id", "CLI_QUERY_ID")
 	v.BindEnv("query.shard", "CLI_SHARD_ID")
+	v.BindEnv("language.detector", "CLI_LANGUAGE_DETECTOR")
+	v.BindEnv("language.targets", "CLI_LANGUAGE_TARGETS")
+	v.BindEnv("language.workers", "CLI_LANGUAGE_WORKERS")
+	v.BindEnv("language.cache-size", "CLI_LANGUAGE_CACHE_SIZE")
+	v.BindEnv("language.in-mapper", "CLI_LANGUAGE_IN_MAPPER")
 	v.BindEnv("reviver.amount", "CLI_TOPOLOGY_NODES")
+	v.BindEnv("janitor.ttl", "CLI_JANITOR_TTL")
+	v.BindEnv("janitor.interval", "CLI_JANITOR_INTERVAL")
+	v.BindEnv("cleanup.retryInterval", "CLI_CLEANUP_RETRY_INTERVAL")
+	v.BindEnv("cleanup.maxRetries", "CLI_CLEANUP_MAX_RETRIES")
+	v.BindEnv("tombstones.retention", "CLI_TOMBSTONES_RETENTION")
+	v.BindEnv("tombstones.compactInterval", "CLI_TOMBSTONES_COMPACT_INTERVAL")
+	v.BindEnv("fairness.quantum", "CLI_FAIRNESS_QUANTUM")
+	v.BindEnv("lifecycle.drainTimeout", "CLI_LIFECYCLE_DRAIN_TIMEOUT")
+	v.BindEnv("health.port", "CLI_HEALTH_PORT")
+	v.BindEnv("health.stallTimeout", "CLI_HEALTH_STALL_TIMEOUT")
+	v.BindEnv("tracing.exporter", "CLI_TRACING_EXPORTER")
+	v.BindEnv("tracing.endpoint", "CLI_TRACING_ENDPOINT")
 
 	v.SetConfigFile("./server.yml")
 	if err := v.ReadInConfig(); err != nil {
-		fmt.Printf("Configuration could not be read from config file. Using env variables instead: %s", err)
+		log.Infof("action: read_config | result: fail | error: %s | using env variables instead", err)
 	}
 
 	config := Config{}
 	if err := v.Unmarshal(&config); err != nil {
 		return nil, err
 	}
+	if err := validate(&config); err != nil {
+		log.Errorf("action: validate_config | result: fail | error: %s", err)
+		return nil, err
+	}
 
 	printConfig(&config)
 
 	return &config, nil
 }
 
+// validate rechaza las combinaciones con las que algun nodo no puede arrancar
+func validate(config *Config) error {
+	if config.Query.Approximate && config.Query.SketchInterval <= 0 {
+		return fmt.Errorf("query.sketch-interval tiene que ser mayor a 0 con query.approximate, es %d", config.Query.SketchInterval)
+	}
+	if config.Mappers.Partitioned && config.Mappers.Amount <= 0 {
+		return fmt.Errorf("mappers.amount tiene que ser mayor a 0 con mappers.partitioned, es %d", config.Mappers.Amount)
+	}
+	return nil
+}
+
 func printConfig(config *Config) {
 	log.Infof("action: config | result: success | server_address: %s | log_level: %s",
 		config.Server.Address,
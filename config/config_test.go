@@ -0,0 +1,27 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSketchInterval(t *testing.T) {
+	config := &Config{}
+	assert.Nil(t, validate(config))
+
+	config.Query.Approximate = true
+	assert.NotNil(t, validate(config))
+
+	config.Query.SketchInterval = 2000
+	assert.Nil(t, validate(config))
+}
+
+func TestValidatePartitionedMappers(t *testing.T) {
+	config := &Config{}
+	config.Mappers.Partitioned = true
+	assert.NotNil(t, validate(config))
+
+	config.Mappers.Amount = 2
+	assert.Nil(t, validate(config))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"tp1-distribuidos/middleware"
+)
+
+// GameStore son los juegos Action e Indie de un cliente, indexados en memoria
+// por AppId. Mientras llegan se agregan a <dir>/games.log y cuando estan todos
+// Seal los escribe ordenados y sin duplicados en <dir>/games.csv. Al abrirlo
+// se leen los dos una sola vez, despues las busquedas no tocan el disco.
+type GameStore struct {
+	dir    string
+	games  map[string][]string
+	log    *os.File
+	writer *csv.Writer
+}
+
+// NewGameStore abre los juegos de un cliente. Si falla la lectura devuelve el
+// error junto con lo que se pudo cargar.
+func NewGameStore(dir string) (*GameStore, error) {
+	store := &GameStore{dir: dir, games: make(map[string][]string)}
+
+	if err := store.load(store.sortedPath()); err != nil {
+		return store, err
+	}
+	if err := store.load(store.logPath()); err != nil {
+		return store, err
+	}
+
+	return store, nil
+}
+
+func (s *GameStore) sortedPath() string {
+	return filepath.Join(s.dir, "games.csv")
+}
+
+func (s *GameStore) logPath() string {
+	return filepath.Join(s.dir, "games.log")
+}
+
+// load agrega los juegos de un archivo al indice. Un juego escrito a medias
+// antes de un crash se descarta, el game no se ackeo y vuelve a llegar.
+func (s *GameStore) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	if complete < len(data) {
+		if err := os.Truncate(path, int64(complete)); err != nil {
+			return err
+		}
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(data[:complete])).ReadAll()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		s.games[record[0]] = record
+	}
+	return nil
+}
+
+// Add guarda un juego. Si el game se redelivera se escribe de vuelta y el
+// indice se queda con uno solo.
+func (s *GameStore) Add(game *middleware.Game) error {
+	if s.log == nil {
+		file, err := os.OpenFile(s.logPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0755)
+		if err != nil {
+			return err
+		}
+		s.log = file
+		s.writer = csv.NewWriter(file)
+	}
+
+	record := []string{
+		strconv.Itoa(game.AppId),
+		game.Name,
+		strconv.Itoa(game.Year),
+		strings.Join(game.Genres, ","),
+	}
+	s.writer.Write(record)
+	s.writer.Flush()
+	if err := s.writer.Error(); err != nil {
+		// el writer se queda con el error, el game redeliverado reabre el log
+		// sin la linea que quedo a medias
+		s.closeLog()
+		s.dropPartialLine()
+		return err
+	}
+
+	s.games[record[0]] = record
+	return nil
+}
+
+// dropPartialLine corta el log despues de la ultima linea completa
+func (s *GameStore) dropPartialLine() {
+	data, err := os.ReadFile(s.logPath())
+	if err != nil {
+		return
+	}
+	if complete := bytes.LastIndexByte(data, '\n') + 1; complete < len(data) {
+		os.Truncate(s.logPath(), int64(complete))
+	}
+}
+
+// Get devuelve el registro del juego como lo espera middleware.NewStats
+func (s *GameStore) Get(appId string) ([]string, bool) {
+	record, ok := s.games[appId]
+	return record, ok
+}
+
+func (s *GameStore) Count() int {
+	return len(s.games)
+}
+
+// Seal escribe el indice ordenado por AppId en un temporal, lo renombra a
+// games.csv y recien despues borra games.log. Un crash en el medio deja los
+// dos archivos y al abrirlo se juntan.
+func (s *GameStore) Seal() error {
+	s.closeLog()
+
+	appIds := make([]int, 0, len(s.games))
+	for appId := range s.games {
+		id, err := strconv.Atoi(appId)
+		if err != nil {
+			continue
+		}
+		appIds = append(appIds, id)
+	}
+	sort.Ints(appIds)
+
+	tmpFile, err := os.CreateTemp(s.dir, "games-*.csv")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	writer := csv.NewWriter(tmpFile)
+	for _, appId := range appIds {
+		writer.Write(s.games[strconv.Itoa(appId)])
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpFile.Name(), s.sortedPath()); err != nil {
+		return err
+	}
+	if err := os.Remove(s.logPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Remove borra los juegos del disco y de memoria
+func (s *GameStore) Remove() {
+	s.closeLog()
+	os.Remove(s.logPath())
+	os.Remove(s.sortedPath())
+	s.games = make(map[string][]string)
+}
+
+func (s *GameStore) closeLog() {
+	if s.log == nil {
+		return
+	}
+	s.log.Close()
+	s.log = nil
+	s.writer = nil
+}
+
+func (s *GameStore) Close() {
+	s.closeLog()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"tp1-distribuidos/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGameStoreRebuildsAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewGameStore(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Add(&middleware.Game{AppId: 20, Name: "Dota", Year: 2013, Genres: []string{"Action"}}))
+	assert.Nil(t, store.Add(&middleware.Game{AppId: 10, Name: "Celeste", Year: 2018, Genres: []string{"Indie", "Platformer"}}))
+	// un game redeliverado se vuelve a escribir
+	assert.Nil(t, store.Add(&middleware.Game{AppId: 20, Name: "Dota", Year: 2013, Genres: []string{"Action"}}))
+	store.Close()
+
+	// un crash a mitad de un game deja la linea sin terminar
+	file, err := os.OpenFile(filepath.Join(dir, "games.log"), os.O_WRONLY|os.O_APPEND, 0755)
+	assert.Nil(t, err)
+	file.WriteString("30,Half")
+	file.Close()
+
+	reopened, err := NewGameStore(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, reopened.Count())
+	_, ok := reopened.Get("30")
+	assert.False(t, ok)
+
+	assert.Nil(t, reopened.Add(&middleware.Game{AppId: 30, Name: "Half-Life", Year: 1998, Genres: []string{"Action"}}))
+	record, ok := reopened.Get("30")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"30", "Half-Life", "1998", "Action"}, record)
+	reopened.Close()
+
+	record, ok = mustOpen(t, dir).Get("10")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"10", "Celeste", "2018", "Indie,Platformer"}, record)
+}
+
+func TestGameStoreSealSortsAndRemovesLog(t *testing.T) {
+	dir := t.TempDir()
+
+	store := mustOpen(t, dir)
+	for _, appId := range []int{300, 20, 1000, 20} {
+		assert.Nil(t, store.Add(&middleware.Game{AppId: appId, Name: "game", Year: 2020, Genres: []string{"Indie"}}))
+	}
+	assert.Nil(t, store.Seal())
+
+	_, err := os.Stat(filepath.Join(dir, "games.log"))
+	assert.True(t, os.IsNotExist(err))
+	data, err := os.ReadFile(filepath.Join(dir, "games.csv"))
+	assert.Nil(t, err)
+	assert.Equal(t, "20,game,2020,Indie\n300,game,2020,Indie\n1000,game,2020,Indie\n", string(data))
+
+	sealed := mustOpen(t, dir)
+	assert.Equal(t, 3, sealed.Count())
+
+	sealed.Remove()
+	assert.Equal(t, 0, mustOpen(t, dir).Count())
+}
+
+func TestGameStoreRetriesAfterWriteError(t *testing.T) {
+	dir := t.TempDir()
+
+	store := mustOpen(t, dir)
+	assert.Nil(t, store.Add(&middleware.Game{AppId: 10, Name: "Celeste", Year: 2018, Genres: []string{"Indie"}}))
+
+	// el log se cierra por debajo y la escritura falla
+	store.log.Close()
+	assert.NotNil(t, store.Add(&middleware.Game{AppId: 20, Name: "Dota", Year: 2013, Genres: []string{"Action"}}))
+
+	// el game redeliverado se guarda con un log nuevo
+	assert.Nil(t, store.Add(&middleware.Game{AppId: 20, Name: "Dota", Year: 2013, Genres: []string{"Action"}}))
+	store.Close()
+
+	reopened := mustOpen(t, dir)
+	assert.Equal(t, 2, reopened.Count())
+	_, ok := reopened.Get("20")
+	assert.True(t, ok)
+}
+
+func mustOpen(t *testing.T, dir string) *GameStore {
+	store, err := NewGameStore(dir)
+	assert.Nil(t, err)
+	return store
+}
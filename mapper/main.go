@@ -1,18 +1,20 @@
 package main
 
 import (
-	"context"
 	_ "net/http/pprof"
 	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
+	"time"
 	"tp1-distribuidos/config"
 	"tp1-distribuidos/shared"
-
-	"github.com/op/go-logging"
+	"tp1-distribuidos/shared/admin"
+	"tp1-distribuidos/shared/health"
+	"tp1-distribuidos/shared/lifecycle"
+	"tp1-distribuidos/shared/logs"
+	"tp1-distribuidos/shared/tracing"
 )
 
-var log = logging.MustGetLogger("log")
+var log = logs.Get("mapper")
 
 func main() {
 	os.Mkdir("./database", 0666)
@@ -21,7 +23,8 @@ func main() {
 		log.Criticalf("%s", err)
 	}
 
-	if err := shared.InitLogger(config.Log.Level); err != nil {
+	name := "mapper-" + strconv.Itoa(config.Mappers.Id)
+	if err := logs.Init(logs.Options{Node: name, Level: config.Log.Level, Format: config.Log.Format, Modules: config.Log.Modules}); err != nil {
 		log.Criticalf("%s", err)
 	}
 
@@ -30,17 +33,26 @@ func main() {
 		log.Criticalf("Error creating mapper: %s", err)
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGKILL)
-	defer stop()
+	node := lifecycle.New(name, time.Duration(config.Lifecycle.DrainTimeout)*time.Second)
+	if err := tracing.Init(name, config.Tracing.Exporter, config.Tracing.Endpoint); err != nil {
+		log.Errorf("action: init_tracing | result: fail | error: %s", err)
+	}
+	node.OnClose("tracing", tracing.Shutdown)
+	node.OnDrain("stop consuming", mapper.Drain)
+	node.OnClose("middleware", mapper.Close)
+	node.Notify()
+
+	checks := health.New()
+	checks.Liveness("broker", mapper.middleware.Connected)
+	checks.Liveness("consumers", mapper.middleware.Progress().Check)
+	checks.Liveness("disk", health.Writable("./database"))
+	checks.Readiness("lifecycle", node.Check)
+	checks.Handle("GET /admin/state", admin.StateHandler(name, "./database"))
+	go checks.ListenAndServe(config.Health.Port)
 
 	go shared.RunUDPListener(8080)
 
-	go func() {
-		<-ctx.Done()
-		log.Info("action: cerrar_mapper | result: in_progress")
-		mapper.Close()
-	}()
-
-	mapper.Run()
-	log.Info("action: cerrar_mapper | result: success")
+	status := node.Run(mapper.Run)
+	log.Infof("action: cerrar_mapper | result: success | status: %d", status)
+	os.Exit(status)
 }
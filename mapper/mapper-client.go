@@ -1,177 +1,291 @@
 package main
 
 import (
-	"encoding/csv"
 	"fmt"
 	"os"
 	"slices"
-	"strconv"
-	"strings"
 	"sync"
-	"time"
 	"tp1-distribuidos/middleware"
 	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/language"
+	"tp1-distribuidos/shared/logs"
 )
 
+// MapperClient procesa los games y reviews de un cliente. Su fase se persiste
+// en database/<id>/state.csv, los games recibidos
+// y el total de cada shard en database/<id>/games/, los juegos Action e Indie
+// en el GameStore y los batches de reviews cuyos stats ya salieron en
+// processed_batches.bin.
 type MapperClient struct {
-	id            string
-	middleware    *middleware.Middleware
-	games         chan middleware.GameMsg
-	reviews       chan middleware.ReviewsMsg
-	finishedGames *shared.Processed
-	finishedSteps *shared.Processed
-	cancelWg      *sync.WaitGroup
+	id               middleware.ClientId
+	middleware       *middleware.Middleware
+	games            chan middleware.GameMsg
+	reviews          chan middleware.ReviewsMsg
+	state            ClientState
+	receivedGames    *shared.EndOfStream
+	store            *GameStore
+	processedBatches *shared.Processed
+	cancelWg         *sync.WaitGroup
+	languages        *language.Pool
+	log              *logs.Logger
 }
 
 const GEOMETRY_DASH_APP_ID = "322170"
 
-type finishedSteps int
-
-const (
-	FINISHED_FILE finishedSteps = iota
-	FINISHED
-)
-
-func NewMapperClient(id string, m *middleware.Middleware) *MapperClient {
+func NewMapperClient(id middleware.ClientId, m *middleware.Middleware, languages *language.Pool) *MapperClient {
 	os.MkdirAll(fmt.Sprintf("database/%s", id), 0755)
 
 	client := &MapperClient{
-		id:            id,
-		middleware:    m,
-		games:         make(chan middleware.GameMsg),
-		reviews:       make(chan middleware.ReviewsMsg),
-		finishedGames: shared.NewProcessed(fmt.Sprintf("database/%s/processed_games.bin", id)),
-		finishedSteps: shared.NewProcessed(fmt.Sprintf("database/%s/processed_steps.bin", id)),
-		cancelWg:      &sync.WaitGroup{},
+		id:               id,
+		middleware:       m,
+		games:            make(chan middleware.GameMsg),
+		reviews:          make(chan middleware.ReviewsMsg),
+		receivedGames:    shared.NewEndOfStream(fmt.Sprintf("database/%s/games", id)),
+		processedBatches: shared.NewProcessed(fmt.Sprintf("database/%s/processed_batches.bin", id)),
+		cancelWg:         &sync.WaitGroup{},
+		languages:        languages,
+		log:              log.With("client_id", id),
+	}
+
+	store, err := NewGameStore(fmt.Sprintf("database/%s", id))
+	if err != nil {
+		client.log.Errorf("action: load_games | result: fail | error: %s", err)
 	}
+	client.store = store
 
+	state, err := LoadClientState(client.statePath())
+	if err != nil {
+		client.log.Errorf("action: load_state | result: fail | error: %s", err)
+	}
+	client.state = state
+
+	// el crash pudo ser entre marcar el ultimo shard o batch y guardar la fase
+	if client.state.Phase == CollectingGames && client.receivedGames.Finished(m.Config.Sharding.Amount) {
+		client.setPhase(GamesComplete)
+	}
+	if client.state.Phase == GamesComplete && client.processedBatches.Count() > 0 {
+		client.setPhase(StreamingReviews)
+	}
+	if client.state.Phase != CollectingGames {
+		client.log.Infof("action: restore_state | result: success | phase: %s | batches: %d | games: %d", client.state.Phase, client.processedBatches.Count(), client.store.Count())
+	}
+
+	client.cancelWg.Add(1)
 	go client.consumeGames()
-	if client.finishedGames.Count() == m.Config.Sharding.Amount {
-		log.Infof("client %s After reviving, consuming reviews", client.id)
+	if client.state.Phase >= GamesComplete {
+		client.cancelWg.Add(1)
 		go client.consumeReviews()
 	}
 
-	client.cancelWg.Add(1)
 	return client
 }
 
-func (c *MapperClient) Close() {
-	if c.finishedSteps.Contains(int64(FINISHED)) {
-		return
+func (c *MapperClient) statePath() string {
+	return fmt.Sprintf("database/%s/state.csv", c.id)
+}
+
+func (c *MapperClient) saveState() {
+	if err := c.state.Save(c.statePath()); err != nil {
+		c.log.Errorf("action: save_state | result: fail | phase: %s | error: %s", c.state.Phase, err)
 	}
-	c.finishedSteps.Add(int64(FINISHED))
-	c.cancelWg.Done()
+}
+
+func (c *MapperClient) setPhase(phase ClientPhase) {
+	c.log.Infof("action: mapper_client_phase | result: success | from: %s | to: %s", c.state.Phase, phase)
+	c.state.Phase = phase
+	c.saveState()
+}
+
+// Close se llama al apagar el mapper, cuando ya no se consume mas. Cierra los
+// channels y espera a que se termine el batch en curso, no marca al cliente
+// como terminado para que siga al reiniciar.
+func (c *MapperClient) Close() {
 	c.ignoreAllGames()
 	c.ignoreAllReviews()
 
 	c.cancelWg.Wait()
-	log.Infof("action: mapper_client_close | result: success | client_id: %s", c.id)
+	c.receivedGames.Close()
+	c.processedBatches.Close()
+	c.store.Close()
+	c.log.Infof("action: mapper_client_close | result: success")
 }
 
 func (c *MapperClient) consumeGames() {
+	defer c.cancelWg.Done()
 
-	c.cancelWg.Add(1)
 	for game := range c.games {
-		if c.finishedGames.Count() == c.middleware.Config.Sharding.Amount {
+		if c.state.Phase >= GamesComplete {
 			game.Ack()
 			continue
 		}
 
 		if game.Last {
 			shared.TestTolerance(1, 4, "Exiting at last game before adding")
-			c.finishedGames.Add(int64(game.ShardId))
+			c.receivedGames.Expect(game.ShardId, game.PartitionTotal(c.middleware.MapperPartition()))
 			shared.TestTolerance(1, 4, "Exiting at last game after adding")
-			if c.finishedGames.Count() == c.middleware.Config.Sharding.Amount {
-				go c.consumeReviews()
-			}
+			c.checkGamesComplete()
 			game.Ack()
 			continue
 		}
 
 		if !slices.Contains(game.Game.Genres, "Action") && !slices.Contains(game.Game.Genres, "Indie") {
-			game.Ack()
+			c.receiveGame(game)
 			continue
 		}
 
-		file, err := os.OpenFile(fmt.Sprintf("database/%s/%d.csv", c.id, game.Game.AppId), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0755)
-		if err != nil {
-			log.Errorf("Failed to open games.csv: %v", err)
-			return
-		}
-
-		writer := csv.NewWriter(file)
-
 		shared.TestTolerance(1, 5000, "Exiting at game before writing")
 
-		gameStats := []string{
-			strconv.Itoa(game.Game.AppId),
-			game.Game.Name,
-			strconv.Itoa(game.Game.Year),
-			strings.Join(game.Game.Genres, ","),
-		}
-
-		if err := writer.Write(gameStats); err != nil {
-			log.Errorf("Failed to write to games.csv: %v", err)
+		// el game vuelve a la cola sin contarse, el Mapper no se queda
+		// esperando a este cliente
+		if err := c.store.Add(game.Game); err != nil {
+			c.log.Errorf("action: store_game | result: fail | app_id: %d | error: %s", game.Game.AppId, err)
+			game.Nack()
+			continue
 		}
-		writer.Flush()
 
 		shared.TestTolerance(1, 5000, "Exiting at game after writing")
 
-		file.Close()
+		c.receiveGame(game)
+	}
+	c.log.Infof("Mapper client finished consuming games")
+}
+
+// receiveGame cuenta el game en su shard y lo ackea
+func (c *MapperClient) receiveGame(game middleware.GameMsg) {
+	c.receivedGames.Receive(game.ShardId, game.Id)
+	c.checkGamesComplete()
+	game.Ack()
+}
 
-		game.Ack()
+// checkGamesComplete empieza a consumir reviews cuando en todos los shards
+// llego el Last y la cantidad de games que anuncio
+func (c *MapperClient) checkGamesComplete() {
+	if c.state.Phase != CollectingGames || !c.receivedGames.Finished(c.middleware.Config.Sharding.Amount) {
+		return
 	}
-	log.Infof("Mapper client %s finished consuming games", c.id)
-	c.cancelWg.Done()
+	if err := c.store.Seal(); err != nil {
+		c.log.Errorf("action: seal_games | result: fail | error: %s", err)
+	}
+	c.setPhase(GamesComplete)
+	c.cancelWg.Add(1)
+	go c.consumeReviews()
 }
 
 func (c *MapperClient) consumeReviews() {
-	log.Infof("Starting to consume reviews")
+	c.log.Infof("Starting to consume reviews")
+	defer c.cancelWg.Done()
 
-	c.cancelWg.Add(1)
 	for reviewBatch := range c.reviews {
 
-		if reviewBatch.Last > 0 {
+		if reviewBatch.Last {
 			c.handleFinsished(reviewBatch)
 			continue
 		}
 
-		for _, review := range reviewBatch.Reviews {
-			file, err := os.Open(fmt.Sprintf("database/%s/%s.csv", c.id, review.AppId))
-			if err != nil {
-				continue // no existe el juego
-			}
+		batchStats := c.mapReviews(reviewBatch)
+		counts := middleware.StatsCounts{}
+		for _, stats := range batchStats {
+			counts.Add(c.middleware.ShardOf(stats.AppId), stats.Genres)
+		}
 
-			if review.AppId == GEOMETRY_DASH_APP_ID {
-				shared.TestTolerance(1, 13000, "Exiting at review before reading")
-			}
+		// los stats del batch ya salieron antes de un crash, solo falta avisar
+		// al server cuantos fueron y ackear
+		if c.processedBatches.Contains(int64(reviewBatch.Id)) {
+			c.log.With("batch_id", reviewBatch.Id).Debugf("action: skip_batch | result: success")
+			c.sendReviewsProcessed(reviewBatch, counts)
+			continue
+		}
 
-			reader := csv.NewReader(file)
-			record, _ := reader.Read()
+		c.detectLanguages(batchStats)
 
-			stats := middleware.NewStats(record, &review)
+		// si un stat no sale el batch vuelve a la cola sin marcarse, al
+		// redeliverarse se publican de nuevo y las queries descartan los
+		// repetidos por id. Contarlo dejaria al server esperando un stat que
+		// nunca llega.
+		if err := c.sendStats(reviewBatch, batchStats); err != nil {
+			c.log.With("batch_id", reviewBatch.Id).Errorf("action: send_stats | result: fail | error: %v", err)
+			reviewBatch.Nack()
+			continue
+		}
 
-			if slices.Contains(stats.Genres, "Action") || slices.Contains(stats.Genres, "Indie") {
-				err := c.middleware.SendStats(&middleware.StatsMsg{ClientId: c.id, Stats: stats})
-				if err != nil {
-					log.Errorf("Failed to publish stats message: %v", err)
-				}
-			}
+		c.processedBatches.Add(int64(reviewBatch.Id))
+		if c.state.Phase == GamesComplete {
+			c.setPhase(StreamingReviews)
+		}
 
-			if review.AppId == GEOMETRY_DASH_APP_ID {
-				shared.TestTolerance(1, 13000, "Exiting at review after reading")
-			}
+		c.sendReviewsProcessed(reviewBatch, counts)
+	}
+	c.log.Infof("Mapper client finished consuming reviews")
+}
 
-			file.Close()
+// mapReviews arma los stats de las reviews del batch cuyo juego es Action o
+// Indie. Sin efectos, un batch redeliverado da los mismos stats.
+func (c *MapperClient) mapReviews(reviewBatch middleware.ReviewsMsg) []*middleware.Stats {
+	batchStats := make([]*middleware.Stats, 0, len(reviewBatch.Reviews))
+	for _, review := range reviewBatch.Reviews {
+		record, ok := c.store.Get(review.AppId)
+		if !ok {
+			continue // no existe el juego
+		}
 
+		if review.AppId == GEOMETRY_DASH_APP_ID {
+			shared.TestTolerance(1, 13000, "Exiting at review before reading")
 		}
 
-		c.middleware.SendReviewsProcessed(&middleware.ReviewsProcessedMsg{ClientId: c.id, BatchId: reviewBatch.Id})
-		reviewBatch.Ack()
+		stats := middleware.NewStats(record, &review)
+
+		if stats != nil && (slices.Contains(stats.Genres, "Action") || slices.Contains(stats.Genres, "Indie")) {
+			batchStats = append(batchStats, stats)
+		}
 
+		if review.AppId == GEOMETRY_DASH_APP_ID {
+			shared.TestTolerance(1, 13000, "Exiting at review after reading")
+		}
+	}
+	return batchStats
+}
+
+func (c *MapperClient) sendStats(reviewBatch middleware.ReviewsMsg, batchStats []*middleware.Stats) error {
+	for _, stats := range batchStats {
+		statsMsg := &middleware.StatsMsg{ClientId: c.id, Priority: reviewBatch.Priority, Stats: stats}
+		statsMsg.SetTrace(reviewBatch.Trace())
+		if err := c.middleware.SendStats(statsMsg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendReviewsProcessed le avisa al server que termino el batch y cuantos stats
+// salieron por shard y genero, con eso arma los Last de las queries
+func (c *MapperClient) sendReviewsProcessed(reviewBatch middleware.ReviewsMsg, counts middleware.StatsCounts) {
+	processed := &middleware.ReviewsProcessedMsg{ClientId: c.id, BatchId: reviewBatch.Id, Stats: counts}
+	processed.SetTrace(reviewBatch.Trace())
+	c.middleware.SendReviewsProcessed(processed)
+	reviewBatch.Ack()
+}
+
+// detectLanguages detecta el idioma de las reviews negativas del batch en
+// paralelo y borra el texto de todos los stats, asi el texto nunca viaja por
+// el broker. Solo la query 4 usa el texto y le alcanza con el idioma.
+func (c *MapperClient) detectLanguages(batchStats []*middleware.Stats) {
+	if c.languages == nil {
+		return
+	}
+
+	texts := make([]string, 0)
+	pending := make([]*middleware.Stats, 0)
+	for _, stats := range batchStats {
+		if stats.Negatives > 0 && stats.Text != "" {
+			texts = append(texts, stats.Text)
+			pending = append(pending, stats)
+		}
+		stats.Text = ""
+	}
+
+	for i, lang := range c.languages.DetectBatch(texts) {
+		pending[i].Language = lang
 	}
-	log.Infof("Mapper client %s finished consuming reviews", c.id)
-	c.cancelWg.Done()
 }
 
 func (c *MapperClient) ignoreAllGames() {
@@ -206,22 +320,19 @@ func (c *MapperClient) ignoreAllReviews() {
 	}
 }
 
+// handleFinsished recibe el aviso de reviewsFinished. El server lo manda a
+// todos los mappers cuando le llegaron los reviewsProcessed de todos los
+// batches, asi que ya no queda ningun batch del cliente por procesar.
 func (c *MapperClient) handleFinsished(reviewBatch middleware.ReviewsMsg) {
-	log.Debugf("Received Last message for client %s: %v", reviewBatch.ClientId, reviewBatch.Last)
-	if c.finishedSteps.Contains(int64(FINISHED)) {
-		log.Debugf("Received Last again, ignoring and NACKing...")
-		go func() {
-			time.Sleep(500 * time.Millisecond)
-			c.middleware.SendReviewsFinished(reviewBatch.ClientId, reviewBatch.Last)
-			shared.TestTolerance(1, 8, "Exiting at review processed after sending finished")
-			reviewBatch.Ack()
-		}()
+	if c.state.Phase == Finished {
+		c.log.Debugf("action: reviews_finished | result: skip | batches: %d", reviewBatch.Batches)
+		reviewBatch.Ack()
 		return
 	}
 
-	c.middleware.SendReviewsFinished(reviewBatch.ClientId, reviewBatch.Last+1)
-	shared.TestTolerance(1, 8, "Exiting at review processed after sending finished")
-	c.finishedSteps.Add(int64(FINISHED))
+	c.log.Infof("action: reviews_finished | result: success | batches: %d | processed_here: %d", reviewBatch.Batches, c.processedBatches.Count())
+	shared.TestTolerance(1, 8, "Exiting at reviews finished before removing games")
+	c.setPhase(Finished)
+	c.store.Remove()
 	reviewBatch.Ack()
-	os.RemoveAll(fmt.Sprintf("database/%s", c.id))
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"tp1-distribuidos/config"
+	"tp1-distribuidos/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMapperClientReceivesGamesOfItsPartition(t *testing.T) {
+	conf := &config.Config{Mappers: config.MappersConfig{Id: 2, Amount: 3}}
+	m := &middleware.Middleware{Config: conf}
+
+	// sin particionar cada mapper recibe todos los juegos
+	assert.Equal(t, 0, m.PartitionOf(30))
+	assert.Equal(t, 0, m.MapperPartition())
+
+	conf.Mappers.Partitioned = true
+	assert.Equal(t, 2, m.MapperPartition())
+	assert.Equal(t, 2, m.PartitionOf(31))
+	assert.Equal(t, 1, m.PartitionOf(30))
+	assert.Equal(t, 3, m.PartitionOf(32))
+
+	// las reviews del juego van a la cola del mismo mapper
+	assert.Equal(t, 2, m.ReviewPartitionOf("31"))
+	assert.Equal(t, 1, m.ReviewPartitionOf("not-a-number"))
+
+	// el Last trae cuantos games del shard son de la particion
+	last := &middleware.GameMsg{Last: true, Total: 7, Partitions: []int{0, 3, 4, 0}}
+	assert.Equal(t, 4, last.PartitionTotal(m.MapperPartition()))
+	assert.Equal(t, 7, (&middleware.GameMsg{Last: true, Total: 7}).PartitionTotal(2))
+}
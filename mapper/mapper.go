@@ -8,53 +8,80 @@ import (
 	"tp1-distribuidos/config"
 	"tp1-distribuidos/middleware"
 	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/language"
 )
 
 type Mapper struct {
 	id                     int
 	middleware             *middleware.Middleware
-	clients                map[string]*MapperClient
+	clients                map[middleware.ClientId]*MapperClient
 	gamesQueue             *middleware.GamesQueue
 	reviewsQueue           *middleware.ReviewsQueue
+	reviewsFinishedQueue   *middleware.ReviewsQueue
 	FinishedClientsGames   *shared.FinishedClients
 	FinishedClientsReviews *shared.FinishedClients
-	cancelWg               *sync.WaitGroup
-	cancelled              bool
+	stopping               chan struct{}
+	stopOnce               sync.Once
+	languages              *language.Pool
 }
 
 func NewMapper(config *config.Config) (*Mapper, error) {
-	middleware, err := middleware.NewMiddleware(config)
+	mid, err := middleware.NewMiddleware(config)
 	if err != nil {
 		return nil, err
 	}
 
-	gq, err := middleware.ListenGames("mapper"+strconv.Itoa(config.Mappers.Id), "*")
+	gq, err := mid.ListenMapperGames("mapper" + strconv.Itoa(config.Mappers.Id))
 	if err != nil {
 		return nil, err
 	}
 
-	rq, err := middleware.ListenReviews()
+	rq, err := mid.ListenReviews()
 	if err != nil {
 		return nil, err
 	}
 
+	rfq, err := mid.ListenReviewsFinished("reviewsFinished.mapper" + strconv.Itoa(config.Mappers.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	// si la deteccion de idioma se hace en el mapper, el pool se comparte
+	// entre todos los clientes para acotar la concurrencia
+	var languages *language.Pool
+	if config.Language.InMapper {
+		detector, err := language.New(config.Language.Detector, config.Language.CacheSize)
+		if err != nil {
+			return nil, err
+		}
+		languages = language.NewPool(detector, config.Language.Workers)
+	}
+
 	return &Mapper{
 		id:                     0,
-		middleware:             middleware,
-		clients:                make(map[string]*MapperClient),
+		middleware:             mid,
+		clients:                make(map[middleware.ClientId]*MapperClient),
 		gamesQueue:             gq,
 		reviewsQueue:           rq,
-		FinishedClientsGames:   shared.NewFinishedClients("finished-mapper-games."+strconv.Itoa(config.Mappers.Id), middleware),
-		FinishedClientsReviews: shared.NewFinishedClients("finished-mapper-reviews."+strconv.Itoa(config.Mappers.Id), middleware),
-		cancelWg:               &sync.WaitGroup{},
+		reviewsFinishedQueue:   rfq,
+		FinishedClientsGames:   shared.NewFinishedClients("finished-mapper-games."+strconv.Itoa(config.Mappers.Id), mid),
+		FinishedClientsReviews: shared.NewFinishedClients("finished-mapper-reviews."+strconv.Itoa(config.Mappers.Id), mid),
+		stopping:               make(chan struct{}),
+		languages:              languages,
 	}, nil
 }
 
+// Drain deja de consumir y destraba los envios a clientes que no estan
+// leyendo, el Run termina cuando los clientes terminan su batch en curso
+func (m *Mapper) Drain() error {
+	m.stopOnce.Do(func() {
+		close(m.stopping)
+	})
+	return m.middleware.StopConsuming()
+}
+
 func (m *Mapper) Close() error {
-	m.cancelled = true
-	m.middleware.Close()
-	m.cancelWg.Done()
-	return nil
+	return m.middleware.Close()
 }
 
 func (m *Mapper) Run() {
@@ -62,25 +89,35 @@ func (m *Mapper) Run() {
 	m.FinishedClientsReviews.Consume()
 	time.Sleep(500 * time.Millisecond)
 
-	m.cancelWg.Add(1)
-	go m.consumeGameMessages()
-	go m.consumeReviewsMessages()
-
-	m.cancelWg.Wait()
+	consumers := &sync.WaitGroup{}
+	consumers.Add(3)
+	go func() {
+		defer consumers.Done()
+		m.consumeGameMessages()
+	}()
+	go func() {
+		defer consumers.Done()
+		m.consumeReviewsMessages()
+	}()
+	go func() {
+		defer consumers.Done()
+		m.consumeReviewsFinished()
+	}()
+
+	consumers.Wait()
 	for _, client := range m.clients {
 		client.Close()
 	}
-
 }
 
 func (m *Mapper) consumeGameMessages() {
 	log.Info("Starting to consume messages")
 
-	metric := shared.NewMetric(10000, func(total int, elapsed time.Duration, rate float64) string {
+	metric := shared.NewMetric("mapper_games", 10000, func(total int, elapsed time.Duration, rate float64) string {
 		return fmt.Sprintf("Processed %d games in %s (%.2f games/s)", total, elapsed, rate)
 	})
 
-	err := m.gamesQueue.Consume(m.cancelWg, func(msg *middleware.GameMsg) error {
+	err := m.gamesQueue.Consume(&sync.WaitGroup{}, func(msg *middleware.GameMsg) error {
 		m.FinishedClientsGames.Lock()
 		defer m.FinishedClientsGames.Unlock()
 
@@ -94,19 +131,19 @@ func (m *Mapper) consumeGameMessages() {
 			}
 			return nil
 		}
-		metric.Update(1)
+		metric.UpdateClient(msg.ClientId, 1)
 
 		if !exists {
 			log.Infof("New client %s", msg.ClientId)
-			client = NewMapperClient(msg.ClientId, m.middleware)
+			client = NewMapperClient(msg.ClientId, m.middleware, m.languages)
 			m.clients[msg.ClientId] = client
 		}
 
-		if m.cancelled {
-			return nil
+		select {
+		case client.games <- *msg:
+		case <-m.stopping:
+			msg.Nack()
 		}
-
-		client.games <- *msg
 		return nil
 	})
 	if err != nil {
@@ -117,11 +154,16 @@ func (m *Mapper) consumeGameMessages() {
 func (m *Mapper) consumeReviewsMessages() {
 	log.Info("Starting to consume reviews messages")
 
-	metric := shared.NewMetric(10000, func(total int, elapsed time.Duration, rate float64) string {
+	metric := shared.NewMetric("mapper_reviews", 10000, func(total int, elapsed time.Duration, rate float64) string {
 		return fmt.Sprintf("[Mapper] Processed %d reviews in %s (%.2f reviews/s)", total, elapsed, rate)
 	})
 
-	err := m.reviewsQueue.Consume(m.cancelWg, func(msg *middleware.ReviewsMsg) error {
+	// los batches se reparten entre clientes, si no un cliente con muchas
+	// reviews bloquea el envio a los MapperClient de los demas
+	consumeReviews := func(callback func(msg *middleware.ReviewsMsg) error) error {
+		return m.reviewsQueue.Consume(&sync.WaitGroup{}, callback)
+	}
+	err := shared.ConsumeFair(m.middleware.Config.Fairness.Quantum, consumeReviews, func(msg *middleware.ReviewsMsg) error {
 		m.FinishedClientsReviews.Lock()
 		defer m.FinishedClientsReviews.Unlock()
 
@@ -134,18 +176,18 @@ func (m *Mapper) consumeReviewsMessages() {
 			}
 			return nil
 		}
-		metric.Update(len(msg.Reviews))
+		metric.UpdateClient(msg.ClientId, len(msg.Reviews))
 		if !exists {
 			log.Infof("New client %s", msg.ClientId)
-			client = NewMapperClient(msg.ClientId, m.middleware)
+			client = NewMapperClient(msg.ClientId, m.middleware, m.languages)
 			m.clients[msg.ClientId] = client
 		}
 
-		if m.cancelled {
-			return nil
+		select {
+		case client.reviews <- *msg:
+		case <-m.stopping:
+			msg.Nack()
 		}
-
-		client.reviews <- *msg
 		return nil
 	})
 
@@ -153,9 +195,37 @@ func (m *Mapper) consumeReviewsMessages() {
 		log.Errorf("Failed to consume from reviews exchange: %v", err)
 	}
 
-	if m.cancelled {
-		return
-	}
-
 	log.Info("Review messages consumed")
 }
+
+// consumeReviewsFinished le pasa a cada MapperClient el aviso de que se
+// procesaron todos sus batches. Va por el mismo channel que los batches, asi
+// el cliente lo procesa despues del batch en curso.
+func (m *Mapper) consumeReviewsFinished() {
+	err := m.reviewsFinishedQueue.Consume(&sync.WaitGroup{}, func(msg *middleware.ReviewsMsg) error {
+		m.FinishedClientsReviews.Lock()
+		defer m.FinishedClientsReviews.Unlock()
+
+		if m.FinishedClientsReviews.Contains(msg.ClientId) {
+			msg.Ack()
+			return nil
+		}
+
+		client, exists := m.clients[msg.ClientId]
+		if !exists {
+			log.Infof("New client %s", msg.ClientId)
+			client = NewMapperClient(msg.ClientId, m.middleware, m.languages)
+			m.clients[msg.ClientId] = client
+		}
+
+		select {
+		case client.reviews <- *msg:
+		case <-m.stopping:
+			msg.Nack()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to consume from reviews finished exchange: %v", err)
+	}
+}
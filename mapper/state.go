@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type ClientPhase int
+
+const (
+	CollectingGames  ClientPhase = iota
+	GamesComplete                // llegaron todos los games que anunciaron los Last de cada shard
+	StreamingReviews             // se termino al menos un batch de reviews
+	Finished                     // el server aviso que se procesaron todos los batches
+)
+
+func (p ClientPhase) String() string {
+	switch p {
+	case CollectingGames:
+		return "collecting_games"
+	case GamesComplete:
+		return "games_complete"
+	case StreamingReviews:
+		return "streaming_reviews"
+	case Finished:
+		return "finished"
+	}
+	return "unknown"
+}
+
+// ClientState es lo que un MapperClient guarda en database/<id>/state.csv para
+// retomar despues de un crash. Solo cambia con la fase, los batches terminados
+// los lleva processed_batches.bin.
+type ClientState struct {
+	Phase ClientPhase
+}
+
+func NewClientState() ClientState {
+	return ClientState{Phase: CollectingGames}
+}
+
+// LoadClientState lee el estado de un cliente, si no existe es un cliente nuevo
+func LoadClientState(path string) (ClientState, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return NewClientState(), nil
+	}
+	if err != nil {
+		return NewClientState(), err
+	}
+	defer file.Close()
+
+	record, err := csv.NewReader(file).Read()
+	if err != nil {
+		return NewClientState(), err
+	}
+	// las versiones anteriores guardaban tambien el ultimo batch
+	if len(record) != 1 && len(record) != 2 {
+		return NewClientState(), fmt.Errorf("invalid client state record: %v", record)
+	}
+
+	phase, err := strconv.Atoi(record[0])
+	if err != nil {
+		return NewClientState(), err
+	}
+
+	return ClientState{Phase: ClientPhase(phase)}, nil
+}
+
+// Save escribe el estado en un archivo temporal y lo renombra, asi un crash
+// nunca deja un state.csv a medio escribir
+func (s ClientState) Save(path string) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "state-*.csv")
+	if err != nil {
+		return err
+	}
+	defer tmpFile.Close()
+
+	writer := csv.NewWriter(tmpFile)
+	writer.Write([]string{strconv.Itoa(int(s.Phase))})
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientStateDefaultsToCollectingGames(t *testing.T) {
+	state, err := LoadClientState(filepath.Join(t.TempDir(), "state.csv"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, CollectingGames, state.Phase)
+}
+
+func TestClientStateSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.csv")
+
+	assert.Nil(t, ClientState{Phase: GamesComplete}.Save(path))
+	assert.Nil(t, ClientState{Phase: StreamingReviews}.Save(path))
+
+	state, err := LoadClientState(path)
+	assert.Nil(t, err)
+	assert.Equal(t, ClientState{Phase: StreamingReviews}, state)
+
+	// no quedan temporales al lado de los juegos
+	dentries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, dentries, 1)
+}
+
+func TestClientStateRejectsCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.csv")
+	assert.Nil(t, os.WriteFile(path, []byte("2,41,7\n"), 0644))
+
+	_, err := LoadClientState(path)
+	assert.NotNil(t, err)
+}
+
+func TestClientStateReadsLegacyLastBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.csv")
+	assert.Nil(t, os.WriteFile(path, []byte("2,41\n"), 0644))
+
+	state, err := LoadClientState(path)
+	assert.Nil(t, err)
+	assert.Equal(t, ClientState{Phase: StreamingReviews}, state)
+}
@@ -10,13 +10,19 @@ import (
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func (m *Middleware) declare() error {
+// los payloads de Result se registran al cargar el paquete, el server los
+// decodifica de sus sesiones antes de conectarse al broker
+func init() {
 	gob.Register(Query1Result{})
 	gob.Register(Query2Result{})
 	gob.Register(Query3Result{})
 	gob.Register(Query4Result{})
 	gob.Register(Query5Result{})
+	gob.Register(SketchResult{})
+	gob.Register(ApproximateResult{})
+}
 
+func (m *Middleware) declare() error {
 	if err := m.declareGamesExchange(); err != nil {
 		return err
 	}
@@ -25,7 +31,11 @@ func (m *Middleware) declare() error {
 		return err
 	}
 
-	if err := m.declareReviewsProcessedQueue(); err != nil {
+	if err := m.declareReviewsProcessedExchange(); err != nil {
+		return err
+	}
+
+	if err := m.declareReviewsFinishedExchange(); err != nil {
 		return err
 	}
 
@@ -33,11 +43,15 @@ func (m *Middleware) declare() error {
 		return err
 	}
 
+	if err := m.declareStatsConsumedExchange(); err != nil {
+		return err
+	}
+
 	if err := m.declareResultsExchange(); err != nil {
 		return err
 	}
 
-	if err := m.DeclareResponsesQueue(); err != nil {
+	if err := m.declareResponsesExchange(); err != nil {
 		return err
 	}
 
@@ -45,6 +59,10 @@ func (m *Middleware) declare() error {
 		return err
 	}
 
+	if err := m.declareCleanupDoneExchange(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -67,41 +85,90 @@ func (m *Middleware) declareGamesExchange() error {
 	return nil
 }
 
+// declareReviewsQueue declara la work queue de reviews y, con
+// mappers.partitioned, la cola reviews.<id> de cada mapper. Las declaran todos
+// los nodos, asi el server no publica en una cola que todavia no existe.
 func (m *Middleware) declareReviewsQueue() error {
-	queue, err := m.channel.QueueDeclare(
-		"reviews", // name
-		true,      // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		nil,       // arguments
-	)
+	queue, err := m.declareQueue("reviews")
 	m.reviewsQueue = &queue
 
 	if err != nil {
-		log.Errorf("Failed to declare queue: %v", err)
 		return err
 	}
 
+	if !m.Config.Mappers.Partitioned {
+		return nil
+	}
+
+	for partition := 1; partition <= m.Config.Mappers.Amount; partition++ {
+		if _, err := m.declareQueue(reviewsPartitionQueue(partition)); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (m *Middleware) declareReviewsProcessedQueue() error {
-	queue, err := m.channel.QueueDeclare(
-		"reviewsProcessed", // name
-		true,               // durable
-		false,              // delete when unused
-		false,              // exclusive
-		false,              // no-wait
-		nil,                // arguments
+func reviewsPartitionQueue(partition int) string {
+	return "reviews." + strconv.Itoa(partition)
+}
+
+// declareReviewsProcessedExchange declara el exchange por el que los mappers
+// avisan los batches procesados, ruteado por instancia del server igual que
+// las respuestas
+func (m *Middleware) declareReviewsProcessedExchange() error {
+	err := m.channel.ExchangeDeclare(
+		"reviewsProcessed",
+		"direct",
+		true,  // durable
+		false, // auto-deleted
+		false, // internal
+		false, // no-wait
+		nil,   // arguments
 	)
-	m.reviewsProcessedQueue = &queue
+	if err != nil {
+		log.Errorf("Failed to declare reviews processed exchange: %v", err)
+		return err
+	}
+	return nil
+}
 
+// declareStatsConsumedExchange declara el exchange por el que las queries
+// avisan cuantos stats de cada cliente recibieron, ruteado por instancia del
+// server igual que los batches procesados
+func (m *Middleware) declareStatsConsumedExchange() error {
+	err := m.channel.ExchangeDeclare(
+		"statsConsumed",
+		"direct",
+		true,  // durable
+		false, // auto-deleted
+		false, // internal
+		false, // no-wait
+		nil,   // arguments
+	)
 	if err != nil {
-		log.Errorf("Failed to declare queue: %v", err)
+		log.Errorf("Failed to declare stats consumed exchange: %v", err)
 		return err
 	}
+	return nil
+}
 
+// declareReviewsFinishedExchange declara el exchange por el que el server avisa
+// a todos los mappers que se procesaron todos los batches de un cliente
+func (m *Middleware) declareReviewsFinishedExchange() error {
+	err := m.channel.ExchangeDeclare(
+		"reviewsFinished",
+		"fanout",
+		true,  // durable
+		false, // auto-deleted
+		false, // internal
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		log.Errorf("Failed to declare reviews finished exchange: %v", err)
+		return err
+	}
 	return nil
 }
 
@@ -141,22 +208,22 @@ func (m *Middleware) declareResultsExchange() error {
 	return nil
 }
 
-func (m *Middleware) DeclareResponsesQueue() error {
-	queue, err := m.channel.QueueDeclare(
-		"responses", // name
-		true,        // durable
-		false,       // delete when unused
-		false,       // exclusive
-		false,       // no-wait
-		nil,         // arguments
+// declareResponsesExchange declara el exchange de respuestas. Cada instancia
+// del server consume con su numero como routing key.
+func (m *Middleware) declareResponsesExchange() error {
+	err := m.channel.ExchangeDeclare(
+		"responses",
+		"direct",
+		true,  // durable
+		false, // auto-deleted
+		false, // internal
+		false, // no-wait
+		nil,   // arguments
 	)
-	m.responsesQueue = &queue
-
 	if err != nil {
-		log.Errorf("Failed to declare queue: %v", err)
+		log.Errorf("Failed to declare responses exchange: %v", err)
 		return err
 	}
-
 	return nil
 }
 
@@ -179,8 +246,29 @@ func (m *Middleware) declareClientsFinishedExchange() error {
 	return nil
 }
 
+// declareCleanupDoneExchange declara el exchange por el que los nodos avisan
+// que borraron el estado de un cliente, ruteado por instancia del server
+func (m *Middleware) declareCleanupDoneExchange() error {
+	err := m.channel.ExchangeDeclare(
+		"cleanupDone",
+		"direct",
+		true,  // durable
+		false, // auto-deleted
+		false, // internal
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		log.Errorf("Failed to declare cleanup done exchange: %v", err)
+		return err
+	}
+	return nil
+}
+
+// ListenGames bindea la cola de un shard de una query a los games de todas las
+// particiones y a los Last del shard
 func (m *Middleware) ListenGames(name string, shardId string) (*GamesQueue, error) {
-	queue, err := m.bindExchange(name, "games", shardId)
+	queue, err := m.bindExchange(name, "games", shardId+".*")
 	if err != nil {
 		return nil, err
 	}
@@ -188,26 +276,57 @@ func (m *Middleware) ListenGames(name string, shardId string) (*GamesQueue, erro
 	return &GamesQueue{queue: queue, middleware: m}, nil
 }
 
-func (m *Middleware) SendGameMsg(message *GameMsg) error {
+// ListenMapperGames bindea la cola de un mapper a los games de su particion de
+// todos los shards y a los Last de todos los shards
+func (m *Middleware) ListenMapperGames(name string) (*GamesQueue, error) {
+	queue, err := m.bindExchange(name, "games", "*."+strconv.Itoa(m.MapperPartition()), "*."+GAMES_LAST_KEY)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GamesQueue{queue: queue, middleware: m}, nil
+}
+
+// los games se publican con la routing key <shard>.<particion> y los Last con
+// <shard>.last, asi a cada shard de las queries le llegan todos los games del
+// shard y a cada mapper solo los de su particion
+const GAMES_LAST_KEY = "last"
+
+func gamesKey(shardId int, partition string) string {
+	return strconv.Itoa(shardId) + "." + partition
+}
+
+// ShardOf es el shard de los games y stats de un juego, la suma de los
+// digitos del AppId modulo sharding.amount
+func (m *Middleware) ShardOf(appId int) int {
 	totalInt := 0
-	for _, char := range strconv.Itoa(message.Game.AppId) {
+	for _, char := range strconv.Itoa(appId) {
 		int, _ := strconv.Atoi(string(char))
 		totalInt += int
 	}
-	shardId := totalInt % m.Config.Sharding.Amount
-	stringShardId := strconv.Itoa(shardId)
+	return totalInt % m.Config.Sharding.Amount
+}
+
+func (m *Middleware) SendGameMsg(message *GameMsg) error {
+	shardId := m.ShardOf(message.Game.AppId)
+	partition := m.PartitionOf(message.Game.AppId)
 
 	message.ShardId = shardId
-	return m.publishExchange("games", stringShardId, message)
+	return m.publishExchange("games", gamesKey(shardId, strconv.Itoa(partition)), message)
 }
 
-func (m Middleware) SendGameFinished(clientId string) error {
+// SendGameFinished manda el Last de cada shard con la cantidad de games que se
+// le mandaron a cada particion, totals[shardId][particion], y su suma
+func (m *Middleware) SendGameFinished(clientId ClientId, priority Priority, totals [][]int) error {
 
 	for shardId := range m.Config.Sharding.Amount {
-		stringShardId := strconv.Itoa(shardId)
-		err := m.publishExchange("games", stringShardId, &GameMsg{ClientId: clientId, Game: &Game{}, Last: true, ShardId: shardId})
+		total := 0
+		for _, games := range totals[shardId] {
+			total += games
+		}
+		err := m.publishExchange("games", gamesKey(shardId, GAMES_LAST_KEY), &GameMsg{ClientId: clientId, Priority: priority, Game: &Game{}, Last: true, ShardId: shardId, Total: total, Partitions: totals[shardId]})
 		if err != nil {
-			log.Errorf("Failed to send game finished to shard %s: %v", stringShardId, err)
+			log.Errorf("Failed to send game finished to shard %d: %v", shardId, err)
 			return err
 		}
 	}
@@ -228,6 +347,11 @@ func (gq *GamesQueue) Consume(wg *sync.WaitGroup, callback func(message *GameMsg
 
 	wg.Add(1)
 	for msg := range msgs {
+		msg = gq.middleware.track(gq.queue.Name, msg)
+		if gq.middleware.requeueIfDraining(msg) {
+			continue
+		}
+
 		var res GameMsg
 
 		decoder := gob.NewDecoder(bytes.NewReader(msg.Body))
@@ -254,24 +378,81 @@ type ReviewsQueue struct {
 	middleware *Middleware
 }
 
+// ListenReviews devuelve la work queue de reviews o, con mappers.partitioned,
+// la cola de la particion del mapper
 func (m *Middleware) ListenReviews() (*ReviewsQueue, error) {
+	if m.Config.Mappers.Partitioned {
+		return &ReviewsQueue{queue: &amqp.Queue{Name: reviewsPartitionQueue(m.Config.Mappers.Id)}, middleware: m}, nil
+	}
 	return &ReviewsQueue{queue: m.reviewsQueue, middleware: m}, nil
 }
 
-func (m *Middleware) SendReviewBatch(message *ReviewsMsg) error {
-	return m.publishQueue(m.reviewsQueue, message)
+// PartitionOf es el mapper duenio de un juego y de sus reviews, 0 si los
+// mappers no estan particionados
+func (m *Middleware) PartitionOf(appId int) int {
+	if !m.Config.Mappers.Partitioned {
+		return 0
+	}
+	if appId < 0 {
+		return 1
+	}
+	return appId%m.Config.Mappers.Amount + 1
 }
 
-func (m Middleware) SendReviewsProcessed(message *ReviewsProcessedMsg) error {
-	return m.publishQueue(m.reviewsProcessedQueue, message)
+// ReviewPartitionOf es PartitionOf para el AppId de una review, que llega como
+// texto. Un AppId que no es un numero va al mapper 1.
+func (m *Middleware) ReviewPartitionOf(appId string) int {
+	if !m.Config.Mappers.Partitioned {
+		return 0
+	}
+	id, err := strconv.Atoi(appId)
+	if err != nil {
+		return 1
+	}
+	return m.PartitionOf(id)
 }
 
-func (m Middleware) SendReviewsFinished(clientId string, last int) error {
-	if last == m.Config.Mappers.Amount+1 {
-		log.Infof("ALL MAPPERS FINISHED FOR CLIENT %s", clientId)
-		return nil
+// MapperPartition es la particion de este mapper, 0 si no estan particionados
+// y todos reciben todos los games
+func (m *Middleware) MapperPartition() int {
+	if !m.Config.Mappers.Partitioned {
+		return 0
+	}
+	return m.Config.Mappers.Id
+}
+
+// SendReviewBatch manda un batch a la work queue, o a la cola del mapper
+// partition si las reviews estan particionadas. Todas las reviews del batch
+// tienen que ser de esa particion.
+func (m *Middleware) SendReviewBatch(partition int, message *ReviewsMsg) error {
+	if partition == 0 {
+		return m.publishQueue(m.reviewsQueue, message)
 	}
-	return m.publishQueue(m.reviewsQueue, &ReviewsMsg{ClientId: clientId, Last: last})
+	return m.publishExchange("", reviewsPartitionQueue(partition), message)
+}
+
+func (m *Middleware) SendReviewsProcessed(message *ReviewsProcessedMsg) error {
+	return m.SendReviewsProcessedTo(message.ClientId.Instance(), message)
+}
+
+func (m *Middleware) SendReviewsProcessedTo(instance int, message *ReviewsProcessedMsg) error {
+	return m.publishExchange("reviewsProcessed", strconv.Itoa(instance), message)
+}
+
+// SendReviewsFinished avisa a todos los mappers que se procesaron los batches
+// batches de reviews del cliente
+func (m *Middleware) SendReviewsFinished(clientId ClientId, priority Priority, batches int) error {
+	return m.publishExchange("reviewsFinished", "", &ReviewsMsg{ClientId: clientId, Priority: priority, Last: true, Batches: batches})
+}
+
+// ListenReviewsFinished bindea la cola propia de un mapper al exchange
+// reviewsFinished, cada mapper recibe una copia de cada aviso
+func (m *Middleware) ListenReviewsFinished(name string) (*ReviewsQueue, error) {
+	queue, err := m.bindExchange(name, "reviewsFinished", "")
+	if err != nil {
+		return nil, err
+	}
+	return &ReviewsQueue{queue: queue, middleware: m}, nil
 }
 
 func (rq *ReviewsQueue) Consume(wg *sync.WaitGroup, callback func(message *ReviewsMsg) error) error {
@@ -282,6 +463,11 @@ func (rq *ReviewsQueue) Consume(wg *sync.WaitGroup, callback func(message *Revie
 
 	wg.Add(1)
 	for msg := range msgs {
+		msg = rq.middleware.track(rq.queue.Name, msg)
+		if rq.middleware.requeueIfDraining(msg) {
+			continue
+		}
+
 		var res ReviewsMsg
 
 		decoder := gob.NewDecoder(bytes.NewReader(msg.Body))
@@ -300,13 +486,67 @@ func (rq *ReviewsQueue) Consume(wg *sync.WaitGroup, callback func(message *Revie
 	return nil
 }
 
+func (m *Middleware) SendStatsConsumed(message *StatsConsumedMsg) error {
+	return m.SendStatsConsumedTo(message.ClientId.Instance(), message)
+}
+
+func (m *Middleware) SendStatsConsumedTo(instance int, message *StatsConsumedMsg) error {
+	return m.publishExchange("statsConsumed", strconv.Itoa(instance), message)
+}
+
+type StatsConsumedQueue struct {
+	queue      *amqp.Queue
+	middleware *Middleware
+}
+
+func (m *Middleware) ListenStatsConsumed(instance int) (*StatsConsumedQueue, error) {
+	queue, err := m.bindExchange("statsConsumed."+strconv.Itoa(instance), "statsConsumed", strconv.Itoa(instance))
+	if err != nil {
+		return nil, err
+	}
+	return &StatsConsumedQueue{queue: queue, middleware: m}, nil
+}
+
+func (scq *StatsConsumedQueue) Consume(callback func(message *StatsConsumedMsg) error) error {
+	msgs, err := scq.middleware.consumeQueue(scq.queue)
+	if err != nil {
+		return err
+	}
+
+	for msg := range msgs {
+		msg = scq.middleware.track(scq.queue.Name, msg)
+		if scq.middleware.requeueIfDraining(msg) {
+			continue
+		}
+
+		var res StatsConsumedMsg
+
+		decoder := gob.NewDecoder(bytes.NewReader(msg.Body))
+		err := decoder.Decode(&res)
+		if err != nil {
+			log.Errorf("Failed to decode message: %v", err)
+			continue
+		}
+
+		res.msg = msg
+
+		callback(&res)
+	}
+
+	return nil
+}
+
 type ReviewsProcessedQueue struct {
 	queue      *amqp.Queue
 	middleware *Middleware
 }
 
-func (m *Middleware) ListenReviewsProcessed() (*ReviewsProcessedQueue, error) {
-	return &ReviewsProcessedQueue{queue: m.reviewsProcessedQueue, middleware: m}, nil
+func (m *Middleware) ListenReviewsProcessed(instance int) (*ReviewsProcessedQueue, error) {
+	queue, err := m.bindExchange("reviewsProcessed."+strconv.Itoa(instance), "reviewsProcessed", strconv.Itoa(instance))
+	if err != nil {
+		return nil, err
+	}
+	return &ReviewsProcessedQueue{queue: queue, middleware: m}, nil
 }
 
 func (rpq *ReviewsProcessedQueue) Consume(wg *sync.WaitGroup, callback func(message *ReviewsProcessedMsg) error) error {
@@ -316,6 +556,11 @@ func (rpq *ReviewsProcessedQueue) Consume(wg *sync.WaitGroup, callback func(mess
 	}
 
 	for msg := range msgs {
+		msg = rpq.middleware.track(rpq.queue.Name, msg)
+		if rpq.middleware.requeueIfDraining(msg) {
+			continue
+		}
+
 		var res ReviewsProcessedMsg
 
 		decoder := gob.NewDecoder(bytes.NewReader(msg.Body))
@@ -334,26 +579,24 @@ func (rpq *ReviewsProcessedQueue) Consume(wg *sync.WaitGroup, callback func(mess
 }
 
 func (m *Middleware) SendStats(message *StatsMsg) error {
-	totalInt := 0
-	for _, char := range strconv.Itoa(message.Stats.AppId) {
-		int, _ := strconv.Atoi(string(char))
-		totalInt += int
-	}
-	shardId := totalInt % m.Config.Sharding.Amount
-	topic := strconv.Itoa(shardId) + "." + strings.Join(message.Stats.Genres, ".")
+	topic := strconv.Itoa(m.ShardOf(message.Stats.AppId)) + "." + strings.Join(message.Stats.Genres, ".")
 
 	return m.publishExchange("stats", topic, message)
 }
 
-func (m *Middleware) SendStatsFinished(clientId string) error {
+// SendStatsFinished manda un Last por shard y genero con la cantidad de stats
+// que publicaron los mappers para esa combinacion
+func (m *Middleware) SendStatsFinished(clientId ClientId, priority Priority, counts StatsCounts) error {
 	for shardId := range m.Config.Sharding.Amount {
-		stringShardId := strconv.Itoa(shardId)
-		topic := stringShardId + ".Indie.Action"
-		log.Infof("Sending stats finished to shard %s for client %s", topic, clientId)
-		err := m.publishExchange("stats", topic, &StatsMsg{ClientId: clientId, Stats: &Stats{}, Last: true})
-		if err != nil {
-			log.Errorf("Failed to send stats finished to shard %s: %v", topic, err)
-			return err
+		for _, genre := range StatsGenres {
+			topic := strconv.Itoa(shardId) + "." + genre
+			total := counts.Get(shardId, genre)
+			log.Infof("Sending stats finished to shard %s for client %s | total: %d", topic, clientId, total)
+			err := m.publishExchange("stats", topic, &StatsMsg{ClientId: clientId, Priority: priority, Stats: &Stats{}, Last: true, Total: total})
+			if err != nil {
+				log.Errorf("Failed to send stats finished to shard %s: %v", topic, err)
+				return err
+			}
 		}
 	}
 	return nil
@@ -380,6 +623,11 @@ func (sq *StatsQueue) Consume(callback func(message *StatsMsg) error) error {
 	}
 
 	for msg := range msgs {
+		msg = sq.middleware.track(sq.queue.Name, msg)
+		if sq.middleware.requeueIfDraining(msg) {
+			continue
+		}
+
 		var res StatsMsg
 
 		decoder := gob.NewDecoder(bytes.NewReader(msg.Body))
@@ -411,7 +659,7 @@ func (m *Middleware) ListenResults(queryId string) (*ResultsQueue, error) {
 }
 
 func (m *Middleware) SendResult(queryId string, result *Result) error {
-	log.Infof("Sending result from query %s for client %d with id: %v", queryId, result.ClientId, result.Id)
+	log.Infof("Sending result from query %s for client %s with id: %v", queryId, result.ClientId, result.Id)
 	return m.publishExchange("results", queryId, result)
 }
 
@@ -422,6 +670,11 @@ func (rq *ResultsQueue) Consume(callback func(message *Result) error) error {
 	}
 
 	for msg := range msgs {
+		msg = rq.middleware.track(rq.queue.Name, msg)
+		if rq.middleware.requeueIfDraining(msg) {
+			continue
+		}
+
 		var res Result
 
 		decoder := gob.NewDecoder(bytes.NewReader(msg.Body))
@@ -447,15 +700,26 @@ type ResponsesQueue struct {
 	middleware *Middleware
 }
 
-func (m *Middleware) ListenResponses() (*ResponsesQueue, error) {
-	return &ResponsesQueue{queue: m.responsesQueue, middleware: m}, nil
+// ListenResponses escucha las respuestas de los clientes de una instancia del
+// server. La cola es durable, si la instancia se cae otra la puede consumir.
+func (m *Middleware) ListenResponses(instance int) (*ResponsesQueue, error) {
+	queue, err := m.bindExchange("responses."+strconv.Itoa(instance), "responses", strconv.Itoa(instance))
+	if err != nil {
+		return nil, err
+	}
+	return &ResponsesQueue{queue: queue, middleware: m}, nil
 }
 
+// SendResponse manda la respuesta a la instancia del server que creo al cliente
 func (m *Middleware) SendResponse(response *Result) error {
+	return m.SendResponseTo(response.ClientId.Instance(), response)
+}
+
+func (m *Middleware) SendResponseTo(instance int, response *Result) error {
 	if response.IsFinalMessage {
-		log.Infof("Sending final response for client %d with id: %v", response.ClientId, response.Id)
+		log.Infof("Sending final response for client %s to server %d with id: %v", response.ClientId, instance, response.Id)
 	}
-	return m.publishQueue(m.responsesQueue, response)
+	return m.publishExchange("responses", strconv.Itoa(instance), response)
 }
 
 func (rq *ResponsesQueue) Consume(callback func(message *Result) error) error {
@@ -465,6 +729,11 @@ func (rq *ResponsesQueue) Consume(callback func(message *Result) error) error {
 	}
 
 	for msg := range msgs {
+		msg = rq.middleware.track(rq.queue.Name, msg)
+		if rq.middleware.requeueIfDraining(msg) {
+			continue
+		}
+
 		var res Result
 
 		decoder := gob.NewDecoder(bytes.NewReader(msg.Body))
@@ -487,8 +756,10 @@ type ClientsFinishedQueue struct {
 	middleware *Middleware
 }
 
+// ListenClientsFinished escucha los ClientsFinished para todos ("*") y los
+// reintentos dirigidos a este nodo ("node.<name>")
 func (m *Middleware) ListenClientsFinished(name string) (*ClientsFinishedQueue, error) {
-	queue, err := m.bindExchange(name, "clientsFinished", "*")
+	queue, err := m.bindExchange(name, "clientsFinished", "*", clientsFinishedKey(name))
 	if err != nil {
 		return nil, err
 	}
@@ -503,6 +774,11 @@ func (cfq *ClientsFinishedQueue) Consume(callback func(message *ClientsFinishedM
 	}
 
 	for msg := range msgs {
+		msg = cfq.middleware.track(cfq.queue.Name, msg)
+		if cfq.middleware.requeueIfDraining(msg) {
+			continue
+		}
+
 		var res ClientsFinishedMsg
 
 		decoder := gob.NewDecoder(bytes.NewReader(msg.Body))
@@ -519,6 +795,67 @@ func (cfq *ClientsFinishedQueue) Consume(callback func(message *ClientsFinishedM
 	return nil
 }
 
-func (m *Middleware) SendClientsFinished(clientId int) error {
-	return m.publishExchange("clientsFinished", "*", &ClientsFinishedMsg{ClientId: clientId})
+// SendClientsFinished avisa a todos los nodos que borren el estado del
+// cliente. replyTo es la instancia del server que espera los CleanupDone.
+func (m *Middleware) SendClientsFinished(clientId ClientId, replyTo int) error {
+	return m.publishExchange("clientsFinished", "*", &ClientsFinishedMsg{ClientId: clientId, ReplyTo: replyTo})
+}
+
+// SendClientsFinishedTo reenvia el ClientsFinished a un solo nodo, el que no
+// confirmo
+func (m *Middleware) SendClientsFinishedTo(clientId ClientId, replyTo int, node string) error {
+	return m.publishExchange("clientsFinished", clientsFinishedKey(node), &ClientsFinishedMsg{ClientId: clientId, ReplyTo: replyTo})
+}
+
+// clientsFinishedKey tiene al menos dos palabras (los nombres de los reducers
+// no tienen puntos), asi el binding "*" de los demas nodos no la matchea
+func clientsFinishedKey(node string) string {
+	return "node." + node
+}
+
+type CleanupDoneQueue struct {
+	queue      *amqp.Queue
+	middleware *Middleware
+}
+
+func (m *Middleware) ListenCleanupDone(instance int) (*CleanupDoneQueue, error) {
+	queue, err := m.bindExchange("cleanupDone."+strconv.Itoa(instance), "cleanupDone", strconv.Itoa(instance))
+	if err != nil {
+		return nil, err
+	}
+	return &CleanupDoneQueue{queue: queue, middleware: m}, nil
+}
+
+func (cdq *CleanupDoneQueue) Consume(callback func(message *CleanupDoneMsg) error) error {
+	msgs, err := cdq.middleware.consumeQueue(cdq.queue)
+	if err != nil {
+		return err
+	}
+
+	for msg := range msgs {
+		msg = cdq.middleware.track(cdq.queue.Name, msg)
+		if cdq.middleware.requeueIfDraining(msg) {
+			continue
+		}
+
+		var res CleanupDoneMsg
+
+		decoder := gob.NewDecoder(bytes.NewReader(msg.Body))
+		err := decoder.Decode(&res)
+		if err != nil {
+			log.Errorf("Failed to decode message: %v", err)
+			continue
+		}
+
+		res.msg = msg
+
+		callback(&res)
+	}
+	return nil
+}
+
+// SendCleanupDoneTo avisa a la instancia del server que mando el
+// ClientsFinished (su ReplyTo)
+func (m *Middleware) SendCleanupDoneTo(instance int, message *CleanupDoneMsg) error {
+	return m.publishExchange("cleanupDone", strconv.Itoa(instance), message)
 }
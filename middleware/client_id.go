@@ -0,0 +1,24 @@
+package middleware
+
+import "strconv"
+
+// ClientId identifies a client in every message. It is built by the server as
+// instance (16 bits) | epoch (16 bits) | counter (32 bits), see
+// shared.ClientIdAllocator. It is only formatted as a string for file paths,
+// logs and the client protocol.
+type ClientId uint64
+
+func (id ClientId) String() string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+func ParseClientId(s string) (ClientId, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	return ClientId(id), err
+}
+
+// Instance es la instancia del server que asigno el id, las respuestas del
+// cliente se rutean con ella
+func (id ClientId) Instance() int {
+	return int(id >> 48)
+}
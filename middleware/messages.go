@@ -4,6 +4,8 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"tp1-distribuidos/shared/sketch"
+	"tp1-distribuidos/shared/tracing"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -68,17 +70,43 @@ func NewGame(record []string) *Game {
 }
 
 type GameMsg struct {
-	ClientId string
-	ShardId  int
-	Game     *Game
-	Last     bool
-	msg      amqp.Delivery
+	Id         int // orden del game en la subida del cliente
+	ClientId   ClientId
+	Priority   Priority
+	ShardId    int
+	Game       *Game
+	Last       bool
+	Total      int   // en el Last, games que se mandaron al shard
+	Partitions []int // en el Last, games del shard que se mandaron a cada particion de mappers
+	msg        amqp.Delivery
+	trace      tracing.SpanContext
+}
+
+// PartitionTotal es lo que anuncia el Last para el mapper de la particion. Un
+// Last sin particiones es de cuando los games llegaban a todos los mappers.
+func (g *GameMsg) PartitionTotal(partition int) int {
+	if partition < len(g.Partitions) {
+		return g.Partitions[partition]
+	}
+	return g.Total
 }
 
 func (g *GameMsg) Ack() {
 	g.msg.Ack(false)
 }
 
+func (g *GameMsg) Nack() {
+	g.msg.Nack(false, true)
+}
+
+func (g *GameMsg) GetClientId() ClientId {
+	return g.ClientId
+}
+
+func (g *GameMsg) GetPriority() Priority {
+	return g.Priority
+}
+
 type Review struct {
 	Id    int
 	AppId string
@@ -110,36 +138,69 @@ func NewReview(record []string, id int) *Review {
 
 type ReviewsMsg struct {
 	Id        int
-	ClientId  string
+	ClientId  ClientId
+	Priority  Priority
 	Reviews   []Review
-	Last      int
+	Last      bool // aviso de reviewsFinished, no trae reviews
+	Batches   int  // en el Last, batches de reviews que subio el cliente
 	Processed map[int]int
 	msg       amqp.Delivery
+	trace     tracing.SpanContext
 }
 
 func (r *ReviewsMsg) Ack() {
 	r.msg.Ack(false)
 }
 
+func (r *ReviewsMsg) GetClientId() ClientId {
+	return r.ClientId
+}
+
+func (r *ReviewsMsg) GetPriority() Priority {
+	return r.Priority
+}
+
 func (r *ReviewsMsg) Nack() {
 	r.msg.Nack(false, true)
 }
 
 type ReviewsProcessedMsg struct {
-	ClientId string
+	ClientId ClientId
 	BatchId  int
+	Stats    StatsCounts // stats que publico el mapper para el batch
 	msg      amqp.Delivery
+	trace    tracing.SpanContext
 }
 
 func (r *ReviewsProcessedMsg) Ack() {
 	r.msg.Ack(false)
 }
 
+func (r *ReviewsProcessedMsg) Nack() {
+	r.msg.Nack(false, true)
+}
+
+// StatsConsumedMsg es cuantos stats distintos de un cliente recibio un shard
+// de una query, acumulado. Cada query lo manda periodicamente al server que
+// atiende al cliente, que con eso limita los stats sin consumir del cliente.
+type StatsConsumedMsg struct {
+	ClientId ClientId
+	QueryId  int
+	ShardId  int
+	Received int
+	msg      amqp.Delivery
+}
+
+func (s *StatsConsumedMsg) Ack() {
+	s.msg.Ack(false)
+}
+
 type Stats struct {
 	Id        int
 	AppId     int
 	Name      string
 	Text      string
+	Language  string // detectado en el mapper si language.in-mapper esta activo
 	Genres    []string
 	Positives int
 	Negatives int
@@ -184,30 +245,90 @@ func NewStats(game []string, review *Review) *Stats {
 }
 
 type StatsMsg struct {
-	ClientId string
+	ClientId ClientId
+	Priority Priority
 	Stats    *Stats
 	Last     bool
+	Total    int // en el Last, stats que se publicaron para el shard y genero
 	msg      amqp.Delivery
+	trace    tracing.SpanContext
 }
 
 func (s *StatsMsg) Ack() {
 	s.msg.Ack(false)
 }
 
+func (s *StatsMsg) Nack() {
+	s.msg.Nack(false, true)
+}
+
+func (s *StatsMsg) GetClientId() ClientId {
+	return s.ClientId
+}
+
+func (s *StatsMsg) GetPriority() Priority {
+	return s.Priority
+}
+
+// StatsGenres son los generos por los que filtran las queries de stats, cada
+// shard de las queries 3, 4 y 5 recibe los stats de uno de ellos
+var StatsGenres = []string{"Action", "Indie"}
+
+// StatsQueries es el genero por el que filtra cada query de stats
+var StatsQueries = map[int]string{3: "Indie", 4: "Action", 5: "Action"}
+
+// StatsCounts cuenta stats publicados por shard y genero, con la clave
+// "<shard>.<genero>"
+type StatsCounts map[string]int
+
+func statsCountKey(shardId int, genre string) string {
+	return strconv.Itoa(shardId) + "." + genre
+}
+
+// Add cuenta un stat del shard en cada uno de sus generos que esta en
+// StatsGenres
+func (s StatsCounts) Add(shardId int, genres []string) {
+	for _, genre := range StatsGenres {
+		if slices.Contains(genres, genre) {
+			s[statsCountKey(shardId, genre)]++
+		}
+	}
+}
+
+func (s StatsCounts) Merge(other StatsCounts) {
+	for key, count := range other {
+		s[key] += count
+	}
+}
+
+func (s StatsCounts) Get(shardId int, genre string) int {
+	return s[statsCountKey(shardId, genre)]
+}
+
 type Result struct {
 	Id             int64
-	ClientId       string
+	ClientId       ClientId
+	Priority       Priority
 	QueryId        int
 	ShardId        int
 	IsFinalMessage bool
 	Payload        interface{}
 	msg            amqp.Delivery
+	trace          tracing.SpanContext
 }
 
 func (r *Result) Ack() {
 	r.msg.Ack(false)
 }
 
+func (r *Result) GetPriority() Priority {
+	return r.Priority
+}
+
+func (r *Result) Nack() {
+	r.msg.Nack(false, true)
+}
+
 type Query1Result struct {
 	Windows int64
 	Mac     int64
@@ -220,7 +341,8 @@ type Query2Result struct {
 }
 
 type Query3Result struct {
-	TopStats []Stats
+	TopStats  []Stats
+	Processed int // solo en los parciales (IsFinalMessage false)
 }
 
 type Query4Result struct {
@@ -231,11 +353,45 @@ type Query5Result struct {
 	Stats []Stats
 }
 
+// SketchResult is a partial approximation sent periodically by a query shard
+// when the approximate mode is enabled. Processed is the amount of stats the
+// shard had seen for the client when the sketch was taken.
+type SketchResult struct {
+	Processed int
+	TopK      *sketch.TopK
+	Quantiles *sketch.Quantiles
+}
+
+// ApproximateResult is sent by the reducers to the server with the merged
+// sketches of every shard. The exact result is still sent at the end.
+type ApproximateResult struct {
+	Stats  []Stats
+	Cutoff int
+}
+
 type ClientsFinishedMsg struct {
-	ClientId int
+	ClientId ClientId
+	ReplyTo  int // instancia del server que espera los CleanupDone
 	msg      amqp.Delivery
 }
 
 func (c *ClientsFinishedMsg) Ack() {
 	c.msg.Ack(false)
 }
+
+// CleanupDoneMsg lo manda cada consumidor de clientsFinished cuando termino de
+// borrar el estado del cliente. Node es el nombre de su cola.
+type CleanupDoneMsg struct {
+	ClientId ClientId
+	Node     string
+	msg      amqp.Delivery
+	trace    tracing.SpanContext
+}
+
+func (c *CleanupDoneMsg) Ack() {
+	c.msg.Ack(false)
+}
+
+func (c *CleanupDoneMsg) Nack() {
+	c.msg.Nack(false, true)
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import "strconv"
+
+// Priority es la prioridad del cliente que eligio en el handshake. Viaja en
+// todos sus mensajes y se usa como prioridad del mensaje en RabbitMQ, donde
+// las colas se declaran con x-max-priority = MAX_PRIORITY.
+type Priority uint8
+
+const (
+	PriorityLow    Priority = 1
+	PriorityNormal Priority = 5
+	PriorityHigh   Priority = 9
+)
+
+const MAX_PRIORITY = PriorityHigh
+
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "", "normal":
+		return PriorityNormal, nil
+	case "low", "bulk":
+		return PriorityLow, nil
+	case "high", "interactive":
+		return PriorityHigh, nil
+	}
+
+	priority, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	return Priority(min(max(priority, 0), int(MAX_PRIORITY))), nil
+}
+
+type prioritized interface {
+	GetPriority() Priority
+}
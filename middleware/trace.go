@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"tp1-distribuidos/shared/tracing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// traced lo implementan los mensajes que propagan el contexto de la traza en
+// el header traceparent
+type traced interface {
+	Trace() tracing.SpanContext
+}
+
+// messageTrace es el padre de lo que se haga con un mensaje: el contexto que
+// se le asigno con SetTrace, si no el span de consume de la delivery y si el
+// mensaje no vino de rabbit la raiz del cliente
+func messageTrace(explicit tracing.SpanContext, msg amqp.Delivery, clientId ClientId) tracing.SpanContext {
+	if explicit.IsValid() {
+		return explicit
+	}
+	if acknowledger, ok := msg.Acknowledger.(*trackedAcknowledger); ok {
+		return acknowledger.span.Context
+	}
+	return tracing.ClientTrace(uint64(clientId))
+}
+
+// deliveryParent es el contexto que mando el publisher. Si el mensaje llego sin
+// header (por ejemplo publicado por una version vieja) el span de consume
+// empieza una traza nueva.
+func deliveryParent(msg amqp.Delivery) tracing.SpanContext {
+	if value, ok := msg.Headers[tracing.HEADER].(string); ok {
+		if parent, ok := tracing.ParseTraceparent(value); ok {
+			return parent
+		}
+	}
+	return tracing.SpanContext{}
+}
+
+func (g *GameMsg) Trace() tracing.SpanContext {
+	return messageTrace(g.trace, g.msg, g.ClientId)
+}
+
+func (g *GameMsg) SetTrace(trace tracing.SpanContext) {
+	g.trace = trace
+}
+
+func (r *ReviewsMsg) Trace() tracing.SpanContext {
+	return messageTrace(r.trace, r.msg, r.ClientId)
+}
+
+func (r *ReviewsMsg) SetTrace(trace tracing.SpanContext) {
+	r.trace = trace
+}
+
+func (r *ReviewsProcessedMsg) Trace() tracing.SpanContext {
+	return messageTrace(r.trace, r.msg, r.ClientId)
+}
+
+func (r *ReviewsProcessedMsg) SetTrace(trace tracing.SpanContext) {
+	r.trace = trace
+}
+
+func (s *StatsMsg) Trace() tracing.SpanContext {
+	return messageTrace(s.trace, s.msg, s.ClientId)
+}
+
+func (s *StatsMsg) SetTrace(trace tracing.SpanContext) {
+	s.trace = trace
+}
+
+func (r *Result) Trace() tracing.SpanContext {
+	return messageTrace(r.trace, r.msg, r.ClientId)
+}
+
+func (r *Result) SetTrace(trace tracing.SpanContext) {
+	r.trace = trace
+}
+
+func (c *ClientsFinishedMsg) Trace() tracing.SpanContext {
+	return messageTrace(tracing.SpanContext{}, c.msg, c.ClientId)
+}
+
+func (c *CleanupDoneMsg) Trace() tracing.SpanContext {
+	return messageTrace(c.trace, c.msg, c.ClientId)
+}
+
+func (c *CleanupDoneMsg) SetTrace(trace tracing.SpanContext) {
+	c.trace = trace
+}
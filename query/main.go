@@ -1,19 +1,21 @@
 package main
 
 import (
-	"context"
+	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
+	"time"
 	"tp1-distribuidos/config"
 	"tp1-distribuidos/middleware"
 	"tp1-distribuidos/query/queries"
 	"tp1-distribuidos/shared"
-
-	"github.com/op/go-logging"
+	"tp1-distribuidos/shared/admin"
+	"tp1-distribuidos/shared/health"
+	"tp1-distribuidos/shared/lifecycle"
+	"tp1-distribuidos/shared/logs"
+	"tp1-distribuidos/shared/tracing"
 )
 
-var log = logging.MustGetLogger("log")
+var log = logs.Get("query")
 
 func main() {
 	os.Mkdir("./database", 0666)
@@ -22,7 +24,15 @@ func main() {
 		log.Criticalf("%s", err)
 	}
 
-	if err := shared.InitLogger(config.Log.Level); err != nil {
+	name := fmt.Sprintf("query-%d.%d", config.Query.Id, config.Query.Shard)
+	err = logs.Init(logs.Options{
+		Node:    name,
+		Level:   config.Log.Level,
+		Format:  config.Log.Format,
+		Modules: config.Log.Modules,
+		Fields:  []logs.Field{{Key: "query", Value: config.Query.Id}, {Key: "shard", Value: config.Query.Shard}},
+	})
+	if err != nil {
 		log.Criticalf("%s", err)
 	}
 
@@ -39,28 +49,39 @@ func main() {
 	case 2:
 		query = queries.NewQuery2(middleware, config.Query.Shard)
 	case 3:
-		query = queries.NewQuery3(middleware, config.Query.Shard)
+		query = queries.NewQuery3(middleware, config.Query.Shard, config.Query.TopInterval)
 	case 4:
 		query = queries.NewQuery4(middleware, config.Query.Shard)
 	case 5:
 		query = queries.NewQuery5(middleware, config.Query.Shard)
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGKILL)
-	defer stop()
+	node := lifecycle.New(name, time.Duration(config.Lifecycle.DrainTimeout)*time.Second)
+	if err := tracing.Init(name, config.Tracing.Exporter, config.Tracing.Endpoint); err != nil {
+		log.Errorf("action: init_tracing | result: fail | error: %s", err)
+	}
+	node.OnClose("tracing", tracing.Shutdown)
+	node.OnDrain("stop consuming", middleware.StopConsuming)
+	node.OnClose("files", query.Close)
+	node.OnClose("middleware", middleware.Close)
+	node.Notify()
 
-	go func() {
-		<-ctx.Done()
-		log.Info("action: cancelar_query | result: in_progress")
-		middleware.Close()
-	}()
+	checks := health.New()
+	checks.Liveness("broker", middleware.Connected)
+	checks.Liveness("consumers", middleware.Progress().Check)
+	checks.Liveness("disk", health.Writable("./database"))
+	checks.Readiness("lifecycle", node.Check)
+	checks.Handle("GET /admin/state", admin.StateHandler(name, "./database"))
+	go checks.ListenAndServe(config.Health.Port)
 
 	go shared.RunUDPListener(8080)
-	query.Run()
+	status := node.Run(query.Run)
 
-	log.Info("action: cerrar_query | result: success")
+	log.Infof("action: cerrar_query | result: success | status: %d", status)
+	os.Exit(status)
 }
 
 type Query interface {
 	Run()
+	Close() error
 }
@@ -10,17 +10,16 @@ import (
 	"time"
 	"tp1-distribuidos/middleware"
 	"tp1-distribuidos/shared"
-
-	"github.com/op/go-logging"
+	"tp1-distribuidos/shared/logs"
 )
 
-var log = logging.MustGetLogger("log")
+var log = logs.Get("queries")
 
 type Query1 struct {
 	middleware      *middleware.Middleware
 	shardId         int
 	resultInterval  int
-	clients         map[string]*Query1Client
+	clients         map[middleware.ClientId]*Query1Client
 	commit          *shared.Commit
 	FinishedClients *shared.FinishedClients
 }
@@ -30,12 +29,22 @@ func NewQuery1(m *middleware.Middleware, shardId int, resultInterval int) *Query
 		middleware:      m,
 		shardId:         shardId,
 		resultInterval:  resultInterval,
-		clients:         make(map[string]*Query1Client),
+		clients:         make(map[middleware.ClientId]*Query1Client),
 		commit:          shared.NewCommit("./database/commit.csv"),
 		FinishedClients: shared.NewFinishedClients("finished-1."+strconv.Itoa(shardId), m),
 	}
 }
 
+// Close cierra los archivos de los clientes y el commit, se llama al apagar
+// el nodo cuando ya termino el Run
+func (q *Query1) Close() error {
+	for _, client := range q.clients {
+		client.processedGames.Close()
+		client.eos.Close()
+	}
+	return q.commit.Close()
+}
+
 func (q *Query1) Run() {
 	go q.FinishedClients.Consume()
 
@@ -61,12 +70,15 @@ func (q *Query1) Run() {
 		return
 	}
 
-	metric := shared.NewMetric(10000, func(total int, elapsed time.Duration, rate float64) string {
+	metric := shared.NewMetric("query1_games", 10000, func(total int, elapsed time.Duration, rate float64) string {
 		return fmt.Sprintf("[Query 1-%d] Processed %d games in %s (%.2f games/s)", q.shardId, total, elapsed, rate)
 	})
 
 	cancelWg := &sync.WaitGroup{}
-	gamesQueue.Consume(cancelWg, func(message *middleware.GameMsg) error {
+	consumeGames := func(callback func(message *middleware.GameMsg) error) error {
+		return gamesQueue.Consume(cancelWg, callback)
+	}
+	shared.ConsumeFair(q.middleware.Config.Fairness.Quantum, consumeGames, func(message *middleware.GameMsg) error {
 		q.FinishedClients.Lock()
 		defer q.FinishedClients.Unlock()
 
@@ -75,11 +87,11 @@ func (q *Query1) Run() {
 			return nil
 		}
 
-		metric.Update(1)
+		metric.UpdateClient(message.ClientId, 1)
 
 		client, exists := q.clients[message.ClientId]
 		if !exists {
-			client = NewQuery1Client(q.middleware, q.commit, message.ClientId, q.shardId, q.resultInterval)
+			client = NewQuery1Client(q.middleware, q.commit, message.ClientId, message.Priority, q.shardId, q.resultInterval)
 			q.clients[message.ClientId] = client
 		}
 
@@ -93,14 +105,18 @@ func (q *Query1) Run() {
 type Query1Client struct {
 	middleware     *middleware.Middleware
 	commit         *shared.Commit
-	clientId       string
+	clientId       middleware.ClientId
+	priority       middleware.Priority
 	shardId        int
 	processedGames *shared.Processed
+	eos            *shared.EndOfStream
+	ended          bool
 	result         middleware.Query1Result
 	resultInterval int
+	log            *logs.Logger
 }
 
-func NewQuery1Client(m *middleware.Middleware, commit *shared.Commit, clientId string, shardId int, resultInterval int) *Query1Client {
+func NewQuery1Client(m *middleware.Middleware, commit *shared.Commit, clientId middleware.ClientId, priority middleware.Priority, shardId int, resultInterval int) *Query1Client {
 	os.Mkdir(fmt.Sprintf("./database/%s", clientId), 0777)
 	resultFile, err := os.OpenFile(fmt.Sprintf("./database/%s/query-1.csv", clientId), os.O_CREATE|os.O_RDONLY, 0777)
 	if err != nil {
@@ -132,31 +148,39 @@ func NewQuery1Client(m *middleware.Middleware, commit *shared.Commit, clientId s
 		middleware:     m,
 		commit:         commit,
 		clientId:       clientId,
+		priority:       priority,
 		shardId:        shardId,
 		processedGames: shared.NewProcessed(fmt.Sprintf("./database/%s/processed.bin", clientId)),
+		eos:            shared.NewEndOfStream(fmt.Sprintf("./database/%s", clientId)),
 		resultInterval: resultInterval,
 		result:         result,
+		log:            log.With("client_id", clientId),
 	}
 }
 
 func (qc *Query1Client) processGame(msg *middleware.GameMsg) {
+	if qc.ended {
+		msg.Ack()
+		return
+	}
+
 	if msg.Last {
-		qc.sendResult(true)
+		qc.eos.Expect(qc.shardId, msg.Total)
+		qc.finishIfDone()
 		msg.Ack()
-		qc.End()
 		return
 	}
 
 	game := msg.Game
 
 	if qc.processedGames.Contains(int64(game.AppId)) {
-		log.Infof("Game %d already processed", game.AppId)
+		qc.log.Infof("Game %d already processed", game.AppId)
 
 		if qc.processedGames.Count()%qc.resultInterval == 0 {
 			qc.sendResult(false)
 		}
 
-		msg.Ack()
+		qc.ack(msg)
 		return
 	}
 
@@ -172,7 +196,7 @@ func (qc *Query1Client) processGame(msg *middleware.GameMsg) {
 
 	tmpFile, err := os.CreateTemp(fmt.Sprintf("./database/%s", qc.clientId), "query-1.csv")
 	if err != nil {
-		log.Errorf("failed to create temp file: %v", err)
+		qc.log.Errorf("failed to create temp file: %v", err)
 		return
 	}
 
@@ -182,8 +206,8 @@ func (qc *Query1Client) processGame(msg *middleware.GameMsg) {
 
 	realFilename := fmt.Sprintf("./database/%s/query-1.csv", qc.clientId)
 
-	qc.commit.Write([][]string{
-		{qc.clientId, strconv.Itoa(game.AppId), tmpFile.Name(), realFilename},
+	qc.commit.Write(msg.Trace(), [][]string{
+		{qc.clientId.String(), strconv.Itoa(game.AppId), tmpFile.Name(), realFilename},
 	})
 
 	shared.TestTolerance(1, 3000, fmt.Sprintf("Exiting after creating commit (game %d)", game.AppId))
@@ -204,9 +228,26 @@ func (qc *Query1Client) processGame(msg *middleware.GameMsg) {
 
 	qc.commit.End()
 
+	qc.ack(msg)
+}
+
+// ack cuenta el game para el fin del shard y lo ackea
+func (qc *Query1Client) ack(msg *middleware.GameMsg) {
+	qc.eos.Receive(qc.shardId, msg.Id)
+	qc.finishIfDone()
 	msg.Ack()
 }
 
+// finishIfDone manda el resultado final cuando llego el Last y todos los games
+// que anuncio
+func (qc *Query1Client) finishIfDone() {
+	if qc.ended || !qc.eos.Done(qc.shardId) {
+		return
+	}
+	qc.sendResult(true)
+	qc.End()
+}
+
 func (qc *Query1Client) sendResult(final bool) {
 	qc.result.Final = final
 
@@ -214,6 +255,7 @@ func (qc *Query1Client) sendResult(final bool) {
 	resultMsg := &middleware.Result{
 		Id:             id,
 		ClientId:       qc.clientId,
+		Priority:       qc.priority,
 		QueryId:        1,
 		ShardId:        qc.shardId,
 		IsFinalMessage: final,
@@ -223,17 +265,17 @@ func (qc *Query1Client) sendResult(final bool) {
 	shared.TestTolerance(1, 8, "Exiting before sending result")
 
 	if resultMsg.IsFinalMessage {
-		log.Infof("Query 1 [FINAL] - Query 1-%d - Windows: %d, Linux: %d, Mac: %d", qc.shardId, qc.result.Windows, qc.result.Linux, qc.result.Mac)
+		qc.log.Infof("Query 1 [FINAL] - Query 1-%d - Windows: %d, Linux: %d, Mac: %d", qc.shardId, qc.result.Windows, qc.result.Linux, qc.result.Mac)
 
 		if err := qc.middleware.SendResult("1", resultMsg); err != nil {
-			log.Errorf("Failed to send result: %v", err)
+			qc.log.Errorf("Failed to send result: %v", err)
 		}
 
 	} else {
-		log.Infof("Query 1 [PARTIAL] - Query 1-%d - Windows: %d, Linux: %d, Mac: %d", qc.shardId, qc.result.Windows, qc.result.Linux, qc.result.Mac)
+		qc.log.Infof("Query 1 [PARTIAL] - Query 1-%d - Windows: %d, Linux: %d, Mac: %d", qc.shardId, qc.result.Windows, qc.result.Linux, qc.result.Mac)
 
 		if err := qc.middleware.SendResult("1", resultMsg); err != nil {
-			log.Errorf("Failed to send result: %v", err)
+			qc.log.Errorf("Failed to send result: %v", err)
 		}
 	}
 
@@ -249,19 +291,16 @@ func (qc *Query1Client) sendResult(final bool) {
 
 }
 
-// clientId (2 bytes) + queryId (1 byte) + shardId (1 byte) + appId (4 bytes)
+// queryId (1 byte) + shardId (1 byte) + appId (4 bytes)
 func (qc *Query1Client) getNextId() int64 {
-	clientId, _ := strconv.Atoi(qc.clientId)
-
-	clientIdHigh := (clientId >> 8) & 0xFF // Get high byte
-	clientIdLow := clientId & 0xFF         // Get low byte
-
 	processed := qc.processedGames.Count() + 1 // 0 means last
 
-	return int64(clientIdHigh)<<56 | int64(clientIdLow)<<48 | int64(1)<<40 | int64(qc.shardId)<<32 | int64(processed)
+	return int64(1)<<40 | int64(qc.shardId)<<32 | int64(processed)
 }
 
 func (qc *Query1Client) End() {
+	qc.ended = true
 	os.RemoveAll(fmt.Sprintf("./database/%s", qc.clientId))
 	qc.processedGames.Close()
+	qc.eos.Close()
 }
@@ -10,6 +10,7 @@ import (
 	"time"
 	"tp1-distribuidos/middleware"
 	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/logs"
 )
 
 const QUERY2_TOP_SIZE = 10
@@ -17,7 +18,7 @@ const QUERY2_TOP_SIZE = 10
 type Query2 struct {
 	middleware      *middleware.Middleware
 	shardId         int
-	clients         map[string]*Query2Client
+	clients         map[middleware.ClientId]*Query2Client
 	commit          *shared.Commit
 	FinishedClients *shared.FinishedClients
 }
@@ -27,12 +28,22 @@ func NewQuery2(m *middleware.Middleware, shardId int) *Query2 {
 	return &Query2{
 		middleware:      m,
 		shardId:         shardId,
-		clients:         make(map[string]*Query2Client),
+		clients:         make(map[middleware.ClientId]*Query2Client),
 		commit:          shared.NewCommit("./database/commit.csv"),
 		FinishedClients: shared.NewFinishedClients("finished-2."+strconv.Itoa(shardId), m),
 	}
 }
 
+// Close cierra los archivos de los clientes y el commit, se llama al apagar
+// el nodo cuando ya termino el Run
+func (q *Query2) Close() error {
+	for _, client := range q.clients {
+		client.processedGames.Close()
+		client.eos.Close()
+	}
+	return q.commit.Close()
+}
+
 func (q *Query2) Run() {
 	go q.FinishedClients.Consume()
 	time.Sleep(500 * time.Millisecond)
@@ -57,12 +68,15 @@ func (q *Query2) Run() {
 		return
 	}
 
-	metric := shared.NewMetric(10000, func(total int, elapsed time.Duration, rate float64) string {
+	metric := shared.NewMetric("query2_games", 10000, func(total int, elapsed time.Duration, rate float64) string {
 		return fmt.Sprintf("[Query 2-%d] Processed %d games in %s (%.2f games/s)", q.shardId, total, elapsed, rate)
 	})
 
 	cancelWg := &sync.WaitGroup{}
-	gamesQueue.Consume(cancelWg, func(message *middleware.GameMsg) error {
+	consumeGames := func(callback func(message *middleware.GameMsg) error) error {
+		return gamesQueue.Consume(cancelWg, callback)
+	}
+	shared.ConsumeFair(q.middleware.Config.Fairness.Quantum, consumeGames, func(message *middleware.GameMsg) error {
 		q.FinishedClients.Lock()
 		defer q.FinishedClients.Unlock()
 
@@ -71,11 +85,11 @@ func (q *Query2) Run() {
 			return nil
 		}
 
-		metric.Update(1)
+		metric.UpdateClient(message.ClientId, 1)
 
 		client, exists := q.clients[message.ClientId]
 		if !exists {
-			client = NewQuery2Client(q.middleware, q.commit, message.ClientId, q.shardId)
+			client = NewQuery2Client(q.middleware, q.commit, message.ClientId, message.Priority, q.shardId)
 			q.clients[message.ClientId] = client
 		}
 
@@ -88,14 +102,18 @@ func (q *Query2) Run() {
 type Query2Client struct {
 	middleware     *middleware.Middleware
 	commit         *shared.Commit
-	clientId       string
+	clientId       middleware.ClientId
+	priority       middleware.Priority
 	shardId        int
 	processedGames *shared.Processed
+	eos            *shared.EndOfStream
+	ended          bool
 	result         middleware.Query2Result
 	i              int
+	log            *logs.Logger
 }
 
-func NewQuery2Client(m *middleware.Middleware, commit *shared.Commit, clientId string, shardId int) *Query2Client {
+func NewQuery2Client(m *middleware.Middleware, commit *shared.Commit, clientId middleware.ClientId, priority middleware.Priority, shardId int) *Query2Client {
 	os.Mkdir(fmt.Sprintf("./database/%s", clientId), 0777)
 	resultFile, err := os.OpenFile(fmt.Sprintf("./database/%s/query-2.csv", clientId), os.O_CREATE|os.O_RDONLY, 0777)
 	if err != nil {
@@ -127,31 +145,39 @@ func NewQuery2Client(m *middleware.Middleware, commit *shared.Commit, clientId s
 		middleware:     m,
 		commit:         commit,
 		clientId:       clientId,
+		priority:       priority,
 		shardId:        shardId,
 		processedGames: shared.NewProcessed(fmt.Sprintf("./database/%s/processed.bin", clientId)),
+		eos:            shared.NewEndOfStream(fmt.Sprintf("./database/%s", clientId)),
 		result:         result,
 		i:              0,
+		log:            log.With("client_id", clientId),
 	}
 }
 
 func (qc *Query2Client) processGame(msg *middleware.GameMsg) {
+	if qc.ended {
+		msg.Ack()
+		return
+	}
+
 	if msg.Last {
-		qc.sendResult()
+		qc.eos.Expect(qc.shardId, msg.Total)
+		qc.finishIfDone()
 		msg.Ack()
-		qc.End()
 		return
 	}
 
 	game := msg.Game
 
 	if qc.processedGames.Contains(int64(game.AppId)) {
-		log.Infof("Game %d already processed", game.AppId)
-		msg.Ack()
+		qc.log.Infof("Game %d already processed", game.AppId)
+		qc.ack(msg)
 		return
 	}
 
 	if game.Year < 2010 || game.Year > 2019 || !slices.Contains(game.Genres, "Indie") {
-		msg.Ack()
+		qc.ack(msg)
 		return
 	}
 
@@ -170,7 +196,7 @@ func (qc *Query2Client) processGame(msg *middleware.GameMsg) {
 		copy(qc.result.TopGames[insertIndex+1:], qc.result.TopGames[insertIndex:])
 		qc.result.TopGames[insertIndex] = *game
 	} else {
-		msg.Ack()
+		qc.ack(msg)
 		return
 	}
 
@@ -182,7 +208,7 @@ func (qc *Query2Client) processGame(msg *middleware.GameMsg) {
 
 	tmpFile, err := os.CreateTemp(fmt.Sprintf("./database/%s", qc.clientId), "query-2.csv")
 	if err != nil {
-		log.Errorf("failed to create temp file: %v", err)
+		qc.log.Errorf("failed to create temp file: %v", err)
 		return
 	}
 
@@ -196,8 +222,8 @@ func (qc *Query2Client) processGame(msg *middleware.GameMsg) {
 
 	realFilename := fmt.Sprintf("./database/%s/query-2.csv", qc.clientId)
 
-	qc.commit.Write([][]string{
-		{qc.clientId, strconv.Itoa(game.AppId), tmpFile.Name(), realFilename},
+	qc.commit.Write(msg.Trace(), [][]string{
+		{qc.clientId.String(), strconv.Itoa(game.AppId), tmpFile.Name(), realFilename},
 	})
 
 	shared.TestTolerance(1, 40, fmt.Sprintf("Exiting after creating commit (game %d)", game.AppId))
@@ -212,15 +238,32 @@ func (qc *Query2Client) processGame(msg *middleware.GameMsg) {
 
 	qc.commit.End()
 
+	qc.ack(msg)
+}
+
+// ack cuenta el game para el fin del shard y lo ackea
+func (qc *Query2Client) ack(msg *middleware.GameMsg) {
+	qc.eos.Receive(qc.shardId, msg.Id)
+	qc.finishIfDone()
 	msg.Ack()
 }
 
+// finishIfDone manda el top cuando llego el Last y todos los games que anuncio
+func (qc *Query2Client) finishIfDone() {
+	if qc.ended || !qc.eos.Done(qc.shardId) {
+		return
+	}
+	qc.sendResult()
+	qc.End()
+}
+
 func (qc *Query2Client) sendResult() {
-	log.Infof("Query 2 [FINAL]")
-	log.Infof("Query 2 [FINAL] - i: %d", qc.i)
+	qc.log.Infof("Query 2 [FINAL]")
+	qc.log.Infof("Query 2 [FINAL] - i: %d", qc.i)
 
 	result := middleware.Result{
 		ClientId:       qc.clientId,
+		Priority:       qc.priority,
 		QueryId:        2,
 		ShardId:        qc.shardId,
 		IsFinalMessage: true,
@@ -230,15 +273,17 @@ func (qc *Query2Client) sendResult() {
 	shared.TestTolerance(1, 4, "Exiting before sending result")
 
 	if err := qc.middleware.SendResult("2", &result); err != nil {
-		log.Errorf("Failed to send result: %v", err)
+		qc.log.Errorf("Failed to send result: %v", err)
 	}
 	for i, game := range qc.result.TopGames {
-		log.Debugf("Top %d game: %s (%d)", i+1, game.Name, game.AvgPlaytime)
+		qc.log.Debugf("Top %d game: %s (%d)", i+1, game.Name, game.AvgPlaytime)
 	}
 	shared.TestTolerance(1, 4, "Exiting after sending result")
 }
 
 func (qc *Query2Client) End() {
+	qc.ended = true
 	os.RemoveAll(fmt.Sprintf("./database/%s", qc.clientId))
 	qc.processedGames.Close()
+	qc.eos.Close()
 }
@@ -7,6 +7,7 @@ import (
 	"time"
 	"tp1-distribuidos/middleware"
 	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/logs"
 )
 
 const GEOMETRY_DASH_APP_ID = 322170
@@ -16,23 +17,36 @@ const QUERY3_TOP_SIZE = 5
 type Query3 struct {
 	middleware      *middleware.Middleware
 	shardId         int
-	clients         map[string]*Query3Client
+	resultInterval  int
+	clients         map[middleware.ClientId]*Query3Client
 	commit          *shared.Commit
 	FinishedClients *shared.FinishedClients
 }
 
-func NewQuery3(m *middleware.Middleware, shardId int) *Query3 {
+func NewQuery3(m *middleware.Middleware, shardId int, resultInterval int) *Query3 {
 	return &Query3{
 		middleware:      m,
 		shardId:         shardId,
-		clients:         make(map[string]*Query3Client),
+		resultInterval:  resultInterval,
+		clients:         make(map[middleware.ClientId]*Query3Client),
 		commit:          shared.NewCommit("./database/commit.csv"),
 		FinishedClients: shared.NewFinishedClients("finished-3."+strconv.Itoa(shardId), m),
 	}
 }
 
+// Close cierra los archivos de los clientes y el commit, se llama al apagar
+// el nodo cuando ya termino el Run
+func (q *Query3) Close() error {
+	for _, client := range q.clients {
+		client.processedStats.Close()
+		client.eos.Close()
+	}
+	return q.commit.Close()
+}
+
 func (q *Query3) Run() {
 	go q.FinishedClients.Consume()
+	go reportConsumed(q.middleware, q.FinishedClients, 3, q.shardId, q.received)
 
 	time.Sleep(500 * time.Millisecond)
 
@@ -42,6 +56,9 @@ func (q *Query3) Run() {
 		log.Infof("Restored commit: %v", commit)
 
 		os.Rename(commit.Data[0][2], commit.Data[0][3])
+		if len(commit.Data[0]) > 4 {
+			os.Rename(commit.Data[0][4], commit.Data[0][5]) // top
+		}
 
 		processed := shared.NewProcessed(fmt.Sprintf("./database/%s/processed.bin", commit.Data[0][0]))
 
@@ -51,17 +68,17 @@ func (q *Query3) Run() {
 		}
 	})
 
-	statsQueue, err := q.middleware.ListenStats("3."+strconv.Itoa(q.shardId), strconv.Itoa(q.shardId), "Indie")
+	statsQueue, err := q.middleware.ListenStats("3."+strconv.Itoa(q.shardId), strconv.Itoa(q.shardId), middleware.StatsQueries[3])
 	if err != nil {
 		log.Errorf("Error listening stats: %s", err)
 		return
 	}
 
-	metric := shared.NewMetric(10000, func(total int, elapsed time.Duration, rate float64) string {
+	metric := shared.NewMetric("query3_stats", 10000, func(total int, elapsed time.Duration, rate float64) string {
 		return fmt.Sprintf("[Query 3-%d] Processed %d stats in %s (%.2f stats/s)", q.shardId, total, elapsed, rate)
 	})
 
-	statsQueue.Consume(func(message *middleware.StatsMsg) error {
+	shared.ConsumeFair(q.middleware.Config.Fairness.Quantum, statsQueue.Consume, func(message *middleware.StatsMsg) error {
 		q.FinishedClients.Lock()
 		defer q.FinishedClients.Unlock()
 
@@ -70,11 +87,11 @@ func (q *Query3) Run() {
 			return nil
 		}
 
-		metric.Update(1)
+		metric.UpdateClient(message.ClientId, 1)
 
 		client, exists := q.clients[message.ClientId]
 		if !exists {
-			client = NewQuery3Client(q.middleware, q.commit, message.ClientId, q.shardId)
+			client = NewQuery3Client(q.middleware, q.commit, message.ClientId, message.Priority, q.shardId, q.resultInterval)
 			q.clients[message.ClientId] = client
 		}
 
@@ -85,53 +102,106 @@ func (q *Query3) Run() {
 
 }
 
+// received devuelve cuantos stats recibio el shard de cada cliente que no
+// termino, se llama con el lock de FinishedClients tomado
+func (q *Query3) received() map[middleware.ClientId]int {
+	counts := make(map[middleware.ClientId]int, len(q.clients))
+	for clientId, client := range q.clients {
+		if !client.ended {
+			counts[clientId] = client.eos.Received(q.shardId)
+		}
+	}
+	return counts
+}
+
 type Query3Client struct {
 	middleware     *middleware.Middleware
 	commit         *shared.Commit
-	clientId       string
+	clientId       middleware.ClientId
+	priority       middleware.Priority
 	shardId        int
 	processedStats *shared.Processed
+	eos            *shared.EndOfStream
+	ended          bool
 	cache          *shared.Cache[*middleware.Stats]
+	sketches       *clientSketches
+	top            *shared.TopStats
+	resultInterval int
+	log            *logs.Logger
 }
 
-func NewQuery3Client(m *middleware.Middleware, commit *shared.Commit, clientId string, shardId int) *Query3Client {
+func NewQuery3Client(m *middleware.Middleware, commit *shared.Commit, clientId middleware.ClientId, priority middleware.Priority, shardId int, resultInterval int) *Query3Client {
 	os.MkdirAll(fmt.Sprintf("./database/%s/stats", clientId), 0777)
+
+	top, err := shared.LoadTopStats(topPath(clientId), QUERY3_TOP_SIZE, shared.ByPositivesDesc)
+	if err != nil {
+		log.Errorf("action: load_top | result: fail | client_id: %s | error: %s", clientId, err)
+		top = shared.NewTopStats(QUERY3_TOP_SIZE, shared.ByPositivesDesc)
+	}
+
+	// stats guardados antes de que existiera top.csv
+	if _, err := os.Stat(topPath(clientId)); os.IsNotExist(err) {
+		shared.ForEachStatFS(clientId, func(stat *middleware.Stats) {
+			top.Update(stat)
+		})
+	}
+
 	return &Query3Client{
 		middleware:     m,
 		commit:         commit,
 		clientId:       clientId,
+		priority:       priority,
 		shardId:        shardId,
 		processedStats: shared.NewProcessed(fmt.Sprintf("./database/%s/processed.bin", clientId)),
+		eos:            shared.NewEndOfStream(fmt.Sprintf("./database/%s", clientId)),
 		cache:          shared.NewCache[*middleware.Stats](),
+		sketches: newClientSketches(m, clientId, func(stat *middleware.Stats) int {
+			return stat.Positives
+		}),
+		top:            top,
+		resultInterval: resultInterval,
+		log:            log.With("client_id", clientId),
 	}
 }
 
+// el top vive junto a los stats del cliente y se renombra en el mismo commit
+// que el stat que lo modifico
+func topPath(clientId middleware.ClientId) string {
+	return fmt.Sprintf("./database/%s/top.csv", clientId)
+}
+
 func (qc *Query3Client) processStat(msg *middleware.StatsMsg) {
+	if qc.ended {
+		msg.Ack()
+		return
+	}
+
 	if msg.Last {
-		qc.sendResult()
+		qc.eos.Expect(qc.shardId, msg.Total)
+		qc.finishIfDone()
 		msg.Ack()
-		qc.End()
 		return
 	}
 
 	if qc.processedStats.Contains(int64(msg.Stats.Id)) {
-		msg.Ack()
+		qc.ack(msg)
 		return
 	}
 
 	if msg.Stats.Positives == 0 {
-		msg.Ack()
+		qc.ack(msg)
 		return
 	}
 
 	tmpFile, err := os.CreateTemp("./database", fmt.Sprintf("%d.csv", msg.Stats.AppId))
 	if err != nil {
-		log.Errorf("failed to create temp file: %v", err)
+		qc.log.Errorf("failed to create temp file: %v", err)
 		return
 	}
 
-	if stat := shared.UpdateStat(qc.clientId, msg.Stats, tmpFile, qc.cache); stat == nil {
-		log.Errorf("Failed to upsert stats, could not retrieve stat for client %s", qc.clientId)
+	stat := shared.UpdateStat(qc.clientId, msg.Stats, tmpFile, qc.cache)
+	if stat == nil {
+		qc.log.Errorf("Failed to upsert stats, could not retrieve stat for client %s", qc.clientId)
 		return
 	}
 
@@ -140,10 +210,23 @@ func (qc *Query3Client) processStat(msg *middleware.StatsMsg) {
 	}
 
 	realFilename := fmt.Sprintf("./database/%s/stats/%d.csv", qc.clientId, msg.Stats.AppId)
+	commitRow := []string{qc.clientId.String(), strconv.Itoa(msg.Stats.Id), tmpFile.Name(), realFilename}
+
+	// el top se actualiza en una copia, si algo falla antes del commit el
+	// stat se redelivera y el de memoria sigue igual al del disco
+	top := qc.top.Clone()
+	topChanged := top.Update(stat)
+	if topChanged {
+		tmpTop, err := qc.storeTop(top)
+		if err != nil {
+			qc.log.Errorf("failed to store top: %v", err)
+			return
+		}
+		commitRow = append(commitRow, tmpTop, topPath(qc.clientId))
+	}
 
-	qc.commit.Write([][]string{
-		{qc.clientId, strconv.Itoa(msg.Stats.Id), tmpFile.Name(), realFilename},
-	})
+	qc.commit.Write(msg.Trace(), [][]string{commitRow})
+	qc.top = top
 
 	if msg.Stats.AppId == GEOMETRY_DASH_APP_ID {
 		shared.TestTolerance(1, 8000, fmt.Sprintf("Exiting after commit (game %d)", msg.Stats.AppId))
@@ -155,6 +238,9 @@ func (qc *Query3Client) processStat(msg *middleware.StatsMsg) {
 	}
 
 	os.Rename(tmpFile.Name(), realFilename)
+	if topChanged {
+		os.Rename(commitRow[4], commitRow[5])
+	}
 
 	if msg.Stats.AppId == GEOMETRY_DASH_APP_ID {
 		shared.TestTolerance(1, 8000, fmt.Sprintf("Exiting after renaming (game %d)", msg.Stats.AppId))
@@ -162,19 +248,77 @@ func (qc *Query3Client) processStat(msg *middleware.StatsMsg) {
 
 	qc.commit.End()
 
+	if qc.resultInterval > 0 && qc.processedStats.Count()%qc.resultInterval == 0 {
+		qc.sendPartialResult()
+	}
+
+	if qc.sketches != nil {
+		qc.sketches.update(stat, stat.Positives-1, stat.Positives)
+		qc.sketches.send(qc.middleware, 3, qc.clientId, qc.priority, qc.shardId, qc.processedStats.Count())
+	}
+
+	qc.ack(msg)
+}
+
+// ack cuenta el stat para el fin del shard y lo ackea
+func (qc *Query3Client) ack(msg *middleware.StatsMsg) {
+	qc.eos.Receive(qc.shardId, msg.Stats.Id)
+	qc.finishIfDone()
 	msg.Ack()
 }
 
+// finishIfDone manda el top final cuando llego el Last y todos los stats que
+// anuncio
+func (qc *Query3Client) finishIfDone() {
+	if qc.ended || !qc.eos.Done(qc.shardId) {
+		return
+	}
+	qc.sendResult()
+	qc.End()
+}
+
+func (qc *Query3Client) storeTop(top *shared.TopStats) (string, error) {
+	tmpTop, err := os.CreateTemp(fmt.Sprintf("./database/%s", qc.clientId), "top-*.csv")
+	if err != nil {
+		return "", err
+	}
+	defer tmpTop.Close()
+
+	if err := top.Store(tmpTop); err != nil {
+		return "", err
+	}
+
+	return tmpTop.Name(), nil
+}
+
+// sendPartialResult manda el top actual del shard. Processed permite al
+// reducer descartar parciales viejos si llegan desordenados.
+func (qc *Query3Client) sendPartialResult() {
+	result := &middleware.Result{
+		ClientId: qc.clientId,
+		Priority: qc.priority,
+		QueryId:  3,
+		ShardId:  qc.shardId,
+		Payload: middleware.Query3Result{
+			TopStats:  qc.top.Stats,
+			Processed: qc.processedStats.Count(),
+		},
+		IsFinalMessage: false,
+	}
+
+	if err := qc.middleware.SendResult("3", result); err != nil {
+		qc.log.Errorf("Failed to send partial result: %v", err)
+	}
+}
+
 func (qc *Query3Client) sendResult() {
-	log.Infof("Sending result for client %s", qc.clientId)
+	qc.log.Infof("Sending result for client %s", qc.clientId)
 
-	top := shared.GetTopStatsFS(qc.clientId, QUERY3_TOP_SIZE, func(a *middleware.Stats, b *middleware.Stats) bool {
-		return a.Positives > b.Positives
-	})
+	top := qc.top.Stats
 
-	log.Infof("Query 3 [FINAL]")
+	qc.log.Infof("Query 3 [FINAL]")
 	for _, game := range top {
-		log.Infof("Game: %s (Positives: %d, Negatives: %d)", game.Name, game.Positives, game.Negatives)
+		qc.log.Infof("Game: %s (Positives: %d, Negatives: %d)", game.Name, game.Positives, game.Negatives)
 	}
 
 	query3Result := middleware.Query3Result{
@@ -183,6 +327,7 @@ func (qc *Query3Client) sendResult() {
 
 	result := &middleware.Result{
 		ClientId:       qc.clientId,
+		Priority:       qc.priority,
 		QueryId:        3,
 		ShardId:        qc.shardId,
 		Payload:        query3Result,
@@ -192,13 +337,15 @@ func (qc *Query3Client) sendResult() {
 	shared.TestTolerance(1, 4, "Exiting before sending result")
 
 	if err := qc.middleware.SendResult("3", result); err != nil {
-		log.Errorf("Failed to send result: %v", err)
+		qc.log.Errorf("Failed to send result: %v", err)
 	}
 
 	shared.TestTolerance(1, 4, "Exiting after sending result")
 }
 
 func (qc *Query3Client) End() {
+	qc.ended = true
 	os.RemoveAll(fmt.Sprintf("./database/%s", qc.clientId))
 	qc.processedStats.Close()
+	qc.eos.Close()
 }
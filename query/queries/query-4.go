@@ -1,44 +1,63 @@
 package queries
 
 import (
-	"context"
 	"encoding/csv"
 	"fmt"
 	"os"
-	"os/signal"
 	"strconv"
-	"sync"
-	"syscall"
 	"time"
 	"tp1-distribuidos/middleware"
 	"tp1-distribuidos/shared"
-
-	"github.com/rylans/getlang"
+	"tp1-distribuidos/shared/language"
+	"tp1-distribuidos/shared/logs"
 )
 
 type Query4 struct {
 	middleware      *middleware.Middleware
 	shardId         int
-	clients         map[string]*Query4Client
+	clients         map[middleware.ClientId]*Query4Client
 	commit          *shared.Commit
 	FinishedClients *shared.FinishedClients
+	pipeline        *query4Pipeline
+	filter          *language.Filter
 }
 
+const QUERY4_WORKER_QUEUE_SIZE = 100
+
 func NewQuery4(m *middleware.Middleware, shardId int) *Query4 {
-	return &Query4{
+	languageConfig := m.Config.Language
+	detector, err := language.New(languageConfig.Detector, languageConfig.CacheSize)
+	if err != nil {
+		log.Errorf("action: create_language_detector | result: fail | error: %s", err)
+		detector = language.GetlangDetector{}
+	}
+
+	q := &Query4{
 		middleware:      m,
 		shardId:         shardId,
-		clients:         make(map[string]*Query4Client),
+		clients:         make(map[middleware.ClientId]*Query4Client),
 		commit:          shared.NewCommit("./database/commit.csv"),
 		FinishedClients: shared.NewFinishedClients("finished-4."+strconv.Itoa(shardId), m),
+		filter:          language.NewFilter(detector, languageConfig.Targets),
 	}
+	q.pipeline = newQuery4Pipeline(languageConfig.Workers, q.filterStats, q.processFilteredStat, q.skipStat)
+
+	return q
 }
 
-func (q *Query4) Close() {
+// Close cierra los archivos de los clientes y el commit, se llama al apagar
+// el nodo cuando ya termino el Run
+func (q *Query4) Close() error {
+	for _, client := range q.clients {
+		client.processedStats.Close()
+		client.eos.Close()
+	}
+	return q.commit.Close()
 }
 
 func (q *Query4) Run() {
 	go q.FinishedClients.Consume()
+	go reportConsumed(q.middleware, q.FinishedClients, 4, q.shardId, q.received)
 
 	time.Sleep(500 * time.Millisecond)
 	log.Info("Query 4 running")
@@ -59,9 +78,18 @@ func (q *Query4) Run() {
 		reader := csv.NewReader(file)
 		val, _ := reader.Read()
 		stat, _ := shared.ParseStat(val)
+		clientId, _ := middleware.ParseClientId(commit.Data[0][0])
+		// un commit escrito antes de las prioridades no trae la columna
+		priority := middleware.PriorityNormal
+		if len(commit.Data[0]) > 4 {
+			if parsed, err := strconv.Atoi(commit.Data[0][4]); err == nil {
+				priority = middleware.Priority(parsed)
+			}
+		}
 		if stat.Negatives == q.middleware.Config.Query.MinNegatives {
 			result := &middleware.Result{
-				ClientId: commit.Data[0][0],
+				ClientId: clientId,
+				Priority: priority,
 				QueryId:  4,
 				ShardId:  q.shardId,
 				Payload: middleware.Query4Result{
@@ -76,116 +104,175 @@ func (q *Query4) Run() {
 		}
 	})
 
-	statsQueue, err := q.middleware.ListenStats("4."+strconv.Itoa(q.shardId), strconv.Itoa(q.shardId), "Action")
+	statsQueue, err := q.middleware.ListenStats("4."+strconv.Itoa(q.shardId), strconv.Itoa(q.shardId), middleware.StatsQueries[4])
 	if err != nil {
 		log.Errorf("Error listening stats: %s", err)
 		return
 	}
 
-	metric := shared.NewMetric(25000, func(total int, elapsed time.Duration, rate float64) string {
+	metric := shared.NewMetric("query4_stats", 25000, func(total int, elapsed time.Duration, rate float64) string {
 		return fmt.Sprintf("[Query 4-%d] Processed %d stats in %s (%.2f stats/s)", q.shardId, total, elapsed, rate)
 	})
-	messagesChan := make(chan *middleware.StatsMsg)
-
-	go statsQueue.Consume(func(message *middleware.StatsMsg) error {
-		q.FinishedClients.Lock()
-		defer q.FinishedClients.Unlock()
 
-		if q.FinishedClients.Contains(message.ClientId) {
-			message.Ack()
+	err = shared.ConsumeFair(q.middleware.Config.Fairness.Quantum, statsQueue.Consume, func(message *middleware.StatsMsg) error {
+		if !q.addClient(message) {
 			return nil
 		}
 
-		metric.Update(1)
+		metric.UpdateClient(message.ClientId, 1)
 
-		client, exists := q.clients[message.ClientId]
-		if !exists {
-			client = NewQuery4Client(q.middleware, q.commit, message.ClientId, q.shardId)
-			q.clients[message.ClientId] = client
-		}
-
-		if message.Last {
-			messagesChan <- message
-			return nil
-		}
-
-		go client.filterStats(message, messagesChan)
+		q.pipeline.dispatch(message)
 		return nil
 	})
+	if err != nil {
+		log.Errorf("Error consuming stats: %s", err)
+	}
+
+	q.pipeline.close()
+}
+
+// addClient crea el cliente del mensaje si no existe. Devuelve false (y
+// ackea) si el cliente ya termino.
+func (q *Query4) addClient(message *middleware.StatsMsg) bool {
+	q.FinishedClients.Lock()
+	defer q.FinishedClients.Unlock()
 
-	q.consumeFilteredStats(messagesChan)
+	if q.FinishedClients.Contains(message.ClientId) {
+		message.Ack()
+		return false
+	}
+
+	if _, exists := q.clients[message.ClientId]; !exists {
+		q.clients[message.ClientId] = NewQuery4Client(q.middleware, q.commit, message.ClientId, message.Priority, q.shardId)
+	}
+
+	return true
+}
+
+// filterStats corre en los workers del pipeline sin tomar el lock, es la
+// parte cara (deteccion de idioma)
+func (q *Query4) filterStats(message *middleware.StatsMsg) bool {
+	if message.Stats.Negatives == 0 {
+		return false
+	}
+
+	return matchesLanguage(message.Stats, q.filter)
 }
 
-func (q *Query4) consumeFilteredStats(messages chan *middleware.StatsMsg) {
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGKILL)
-	defer stop()
+// processFilteredStat commitea con el lock tomado porque el commit es
+// compartido por todos los clientes
+func (q *Query4) processFilteredStat(message *middleware.StatsMsg) {
+	q.FinishedClients.Lock()
+	defer q.FinishedClients.Unlock()
 
-	for {
-		select {
-		case <-ctx.Done():
+	if q.FinishedClients.Contains(message.ClientId) {
+		message.Ack()
+		return
+	}
+
+	q.clients[message.ClientId].processStat(message)
+}
+
+// skipStat cuenta un stat que no paso el filtro, tambien cuenta para el fin
+// del shard
+func (q *Query4) skipStat(message *middleware.StatsMsg) {
+	q.FinishedClients.Lock()
+	defer q.FinishedClients.Unlock()
+
+	if q.FinishedClients.Contains(message.ClientId) {
+		message.Ack()
+		return
+	}
+
+	q.clients[message.ClientId].skipStat(message)
+}
+
+// query4Pipeline filtra los stats en una cantidad fija de workers y los
+// procesa en orden por cliente. Todos los mensajes de un cliente van al mismo
+// worker, asi que el Last se procesa despues de que se commitearon todos los
+// stats que llegaron antes que el. Los que no pasan el filtro van a skip. Si
+// las colas de los workers se llenan, dispatch bloquea y deja de consumir del
+// broker.
+type query4Pipeline struct {
+	pool    *shared.KeyedPool
+	filter  func(message *middleware.StatsMsg) bool
+	process func(message *middleware.StatsMsg)
+	skip    func(message *middleware.StatsMsg)
+}
+
+func newQuery4Pipeline(workers int, filter func(message *middleware.StatsMsg) bool, process func(message *middleware.StatsMsg), skip func(message *middleware.StatsMsg)) *query4Pipeline {
+	return &query4Pipeline{
+		pool:    shared.NewKeyedPool(workers, QUERY4_WORKER_QUEUE_SIZE),
+		filter:  filter,
+		process: process,
+		skip:    skip,
+	}
+}
+
+func (p *query4Pipeline) dispatch(message *middleware.StatsMsg) {
+	p.pool.Submit(message.ClientId.String(), func() {
+		if !message.Last && !p.filter(message) {
+			p.skip(message)
 			return
-		case message := <-messages:
-			q.FinishedClients.Lock()
+		}
+		p.process(message)
+	})
+}
 
-			if q.FinishedClients.Contains(message.ClientId) {
-				message.Ack()
-				q.FinishedClients.Unlock()
-				continue
-			}
-			client := q.clients[message.ClientId]
-			client.processStat(message)
-			q.FinishedClients.Unlock()
+func (p *query4Pipeline) close() {
+	p.pool.Close()
+}
+
+// received devuelve cuantos stats recibio el shard de cada cliente que no
+// termino, se llama con el lock de FinishedClients tomado
+func (q *Query4) received() map[middleware.ClientId]int {
+	counts := make(map[middleware.ClientId]int, len(q.clients))
+	for clientId, client := range q.clients {
+		if !client.ended {
+			counts[clientId] = client.eos.Received(q.shardId)
 		}
 	}
+	return counts
 }
 
 type Query4Client struct {
 	middleware     *middleware.Middleware
 	commit         *shared.Commit
-	clientId       string
+	clientId       middleware.ClientId
+	priority       middleware.Priority
 	shardId        int
 	processedStats *shared.Processed
-	wg             sync.WaitGroup
+	eos            *shared.EndOfStream
+	ended          bool
 	cache          *shared.Cache[*middleware.Stats]
+	log            *logs.Logger
 }
 
-func NewQuery4Client(m *middleware.Middleware, commit *shared.Commit, clientId string, shardId int) *Query4Client {
+func NewQuery4Client(m *middleware.Middleware, commit *shared.Commit, clientId middleware.ClientId, priority middleware.Priority, shardId int) *Query4Client {
 	os.MkdirAll(fmt.Sprintf("./database/%s/stats", clientId), 0777)
 	return &Query4Client{
 		middleware:     m,
 		commit:         commit,
 		clientId:       clientId,
+		priority:       priority,
 		shardId:        shardId,
 		processedStats: shared.NewProcessed(fmt.Sprintf("./database/%s/processed.bin", clientId)),
+		eos:            shared.NewEndOfStream(fmt.Sprintf("./database/%s", clientId)),
 		cache:          shared.NewCache[*middleware.Stats](),
-		wg:             sync.WaitGroup{},
+		log:            log.With("client_id", clientId),
 	}
 }
 
-func (qc *Query4Client) filterStats(message *middleware.StatsMsg, messagesChan chan *middleware.StatsMsg) {
-	qc.wg.Add(1)
-	defer qc.wg.Done()
-	if message.Stats.Negatives == 0 {
-		message.Ack()
-		return
-	}
-
-	if !isEnglish(message.Stats) {
-		message.Ack()
+func (qc *Query4Client) processStat(msg *middleware.StatsMsg) {
+	if qc.ended {
+		msg.Ack()
 		return
 	}
 
-	messagesChan <- message
-}
-
-func (qc *Query4Client) processStat(msg *middleware.StatsMsg) {
 	if msg.Last {
-		go func() {
-			qc.wg.Wait()
-			qc.sendResultFinal()
-			msg.Ack()
-			qc.End()
-		}()
+		qc.eos.Expect(qc.shardId, msg.Total)
+		qc.finishIfDone()
+		msg.Ack()
 		return
 	}
 
@@ -196,13 +283,13 @@ func (qc *Query4Client) processStat(msg *middleware.StatsMsg) {
 				qc.sendResult(msg.Stats)
 			}
 		}
-		msg.Ack()
+		qc.ack(msg)
 		return
 	}
 
 	tmpFile, err := os.CreateTemp("./database", fmt.Sprintf("%d.csv", msg.Stats.AppId))
 	if err != nil {
-		log.Errorf("failed to create temp file: %v", err)
+		qc.log.Errorf("failed to create temp file: %v", err)
 		return
 	}
 
@@ -210,14 +297,14 @@ func (qc *Query4Client) processStat(msg *middleware.StatsMsg) {
 
 	stat := shared.UpdateStat(qc.clientId, msg.Stats, tmpFile, qc.cache)
 	if stat == nil {
-		log.Errorf("Failed to upsert stats, could not retrieve stat for client %s", qc.clientId)
+		qc.log.Errorf("Failed to upsert stats, could not retrieve stat for client %s", qc.clientId)
 		return
 	}
 
 	realFilename := fmt.Sprintf("./database/%s/stats/%d.csv", qc.clientId, msg.Stats.AppId)
 
-	qc.commit.Write([][]string{
-		{qc.clientId, strconv.Itoa(msg.Stats.Id), tmpFile.Name(), realFilename},
+	qc.commit.Write(msg.Trace(), [][]string{
+		{qc.clientId.String(), strconv.Itoa(msg.Stats.Id), tmpFile.Name(), realFilename, strconv.Itoa(int(qc.priority))},
 	})
 
 	shared.TestTolerance(1, 18000, "Exiting before a commit")
@@ -233,17 +320,43 @@ func (qc *Query4Client) processStat(msg *middleware.StatsMsg) {
 	}
 
 	qc.commit.End()
+	qc.ack(msg)
+}
+
+func (qc *Query4Client) skipStat(msg *middleware.StatsMsg) {
+	if qc.ended {
+		msg.Ack()
+		return
+	}
+	qc.ack(msg)
+}
+
+// ack cuenta el stat para el fin del shard y lo ackea
+func (qc *Query4Client) ack(msg *middleware.StatsMsg) {
+	qc.eos.Receive(qc.shardId, msg.Stats.Id)
+	qc.finishIfDone()
 	msg.Ack()
 }
 
+// finishIfDone manda el final cuando llego el Last y todos los stats que
+// anuncio
+func (qc *Query4Client) finishIfDone() {
+	if qc.ended || !qc.eos.Done(qc.shardId) {
+		return
+	}
+	qc.sendResultFinal()
+	qc.End()
+}
+
 func (qc *Query4Client) sendResult(message *middleware.Stats) {
-	log.Infof("Query 4 [PARTIAL]: %s", message.Name)
+	qc.log.Infof("Query 4 [PARTIAL]: %s", message.Name)
 	query4Result := middleware.Query4Result{
 		Game: message.Name,
 	}
 
 	result := &middleware.Result{
 		ClientId:       qc.clientId,
+		Priority:       qc.priority,
 		QueryId:        4,
 		ShardId:        qc.shardId,
 		Payload:        query4Result,
@@ -251,14 +364,15 @@ func (qc *Query4Client) sendResult(message *middleware.Stats) {
 	}
 
 	if err := qc.middleware.SendResult("4", result); err != nil {
-		log.Errorf("Failed to send result: %v", err)
+		qc.log.Errorf("Failed to send result: %v", err)
 	}
 }
 
 func (qc *Query4Client) sendResultFinal() {
-	log.Infof("Query 4 [FINAL]")
+	qc.log.Infof("Query 4 [FINAL]")
 	result := &middleware.Result{
 		ClientId:       qc.clientId,
+		Priority:       qc.priority,
 		QueryId:        4,
 		ShardId:        qc.shardId,
 		IsFinalMessage: true,
@@ -266,16 +380,21 @@ func (qc *Query4Client) sendResultFinal() {
 	}
 
 	if err := qc.middleware.SendResult("4", result); err != nil {
-		log.Errorf("Failed to send result: %v", err)
+		qc.log.Errorf("Failed to send result: %v", err)
 	}
 }
 
-func isEnglish(message *middleware.Stats) bool {
-	lang := getlang.FromString(message.Text)
-	return lang.LanguageName() == "English"
+// si el mapper ya detecto el idioma el texto no viaja, se usa el detectado
+func matchesLanguage(message *middleware.Stats, filter *language.Filter) bool {
+	if message.Language != "" {
+		return filter.MatchesLanguage(message.Language)
+	}
+	return filter.Matches(message.Text)
 }
 
 func (qc *Query4Client) End() {
+	qc.ended = true
 	os.RemoveAll(fmt.Sprintf("./database/%s", qc.clientId))
 	qc.processedStats.Close()
+	qc.eos.Close()
 }
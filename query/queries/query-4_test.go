@@ -0,0 +1,75 @@
+package queries
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+	"tp1-distribuidos/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPipelineFinalAfterCommittedStats checks that the Last message of each
+// client is processed after every stat of that client, committed or skipped by
+// the filter, even if filtering takes a random amount of time.
+func TestPipelineFinalAfterCommittedStats(t *testing.T) {
+	const clients = 5
+	const statsPerClient = 300
+
+	lock := sync.Mutex{}
+	committed := make(map[middleware.ClientId][]int)
+	skipped := make(map[middleware.ClientId]int)
+	finished := make(map[middleware.ClientId]int)
+
+	filter := func(message *middleware.StatsMsg) bool {
+		time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+		return message.Stats.Negatives > 0
+	}
+
+	process := func(message *middleware.StatsMsg) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if message.Last {
+			finished[message.ClientId] = len(committed[message.ClientId]) + skipped[message.ClientId]
+			return
+		}
+		committed[message.ClientId] = append(committed[message.ClientId], message.Stats.Id)
+	}
+
+	skip := func(message *middleware.StatsMsg) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		skipped[message.ClientId]++
+	}
+
+	pipeline := newQuery4Pipeline(3, filter, process, skip)
+
+	expected := make(map[middleware.ClientId][]int)
+	for i := 0; i < statsPerClient; i++ {
+		for c := 0; c < clients; c++ {
+			clientId := middleware.ClientId(1001 + c)
+			negatives := rand.Intn(2)
+			if negatives > 0 {
+				expected[clientId] = append(expected[clientId], i)
+			}
+
+			pipeline.dispatch(&middleware.StatsMsg{
+				ClientId: clientId,
+				Stats:    &middleware.Stats{Id: i, Negatives: negatives},
+			})
+		}
+	}
+	for c := 0; c < clients; c++ {
+		pipeline.dispatch(&middleware.StatsMsg{ClientId: middleware.ClientId(1001 + c), Last: true})
+	}
+
+	pipeline.close()
+
+	for clientId, ids := range expected {
+		assert.Equal(t, ids, committed[clientId], "client %s", clientId)
+		assert.Equal(t, statsPerClient, finished[clientId], "client %s finished before handling every stat", clientId)
+	}
+}
@@ -5,17 +5,19 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path"
 	"strconv"
 	"time"
 	"tp1-distribuidos/middleware"
 	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/logs"
 )
 
+const QUERY5_SORT_CHUNK_SIZE = 10000
+
 type Query5 struct {
 	middleware      *middleware.Middleware
 	shardId         int
-	clients         map[string]*Query5Client
+	clients         map[middleware.ClientId]*Query5Client
 	commit          *shared.Commit
 	FinishedClients *shared.FinishedClients
 }
@@ -24,14 +26,25 @@ func NewQuery5(m *middleware.Middleware, shardId int) *Query5 {
 	return &Query5{
 		middleware:      m,
 		shardId:         shardId,
-		clients:         make(map[string]*Query5Client),
+		clients:         make(map[middleware.ClientId]*Query5Client),
 		commit:          shared.NewCommit("./database/commit.csv"),
 		FinishedClients: shared.NewFinishedClients("finished-5."+strconv.Itoa(shardId), m),
 	}
 }
 
+// Close cierra los archivos de los clientes y el commit, se llama al apagar
+// el nodo cuando ya termino el Run
+func (q *Query5) Close() error {
+	for _, client := range q.clients {
+		client.processedStats.Close()
+		client.eos.Close()
+	}
+	return q.commit.Close()
+}
+
 func (q *Query5) Run() {
 	go q.FinishedClients.Consume()
+	go reportConsumed(q.middleware, q.FinishedClients, 5, q.shardId, q.received)
 
 	time.Sleep(500 * time.Millisecond)
 	log.Info("Query 5 running")
@@ -49,16 +62,16 @@ func (q *Query5) Run() {
 		}
 	})
 
-	statsQueue, err := q.middleware.ListenStats("5."+strconv.Itoa(q.shardId), strconv.Itoa(q.shardId), "Action")
+	statsQueue, err := q.middleware.ListenStats("5."+strconv.Itoa(q.shardId), strconv.Itoa(q.shardId), middleware.StatsQueries[5])
 	if err != nil {
 		log.Errorf("Error listening stats: %s", err)
 		return
 	}
 
-	metric := shared.NewMetric(25000, func(total int, elapsed time.Duration, rate float64) string {
+	metric := shared.NewMetric("query5_stats", 25000, func(total int, elapsed time.Duration, rate float64) string {
 		return fmt.Sprintf("[Query 5-%d] Processed %d stats in %s (%.2f stats/s)", q.shardId, total, elapsed, rate)
 	})
-	statsQueue.Consume(func(message *middleware.StatsMsg) error {
+	shared.ConsumeFair(q.middleware.Config.Fairness.Quantum, statsQueue.Consume, func(message *middleware.StatsMsg) error {
 		q.FinishedClients.Lock()
 		defer q.FinishedClients.Unlock()
 
@@ -66,11 +79,11 @@ func (q *Query5) Run() {
 			message.Ack()
 			return nil
 		}
-		metric.Update(1)
+		metric.UpdateClient(message.ClientId, 1)
 
 		client, exists := q.clients[message.ClientId]
 		if !exists {
-			client = NewQuery5Client(q.middleware, q.commit, message.ClientId, q.shardId)
+			client = NewQuery5Client(q.middleware, q.commit, message.ClientId, message.Priority, q.shardId)
 			q.clients[message.ClientId] = client
 		}
 
@@ -79,56 +92,82 @@ func (q *Query5) Run() {
 	})
 }
 
+// received devuelve cuantos stats recibio el shard de cada cliente que no
+// termino, se llama con el lock de FinishedClients tomado
+func (q *Query5) received() map[middleware.ClientId]int {
+	counts := make(map[middleware.ClientId]int, len(q.clients))
+	for clientId, client := range q.clients {
+		if !client.ended {
+			counts[clientId] = client.eos.Received(q.shardId)
+		}
+	}
+	return counts
+}
+
 type Query5Client struct {
-	middleware         *middleware.Middleware
-	commit             *shared.Commit
-	clientId           string
-	shardId            int
-	processedStats     *shared.Processed
-	minNegativeReviews int
-	cache              *shared.Cache[*middleware.Stats]
-	id                 int64
+	middleware     *middleware.Middleware
+	commit         *shared.Commit
+	clientId       middleware.ClientId
+	priority       middleware.Priority
+	shardId        int
+	processedStats *shared.Processed
+	eos            *shared.EndOfStream
+	ended          bool
+	cache          *shared.Cache[*middleware.Stats]
+	sketches       *clientSketches
+	id             int64
+	log            *logs.Logger
 }
 
-func NewQuery5Client(m *middleware.Middleware, commit *shared.Commit, clientId string, shardId int) *Query5Client {
+func NewQuery5Client(m *middleware.Middleware, commit *shared.Commit, clientId middleware.ClientId, priority middleware.Priority, shardId int) *Query5Client {
 	os.MkdirAll(fmt.Sprintf("./database/%s/stats", clientId), 0777)
 	return &Query5Client{
-		middleware:         m,
-		commit:             commit,
-		clientId:           clientId,
-		shardId:            shardId,
-		minNegativeReviews: -1,
-		processedStats:     shared.NewProcessed(fmt.Sprintf("./database/%s/processed.bin", clientId)),
-		cache:              shared.NewCache[*middleware.Stats](),
+		middleware:     m,
+		commit:         commit,
+		clientId:       clientId,
+		priority:       priority,
+		shardId:        shardId,
+		processedStats: shared.NewProcessed(fmt.Sprintf("./database/%s/processed.bin", clientId)),
+		eos:            shared.NewEndOfStream(fmt.Sprintf("./database/%s", clientId)),
+		cache:          shared.NewCache[*middleware.Stats](),
+		sketches: newClientSketches(m, clientId, func(stat *middleware.Stats) int {
+			return stat.Negatives
+		}),
+		log: log.With("client_id", clientId),
 	}
 }
 
 func (qc *Query5Client) processStat(msg *middleware.StatsMsg) {
-	if msg.Last {
-		qc.calculatePercentile()
+	if qc.ended {
 		msg.Ack()
-		qc.End()
+		return
+	}
+
+	if msg.Last {
+		qc.eos.Expect(qc.shardId, msg.Total)
+		qc.finish(msg)
 		return // esto no estaba antes pero lo agrego porque tira error el processed
 	}
 
 	if msg.Stats.Negatives == 0 {
-		msg.Ack()
+		qc.ack(msg)
 		return
 	}
 
 	if qc.processedStats.Contains(int64(msg.Stats.Id)) {
-		msg.Ack()
+		qc.ack(msg)
 		return
 	}
 
 	tmpFile, err := os.CreateTemp("./database", fmt.Sprintf("%d.csv", msg.Stats.AppId))
 	if err != nil {
-		log.Errorf("failed to create temp file: %v", err)
+		qc.log.Errorf("failed to create temp file: %v", err)
 		return
 	}
 
-	if stat := shared.UpdateStat(qc.clientId, msg.Stats, tmpFile, qc.cache); stat == nil {
-		log.Errorf("Failed to upsert stats, could not retrieve stat for client %s", qc.clientId)
+	stat := shared.UpdateStat(qc.clientId, msg.Stats, tmpFile, qc.cache)
+	if stat == nil {
+		qc.log.Errorf("Failed to upsert stats, could not retrieve stat for client %s", qc.clientId)
 		return
 	}
 
@@ -138,8 +177,8 @@ func (qc *Query5Client) processStat(msg *middleware.StatsMsg) {
 
 	realFilename := fmt.Sprintf("./database/%s/stats/%d.csv", qc.clientId, msg.Stats.AppId)
 
-	qc.commit.Write([][]string{
-		{qc.clientId, strconv.Itoa(msg.Stats.Id), tmpFile.Name(), realFilename},
+	qc.commit.Write(msg.Trace(), [][]string{
+		{qc.clientId.String(), strconv.Itoa(msg.Stats.Id), tmpFile.Name(), realFilename},
 	})
 
 	if msg.Stats.AppId == GEOMETRY_DASH_APP_ID {
@@ -160,23 +199,60 @@ func (qc *Query5Client) processStat(msg *middleware.StatsMsg) {
 
 	qc.commit.End()
 
+	if qc.sketches != nil {
+		qc.sketches.update(stat, stat.Negatives-1, stat.Negatives)
+		qc.sketches.send(qc.middleware, 5, qc.clientId, qc.priority, qc.shardId, qc.processedStats.Count())
+	}
+
+	qc.ack(msg)
+}
+
+// ack cuenta el stat para el fin del shard y lo ackea
+func (qc *Query5Client) ack(msg *middleware.StatsMsg) {
+	qc.eos.Receive(qc.shardId, msg.Stats.Id)
+	qc.finish(msg)
+}
+
+// finish ackea el mensaje si el cliente no termino o si se pudo mandar el
+// percentil. Si fallo lo nackea, el mensaje vuelve y se reintenta el calculo.
+func (qc *Query5Client) finish(msg *middleware.StatsMsg) {
+	if err := qc.finishIfDone(); err != nil {
+		qc.log.Errorf("action: calculate_percentile | result: fail | error: %v", err)
+		msg.Nack()
+		return
+	}
 	msg.Ack()
 }
 
-func (qc *Query5Client) calculatePercentile() {
-	os.Remove(path.Join("client-"+qc.clientId, "stored.csv"))
-	qc.minNegativeReviews = -1
+// finishIfDone calcula el percentil cuando llego el Last y todos los stats que
+// anuncio. Si falla el cliente sigue abierto y el error vuelve al caller.
+func (qc *Query5Client) finishIfDone() error {
+	if qc.ended || !qc.eos.Done(qc.shardId) {
+		return nil
+	}
+	if err := qc.calculatePercentile(); err != nil {
+		return err
+	}
+	qc.End()
+	return nil
+}
+
+// calculatePercentile ordena los stats del cliente y manda el resultado. Si no
+// se pudo leer algun stat devuelve el error sin ordenar ni mandar nada, un
+// percentil con datos parciales no se puede publicar como el final.
+func (qc *Query5Client) calculatePercentile() error {
+	sorter := shared.NewStatsSorter(fmt.Sprintf("./database/%s/runs", qc.clientId), QUERY5_SORT_CHUNK_SIZE, shared.ByNegativesDesc)
 
 	dentries, err := os.ReadDir(fmt.Sprintf("./database/%s/stats", qc.clientId))
 	if err != nil {
-		log.Errorf("failed to read directory: %v", err)
+		return fmt.Errorf("failed to read directory: %w", err)
 	}
 
 	for _, dentry := range dentries {
-		func() {
+		err := func() error {
 			file, err := os.Open(fmt.Sprintf("./database/%s/stats/%s", qc.clientId, dentry.Name()))
 			if err != nil {
-				log.Errorf("failed to open file: %v", err)
+				return fmt.Errorf("failed to open file: %w", err)
 			}
 
 			defer file.Close()
@@ -186,102 +262,46 @@ func (qc *Query5Client) calculatePercentile() {
 			for {
 				record, err := reader.Read()
 				if err == io.EOF {
-					break
+					return nil
 				}
 				if err != nil {
-					log.Errorf("Error reading file: %s", err)
-					return
+					return fmt.Errorf("error reading file: %w", err)
 				}
-				qc.handleRecord(record)
-			}
-		}()
-
-	}
-
-	qc.sendResult()
 
-}
-
-func (qc *Query5Client) handleRecord(record []string) {
-	path := path.Join("client-"+qc.clientId, "stored.csv")
-	stats, err := shared.ParseStat(record)
-	if err != nil {
-		log.Errorf("Error parsing stats: %s", err)
-		return
-	}
-
-	// si ya sabemos que va a ser el ultimo, lo agregamos directamente y actualizamos el minimo
-	if stats.Negatives < qc.minNegativeReviews {
-		sortedFile, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE, 0666)
-		if err != nil {
-			log.Errorf("Error creating sorted file: %s", err)
-			return
-		}
-		writer := csv.NewWriter(sortedFile)
-
-		writer.Write(record)
-		writer.Flush()
-		sortedFile.Close()
-
-		qc.minNegativeReviews = stats.Negatives
-		return
-	}
-
-	// si no, lo agregamos a la lista ordenada
-	sortedFile, err := shared.GetStoreRWriter(path)
-	if err != nil {
-		log.Errorf("Error creating sorted file: %s", err)
-		return
-	}
-	defer sortedFile.Close()
-
-	tempFile, err := os.CreateTemp("", "temp-*.csv")
-	if err != nil {
-		log.Errorf("Error creating temp file: %s", err)
-		return
-	}
-	defer tempFile.Close()
-
-	reader := csv.NewReader(sortedFile)
-	writer := csv.NewWriter(tempFile)
+				stat, err := shared.ParseStat(record)
+				if err != nil {
+					return fmt.Errorf("error parsing stats: %w", err)
+				}
 
-	found := false
-	for {
-		storedRecord, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
+				if err := sorter.Add(*stat); err != nil {
+					return fmt.Errorf("error spilling sorted run: %w", err)
+				}
+			}
+		}()
 		if err != nil {
-			log.Errorf("Error reading file: %s", err)
-			return
+			sorter.Discard()
+			return err
 		}
-
-		storedNegatives, _ := strconv.Atoi(storedRecord[3])
-
-		if !found && stats.Negatives >= storedNegatives {
-			found = true
-			writer.Write(record)
-		}
-
-		writer.Write(storedRecord)
 	}
 
-	if !found {
-		writer.Write(record)
+	if err := sorter.Sort(qc.sortedPath()); err != nil {
+		return fmt.Errorf("error sorting stats: %w", err)
 	}
 
-	writer.Flush()
-
-	os.Rename(tempFile.Name(), path)
+	qc.sendResult()
+	return nil
+}
 
+// el archivo ordenado vive dentro de ./database/<client> para que End y
+// FinishedClients lo borren junto con el resto del estado del cliente
+func (qc *Query5Client) sortedPath() string {
+	return fmt.Sprintf("./database/%s/query-5-sorted.csv", qc.clientId)
 }
 
 func (qc *Query5Client) sendResult() {
-	log.Info("HOLA Q5 SR")
-	path := path.Join("client-"+qc.clientId, "stored.csv")
-	file, err := os.Open(path)
+	file, err := os.Open(qc.sortedPath())
 	if err != nil {
-		log.Errorf("Error opening stored.csv: %s", err)
+		qc.log.Errorf("Error opening sorted stats: %s", err)
 		return
 	}
 	defer file.Close()
@@ -300,22 +320,23 @@ func (qc *Query5Client) sendResult() {
 			qc.middleware.SendResult("5", &middleware.Result{
 				Id:             id,
 				ClientId:       qc.clientId,
+				Priority:       qc.priority,
 				QueryId:        5,
 				ShardId:        qc.shardId,
 				Payload:        result,
 				IsFinalMessage: true,
 			})
-			log.Infof("Sending FINAL Query 5 message")
+			qc.log.Infof("Sending FINAL Query 5 message")
 			break
 		}
 		if err != nil {
-			log.Errorf("Error reading stored.csv: %s", err)
+			qc.log.Errorf("Error reading sorted stats: %s", err)
 			return
 		}
 
 		stats, err := shared.ParseStat(record)
 		if err != nil {
-			log.Errorf("Error parsing stats: %s", err)
+			qc.log.Errorf("Error parsing stats: %s", err)
 			return
 		}
 
@@ -326,6 +347,7 @@ func (qc *Query5Client) sendResult() {
 			qc.middleware.SendResult("5", &middleware.Result{
 				Id:             id,
 				ClientId:       qc.clientId,
+				Priority:       qc.priority,
 				QueryId:        5,
 				ShardId:        qc.shardId,
 				Payload:        result,
@@ -337,20 +359,17 @@ func (qc *Query5Client) sendResult() {
 
 	shared.TestTolerance(1, 2, "Exiting after sending result")
 
-	log.Infof("Query 5 finished")
+	qc.log.Infof("Query 5 finished")
 }
 
 func (qc *Query5Client) End() {
+	qc.ended = true
 	os.RemoveAll(fmt.Sprintf("./database/%s", qc.clientId))
 	qc.processedStats.Close()
+	qc.eos.Close()
 }
 
-// clientId (2 bytes) + queryId (1 byte) + shardId (1 byte) + appId (4 bytes)
+// queryId (1 byte) + shardId (1 byte) + appId (4 bytes)
 func (qc *Query5Client) getNextId() int64 {
-	clientId, _ := strconv.Atoi(qc.clientId)
-
-	clientIdHigh := (clientId >> 8) & 0xFF // Get high byte
-	clientIdLow := clientId & 0xFF         // Get low byte
-
-	return int64(clientIdHigh)<<56 | int64(clientIdLow)<<48 | int64(5)<<40 | int64(qc.shardId)<<32 | qc.id
+	return int64(5)<<40 | int64(qc.shardId)<<32 | qc.id
 }
@@ -0,0 +1,65 @@
+package queries
+
+import (
+	"strconv"
+	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/sketch"
+)
+
+const QUANTILES_ALPHA = 0.01
+
+// clientSketches holds the approximate state of a client when the query runs
+// in approximate mode. It is kept in memory only and rebuilt from the stats on
+// disk after a restart, losing it only delays the next approximation.
+type clientSketches struct {
+	topK      *sketch.TopK
+	quantiles *sketch.Quantiles
+}
+
+func newClientSketches(m *middleware.Middleware, clientId middleware.ClientId, value func(stat *middleware.Stats) int) *clientSketches {
+	if !m.Config.Query.Approximate {
+		return nil
+	}
+
+	sketches := &clientSketches{
+		topK:      sketch.NewTopK(m.Config.Query.SketchTopK),
+		quantiles: sketch.NewQuantiles(QUANTILES_ALPHA),
+	}
+
+	shared.ForEachStatFS(clientId, func(stat *middleware.Stats) {
+		sketches.topK.Set(stat.AppId, stat.Name, value(stat))
+		sketches.quantiles.Add(float64(value(stat)))
+	})
+
+	return sketches
+}
+
+// update registers that a game went from old to new
+func (cs *clientSketches) update(stat *middleware.Stats, old int, new int) {
+	cs.topK.Set(stat.AppId, stat.Name, new)
+	cs.quantiles.Update(float64(old), float64(new))
+}
+
+func (cs *clientSketches) send(m *middleware.Middleware, queryId int, clientId middleware.ClientId, priority middleware.Priority, shardId int, processed int) {
+	if processed%m.Config.Query.SketchInterval != 0 {
+		return
+	}
+
+	result := &middleware.Result{
+		ClientId: clientId,
+		Priority: priority,
+		QueryId:  queryId,
+		ShardId:  shardId,
+		Payload: middleware.SketchResult{
+			Processed: processed,
+			TopK:      cs.topK,
+			Quantiles: cs.quantiles,
+		},
+		IsFinalMessage: false,
+	}
+
+	if err := m.SendResult(strconv.Itoa(queryId), result); err != nil {
+		log.Errorf("Failed to send sketch: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package queries
+
+import (
+	"time"
+	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared"
+)
+
+const STATS_CONSUMED_INTERVAL = time.Second
+
+// reportConsumed le avisa al server cada STATS_CONSUMED_INTERVAL cuantos stats
+// distintos recibio el shard de cada cliente, con eso el server limita los
+// stats sin consumir de cada cliente. received se llama con el lock de
+// finished tomado. Se manda el acumulado y solo de los clientes que cambiaron
+// desde el ultimo reporte que salio, un reporte que falla se reintenta en el
+// proximo.
+func reportConsumed(m *middleware.Middleware, finished *shared.FinishedClients, queryId int, shardId int, received func() map[middleware.ClientId]int) {
+	ticker := time.NewTicker(STATS_CONSUMED_INTERVAL)
+	defer ticker.Stop()
+
+	reported := make(map[middleware.ClientId]int)
+	for range ticker.C {
+		finished.Lock()
+		counts := received()
+		finished.Unlock()
+
+		for clientId, count := range counts {
+			if reported[clientId] == count {
+				continue
+			}
+			err := m.SendStatsConsumed(&middleware.StatsConsumedMsg{ClientId: clientId, QueryId: queryId, ShardId: shardId, Received: count})
+			if err != nil {
+				log.Errorf("action: stats_consumed | result: fail | client_id: %s | error: %s", clientId, err)
+				continue
+			}
+			reported[clientId] = count
+		}
+		for clientId := range reported {
+			if _, ok := counts[clientId]; !ok {
+				delete(reported, clientId)
+			}
+		}
+	}
+}
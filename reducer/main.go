@@ -1,23 +1,25 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"os"
-	"os/signal"
 	"strconv"
-	"syscall"
+	"sync"
+	"time"
 	"tp1-distribuidos/config"
 	"tp1-distribuidos/middleware"
 	"tp1-distribuidos/reducer/reducer-queries"
 	"tp1-distribuidos/shared"
-
-	"github.com/op/go-logging"
+	"tp1-distribuidos/shared/admin"
+	"tp1-distribuidos/shared/health"
+	"tp1-distribuidos/shared/lifecycle"
+	"tp1-distribuidos/shared/logs"
+	"tp1-distribuidos/shared/tracing"
 )
 
-var log = logging.MustGetLogger("log")
+var log = logs.Get("reducer")
 
-func createReducer(env *config.Config, clientId string, mid *middleware.Middleware) Reducer {
+func createReducer(env *config.Config, clientId middleware.ClientId, priority middleware.Priority, mid *middleware.Middleware, running *sync.WaitGroup) Reducer {
 	if err := os.MkdirAll(fmt.Sprintf("database/%s", clientId), 0755); err != nil && !os.IsExist(err) {
 		log.Errorf("Failed to create directory for client %s: %v", clientId, err)
 		return nil
@@ -26,19 +28,23 @@ func createReducer(env *config.Config, clientId string, mid *middleware.Middlewa
 	var reduc Reducer
 	switch env.Query.Id {
 	case 1:
-		reduc = reducer.NewReducerQuery1(clientId, mid)
+		reduc = reducer.NewReducerQuery1(clientId, priority, mid)
 	case 2:
-		reduc = reducer.NewReducerQuery2(clientId, mid)
+		reduc = reducer.NewReducerQuery2(clientId, priority, mid)
 	case 3:
-		reduc = reducer.NewReducerQuery3(clientId, mid)
+		reduc = reducer.NewReducerQuery3(clientId, priority, mid)
 	case 4:
-		reduc = reducer.NewReducerQuery4(clientId, mid)
+		reduc = reducer.NewReducerQuery4(clientId, priority, mid)
 	case 5:
-		reduc = reducer.NewReducerQuery5(clientId, mid)
+		reduc = reducer.NewReducerQuery5(clientId, priority, mid)
 	}
 
 	log.Infof("action: running reducer %d | result: success | client_id: %s", env.Query.Id, clientId)
-	go reduc.Run()
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		reduc.Run()
+	}()
 	return reduc
 }
 
@@ -49,7 +55,15 @@ func main() {
 		log.Errorf("action: init config | result: fail | error: %s", err)
 	}
 
-	if err := shared.InitLogger(env.Log.Level); err != nil {
+	name := "reducer-" + strconv.Itoa(env.Query.Id)
+	err = logs.Init(logs.Options{
+		Node:    name,
+		Level:   env.Log.Level,
+		Format:  env.Log.Format,
+		Modules: env.Log.Modules,
+		Fields:  []logs.Field{{Key: "query", Value: env.Query.Id}},
+	})
+	if err != nil {
 		log.Errorf("action: init logger | result: fail | error: %s", err)
 	}
 
@@ -68,18 +82,39 @@ func main() {
 		return
 	}
 
-	reducers := make(map[string]Reducer)
+	node := lifecycle.New(name, time.Duration(env.Lifecycle.DrainTimeout)*time.Second)
+	if err := tracing.Init(name, env.Tracing.Exporter, env.Tracing.Endpoint); err != nil {
+		log.Errorf("action: init_tracing | result: fail | error: %s", err)
+	}
+	node.OnClose("tracing", tracing.Shutdown)
+	node.OnDrain("stop consuming", mid.StopConsuming)
+	node.OnClose("middleware", mid.Close)
+	node.Notify()
+
+	checks := health.New()
+	checks.Liveness("broker", mid.Connected)
+	checks.Liveness("consumers", mid.Progress().Check)
+	checks.Liveness("disk", health.Writable("./database"))
+	checks.Readiness("lifecycle", node.Check)
+	checks.Handle("GET /admin/state", admin.StateHandler(name, "./database"))
+	go checks.ListenAndServe(env.Health.Port)
+
+	go shared.RunUDPListener(8080)
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	defer stop()
+	status := node.Run(func() {
+		consumeResults(env, mid, finishedClients, resultsQueue)
+	})
 
-	go func() {
-		<-ctx.Done()
-		log.Info("action: reducer finishing | result: in progress")
-		mid.Close()
-	}()
+	log.Infof("action: reducer finished | result: success | status: %d", status)
+	os.Exit(status)
+}
 
-	go shared.RunUDPListener(8080)
+// consumeResults reparte los resultados entre los reducers de cada cliente.
+// Cuando se deja de consumir frena los reducers y espera a que terminen el
+// resultado que estaban procesando.
+func consumeResults(env *config.Config, mid *middleware.Middleware, finishedClients *shared.FinishedClients, resultsQueue *middleware.ResultsQueue) {
+	reducers := make(map[middleware.ClientId]Reducer)
+	running := &sync.WaitGroup{}
 
 	resultsQueue.Consume(func(msg *middleware.Result) error {
 		finishedClients.Lock()
@@ -91,16 +126,20 @@ func main() {
 		}
 
 		if _, ok := reducers[msg.ClientId]; !ok {
-			reducers[msg.ClientId] = createReducer(env, msg.ClientId, mid)
+			reducers[msg.ClientId] = createReducer(env, msg.ClientId, msg.Priority, mid, running)
 		}
 		reducers[msg.ClientId].QueueResult(msg)
 		return nil
 	})
 
-	log.Infof("action: reducer finished | result: success")
+	for _, reducer := range reducers {
+		reducer.Stop()
+	}
+	running.Wait()
 }
 
 type Reducer interface {
 	QueueResult(*middleware.Result)
 	Run()
+	Stop()
 }
@@ -6,13 +6,13 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"tp1-distribuidos/middleware"
 	"tp1-distribuidos/shared"
-
-	"github.com/op/go-logging"
+	"tp1-distribuidos/shared/logs"
 )
 
-var log = logging.MustGetLogger("log")
+var log = logs.Get("reducer-queries")
 
 type ReducerQuery1 struct {
 	middleware       *middleware.Middleware
@@ -21,11 +21,14 @@ type ReducerQuery1 struct {
 	finalAnswers     *shared.Processed
 	result           middleware.Query1Result
 	commit           *shared.Commit
-	ClientId         string
+	ClientId         middleware.ClientId
+	Priority         middleware.Priority
 	finished         bool
+	closeOnce        sync.Once
+	log              *logs.Logger
 }
 
-func NewReducerQuery1(clientId string, m *middleware.Middleware) *ReducerQuery1 {
+func NewReducerQuery1(clientId middleware.ClientId, priority middleware.Priority, m *middleware.Middleware) *ReducerQuery1 {
 
 	return &ReducerQuery1{
 		middleware:       m,
@@ -34,6 +37,8 @@ func NewReducerQuery1(clientId string, m *middleware.Middleware) *ReducerQuery1
 		processedAnswers: shared.NewProcessed(fmt.Sprintf("./database/%s/processed.bin", clientId)),
 		finalAnswers:     shared.NewProcessed(fmt.Sprintf("./database/%s/received.bin", clientId)),
 		ClientId:         clientId,
+		Priority:         priority,
+		log:              log.With("client_id", clientId),
 	}
 }
 
@@ -51,13 +56,13 @@ func (r *ReducerQuery1) End() {
 	}
 	r.finished = true
 	os.RemoveAll(fmt.Sprintf("./database/%s", r.ClientId))
-	close(r.results)
+	r.closeResults()
 }
 
 func (r *ReducerQuery1) RestoreResult() {
 	file, err := os.OpenFile(fmt.Sprintf("./database/%s/query-1.csv", r.ClientId), os.O_RDONLY|os.O_CREATE, 0755)
 	if err != nil {
-		log.Errorf("Failed to open file: %v", err)
+		r.log.Errorf("Failed to open file: %v", err)
 		return
 	}
 	defer file.Close()
@@ -71,7 +76,7 @@ func (r *ReducerQuery1) RestoreResult() {
 	reader := bufio.NewReader(file)
 	line, err := reader.ReadString('\n')
 
-	log.Infof("Restoring line: %s", line)
+	r.log.Infof("Restoring line: %s", line)
 
 	if err == nil {
 		fields := strings.Split(strings.TrimSuffix(line, "\n"), ",")
@@ -86,12 +91,24 @@ func (r *ReducerQuery1) RestoreResult() {
 	r.result = result
 }
 
+// Stop termina el Run sin borrar el estado del cliente, se llama al apagar
+// el nodo cuando ya no se encolan resultados
+func (r *ReducerQuery1) Stop() {
+	r.closeResults()
+}
+
+func (r *ReducerQuery1) closeResults() {
+	r.closeOnce.Do(func() {
+		close(r.results)
+	})
+}
+
 func (r *ReducerQuery1) Run() {
-	log.Infof("Reducer Query 1 running")
+	r.log.Infof("Reducer Query 1 running")
 	r.RestoreResult()
 
 	shared.RestoreCommit(fmt.Sprintf("./database/%s/commit.csv", r.ClientId), func(commit *shared.Commit) {
-		log.Infof("Restored commit: %v", commit)
+		r.log.Infof("Restored commit: %v", commit)
 
 		os.Rename(commit.Data[0][2], commit.Data[0][3])
 
@@ -118,7 +135,7 @@ func (r *ReducerQuery1) processResult(result *middleware.Result) {
 	query1Result := result.Payload.(middleware.Query1Result)
 
 	if r.processedAnswers.Contains(result.Id) {
-		log.Infof("Result %d already processed", result.Id)
+		r.log.Infof("Result %d already processed", result.Id)
 		result.Ack()
 		return
 	}
@@ -129,7 +146,7 @@ func (r *ReducerQuery1) processResult(result *middleware.Result) {
 
 	tmpFile, err := os.CreateTemp(fmt.Sprintf("./database/%s", r.ClientId), "query-1.csv")
 	if err != nil {
-		log.Errorf("failed to create temp file: %v", err)
+		r.log.Errorf("failed to create temp file: %v", err)
 		return
 	}
 
@@ -138,8 +155,8 @@ func (r *ReducerQuery1) processResult(result *middleware.Result) {
 
 	shared.TestTolerance(1, 10, "Exiting after tmp")
 
-	r.commit.Write([][]string{
-		{r.ClientId, strconv.FormatInt(result.Id, 10), tmpFile.Name(), realFilename, strconv.FormatBool(query1Result.Final), strconv.Itoa(result.ShardId)},
+	r.commit.Write(result.Trace(), [][]string{
+		{r.ClientId.String(), strconv.FormatInt(result.Id, 10), tmpFile.Name(), realFilename, strconv.FormatBool(query1Result.Final), strconv.Itoa(result.ShardId)},
 	})
 
 	shared.TestTolerance(1, 10, "Exiting after creating commit")
@@ -175,10 +192,11 @@ func (r *ReducerQuery1) processResult(result *middleware.Result) {
 func (r *ReducerQuery1) SendResult(isFinalMessage bool) {
 
 	id := r.getNextId()
-	log.Infof("Q1 Sending id %d", id)
+	r.log.Infof("Q1 Sending id %d", id)
 	result := &middleware.Result{
 		Id:             id,
 		ClientId:       r.ClientId,
+		Priority:       r.Priority,
 		QueryId:        1,
 		Payload:        r.result,
 		IsFinalMessage: isFinalMessage,
@@ -188,22 +206,17 @@ func (r *ReducerQuery1) SendResult(isFinalMessage bool) {
 		return
 	}
 
-	log.Infof("Reducer Query 1: Windows: %d, Mac: %d, Linux: %d, IsFinalMessage: %t", r.result.Windows, r.result.Mac, r.result.Linux, isFinalMessage)
+	r.log.Infof("Reducer Query 1: Windows: %d, Mac: %d, Linux: %d, IsFinalMessage: %t", r.result.Windows, r.result.Mac, r.result.Linux, isFinalMessage)
 
 	err := r.middleware.SendResponse(result)
 	if err != nil {
-		log.Errorf("Failed to send response: %v", err)
+		r.log.Errorf("Failed to send response: %v", err)
 	}
 
 }
 
 func (r *ReducerQuery1) getNextId() int64 {
-	clientId, _ := strconv.Atoi(r.ClientId)
-
-	clientIdHigh := (clientId >> 8) & 0xFF // Get high byte
-	clientIdLow := clientId & 0xFF         // Get low byte
-
 	processed := r.processedAnswers.Count() + 1 // 0 means last
 
-	return int64(clientIdHigh)<<56 | int64(clientIdLow)<<48 | int64(1)<<40 | int64(processed)
+	return int64(1)<<40 | int64(processed)
 }
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"sync"
 	"tp1-distribuidos/middleware"
 	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/logs"
 )
 
 const topGamesSize = 10
@@ -15,19 +17,24 @@ type ReducerQuery2 struct {
 	middleware      *middleware.Middleware
 	results         chan *middleware.Result
 	receivedAnswers *shared.Processed
-	ClientId        string
+	ClientId        middleware.ClientId
+	Priority        middleware.Priority
 	finished        bool
+	closeOnce       sync.Once
 	commit          *shared.Commit
+	log             *logs.Logger
 }
 
-func NewReducerQuery2(clientId string, m *middleware.Middleware) *ReducerQuery2 {
+func NewReducerQuery2(clientId middleware.ClientId, priority middleware.Priority, m *middleware.Middleware) *ReducerQuery2 {
 
 	return &ReducerQuery2{
 		middleware:      m,
 		results:         make(chan *middleware.Result),
 		receivedAnswers: shared.NewProcessed(fmt.Sprintf("./database/%s/received.bin", clientId)),
 		ClientId:        clientId,
+		Priority:        priority,
 		commit:          shared.NewCommit(fmt.Sprintf("./database/%s/commit.csv", clientId)),
+		log:             log.With("client_id", clientId),
 	}
 }
 
@@ -45,13 +52,13 @@ func (r *ReducerQuery2) End() {
 	}
 	r.finished = true
 	os.RemoveAll(fmt.Sprintf("./database/%s", r.ClientId))
-	close(r.results)
+	r.closeResults()
 }
 
 func (r *ReducerQuery2) RestoreResult() []middleware.Game {
 	file, err := os.OpenFile(fmt.Sprintf("./database/%s/2.csv", r.ClientId), os.O_RDONLY|os.O_CREATE, 0755)
 	if err != nil {
-		log.Errorf("Failed to open file: %v", err)
+		r.log.Errorf("Failed to open file: %v", err)
 		return nil
 	}
 	defer file.Close()
@@ -81,12 +88,24 @@ func (r *ReducerQuery2) RestoreResult() []middleware.Game {
 	}
 }
 
+// Stop termina el Run sin borrar el estado del cliente, se llama al apagar
+// el nodo cuando ya no se encolan resultados
+func (r *ReducerQuery2) Stop() {
+	r.closeResults()
+}
+
+func (r *ReducerQuery2) closeResults() {
+	r.closeOnce.Do(func() {
+		close(r.results)
+	})
+}
+
 func (r *ReducerQuery2) Run() {
-	log.Infof("Reducer Query 2 running")
+	r.log.Infof("Reducer Query 2 running")
 	r.RestoreResult()
 
 	shared.RestoreCommit(fmt.Sprintf("./database/%s/commit.csv", r.ClientId), func(commit *shared.Commit) {
-		log.Infof("Restored commit: %v", commit)
+		r.log.Infof("Restored commit: %v", commit)
 
 		os.Rename(commit.Data[0][2], commit.Data[0][3])
 
@@ -110,7 +129,7 @@ func (r *ReducerQuery2) processResult(result *middleware.Result) {
 	query2Result := result.Payload.(middleware.Query2Result)
 
 	if r.receivedAnswers.Contains(int64(result.ShardId)) {
-		log.Infof("Result %d already processed", result.Id)
+		r.log.Infof("Result %d already processed", result.Id)
 		result.Ack()
 		return
 	}
@@ -122,8 +141,8 @@ func (r *ReducerQuery2) processResult(result *middleware.Result) {
 
 	shared.TestTolerance(1, 3, "Exiting after tmp")
 
-	r.commit.Write([][]string{
-		{r.ClientId, strconv.Itoa(result.ShardId), tmpFile.Name(), realFilename},
+	r.commit.Write(result.Trace(), [][]string{
+		{r.ClientId.String(), strconv.Itoa(result.ShardId), tmpFile.Name(), realFilename},
 	})
 
 	shared.TestTolerance(1, 3, "Exiting after creating commit")
@@ -154,7 +173,7 @@ func (r *ReducerQuery2) processResult(result *middleware.Result) {
 func (r *ReducerQuery2) storeResults(topGames []middleware.Game) *os.File {
 	file, err := os.CreateTemp(fmt.Sprintf("./database/%s/", r.ClientId), "tmp-reducer-query-2.csv")
 	if err != nil {
-		log.Errorf("Failed to open file: %v", err)
+		r.log.Errorf("Failed to open file: %v", err)
 		return nil
 	}
 	defer file.Close()
@@ -172,7 +191,7 @@ func (r *ReducerQuery2) storeResults(topGames []middleware.Game) *os.File {
 			strconv.FormatInt(game.AvgPlaytime, 10),
 		}
 		if err := writer.Write(record); err != nil {
-			log.Errorf("Failed to write line: %v", err)
+			r.log.Errorf("Failed to write line: %v", err)
 			return nil
 		}
 	}
@@ -220,30 +239,26 @@ func (r *ReducerQuery2) SendResult() {
 	result := &middleware.Result{
 		Id:             id,
 		ClientId:       r.ClientId,
+		Priority:       r.Priority,
 		QueryId:        2,
 		IsFinalMessage: true,
 		Payload:        query2Result,
 	}
 
-	log.Infof("Sending result")
+	r.log.Infof("Sending result")
 	err := r.middleware.SendResponse(result)
 	if err != nil {
-		log.Errorf("Failed to send response: %v", err)
+		r.log.Errorf("Failed to send response: %v", err)
 	}
 
 	for i, game := range topGames {
-		log.Infof("Top %d Game: %v", i+1, game)
+		r.log.Infof("Top %d Game: %v", i+1, game)
 	}
 
 }
 
 func (r *ReducerQuery2) getNextId() int64 {
-	clientId, _ := strconv.Atoi(r.ClientId)
-
-	clientIdHigh := (clientId >> 8) & 0xFF // Get high byte
-	clientIdLow := clientId & 0xFF         // Get low byte
-
 	processed := r.receivedAnswers.Count() + 1 // 0 means last
 
-	return int64(clientIdHigh)<<56 | int64(clientIdLow)<<48 | int64(2)<<40 | int64(processed)
+	return int64(2)<<40 | int64(processed)
 }
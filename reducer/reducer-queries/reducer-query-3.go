@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"sync"
 	"tp1-distribuidos/middleware"
 	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/logs"
 )
 
 const topStatsSize = 5
@@ -15,18 +17,27 @@ type ReducerQuery3 struct {
 	middleware      *middleware.Middleware
 	results         chan *middleware.Result
 	receivedAnswers *shared.Processed
-	ClientId        string
+	ClientId        middleware.ClientId
+	Priority        middleware.Priority
 	finished        bool
+	closeOnce       sync.Once
 	commit          *shared.Commit
+	sketches        *shardSketches
+	partials        map[int]middleware.Query3Result
+	log             *logs.Logger
 }
 
-func NewReducerQuery3(clientId string, m *middleware.Middleware) *ReducerQuery3 {
+func NewReducerQuery3(clientId middleware.ClientId, priority middleware.Priority, m *middleware.Middleware) *ReducerQuery3 {
 	return &ReducerQuery3{
 		middleware:      m,
 		results:         make(chan *middleware.Result),
 		receivedAnswers: shared.NewProcessed(fmt.Sprintf("./database/%s/received.bin", clientId)),
 		ClientId:        clientId,
+		Priority:        priority,
 		commit:          shared.NewCommit(fmt.Sprintf("./database/%s/commit.csv", clientId)),
+		sketches:        newShardSketches(),
+		partials:        make(map[int]middleware.Query3Result),
+		log:             log.With("client_id", clientId),
 	}
 }
 
@@ -44,15 +55,15 @@ func (r *ReducerQuery3) End() {
 	}
 	r.finished = true
 	if err := os.RemoveAll(fmt.Sprintf("./database/%s", r.ClientId)); err != nil {
-		log.Errorf("Failed to remove directory: %v", err)
+		r.log.Errorf("Failed to remove directory: %v", err)
 	}
-	close(r.results)
+	r.closeResults()
 }
 
 func (r *ReducerQuery3) RestoreResult() []middleware.Stats {
 	file, err := os.OpenFile(fmt.Sprintf("./database/%s/3.csv", r.ClientId), os.O_RDONLY|os.O_CREATE, 0755)
 	if err != nil {
-		log.Errorf("Failed to open file: %v", err)
+		r.log.Errorf("Failed to open file: %v", err)
 		return nil
 	}
 	defer file.Close()
@@ -71,12 +82,24 @@ func (r *ReducerQuery3) RestoreResult() []middleware.Stats {
 	}
 }
 
+// Stop termina el Run sin borrar el estado del cliente, se llama al apagar
+// el nodo cuando ya no se encolan resultados
+func (r *ReducerQuery3) Stop() {
+	r.closeResults()
+}
+
+func (r *ReducerQuery3) closeResults() {
+	r.closeOnce.Do(func() {
+		close(r.results)
+	})
+}
+
 func (r *ReducerQuery3) Run() {
-	log.Infof("Reducer Query 3 running")
+	r.log.Infof("Reducer Query 3 running")
 	r.RestoreResult()
 
 	shared.RestoreCommit(fmt.Sprintf("./database/%s/commit.csv", r.ClientId), func(commit *shared.Commit) {
-		log.Infof("Restored commit: %v", commit)
+		r.log.Infof("Restored commit: %v", commit)
 
 		os.Rename(commit.Data[0][2], commit.Data[0][3])
 
@@ -97,10 +120,22 @@ func (r *ReducerQuery3) Run() {
 }
 
 func (r *ReducerQuery3) processResult(result *middleware.Result) {
+	if sketchResult, ok := result.Payload.(middleware.SketchResult); ok {
+		r.processSketch(result.ShardId, sketchResult)
+		result.Ack()
+		return
+	}
+
 	query3Result := result.Payload.(middleware.Query3Result)
 
+	if !result.IsFinalMessage {
+		r.processPartial(result.ShardId, query3Result)
+		result.Ack()
+		return
+	}
+
 	if r.receivedAnswers.Contains(int64(result.ShardId)) {
-		log.Infof("Result %d already processed", result.Id)
+		r.log.Infof("Result %d already processed", result.Id)
 		result.Ack()
 		return
 	}
@@ -112,8 +147,8 @@ func (r *ReducerQuery3) processResult(result *middleware.Result) {
 
 	shared.TestTolerance(1, 3, "Exiting after tmp")
 
-	r.commit.Write([][]string{
-		{r.ClientId, strconv.Itoa(result.ShardId), tmpFile.Name(), realFilename},
+	r.commit.Write(result.Trace(), [][]string{
+		{r.ClientId.String(), strconv.Itoa(result.ShardId), tmpFile.Name(), realFilename},
 	})
 
 	shared.TestTolerance(1, 3, "Exiting after creating commit")
@@ -142,10 +177,64 @@ func (r *ReducerQuery3) processResult(result *middleware.Result) {
 
 }
 
+func (r *ReducerQuery3) processSketch(shardId int, sketchResult middleware.SketchResult) {
+	if r.receivedAnswers.Contains(int64(shardId)) || !r.sketches.update(shardId, sketchResult) {
+		return
+	}
+
+	topK, _, processed := r.sketches.merge(r.middleware.Config.Query.SketchTopK, sketchResult.Quantiles.Alpha)
+
+	stats := approximateStats(topK.Top(topStatsSize), func(stat *middleware.Stats, count int) {
+		stat.Positives = count
+	})
+
+	sendApproximateResult(r.middleware, r.ClientId, r.Priority, 3, processed, middleware.ApproximateResult{Stats: stats})
+}
+
+// processPartial mergea el ultimo parcial de cada shard que todavia no mando
+// su resultado final con los finales ya commiteados. Los parciales no se
+// persisten: si el reducer se reinicia se pierden hasta el proximo de cada shard.
+func (r *ReducerQuery3) processPartial(shardId int, partial middleware.Query3Result) {
+	if r.receivedAnswers.Contains(int64(shardId)) {
+		return
+	}
+	if current, ok := r.partials[shardId]; ok && current.Processed >= partial.Processed {
+		return
+	}
+	r.partials[shardId] = partial
+
+	topStats := r.RestoreResult()
+	processed := 0
+	for shard, partial := range r.partials {
+		if r.receivedAnswers.Contains(int64(shard)) {
+			continue
+		}
+		topStats = r.mergeTopStats(topStats, partial.TopStats)
+		processed += partial.Processed
+	}
+
+	if len(topStats) == 0 {
+		return
+	}
+
+	result := &middleware.Result{
+		Id:             r.getPartialId(processed),
+		ClientId:       r.ClientId,
+		Priority:       r.Priority,
+		QueryId:        3,
+		IsFinalMessage: false,
+		Payload:        middleware.Query3Result{TopStats: topStats},
+	}
+
+	if err := r.middleware.SendResponse(result); err != nil {
+		r.log.Errorf("Failed to send partial result: %v", err)
+	}
+}
+
 func (r *ReducerQuery3) storeResults(stats []middleware.Stats) *os.File {
 	file, err := os.CreateTemp(fmt.Sprintf("./database/%s/", r.ClientId), "tmp-reducer-query-3.csv")
 	if err != nil {
-		log.Errorf("Failed to open file: %v", err)
+		r.log.Errorf("Failed to open file: %v", err)
 		return nil
 	}
 	defer file.Close()
@@ -160,7 +249,7 @@ func (r *ReducerQuery3) storeResults(stats []middleware.Stats) *os.File {
 		}
 
 		if err := writer.Write(record); err != nil {
-			log.Errorf("Failed to write line: %v", err)
+			r.log.Errorf("Failed to write line: %v", err)
 			return nil
 		}
 	}
@@ -206,29 +295,30 @@ func (r *ReducerQuery3) SendResult() {
 	result := &middleware.Result{
 		Id:             r.getNextId(),
 		ClientId:       r.ClientId,
+		Priority:       r.Priority,
 		QueryId:        3,
 		IsFinalMessage: true,
 		Payload:        query3Result,
 	}
 
 	for i, stat := range topStats {
-		log.Infof("Top %d Stat: %v", i+1, stat)
+		r.log.Infof("Top %d Stat: %v", i+1, stat)
 	}
 
 	err := r.middleware.SendResponse(result)
 	if err != nil {
-		log.Errorf("Failed to send result: %v", err)
+		r.log.Errorf("Failed to send result: %v", err)
 	}
 
 }
 
 func (r *ReducerQuery3) getNextId() int64 {
-	clientId, _ := strconv.Atoi(r.ClientId)
-
-	clientIdHigh := (clientId >> 8) & 0xFF // Get high byte
-	clientIdLow := clientId & 0xFF         // Get low byte
-
 	processed := r.receivedAnswers.Count() + 1 // 0 means last
 
-	return int64(clientIdHigh)<<56 | int64(clientIdLow)<<48 | int64(3)<<40 | int64(processed)
+	return int64(3)<<40 | int64(processed)
+}
+
+// queryId (1 byte) + partial flag (1 bit) + processed stats
+func (r *ReducerQuery3) getPartialId(processed int) int64 {
+	return int64(3)<<40 | int64(1)<<38 | int64(processed)
 }
@@ -3,25 +3,31 @@ package reducer
 import (
 	"fmt"
 	"os"
-	"strconv"
+	"sync"
 	"tp1-distribuidos/middleware"
 	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/logs"
 )
 
 type ReducerQuery4 struct {
 	middleware      *middleware.Middleware
 	results         chan *middleware.Result
 	receivedAnswers *shared.Processed
-	ClientId        string
+	ClientId        middleware.ClientId
+	Priority        middleware.Priority
 	finished        bool
+	closeOnce       sync.Once
+	log             *logs.Logger
 }
 
-func NewReducerQuery4(clientId string, m *middleware.Middleware) *ReducerQuery4 {
+func NewReducerQuery4(clientId middleware.ClientId, priority middleware.Priority, m *middleware.Middleware) *ReducerQuery4 {
 	return &ReducerQuery4{
 		middleware:      m,
 		results:         make(chan *middleware.Result),
 		receivedAnswers: shared.NewProcessed(fmt.Sprintf("./database/%s/received.bin", clientId)),
 		ClientId:        clientId,
+		Priority:        priority,
+		log:             log.With("client_id", clientId),
 	}
 }
 
@@ -35,12 +41,24 @@ func (r *ReducerQuery4) End() {
 	}
 	r.finished = true
 	os.RemoveAll(fmt.Sprintf("./database/%s", r.ClientId))
-	close(r.results)
+	r.closeResults()
+}
+
+// Stop termina el Run sin borrar el estado del cliente, se llama al apagar
+// el nodo cuando ya no se encolan resultados
+func (r *ReducerQuery4) Stop() {
+	r.closeResults()
+}
+
+func (r *ReducerQuery4) closeResults() {
+	r.closeOnce.Do(func() {
+		close(r.results)
+	})
 }
 
 func (r *ReducerQuery4) Run() {
 	for result := range r.results {
-		log.Infof("Result received: %v", result.Payload.(middleware.Query4Result))
+		r.log.Infof("Result received: %v", result.Payload.(middleware.Query4Result))
 		shared.TestTolerance(1, 12, "Exiting after sending result")
 
 		if result.IsFinalMessage {
@@ -50,6 +68,7 @@ func (r *ReducerQuery4) Run() {
 			newResult := middleware.Result{
 				Id:             r.getNextId(result.Payload.(middleware.Query4Result).Game),
 				ClientId:       result.ClientId,
+				Priority:       result.Priority,
 				QueryId:        4,
 				IsFinalMessage: result.IsFinalMessage,
 				Payload:        result.Payload,
@@ -60,10 +79,11 @@ func (r *ReducerQuery4) Run() {
 
 		if r.receivedAnswers.Count() == r.middleware.Config.Sharding.Amount {
 
-			id := r.getNextId(fmt.Sprintf("Final %s", result.ShardId))
+			id := r.getNextId(fmt.Sprintf("Final %d", result.ShardId))
 			r.sendResult(&middleware.Result{
 				Id:             id,
 				ClientId:       result.ClientId,
+				Priority:       result.Priority,
 				QueryId:        4,
 				IsFinalMessage: true,
 				Payload: middleware.Query4Result{
@@ -84,22 +104,17 @@ func (r *ReducerQuery4) Run() {
 func (r *ReducerQuery4) sendResult(result *middleware.Result) {
 	err := r.middleware.SendResponse(result)
 	if err != nil {
-		log.Errorf("Failed to send result: %v", err)
+		r.log.Errorf("Failed to send result: %v", err)
 	}
 
-	log.Infof("Reducer Game: %v for client %d", result.Payload.(middleware.Query4Result).Game, result.ClientId)
+	r.log.Infof("Reducer Game: %v for client %d", result.Payload.(middleware.Query4Result).Game, result.ClientId)
 }
 
 func (r *ReducerQuery4) getNextId(result string) int64 {
-	clientId, _ := strconv.Atoi(r.ClientId)
-
-	clientIdHigh := (clientId >> 8) & 0xFF // Get high byte
-	clientIdLow := clientId & 0xFF         // Get low byte
-
 	gameNameId := uint32(0)
 	for i := 0; i < len(result); i++ {
 		gameNameId += uint32([]byte(result)[i])
 	}
 
-	return int64(clientIdHigh)<<56 | int64(clientIdLow)<<48 | int64(4)<<40 | int64(gameNameId)
+	return int64(4)<<40 | int64(gameNameId)
 }
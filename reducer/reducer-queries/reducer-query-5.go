@@ -1,6 +1,8 @@
 package reducer
 
 import (
+	"sync"
+	"tp1-distribuidos/shared/logs"
 	// "encoding/csv"
 	// "io"
 	"encoding/binary"
@@ -24,13 +26,17 @@ type ReducerQuery5 struct {
 	processedAnswers *shared.Processed
 	finalAnswers     *shared.Processed
 	totalGames       int
-	ClientId         string
+	ClientId         middleware.ClientId
+	Priority         middleware.Priority
 	finished         bool
+	closeOnce        sync.Once
 	commit           *shared.Commit
 	totalFile        *os.File
+	sketches         *shardSketches
+	log              *logs.Logger
 }
 
-func NewReducerQuery5(clientId string, m *middleware.Middleware) *ReducerQuery5 {
+func NewReducerQuery5(clientId middleware.ClientId, priority middleware.Priority, m *middleware.Middleware) *ReducerQuery5 {
 	path := fmt.Sprintf("./database/%s/query-5-total.csv", clientId)
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
 	if err != nil {
@@ -44,8 +50,11 @@ func NewReducerQuery5(clientId string, m *middleware.Middleware) *ReducerQuery5
 		finalAnswers:     shared.NewProcessed(fmt.Sprintf("./database/%s/received.bin", clientId)),
 		totalGames:       0,
 		ClientId:         clientId,
+		Priority:         priority,
 		commit:           shared.NewCommit(fmt.Sprintf("./database/%s/commit.csv", clientId)),
 		totalFile:        file,
+		sketches:         newShardSketches(),
+		log:              log.With("client_id", clientId),
 	}
 }
 
@@ -63,7 +72,7 @@ func (r *ReducerQuery5) End() {
 	}
 	r.finished = true
 	os.RemoveAll(fmt.Sprintf("./database/%s", r.ClientId))
-	close(r.results)
+	r.closeResults()
 }
 
 func (r *ReducerQuery5) RestoreResult() {
@@ -82,11 +91,23 @@ func (r *ReducerQuery5) RestoreResult() {
 	r.totalGames = int(current)
 }
 
+// Stop termina el Run sin borrar el estado del cliente, se llama al apagar
+// el nodo cuando ya no se encolan resultados
+func (r *ReducerQuery5) Stop() {
+	r.closeResults()
+}
+
+func (r *ReducerQuery5) closeResults() {
+	r.closeOnce.Do(func() {
+		close(r.results)
+	})
+}
+
 func (r *ReducerQuery5) Run() {
-	log.Infof("Reducer Query 5 running")
+	r.log.Infof("Reducer Query 5 running")
 
 	shared.RestoreCommit(fmt.Sprintf("./database/%s/commit.csv", r.ClientId), func(commit *shared.Commit) {
-		log.Infof("Restored commit: %v", commit)
+		r.log.Infof("Restored commit: %v", commit)
 
 		os.Rename(commit.Data[0][2], commit.Data[0][3])
 		os.Rename(commit.Data[0][4], commit.Data[0][5])
@@ -108,16 +129,22 @@ func (r *ReducerQuery5) Run() {
 	})
 
 	for result := range r.results {
-		log.Infof("Processing client %v id: %d, isFinal: %v", result.ClientId, result.Id, result.IsFinalMessage)
+		r.log.Infof("Processing client %v id: %d, isFinal: %v", result.ClientId, result.Id, result.IsFinalMessage)
 		r.processResult(result)
 	}
 }
 
 func (r *ReducerQuery5) processResult(result *middleware.Result) {
+	if sketchResult, ok := result.Payload.(middleware.SketchResult); ok {
+		r.processSketch(result.ShardId, sketchResult)
+		result.Ack()
+		return
+	}
+
 	query5Result := result.Payload.(middleware.Query5Result)
 
 	if r.processedAnswers.Contains(int64(result.Id)) {
-		log.Infof("Result %d already processed", result.Id)
+		r.log.Infof("Result %d already processed", result.Id)
 		result.Ack()
 		return
 	}
@@ -128,8 +155,8 @@ func (r *ReducerQuery5) processResult(result *middleware.Result) {
 
 	shared.TestTolerance(1, 10, "Exiting after tmp")
 
-	r.commit.Write([][]string{
-		{r.ClientId, strconv.FormatInt(result.Id, 10), tmpFile.Name(), realFilename, tmpTotalFile.Name(),
+	r.commit.Write(result.Trace(), [][]string{
+		{r.ClientId.String(), strconv.FormatInt(result.Id, 10), tmpFile.Name(), realFilename, tmpTotalFile.Name(),
 			realTotalFilename, strconv.FormatBool(result.IsFinalMessage), strconv.Itoa(result.ShardId)},
 	})
 
@@ -141,21 +168,21 @@ func (r *ReducerQuery5) processResult(result *middleware.Result) {
 
 	// replace file with tmp file
 	if err := os.Rename(tmpFile.Name(), realFilename); err != nil {
-		log.Errorf("action: rename file | result: error | message: %s", err)
+		r.log.Errorf("action: rename file | result: error | message: %s", err)
 		return
 	}
 
 	shared.TestTolerance(1, 10, "Exiting after renaming 1")
 
 	if err := os.Rename(tmpTotalFile.Name(), realTotalFilename); err != nil {
-		log.Errorf("action: rename file | result: error | message: %s", err)
+		r.log.Errorf("action: rename file | result: error | message: %s", err)
 		return
 	}
 
 	shared.TestTolerance(1, 10, "Exiting after renaming 2")
 
 	if result.IsFinalMessage {
-		log.Info("Received final message")
+		r.log.Info("Received final message")
 		r.finalAnswers.Add(int64(result.ShardId))
 	}
 
@@ -169,46 +196,95 @@ func (r *ReducerQuery5) processResult(result *middleware.Result) {
 	result.Ack()
 }
 
+func (r *ReducerQuery5) processSketch(shardId int, sketchResult middleware.SketchResult) {
+	if r.finalAnswers.Contains(int64(shardId)) || !r.sketches.update(shardId, sketchResult) {
+		return
+	}
+
+	topK, quantiles, processed := r.sketches.merge(r.middleware.Config.Query.SketchTopK, sketchResult.Quantiles.Alpha)
+
+	stats := approximateStats(topK.Top(gamesAbovePercentile(quantiles.Count)), func(stat *middleware.Stats, count int) {
+		stat.Negatives = count
+	})
+
+	sendApproximateResult(r.middleware, r.ClientId, r.Priority, 5, processed, middleware.ApproximateResult{
+		Stats:  stats,
+		Cutoff: int(math.Ceil(quantiles.Quantile(0.9))),
+	})
+}
+
 func (r *ReducerQuery5) storeResults(stats []middleware.Stats) (*os.File, *os.File) {
 	tmpFile, err := os.CreateTemp(fmt.Sprintf("./database/%s/", r.ClientId), "tmp-reducer-query-5.csv")
 	if err != nil {
-		log.Errorf("action: create file | result: error | message: %s", err)
+		r.log.Errorf("action: create file | result: error | message: %s", err)
 		return nil, nil
 	}
 
 	file, err := os.OpenFile(fmt.Sprintf("./database/%s/query-5.csv", r.ClientId), os.O_CREATE, 0755)
 	if err != nil {
-		log.Errorf("action: open file | result: error | message: %s", err)
+		r.log.Errorf("action: open file | result: error | message: %s", err)
 		return nil, nil
 	}
 	defer file.Close()
 
-	reader := csv.NewReader(file)
-	writer := csv.NewWriter(tmpFile)
+	totalGames, err := mergeSortedStats(csv.NewReader(file), csv.NewWriter(tmpFile), stats)
+	if err != nil {
+		r.log.Errorf("action: merge results | result: error | message: %s", err)
+		return nil, nil
+	}
+
+	tmpTotalFile, err := os.CreateTemp(fmt.Sprintf("./database/%s/", r.ClientId), "tmp-total-reducer-query-5.csv")
+	if err != nil {
+		r.log.Errorf("action: create file | result: error | message: %s", err)
+		return nil, nil
+	}
+
+	totalFile, err := os.OpenFile(fmt.Sprintf("./database/%s/query-5-total.csv", r.ClientId), os.O_CREATE, 0755)
+	if err != nil {
+		r.log.Errorf("action: open file | result: error | message: %s", err)
+		return nil, nil
+	}
+	defer totalFile.Close()
+
+	var current int64
+	err = binary.Read(totalFile, binary.BigEndian, &current)
+	if err != io.EOF && err != nil {
+		return nil, nil
+	}
+
+	newTotal := current + int64(totalGames)
 
+	err = binary.Write(tmpTotalFile, binary.BigEndian, newTotal)
+	if err != nil {
+		r.log.Errorf("failed to write to file: %v", err)
+		return nil, nil
+	}
+
+	return tmpFile, tmpTotalFile
+}
+
+// mergeSortedStats merges a batch of stats (sorted by shared.ByNegativesDesc)
+// into the stored results, which are kept in the same order. It returns how
+// many new games were written.
+func mergeSortedStats(reader *csv.Reader, writer *csv.Writer, stats []middleware.Stats) (int, error) {
 	totalGames := 0
 
 	for {
 		storedRecord, err := reader.Read()
-		if err != nil && err != io.EOF {
-			log.Errorf("action: read file | result: error | message: %s", err)
-			return nil, nil
-		}
 		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return 0, err
+		}
 
-		negatives, err := strconv.Atoi(storedRecord[2])
+		stored, err := parseStoredStat(storedRecord)
 		if err != nil {
-			log.Errorf("action: convert negative reviews to int | result: error | message: %s", err)
-			return nil, nil
+			return 0, err
 		}
 
-		for _, stat := range stats {
-			if stat.Negatives < negatives {
-				break
-			}
-			writer.Write([]string{strconv.Itoa(stat.AppId), stat.Name, strconv.Itoa(stat.Negatives)})
+		for len(stats) > 0 && shared.ByNegativesDesc(&stats[0], stored) {
+			writer.Write(storedStatRecord(&stats[0]))
 			totalGames++ // new games
 			stats = stats[1:]
 		}
@@ -220,49 +296,47 @@ func (r *ReducerQuery5) storeResults(stats []middleware.Stats) (*os.File, *os.Fi
 		if stat.Negatives == 0 {
 			break
 		}
-		writer.Write([]string{strconv.Itoa(stat.AppId), stat.Name, strconv.Itoa(stat.Negatives)})
+		writer.Write(storedStatRecord(&stat))
 		totalGames++ // new games
 	}
 
 	writer.Flush()
 
-	tmpTotalFile, err := os.CreateTemp(fmt.Sprintf("./database/%s/", r.ClientId), "tmp-total-reducer-query-5.csv")
-	if err != nil {
-		log.Errorf("action: create file | result: error | message: %s", err)
-		return nil, nil
-	}
+	return totalGames, writer.Error()
+}
 
-	totalFile, err := os.OpenFile(fmt.Sprintf("./database/%s/query-5-total.csv", r.ClientId), os.O_CREATE, 0755)
+// appId,name,negatives
+func parseStoredStat(record []string) (*middleware.Stats, error) {
+	appId, err := strconv.Atoi(record[0])
 	if err != nil {
-		log.Errorf("action: open file | result: error | message: %s", err)
-		return nil, nil
+		return nil, err
 	}
-	defer file.Close()
 
-	var current int64
-	err = binary.Read(totalFile, binary.BigEndian, &current)
-	if err != io.EOF && err != nil {
-		return nil, nil
+	negatives, err := strconv.Atoi(record[2])
+	if err != nil {
+		return nil, err
 	}
 
-	newTotal := current + int64(totalGames)
+	return &middleware.Stats{AppId: appId, Name: record[1], Negatives: negatives}, nil
+}
 
-	err = binary.Write(tmpTotalFile, binary.BigEndian, newTotal)
-	if err != nil {
-		log.Errorf("failed to write to file: %v", err)
-		return nil, nil
-	}
+func storedStatRecord(stat *middleware.Stats) []string {
+	return []string{strconv.Itoa(stat.AppId), stat.Name, strconv.Itoa(stat.Negatives)}
+}
 
-	return tmpFile, tmpTotalFile
+// gamesAbovePercentile returns how many games (ordered by negatives) are
+// above the 90th percentile.
+func gamesAbovePercentile(totalGames int) int {
+	return int(math.Ceil(float64(totalGames) / 10.0))
 }
 
 func (r *ReducerQuery5) sendFinalResult() {
-	gamesNeeded := int(math.Ceil(float64(r.totalGames) / 10.0))
-	log.Infof("total games: %d, games needed %v", r.totalGames, gamesNeeded)
+	gamesNeeded := gamesAbovePercentile(r.totalGames)
+	r.log.Infof("total games: %d, games needed %v", r.totalGames, gamesNeeded)
 
 	file, err := os.OpenFile(fmt.Sprintf("./database/%s/query-5.csv", r.ClientId), os.O_CREATE, 0755)
 	if err != nil {
-		log.Errorf("action: open file | result: error | message: %s", err)
+		r.log.Errorf("action: open file | result: error | message: %s", err)
 		return
 	}
 	defer file.Close()
@@ -283,22 +357,13 @@ func (r *ReducerQuery5) sendFinalResult() {
 			break
 		}
 
-		appId, err := strconv.Atoi(record[0])
+		stat, err := parseStoredStat(record)
 		if err != nil {
-			log.Errorf("action: convert appId to int | result: error | message: %s", err)
-			return
-		}
-		negatives, err := strconv.Atoi(record[2])
-		if err != nil {
-			log.Errorf("action: convert negatives to int | result: error | message: %s", err)
+			r.log.Errorf("action: parse stored stat | result: error | message: %s", err)
 			return
 		}
 
-		batch.Stats = append(batch.Stats, middleware.Stats{
-			AppId:     appId,
-			Name:      record[1],
-			Negatives: negatives,
-		})
+		batch.Stats = append(batch.Stats, *stat)
 		i++
 
 		if len(batch.Stats) == resultsBatchSize {
@@ -306,13 +371,14 @@ func (r *ReducerQuery5) sendFinalResult() {
 			result := middleware.Result{
 				Id:             r.getNextId(&batch),
 				ClientId:       r.ClientId,
+				Priority:       r.Priority,
 				QueryId:        5,
 				IsFinalMessage: false,
 				Payload:        batch,
 			}
 
 			if err := r.middleware.SendResponse(&result); err != nil {
-				log.Errorf("action: send final result | result: error | message: %s", err)
+				r.log.Errorf("action: send final result | result: error | message: %s", err)
 				break
 			}
 			batch.Stats = make([]middleware.Stats, 0)
@@ -323,6 +389,7 @@ func (r *ReducerQuery5) sendFinalResult() {
 	result := middleware.Result{
 		Id:             r.getNextId(&batch),
 		ClientId:       r.ClientId,
+		Priority:       r.Priority,
 		QueryId:        5,
 		IsFinalMessage: true,
 		Payload:        batch,
@@ -331,20 +398,15 @@ func (r *ReducerQuery5) sendFinalResult() {
 	shared.TestTolerance(1, 2, "Exiting before sending final")
 
 	if err := r.middleware.SendResponse(&result); err != nil {
-		log.Errorf("action: send final result | result: error | message: %s", err)
+		r.log.Errorf("action: send final result | result: error | message: %s", err)
 	}
 }
 
 func (r *ReducerQuery5) getNextId(batch *middleware.Query5Result) int64 {
-	clientId, _ := strconv.Atoi(r.ClientId)
-
-	clientIdHigh := (clientId >> 8) & 0xFF // Get high byte
-	clientIdLow := clientId & 0xFF         // Get low byte
-
 	negatives := 0
 	for _, stat := range batch.Stats {
 		negatives += stat.Negatives
 	}
 
-	return int64(clientIdHigh)<<56 | int64(clientIdLow)<<48 | int64(5)<<40 | int64(negatives)
+	return int64(5)<<40 | int64(negatives)
 }
@@ -0,0 +1,106 @@
+package reducer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// shardResults sorts the stats of a shard the same way Query5Client does and
+// splits them in batches like the ones sent to the reducer.
+func shardResults(t *testing.T, stats []middleware.Stats) [][]middleware.Stats {
+	dir := t.TempDir()
+	sorter := shared.NewStatsSorter(filepath.Join(dir, "runs"), 64, shared.ByNegativesDesc)
+	for _, stat := range stats {
+		assert.Nil(t, sorter.Add(stat))
+	}
+
+	out := filepath.Join(dir, "sorted.csv")
+	assert.Nil(t, sorter.Sort(out))
+
+	file, err := os.Open(out)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	assert.Nil(t, err)
+
+	batches := make([][]middleware.Stats, 0)
+	batch := make([]middleware.Stats, 0)
+	for _, record := range records {
+		stat, err := shared.ParseStat(record)
+		assert.Nil(t, err)
+		batch = append(batch, *stat)
+		if len(batch) == resultsBatchSize {
+			batches = append(batches, batch)
+			batch = make([]middleware.Stats, 0)
+		}
+	}
+	return append(batches, batch)
+}
+
+func TestPercentileMatchesBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+
+	for _, shards := range []int{1, 2, 3} {
+		for _, games := range []int{0, 1, 9, 10, 11, 487, 2000} {
+			all := make([]middleware.Stats, 0, games)
+			perShard := make([][]middleware.Stats, shards)
+			for i := 0; i < games; i++ {
+				stat := middleware.Stats{
+					AppId:     i + 1,
+					Name:      fmt.Sprintf("Game %d", i+1),
+					Negatives: r.Intn(40) + 1,
+				}
+				shard := r.Intn(shards)
+				all = append(all, stat)
+				perShard[shard] = append(perShard[shard], stat)
+			}
+
+			batches := make([][]middleware.Stats, 0)
+			for _, stats := range perShard {
+				batches = append(batches, shardResults(t, stats)...)
+			}
+			r.Shuffle(len(batches), func(i, j int) { batches[i], batches[j] = batches[j], batches[i] })
+
+			stored := &bytes.Buffer{}
+			totalGames := 0
+			for _, batch := range batches {
+				merged := &bytes.Buffer{}
+				added, err := mergeSortedStats(csv.NewReader(bytes.NewReader(stored.Bytes())), csv.NewWriter(merged), batch)
+				assert.Nil(t, err)
+				totalGames += added
+				stored = merged
+			}
+
+			records, err := csv.NewReader(stored).ReadAll()
+			assert.Nil(t, err)
+			assert.Equal(t, len(all), totalGames)
+			assert.Equal(t, len(all), len(records))
+
+			expected := append([]middleware.Stats{}, all...)
+			sort.Slice(expected, func(i, j int) bool {
+				return shared.ByNegativesDesc(&expected[i], &expected[j])
+			})
+			expected = expected[:gamesAbovePercentile(len(expected))]
+
+			got := make([]middleware.Stats, 0)
+			for _, record := range records[:gamesAbovePercentile(totalGames)] {
+				stat, err := parseStoredStat(record)
+				assert.Nil(t, err)
+				got = append(got, *stat)
+			}
+
+			assert.Equal(t, expected, got, "shards %d, games %d", shards, games)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package reducer
+
+import (
+	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared/sketch"
+)
+
+// shardSketches keeps the latest sketch received from each shard. Sketches
+// are snapshots, so a newer one replaces the previous one instead of being
+// added to it. Nothing is persisted: after a restart the next sketch of each
+// shard rebuilds the state.
+type shardSketches struct {
+	latest map[int]middleware.SketchResult
+}
+
+func newShardSketches() *shardSketches {
+	return &shardSketches{latest: make(map[int]middleware.SketchResult)}
+}
+
+// update returns false if the sketch is older than the one already stored
+func (s *shardSketches) update(shardId int, result middleware.SketchResult) bool {
+	if current, ok := s.latest[shardId]; ok && current.Processed >= result.Processed {
+		return false
+	}
+	s.latest[shardId] = result
+	return true
+}
+
+func (s *shardSketches) merge(capacity int, alpha float64) (*sketch.TopK, *sketch.Quantiles, int) {
+	topK := sketch.NewTopK(capacity)
+	quantiles := sketch.NewQuantiles(alpha)
+	processed := 0
+
+	for _, result := range s.latest {
+		topK.Merge(result.TopK)
+		quantiles.Merge(result.Quantiles)
+		processed += result.Processed
+	}
+
+	return topK, quantiles, processed
+}
+
+func approximateStats(items []sketch.Item, value func(stat *middleware.Stats, count int)) []middleware.Stats {
+	stats := make([]middleware.Stats, 0, len(items))
+	for _, item := range items {
+		stat := middleware.Stats{AppId: item.AppId, Name: item.Name}
+		value(&stat, item.Count)
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+func sendApproximateResult(m *middleware.Middleware, clientId middleware.ClientId, priority middleware.Priority, queryId int, processed int, result middleware.ApproximateResult) {
+	response := &middleware.Result{
+		Id:             getApproximateId(queryId, processed),
+		ClientId:       clientId,
+		Priority:       priority,
+		QueryId:        queryId,
+		IsFinalMessage: false,
+		Payload:        result,
+	}
+
+	if err := m.SendResponse(response); err != nil {
+		log.Errorf("Failed to send approximate result: %v", err)
+	}
+}
+
+// queryId (1 byte) + approximate flag (1 bit) + processed stats
+func getApproximateId(queryId int, processed int) int64 {
+	return int64(queryId)<<40 | int64(1)<<39 | int64(processed)
+}
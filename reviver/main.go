@@ -2,44 +2,77 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"os"
-	"os/signal"
 	"strconv"
-	"syscall"
 	"time"
+	"tp1-distribuidos/shared/health"
+	"tp1-distribuidos/shared/lifecycle"
+	"tp1-distribuidos/shared/logs"
 )
 
+var log = logs.Get("reviver")
+
+// initLogger configura los logs con las mismas variables que el resto de los
+// nodos, el reviver no lee server.yml
+func initLogger(name string) error {
+	level := os.Getenv("CLI_LOG_LEVEL")
+	if level == "" {
+		level = "INFO"
+	}
+	return logs.Init(logs.Options{
+		Node:    name,
+		Level:   level,
+		Format:  os.Getenv("CLI_LOG_FORMAT"),
+		Modules: os.Getenv("CLI_LOG_MODULES"),
+	})
+}
+
 func main() {
 	cliId, err := strconv.Atoi(os.Getenv("CLI_ID"))
 	if err != nil {
-		fmt.Printf("Error getting CLI_ID: %v\n", err)
+		log.Errorf("Error getting CLI_ID: %v", err)
 		os.Exit(1)
 	}
 	if cliId == 0 {
-		fmt.Println("CLI_ID not specified")
+		log.Error("CLI_ID not specified")
 		os.Exit(1)
 	}
 	bullyNodes, err := strconv.Atoi(os.Getenv("CLI_TOPOLOGY_NODES"))
 	if err != nil {
-		fmt.Printf("Error getting CLI_TOPOLOGY_NODES: %v\n", err)
+		log.Errorf("Error getting CLI_TOPOLOGY_NODES: %v", err)
 		os.Exit(1)
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	name := "reviver-" + strconv.Itoa(cliId)
+	if err := initLogger(name); err != nil {
+		log.Errorf("action: init_logger | result: fail | error: %s", err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
 	defer stop()
 
 	node := NewNode(cliId, ctx)
-	go func() {
-		<-ctx.Done()
-		fmt.Println("Received interrupt signal, shutting down")
+
+	reviver := lifecycle.New(name, lifecycle.DEFAULT_DRAIN_TIMEOUT)
+	reviver.OnDrain("stop", func() error {
+		log.Info("Received interrupt signal, shutting down")
+		stop()
+		return nil
+	})
+	reviver.OnClose("peers", func() error {
 		node.Close()
-	}()
+		return nil
+	})
+	reviver.Notify()
+
+	checks := health.New()
+	checks.Readiness("lifecycle", reviver.Check)
+	go checks.ListenAndServe(health.DEFAULT_PORT)
 
 	go node.Listen()
 
 	time.Sleep(1 * time.Second)
 
 	node.CreateTopology(bullyNodes)
-	node.Run()
+	os.Exit(reviver.Run(node.Run))
 }
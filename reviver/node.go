@@ -8,7 +8,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 	"strings"
@@ -54,7 +53,7 @@ func getProcessList(id int) [][]string {
 
 	file, err := os.Open(PROCESS_LIST_FILE)
 	if err != nil {
-		fmt.Printf("Error opening process list file: %v\n", err)
+		log.Errorf("Error opening process list file: %v", err)
 		os.Exit(1)
 	}
 	defer file.Close()
@@ -66,7 +65,7 @@ func getProcessList(id int) [][]string {
 			break
 		}
 		if err != nil {
-			fmt.Printf("Error reading process list file: %v\n", err)
+			log.Errorf("Error reading process list file: %v", err)
 			os.Exit(1)
 		}
 		if record[0] == fmt.Sprintf("reviver-%d", id) {
@@ -82,7 +81,7 @@ func NewNode(id int, stopContext context.Context) *Node {
 
 	serverAddr, err := net.ResolveTCPAddr("tcp", ":8000")
 	if err != nil {
-		fmt.Printf("Error resolving server address: %v\n", err)
+		log.Errorf("Error resolving server address: %v", err)
 		os.Exit(1)
 	}
 
@@ -114,13 +113,13 @@ func (n *Node) Close() {
 	}
 	if n.serverConn != nil {
 		if err := n.serverConn.Close(); err != nil {
-			fmt.Printf("Error closing server connection: %v\n", err)
+			log.Errorf("Error closing server connection: %v", err)
 		}
 	}
 }
 
 func (n *Node) Run() {
-	fmt.Printf("Running reviver %d\n", n.id)
+	log.Infof("Running reviver %d", n.id)
 	go shared.RunUDPListener(8080)
 	n.wg.Add(1)
 	time.Sleep(2 * time.Second)
@@ -148,7 +147,7 @@ func (n *Node) StartElection() {
 				PeerId: n.id,
 				Type:   MessageTypeElection,
 			}); err != nil {
-				log.Printf("Could not send election message to peer %d, err: %v", peer.id, err)
+				log.Errorf("Could not send election message to peer %d, err: %v", peer.id, err)
 				continue
 			}
 
@@ -189,7 +188,7 @@ electionLoop:
 
 		case <-timeoutChan:
 			if n.GetState() == NodeStateCandidate {
-				log.Printf("Node %d becoming leader\n", n.id)
+				log.Infof("Node %d becoming leader", n.id)
 				n.leaderLock.Lock()
 				go n.BecomeLeader()
 				n.leaderLock.Unlock()
@@ -211,7 +210,7 @@ func (n *Node) waitForCoordinator() {
 }
 
 func (n *Node) startFollowerLoop(leaderId int) {
-	log.Printf("Node %d following leader %d\n", n.id, leaderId)
+	log.Infof("Node %d following leader %d", n.id, leaderId)
 	for {
 		select {
 		case <-n.stopContext.Done():
@@ -236,7 +235,7 @@ func (n *Node) startFollowerLoop(leaderId int) {
 			}
 
 			if !found {
-				log.Printf("Leader %d not found, starting election, lo estamos manejando", leaderId)
+				log.Warningf("Leader %d not found, starting election, lo estamos manejando", leaderId)
 				go n.StartElection()
 				n.peersLock.Unlock()
 				return
@@ -244,7 +243,7 @@ func (n *Node) startFollowerLoop(leaderId int) {
 
 			err := leaderPeer.Send(Message{PeerId: n.id, Type: MessageTypePing})
 			if err != nil {
-				log.Printf("Could not send ping message to leader %d, starting election, err: %v", leaderId, err)
+				log.Errorf("Could not send ping message to leader %d, starting election, err: %v", leaderId, err)
 				go n.StartElection()
 				n.peersLock.Unlock()
 				return
@@ -256,20 +255,20 @@ func (n *Node) startFollowerLoop(leaderId int) {
 					n.peersLock.Unlock()
 					continue
 				}
-				log.Printf("Leader %d is dead, starting election", leaderId)
+				log.Warningf("Leader %d is dead, starting election", leaderId)
 				n.ChangeState(NodeStateFollower)
 				go n.StartElection()
 				n.peersLock.Unlock()
 				return
 			}
 			if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
-				log.Printf("Error decoding response from leader %d: %v", leaderId, err)
+				log.Errorf("Error decoding response from leader %d: %v", leaderId, err)
 				n.peersLock.Unlock()
 				continue
 			}
 			n.peersLock.Unlock()
 			if response.Type != MessageTypePong {
-				log.Printf("Node %d received wrong message type %d from leader %d\n", n.id, response.Type, leaderId)
+				log.Errorf("Node %d received wrong message type %d from leader %d", n.id, response.Type, leaderId)
 				continue
 			}
 		}
@@ -285,7 +284,7 @@ func (n *Node) BecomeLeader() {
 
 	for _, peer := range n.peers {
 		if err := peer.Send(Message{PeerId: n.id, Type: MessageTypeCoordinator}); err != nil {
-			log.Printf("Could not send coordinator message to peer %d: %v", peer.id, err)
+			log.Errorf("Could not send coordinator message to peer %d: %v", peer.id, err)
 		}
 	}
 
@@ -295,7 +294,7 @@ func (n *Node) BecomeLeader() {
 }
 
 func (n *Node) StartLeaderLoop() {
-	log.Printf("Node %d is the leader\n", n.id)
+	log.Infof("Node %d is the leader", n.id)
 
 	stopResurrecters, cancel := context.WithCancel(context.Background())
 	resurrecter := NewResurrecter(n.processList, stopResurrecters)
@@ -343,11 +342,11 @@ func (n *Node) CreateTopology(reviverNodes int) {
 		peerName := fmt.Sprintf("reviver-%d", i)
 		peer := NewPeer(i, &peerName)
 		if peer == nil {
-			log.Printf("Could not create peer %d", i)
+			log.Errorf("Could not create peer %d", i)
 			continue
 		}
 		if err := peer.call(); err != nil {
-			log.Printf("Could not connect to peer %d: %v", i, err)
+			log.Errorf("Could not connect to peer %d: %v", i, err)
 			continue
 		}
 		n.peers = append(n.peers, peer)
@@ -362,7 +361,7 @@ func (n *Node) CreateTopology(reviverNodes int) {
 func (n *Node) Listen() {
 	serverConn, err := net.ListenTCP("tcp", n.serverAddr)
 	if err != nil {
-		fmt.Printf("Error listening on server address: %v\n", err)
+		log.Errorf("Error listening on server address: %v", err)
 		os.Exit(1)
 	}
 	n.serverConn = serverConn
@@ -377,7 +376,7 @@ func (n *Node) Listen() {
 				return
 			}
 			if err != nil {
-				// fmt.Printf("Error accepting connection: %v\n", err)
+				// log.Errorf("Error accepting connection: %v", err)
 				continue
 			}
 			go n.RespondToPeer(conn)
@@ -400,14 +399,14 @@ func (n *Node) RespondToPeer(conn *net.TCPConn) {
 
 		if err != nil && err != io.EOF {
 			if err := conn.Close(); err != nil {
-				fmt.Printf("Error closing connection: %v\n", err)
+				log.Errorf("Error closing connection: %v", err)
 			}
 			break
 		}
 
 		if err == io.EOF {
 			if err := conn.Close(); err != nil {
-				fmt.Printf("Error closing connection: %v\n", err)
+				log.Errorf("Error closing connection: %v", err)
 			}
 			break
 		}
@@ -477,14 +476,14 @@ func (n *Node) handleCoordinator(message *Message) {
 func (n *Node) handlePing(encoder *gob.Encoder) {
 	msg := Message{PeerId: n.id, Type: MessageTypePong}
 	if err := encoder.Encode(msg); err != nil {
-		fmt.Printf("Error sending pong message: %v\n", err)
+		log.Errorf("Error sending pong message: %v", err)
 	}
 }
 
 func (n *Node) handleElection(encoder *gob.Encoder) {
 	msg := Message{PeerId: n.id, Type: MessageTypeOk}
 	if err := encoder.Encode(msg); err != nil {
-		fmt.Printf("Error sending ok message: %v\n", err)
+		log.Errorf("Error sending ok message: %v", err)
 	}
 	if !n.inElection {
 		go n.StartElection()
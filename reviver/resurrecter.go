@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
-	"log"
+	"fmt"
 	"net"
+	"net/http"
 	"time"
 
 	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/health"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
@@ -37,12 +39,12 @@ func (r *Resurrecter) Start() {
 	gob.Register(shared.ResurrecterMessage{})
 	connAddr, err := net.ResolveUDPAddr("udp", ":8081")
 	if err != nil {
-		// log.Printf("Error resolving UDP address: %v", err)
+		// log.Errorf("Error resolving UDP address: %v", err)
 	}
 
 	conn, err := net.ListenUDP("udp", connAddr)
 	if err != nil {
-		// log.Printf("Error listening on UDP: %v", err)
+		// log.Errorf("Error listening on UDP: %v", err)
 	}
 	r.conn = conn
 
@@ -73,13 +75,13 @@ func (r *Resurrecter) receiveResponses(responseMap map[string]chan struct{}) err
 		var message shared.ResurrecterMessage
 		decoder := gob.NewDecoder(bytes.NewReader(response[:n]))
 		if err := decoder.Decode(&message); err != nil {
-			log.Printf("Error decoding response: %v", err)
+			log.Errorf("Error decoding response: %v", err)
 			return err
 		}
 
 		responseChan, ok := responseMap[message.ProcessName]
 		if !ok {
-			log.Printf("Unknown process: %s", message.ProcessName)
+			log.Errorf("Unknown process: %s", message.ProcessName)
 			continue
 		}
 
@@ -88,16 +90,45 @@ func (r *Resurrecter) receiveResponses(responseMap map[string]chan struct{}) err
 }
 
 func (r *Resurrecter) RunMainLoop(process []string, responseChan chan struct{}) {
+	healthTicker := time.NewTicker(ResurrecterHealthInterval)
+	defer healthTicker.Stop()
+	unhealthy := 0
+
 	for {
 		select {
 		case <-r.stopContext.Done():
 			return
 		case <-time.After(ResurrecterPingInterval):
 			r.sendPing(process, responseChan)
+		case <-healthTicker.C:
+			if r.checkHealth(process) {
+				unhealthy = 0
+				continue
+			}
+			unhealthy++
+			if unhealthy >= ResurrecterHealthRetries {
+				log.Warningf("Container %s is unhealthy", process[0])
+				r.Restart(process[0])
+				unhealthy = 0
+			}
 		}
 	}
 }
 
+// checkHealth consulta el /healthz del proceso. Solo un 503 cuenta como
+// enfermo, si no contesta (se esta levantando o no tiene endpoint) de eso se
+// encarga el ping.
+func (r *Resurrecter) checkHealth(process []string) bool {
+	client := http.Client{Timeout: ResurrecterHealthTimeout}
+	response, err := client.Get(fmt.Sprintf("http://%s:%d/healthz", process[1], health.DEFAULT_PORT))
+	if err != nil {
+		return true
+	}
+	defer response.Body.Close()
+
+	return response.StatusCode != http.StatusServiceUnavailable
+}
+
 func (r *Resurrecter) sendPing(process []string, responseChan chan struct{}) {
 	if r.conn == nil {
 		r.Resurrect(process[0])
@@ -112,7 +143,7 @@ func (r *Resurrecter) sendPing(process []string, responseChan chan struct{}) {
 	var buf bytes.Buffer
 	encoder := gob.NewEncoder(&buf)
 	if err := encoder.Encode(message); err != nil {
-		log.Printf("Error encoding message: %v", err)
+		log.Errorf("Error encoding message: %v", err)
 		return
 	}
 
@@ -122,7 +153,7 @@ func (r *Resurrecter) sendPing(process []string, responseChan chan struct{}) {
 	for {
 		_, err := r.conn.WriteToUDP(buf.Bytes(), &net.UDPAddr{IP: net.ParseIP(process[1]), Port: 8080})
 		if err != nil {
-			log.Printf("Error sending message: %v", err)
+			log.Errorf("Error sending message: %v", err)
 			return
 		}
 
@@ -136,7 +167,7 @@ func (r *Resurrecter) sendPing(process []string, responseChan chan struct{}) {
 			pingTimeout *= 2
 
 			if retries >= ResurrecterPingRetries {
-				log.Printf("Container %s is dead", process[0])
+				log.Warningf("Container %s is dead", process[0])
 				r.Resurrect(process[0])
 				return
 			}
@@ -147,13 +178,31 @@ func (r *Resurrecter) sendPing(process []string, responseChan chan struct{}) {
 func (r *Resurrecter) Resurrect(process string) {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		log.Printf("Error creating Docker client: %v", err)
+		log.Errorf("Error creating Docker client: %v", err)
 		return
 	}
 
-	log.Printf("Resurrecting container: %s", process)
+	log.Infof("Resurrecting container: %s", process)
 	if err := cli.ContainerStart(context.Background(), process, container.StartOptions{}); err != nil {
-		log.Printf("Error restarting container: %v", err)
+		log.Errorf("Error restarting container: %v", err)
+	}
+
+	time.Sleep(ResurrecterRestartDelay)
+}
+
+// Restart reinicia un container que esta vivo pero trabado, le da tiempo a
+// drenar antes de matarlo
+func (r *Resurrecter) Restart(process string) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		log.Errorf("Error creating Docker client: %v", err)
+		return
+	}
+
+	log.Infof("Restarting container: %s", process)
+	timeout := ResurrecterStopTimeout
+	if err := cli.ContainerRestart(context.Background(), process, container.StopOptions{Timeout: &timeout}); err != nil {
+		log.Errorf("Error restarting container: %v", err)
 	}
 
 	time.Sleep(ResurrecterRestartDelay)
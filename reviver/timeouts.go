@@ -11,4 +11,9 @@ const (
 	ResurrecterPingInterval = 400 * time.Millisecond
 	ResurrecterRestartDelay = 2 * time.Second
 	ResurrecterPingRetries  = 2
+
+	ResurrecterHealthInterval = 5 * time.Second
+	ResurrecterHealthTimeout  = 1 * time.Second
+	ResurrecterHealthRetries  = 3  // /healthz seguidos en 503 antes de reiniciar
+	ResurrecterStopTimeout    = 20 // segundos para drenar antes del SIGKILL
 )
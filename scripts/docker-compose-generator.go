@@ -9,7 +9,7 @@ import (
 )
 
 const (
-	SERVER_IP  = "10.5.1.1"
+	SERVER_IP  = "10.5.1.X"
 	MAPPER_IP  = "10.5.2.X"
 	QUERY_IP   = "10.5.3.X"
 	REDUCER_IP = "10.5.4.X"
@@ -42,46 +42,55 @@ services:
     environment:
       RABBITMQ_DEFAULT_LOG_LEVEL: error
       RABBITMQ_LOG_LEVELS: "connection=error"`
-	composeStr += `
-  server:
-    container_name: server
+	replicas := max(config.Server.Replicas, 1)
+	for replica := 1; replica <= replicas; replica++ {
+		// todas las replicas comparten el alias "server", los clientes se
+		// reparten por DNS y las sesiones se comparten en /sessions
+		composeStr += fmt.Sprintf(`
+  server-%d:
+    container_name: server-%d
     image: server:latest
     entrypoint: /server
     environment:
       - CANT_AGENCIES=5
+      - CLI_SERVER_INSTANCE=%d
     networks:
       network:
-        ipv4_address: 10.5.1.1
+        ipv4_address: %s
+        aliases:
+          - server
     volumes:
       - ./server.yml:/server.yml
-      - ../database/server_database:/database
+      - ../database/server_database_%d:/database
+      - ../database/server_sessions:/sessions
     depends_on:
       rabbitmq:
-        condition: service_healthy`
-	if config.Query.Query3 || config.Query.Query4 || config.Query.Query5 {
-		for i := 1; i <= config.Mappers.Amount; i++ {
-			composeStr += fmt.Sprintf(`
+        condition: service_healthy`, replica, replica, replica, strings.Replace(SERVER_IP, "X", fmt.Sprintf("%d", replica), 1), replica)
+		if config.Query.Query3 || config.Query.Query4 || config.Query.Query5 {
+			for i := 1; i <= config.Mappers.Amount; i++ {
+				composeStr += fmt.Sprintf(`
       mapper-%d:
         condition: service_started`, i)
+			}
 		}
-	}
-	for query := 1; query <= 5; query++ {
-		if query == 1 && !config.Query.Query1 || query == 2 && !config.Query.Query2 || query == 3 && !config.Query.Query3 || query == 4 && !config.Query.Query4 || query == 5 && !config.Query.Query5 {
-			continue
-		}
-		for i := 0; i < config.Sharding.Amount; i++ {
-			composeStr += fmt.Sprintf(`
+		for query := 1; query <= 5; query++ {
+			if query == 1 && !config.Query.Query1 || query == 2 && !config.Query.Query2 || query == 3 && !config.Query.Query3 || query == 4 && !config.Query.Query4 || query == 5 && !config.Query.Query5 {
+				continue
+			}
+			for i := 0; i < config.Sharding.Amount; i++ {
+				composeStr += fmt.Sprintf(`
       queries-%d-%d:
         condition: service_started`, query, i)
-		}
-		composeStr += fmt.Sprintf(`
+			}
+			composeStr += fmt.Sprintf(`
       reducer-%d:
         condition: service_started`, query)
-	}
-	for i := 1; i <= config.Reviver.Amount; i++ {
-		composeStr += fmt.Sprintf(`
+		}
+		for i := 1; i <= config.Reviver.Amount; i++ {
+			composeStr += fmt.Sprintf(`
       reviver-%d:
         condition: service_started`, i)
+		}
 	}
 
 	// Generate client services
@@ -199,9 +208,11 @@ func generateNameIpFile(config *config.Config) {
 	writer := csv.NewWriter(file)
 	defer writer.Flush()
 
-	if err := writer.Write([]string{"server", SERVER_IP}); err != nil {
-		fmt.Printf("Error writing to file: %v\n", err)
-		os.Exit(1)
+	for replica := 1; replica <= max(config.Server.Replicas, 1); replica++ {
+		if err := writer.Write([]string{fmt.Sprintf("server-%d", replica), strings.Replace(SERVER_IP, "X", fmt.Sprintf("%d", replica), 1)}); err != nil {
+			fmt.Printf("Error writing to file: %v\n", err)
+			os.Exit(1)
+		}
 	}
 	if config.Query.Query3 || config.Query.Query4 || config.Query.Query5 {
 		for i := 1; i <= config.Mappers.Amount; i++ {
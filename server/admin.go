@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"time"
+	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared/admin"
+	"tp1-distribuidos/shared/health"
+)
+
+// SessionView es una sesion como la devuelve /admin/sessions
+type SessionView struct {
+	Id              string    `json:"id"`
+	Owner           int       `json:"owner"`
+	Priority        int       `json:"priority"`
+	State           string    `json:"state"`
+	Connected       bool      `json:"connected"`
+	Games           int       `json:"games"`
+	Reviews         int       `json:"reviews"`
+	ReviewBatches   int       `json:"review_batches"`
+	FinishedQueries int       `json:"finished_queries"`
+	PendingResults  int       `json:"pending_results"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// RegisterAdmin agrega los endpoints de admin del server:
+// GET /admin/sessions lista las sesiones de esta instancia,
+// GET /admin/cleanups los clientes terminados que algun nodo no confirmo que
+// borro y POST /admin/clients/{id}/finish termina un cliente como si se hubiera
+// desconectado. Con ?orphan=true avisa ClientsFinished aunque ninguna
+// instancia tenga la sesion, para limpiar clientes que quedaron en los nodos.
+func (s *Server) RegisterAdmin(checks *health.Health) {
+	checks.Handle("GET /admin/sessions", http.HandlerFunc(s.listSessions))
+	checks.Handle("GET /admin/cleanups", http.HandlerFunc(s.listCleanups))
+	checks.Handle("POST /admin/clients/{id}/finish", http.HandlerFunc(s.finishClient))
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	views := []SessionView{}
+	for _, session := range s.sessions.All() {
+		s.sessions.View(session, func(session *Session) {
+			views = append(views, SessionView{
+				Id:              session.Id.String(),
+				Owner:           session.Owner,
+				Priority:        int(session.Priority),
+				State:           session.State.String(),
+				Connected:       session.client != nil,
+				Games:           session.Games,
+				Reviews:         session.Reviews,
+				ReviewBatches:   session.ReviewBatches,
+				FinishedQueries: session.FinishedQueries,
+				PendingResults:  len(session.pending),
+				CreatedAt:       session.CreatedAt,
+				UpdatedAt:       session.UpdatedAt,
+			})
+		})
+	}
+	admin.WriteJSON(w, http.StatusOK, views)
+}
+
+func (s *Server) listCleanups(w http.ResponseWriter, r *http.Request) {
+	admin.WriteJSON(w, http.StatusOK, s.cleanups.All())
+}
+
+func (s *Server) finishClient(w http.ResponseWriter, r *http.Request) {
+	id, err := middleware.ParseClientId(r.PathValue("id"))
+	if err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "invalid client id")
+		return
+	}
+
+	session, ok := s.sessions.Get(id)
+	if !ok {
+		if r.URL.Query().Get("orphan") != "true" {
+			admin.WriteError(w, http.StatusNotFound, "session not owned by this instance")
+			return
+		}
+		log.Infof("action: force_finish | result: success | client_id: %s | orphan: true", id)
+		if err := s.sendClientsFinished(id); err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, map[string]string{"client_id": id.String(), "state": "orphan"})
+		return
+	}
+
+	var client *Client
+	state := ""
+	s.sessions.View(session, func(session *Session) {
+		client = session.client
+		state = session.State.String()
+	})
+
+	log.Infof("action: force_finish | result: success | client_id: %s | state: %s", id, state)
+	if client != nil {
+		// handleDisconnect termina la sesion
+		client.conn.Close()
+	} else {
+		s.finishSession(session)
+	}
+	admin.WriteJSON(w, http.StatusOK, map[string]string{"client_id": id.String(), "state": state})
+}
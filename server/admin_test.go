@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared/health"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminListsSessions(t *testing.T) {
+	server := &Server{sessions: NewSessions(t.TempDir(), 1)}
+	session := server.sessions.Create(middleware.ClientId(42), middleware.PriorityHigh)
+	server.sessions.Update(session, func(session *Session) {
+		session.State = SessionAwaitingResults
+		session.Games = 10
+	})
+
+	checks := health.New()
+	server.RegisterAdmin(checks)
+
+	recorder := httptest.NewRecorder()
+	checks.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/sessions", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	views := []SessionView{}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &views))
+	assert.Len(t, views, 1)
+	assert.Equal(t, "42", views[0].Id)
+	assert.Equal(t, "awaiting_results", views[0].State)
+	assert.Equal(t, 10, views[0].Games)
+	assert.False(t, views[0].Connected)
+}
+
+func TestAdminFinishUnknownClient(t *testing.T) {
+	server := &Server{sessions: NewSessions(t.TempDir(), 1)}
+	checks := health.New()
+	server.RegisterAdmin(checks)
+
+	recorder := httptest.NewRecorder()
+	checks.Handler().ServeHTTP(recorder, httptest.NewRequest("POST", "/admin/clients/7/finish", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	checks.Handler().ServeHTTP(recorder, httptest.NewRequest("POST", "/admin/clients/nope/finish", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
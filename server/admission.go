@@ -0,0 +1,236 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared/metrics"
+)
+
+var (
+	uploadingSessions = metrics.NewGauge("server_uploading_sessions", "Clients currently uploading data.")
+	inFlightBatches   = metrics.NewGauge("server_in_flight_batches", "Review batches published and not yet processed by the mappers.")
+)
+
+// Admission limita cuantos clientes suben datos a la vez y cuantos batches de
+// reviews hay en vuelo (publicados y todavia no procesados por los mappers).
+// Con LimitStats ademas limita los stats de cada cliente que los mappers
+// publicaron y alguna query todavia no consumio, asi las colas de stats no se
+// llenan con un solo cliente mas alla del prefetch que reparte el
+// FairDispatcher. Un limite en 0 es ilimitado.
+type Admission struct {
+	lock        sync.Mutex
+	cond        *sync.Cond
+	maxSessions int
+	maxInFlight int
+	uploading   map[middleware.ClientId]bool
+	inFlight    map[middleware.ClientId]int
+	total       int
+	maxStats    int
+	consumers   map[string]statsConsumer // "<query>.<shard>"
+	published   map[middleware.ClientId]middleware.StatsCounts
+	consumed    map[middleware.ClientId]map[string]int
+}
+
+// statsConsumer es el shard y el genero de los stats que recibe un shard de
+// una query
+type statsConsumer struct {
+	shardId int
+	genre   string
+}
+
+func NewAdmission(maxSessions int, maxInFlight int) *Admission {
+	admission := &Admission{
+		maxSessions: maxSessions,
+		maxInFlight: maxInFlight,
+		uploading:   make(map[middleware.ClientId]bool),
+		inFlight:    make(map[middleware.ClientId]int),
+		consumers:   make(map[string]statsConsumer),
+		published:   make(map[middleware.ClientId]middleware.StatsCounts),
+		consumed:    make(map[middleware.ClientId]map[string]int),
+	}
+	admission.cond = sync.NewCond(&admission.lock)
+	return admission
+}
+
+// LimitStats limita a maxStats los stats sin consumir, repartidos entre los
+// clientes que suben datos. queries son las queries de stats habilitadas,
+// cada una con shards shards.
+func (a *Admission) LimitStats(maxStats int, queries []int, shards int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.maxStats = maxStats
+	for _, queryId := range queries {
+		for shardId := range shards {
+			a.consumers[consumerKey(queryId, shardId)] = statsConsumer{shardId: shardId, genre: middleware.StatsQueries[queryId]}
+		}
+	}
+}
+
+func consumerKey(queryId int, shardId int) string {
+	return strconv.Itoa(queryId) + "." + strconv.Itoa(shardId)
+}
+
+// Admit registra un cliente que empieza a subir datos, devuelve false si ya
+// hay maxSessions subiendo
+func (a *Admission) Admit(id middleware.ClientId) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.busy() {
+		return false
+	}
+	a.uploading[id] = true
+	a.report()
+	return true
+}
+
+// AdmitNext es Admit para un cliente nuevo. El id se pide con next recien
+// cuando hay lugar, asi cada Busy no gasta un id.
+func (a *Admission) AdmitNext(next func() middleware.ClientId) (middleware.ClientId, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.busy() {
+		return 0, false
+	}
+	id := next()
+	a.uploading[id] = true
+	a.report()
+	return id, true
+}
+
+func (a *Admission) busy() bool {
+	return a.maxSessions > 0 && len(a.uploading) >= a.maxSessions
+}
+
+// Leave libera el lugar del cliente cuando termina de subir, sus batches en
+// vuelo se siguen contando hasta que se procesen
+func (a *Admission) Leave(id middleware.ClientId) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.uploading, id)
+	delete(a.published, id)
+	delete(a.consumed, id)
+	a.report()
+	a.cond.Broadcast()
+}
+
+// AcquireBatch bloquea hasta que haya lugar para otro batch en vuelo. Cada
+// cliente que sube datos puede tener a lo sumo su parte del limite, asi la
+// cola de reviews no se llena con un solo cliente y los consumidores tienen
+// batches de todos para repartir. Si el cliente se olvida mientras espera
+// devuelve false.
+func (a *Admission) AcquireBatch(id middleware.ClientId) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for a.uploading[id] && a.full(id) {
+		a.cond.Wait()
+	}
+	if !a.uploading[id] {
+		return false
+	}
+
+	a.inFlight[id]++
+	a.total++
+	a.report()
+	return true
+}
+
+// report actualiza las metricas, se llama con el lock tomado
+func (a *Admission) report() {
+	uploadingSessions.With().Set(float64(len(a.uploading)))
+	inFlightBatches.With().Set(float64(a.total))
+}
+
+func (a *Admission) full(id middleware.ClientId) bool {
+	if a.maxStats > 0 && a.outstanding(id) >= max(a.maxStats/max(len(a.uploading), 1), 1) {
+		return true
+	}
+	if a.maxInFlight <= 0 {
+		return false
+	}
+	share := max(a.maxInFlight/max(len(a.uploading), 1), 1)
+	return a.total >= a.maxInFlight || a.inFlight[id] >= share
+}
+
+// outstanding devuelve cuantos stats del cliente le faltan consumir a la
+// query mas atrasada, con el lock tomado
+func (a *Admission) outstanding(id middleware.ClientId) int {
+	outstanding := 0
+	for key, consumer := range a.consumers {
+		pending := a.published[id].Get(consumer.shardId, consumer.genre) - a.consumed[id][key]
+		outstanding = max(outstanding, pending)
+	}
+	return outstanding
+}
+
+// PublishedStats suma los stats que publico un mapper para un batch del
+// cliente
+func (a *Admission) PublishedStats(id middleware.ClientId, counts middleware.StatsCounts) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !a.uploading[id] {
+		return
+	}
+	if a.published[id] == nil {
+		a.published[id] = middleware.StatsCounts{}
+	}
+	a.published[id].Merge(counts)
+}
+
+// ConsumedStats registra cuantos stats del cliente recibio un shard de una
+// query. Es un acumulado, un reporte viejo que llega tarde no lo baja.
+func (a *Admission) ConsumedStats(id middleware.ClientId, queryId int, shardId int, received int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !a.uploading[id] {
+		return
+	}
+	if a.consumed[id] == nil {
+		a.consumed[id] = make(map[string]int)
+	}
+	key := consumerKey(queryId, shardId)
+	if received > a.consumed[id][key] {
+		a.consumed[id][key] = received
+		a.cond.Broadcast()
+	}
+}
+
+// ReleaseBatch se llama cuando un mapper termino de procesar un batch
+func (a *Admission) ReleaseBatch(id middleware.ClientId) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// puede ser un batch de antes de un reinicio o de una sesion tomada de
+	// otra instancia, que nunca se contaron
+	if a.inFlight[id] == 0 {
+		return
+	}
+	a.inFlight[id]--
+	a.total--
+	if a.inFlight[id] == 0 {
+		delete(a.inFlight, id)
+	}
+	a.report()
+	a.cond.Broadcast()
+}
+
+// Forget libera todo lo del cliente, sus batches en vuelo no se van a procesar
+func (a *Admission) Forget(id middleware.ClientId) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.uploading, id)
+	a.total -= a.inFlight[id]
+	delete(a.inFlight, id)
+	delete(a.published, id)
+	delete(a.consumed, id)
+	a.report()
+	a.cond.Broadcast()
+}
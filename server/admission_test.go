@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"tp1-distribuidos/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmissionLimitsSessions(t *testing.T) {
+	admission := NewAdmission(2, 0)
+
+	assert.True(t, admission.Admit(1))
+	assert.True(t, admission.Admit(2))
+	assert.False(t, admission.Admit(3))
+
+	admission.Leave(1)
+	assert.True(t, admission.Admit(3))
+}
+
+func TestAdmissionBusyDoesNotSpendIds(t *testing.T) {
+	admission := NewAdmission(1, 0)
+	next := middleware.ClientId(0)
+	allocate := func() middleware.ClientId {
+		next++
+		return next
+	}
+
+	id, ok := admission.AdmitNext(allocate)
+	assert.True(t, ok)
+	assert.Equal(t, middleware.ClientId(1), id)
+
+	_, ok = admission.AdmitNext(allocate)
+	assert.False(t, ok)
+
+	admission.Leave(1)
+	id, ok = admission.AdmitNext(allocate)
+	assert.True(t, ok)
+	assert.Equal(t, middleware.ClientId(2), id)
+}
+
+func TestAdmissionBlocksBatchesUntilProcessed(t *testing.T) {
+	admission := NewAdmission(0, 4)
+	admission.Admit(1)
+	admission.Admit(2)
+
+	// con dos clientes subiendo a cada uno le tocan 2
+	assert.True(t, admission.AcquireBatch(1))
+	assert.True(t, admission.AcquireBatch(1))
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- admission.AcquireBatch(1)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquired a batch over the client share")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	admission.ReleaseBatch(1)
+	assert.True(t, <-acquired)
+
+	assert.True(t, admission.AcquireBatch(2))
+	assert.True(t, admission.AcquireBatch(2))
+
+	// un batch que no se conto no libera lugar
+	admission.ReleaseBatch(3)
+	go func() {
+		acquired <- admission.AcquireBatch(2)
+	}()
+
+	// olvidar al cliente que espera lo destraba sin contar el batch
+	admission.Forget(2)
+	assert.False(t, <-acquired)
+}
+
+func TestAdmissionShareGrowsWhenClientsLeave(t *testing.T) {
+	admission := NewAdmission(0, 4)
+	admission.Admit(1)
+	admission.Admit(2)
+
+	assert.True(t, admission.AcquireBatch(1))
+	assert.True(t, admission.AcquireBatch(1))
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- admission.AcquireBatch(1)
+	}()
+
+	admission.Leave(2)
+	assert.True(t, <-acquired)
+}
+
+func TestAdmissionBlocksUntilQueriesConsumeStats(t *testing.T) {
+	admission := NewAdmission(0, 0)
+	admission.LimitStats(10, []int{3, 4}, 2)
+	admission.Admit(1)
+
+	assert.True(t, admission.AcquireBatch(1))
+	admission.PublishedStats(1, middleware.StatsCounts{"0.Indie": 8, "1.Action": 12})
+	admission.ReleaseBatch(1)
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- admission.AcquireBatch(1)
+	}()
+
+	// a la query 4 del shard 1 todavia le faltan 10
+	admission.ConsumedStats(1, 4, 1, 2)
+	select {
+	case <-acquired:
+		t.Fatal("acquired a batch over the stats limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// un reporte viejo no baja lo consumido
+	admission.ConsumedStats(1, 4, 1, 1)
+	admission.ConsumedStats(1, 4, 1, 12)
+	assert.True(t, <-acquired)
+}
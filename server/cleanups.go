@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/metrics"
+)
+
+var (
+	pendingCleanups = metrics.NewGauge("server_pending_cleanups", "Finished clients waiting for CleanupDone from some node.")
+	cleanupRetries  = metrics.NewCounter("server_cleanup_retries_total", "ClientsFinished resent to a node that did not confirm.", "node")
+	cleanupAlerts   = metrics.NewCounter("server_cleanup_alerts_total", "Clients given up after the max retries, per node that never confirmed.", "node")
+)
+
+// Cleanups coordina el borrado de los clientes que termina esta instancia.
+// Cada ClientsFinished queda pendiente en <dir>/cleanups/<instancia>/<id>.bin,
+// con los indices de los nodos que ya mandaron CleanupDone, hasta que
+// confirman todos los nodos de la topologia. A los que no contestan se les
+// reenvia el ClientsFinished con su routing key cada retryInterval y despues
+// de maxRetries se alerta y se deja de esperar.
+type Cleanups struct {
+	dir           string
+	instance      int
+	nodes         []string
+	index         map[string]int
+	retryInterval time.Duration
+	maxRetries    int
+	send          func(clientId middleware.ClientId, node string) error
+	lock          sync.Mutex
+	pending       map[middleware.ClientId]*Cleanup
+}
+
+type Cleanup struct {
+	ClientId  middleware.ClientId
+	StartedAt time.Time
+	Retries   int
+	lastSent  time.Time
+	confirmed *shared.Processed
+}
+
+// NewCleanups carga los borrados pendientes de la instancia. send reenvia el
+// ClientsFinished a un nodo.
+func NewCleanups(dir string, instance int, nodes []string, retryInterval time.Duration, maxRetries int, send func(clientId middleware.ClientId, node string) error) *Cleanups {
+	if retryInterval <= 0 {
+		retryInterval = shared.CLEANUP_DEFAULT_RETRY_INTERVAL
+	}
+	if maxRetries <= 0 {
+		maxRetries = shared.CLEANUP_DEFAULT_MAX_RETRIES
+	}
+
+	index := make(map[string]int, len(nodes))
+	for i, node := range nodes {
+		index[node] = i
+	}
+
+	cleanups := &Cleanups{
+		dir:           dir + "/cleanups",
+		instance:      instance,
+		nodes:         nodes,
+		index:         index,
+		retryInterval: retryInterval,
+		maxRetries:    maxRetries,
+		send:          send,
+		pending:       make(map[middleware.ClientId]*Cleanup),
+	}
+	os.MkdirAll(cleanups.instanceDir(instance), 0777)
+	cleanups.load(instance)
+
+	return cleanups
+}
+
+func (c *Cleanups) instanceDir(instance int) string {
+	return fmt.Sprintf("%s/%d", c.dir, instance)
+}
+
+func (c *Cleanups) path(instance int, clientId middleware.ClientId) string {
+	return fmt.Sprintf("%s/%s.bin", c.instanceDir(instance), clientId)
+}
+
+// load lee los pendientes de una instancia. Los de otra instancia se mueven al
+// directorio de esta, asi sobreviven a un reinicio.
+func (c *Cleanups) load(instance int) {
+	dentries, err := os.ReadDir(c.instanceDir(instance))
+	if err != nil {
+		return
+	}
+
+	for _, dentry := range dentries {
+		clientId, err := middleware.ParseClientId(strings.TrimSuffix(dentry.Name(), ".bin"))
+		if err != nil {
+			continue
+		}
+
+		path := c.path(instance, clientId)
+		if instance != c.instance {
+			if err := os.Rename(path, c.path(c.instance, clientId)); err != nil {
+				log.Errorf("action: claim_cleanup | result: fail | client_id: %s | error: %s", clientId, err)
+				continue
+			}
+			path = c.path(c.instance, clientId)
+		}
+
+		startedAt := time.Now()
+		if info, err := dentry.Info(); err == nil {
+			startedAt = info.ModTime()
+		}
+		c.pending[clientId] = &Cleanup{ClientId: clientId, StartedAt: startedAt, confirmed: shared.NewProcessed(path)}
+	}
+	pendingCleanups.With().Set(float64(len(c.pending)))
+}
+
+// Claim toma los borrados pendientes de una instancia caida, sus CleanupDone
+// llegan a la cola que ahora consume esta
+func (c *Cleanups) Claim(instance int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.load(instance)
+}
+
+// Start registra el ClientsFinished de un cliente. Si ya estaba pendiente se
+// vuelve a esperar a los nodos que faltan.
+func (c *Cleanups) Start(clientId middleware.ClientId) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if cleanup, ok := c.pending[clientId]; ok {
+		cleanup.lastSent = time.Now()
+		return
+	}
+
+	now := time.Now()
+	c.pending[clientId] = &Cleanup{
+		ClientId:  clientId,
+		StartedAt: now,
+		lastSent:  now,
+		confirmed: shared.NewProcessed(c.path(c.instance, clientId)),
+	}
+	pendingCleanups.With().Set(float64(len(c.pending)))
+}
+
+// Confirm registra el CleanupDone de un nodo. Devuelve false si el nodo no es
+// parte de la topologia.
+func (c *Cleanups) Confirm(clientId middleware.ClientId, node string) bool {
+	index, known := c.index[node]
+	if !known {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cleanup, ok := c.pending[clientId]
+	if !ok {
+		return true
+	}
+
+	cleanup.confirmed.Add(int64(index))
+	if cleanup.confirmed.Count() >= len(c.nodes) {
+		log.Infof("action: cleanup | result: success | client_id: %s | retries: %d | duration: %s", clientId, cleanup.Retries, time.Since(cleanup.StartedAt).Round(time.Millisecond))
+		c.remove(cleanup)
+	}
+	return true
+}
+
+// Pending indica si falta que algun nodo confirme el borrado del cliente
+func (c *Cleanups) Pending(clientId middleware.ClientId) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.pending[clientId]
+	return ok
+}
+
+func (c *Cleanups) remove(cleanup *Cleanup) {
+	delete(c.pending, cleanup.ClientId)
+	cleanup.confirmed.Close()
+	os.Remove(c.path(c.instance, cleanup.ClientId))
+	pendingCleanups.With().Set(float64(len(c.pending)))
+}
+
+// missing devuelve los nodos que no confirmaron, con el lock tomado
+func (c *Cleanups) missing(cleanup *Cleanup) []string {
+	missing := []string{}
+	for i, node := range c.nodes {
+		if !cleanup.confirmed.Data()[int64(i)] {
+			missing = append(missing, node)
+		}
+	}
+	return missing
+}
+
+// Run revisa los pendientes cada retryInterval
+func (c *Cleanups) Run() {
+	ticker := time.NewTicker(c.retryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.Retry(time.Now())
+	}
+}
+
+// Retry reenvia el ClientsFinished a los nodos que no confirmaron despues de
+// retryInterval. Los clientes que llegaron a maxRetries se alertan y se dejan
+// de esperar.
+func (c *Cleanups) Retry(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, cleanup := range c.pending {
+		if now.Sub(cleanup.lastSent) < c.retryInterval {
+			continue
+		}
+
+		missing := c.missing(cleanup)
+		if cleanup.Retries >= c.maxRetries {
+			log.Errorf("action: cleanup | result: fail | client_id: %s | retries: %d | missing: %s", cleanup.ClientId, cleanup.Retries, strings.Join(missing, ","))
+			for _, node := range missing {
+				cleanupAlerts.With(node).Inc()
+			}
+			c.remove(cleanup)
+			continue
+		}
+
+		cleanup.Retries++
+		cleanup.lastSent = now
+		for _, node := range missing {
+			log.Warningf("action: cleanup_retry | result: in_progress | client_id: %s | node: %s | retry: %d", cleanup.ClientId, node, cleanup.Retries)
+			cleanupRetries.With(node).Inc()
+			if err := c.send(cleanup.ClientId, node); err != nil {
+				log.Errorf("action: cleanup_retry | result: fail | client_id: %s | node: %s | error: %s", cleanup.ClientId, node, err)
+			}
+		}
+	}
+}
+
+// CleanupView es un borrado pendiente como lo devuelve /admin/cleanups
+type CleanupView struct {
+	ClientId  string    `json:"client_id"`
+	StartedAt time.Time `json:"started_at"`
+	Retries   int       `json:"retries"`
+	Missing   []string  `json:"missing"`
+}
+
+func (c *Cleanups) All() []CleanupView {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	views := make([]CleanupView, 0, len(c.pending))
+	for _, cleanup := range c.pending {
+		views = append(views, CleanupView{
+			ClientId:  cleanup.ClientId.String(),
+			StartedAt: cleanup.StartedAt,
+			Retries:   cleanup.Retries,
+			Missing:   c.missing(cleanup),
+		})
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].StartedAt.Before(views[j].StartedAt) })
+	return views
+}
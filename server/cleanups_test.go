@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"tp1-distribuidos/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type resent struct {
+	clientId middleware.ClientId
+	node     string
+}
+
+func newTestCleanups(dir string, instance int, sent *[]resent) *Cleanups {
+	return NewCleanups(dir, instance, []string{"finished-mapper-games.1", "finished-1.0", "finished-reducer-1"}, time.Second, 2, func(clientId middleware.ClientId, node string) error {
+		*sent = append(*sent, resent{clientId, node})
+		return nil
+	})
+}
+
+func TestCleanupFinishesWhenEveryNodeConfirms(t *testing.T) {
+	sent := []resent{}
+	cleanups := newTestCleanups(t.TempDir(), 1, &sent)
+	cleanups.Start(42)
+
+	assert.True(t, cleanups.Confirm(42, "finished-1.0"))
+	assert.True(t, cleanups.Confirm(42, "finished-1.0"))
+	assert.True(t, cleanups.Confirm(42, "finished-mapper-games.1"))
+	assert.True(t, cleanups.Pending(42))
+
+	assert.False(t, cleanups.Confirm(42, "finished-9.9"))
+	assert.True(t, cleanups.Pending(42))
+
+	assert.True(t, cleanups.Confirm(42, "finished-reducer-1"))
+	assert.False(t, cleanups.Pending(42))
+	assert.Empty(t, cleanups.All())
+}
+
+func TestCleanupRetriesMissingNodesAndGivesUp(t *testing.T) {
+	sent := []resent{}
+	cleanups := newTestCleanups(t.TempDir(), 1, &sent)
+	cleanups.Start(42)
+	cleanups.Confirm(42, "finished-1.0")
+
+	now := time.Now()
+	cleanups.Retry(now)
+	assert.Empty(t, sent)
+
+	cleanups.Retry(now.Add(time.Second))
+	assert.Equal(t, []resent{{42, "finished-mapper-games.1"}, {42, "finished-reducer-1"}}, sent)
+
+	cleanups.Confirm(42, "finished-reducer-1")
+	cleanups.Retry(now.Add(2 * time.Second))
+	assert.Equal(t, resent{42, "finished-mapper-games.1"}, sent[len(sent)-1])
+	assert.Len(t, sent, 3)
+
+	views := cleanups.All()
+	assert.Len(t, views, 1)
+	assert.Equal(t, 2, views[0].Retries)
+	assert.Equal(t, []string{"finished-mapper-games.1"}, views[0].Missing)
+
+	cleanups.Retry(now.Add(3 * time.Second))
+	assert.Len(t, sent, 3)
+	assert.False(t, cleanups.Pending(42))
+}
+
+func TestCleanupsSurviveRestartAndTakeover(t *testing.T) {
+	dir := t.TempDir()
+	sent := []resent{}
+	crashed := newTestCleanups(dir, 1, &sent)
+	crashed.Start(42)
+	crashed.Confirm(42, "finished-1.0")
+
+	restarted := newTestCleanups(dir, 1, &sent)
+	assert.True(t, restarted.Pending(42))
+	assert.Equal(t, []string{"finished-mapper-games.1", "finished-reducer-1"}, restarted.All()[0].Missing)
+
+	other := newTestCleanups(dir, 2, &sent)
+	assert.False(t, other.Pending(42))
+	other.Claim(1)
+	assert.True(t, other.Pending(42))
+
+	other.Confirm(42, "finished-mapper-games.1")
+	other.Confirm(42, "finished-reducer-1")
+	assert.False(t, other.Pending(42))
+	assert.False(t, newTestCleanups(dir, 2, &sent).Pending(42))
+}
@@ -1,17 +1,19 @@
 package main
 
 import (
-	"context"
 	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
+	"time"
 	"tp1-distribuidos/config"
 	"tp1-distribuidos/shared"
-
-	"github.com/op/go-logging"
+	"tp1-distribuidos/shared/admin"
+	"tp1-distribuidos/shared/health"
+	"tp1-distribuidos/shared/lifecycle"
+	"tp1-distribuidos/shared/logs"
+	"tp1-distribuidos/shared/tracing"
 )
 
-var log = logging.MustGetLogger("log")
+var log = logs.Get("server")
 
 func main() {
 	os.Mkdir("./database", 0666)
@@ -20,7 +22,8 @@ func main() {
 		log.Criticalf("%s", err)
 	}
 
-	if err := shared.InitLogger(config.Log.Level); err != nil {
+	name := "server-" + strconv.Itoa(config.Server.Instance)
+	if err := logs.Init(logs.Options{Node: name, Level: config.Log.Level, Format: config.Log.Format, Modules: config.Log.Modules}); err != nil {
 		log.Criticalf("%s", err)
 	}
 
@@ -30,18 +33,30 @@ func main() {
 		log.Criticalf("Error creating server: %s", err)
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGKILL)
-	defer stop()
-
-	go func() {
-		<-ctx.Done()
-		log.Info("action: cerrar_servidor | result: in_progress")
-		server.Close()
-	}()
+	node := lifecycle.New(name, time.Duration(config.Lifecycle.DrainTimeout)*time.Second)
+	if err := tracing.Init(name, config.Tracing.Exporter, config.Tracing.Endpoint); err != nil {
+		log.Errorf("action: init_tracing | result: fail | error: %s", err)
+	}
+	node.OnClose("tracing", tracing.Shutdown)
+	node.OnDrain("stop accepting", server.Drain)
+	node.OnClose("middleware", server.Close)
+	node.Notify()
+
+	// el server no chequea el progreso de los consumidores, las respuestas de
+	// sesiones sin cliente quedan sin ackear hasta el Resume
+	checks := health.New()
+	checks.Liveness("broker", server.middleware.Connected)
+	checks.Liveness("disk", health.Writable("./database"))
+	checks.Liveness("sessions", health.Writable(server.sessions.dir))
+	checks.Readiness("lifecycle", node.Check)
+	checks.Handle("GET /admin/state", admin.StateHandler(name, "./database"))
+	server.RegisterAdmin(checks)
+	go checks.ListenAndServe(config.Health.Port)
 
 	go shared.RunUDPListener(8080)
 
-	server.Run()
+	status := node.Run(server.Run)
 
-	log.Info("action: cerrar_servidor | result: success")
+	log.Infof("action: cerrar_servidor | result: success | status: %d", status)
+	os.Exit(status)
 }
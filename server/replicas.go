@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const HEARTBEAT_INTERVAL = 1 * time.Second
+const HEARTBEAT_TIMEOUT = 10 * time.Second
+
+// Replicas coordina las instancias del server a traves del directorio de
+// sesiones compartido. Cada instancia escribe su heartbeat en
+// <dir>/replicas/<instancia>.heartbeat y la que detecta uno vencido crea
+// <dir>/replicas/<instancia>.takeover (con O_EXCL, solo una gana) y se queda
+// con sus sesiones.
+type Replicas struct {
+	dir      string
+	instance int
+}
+
+func NewReplicas(dir string, instance int) *Replicas {
+	replicas := &Replicas{dir: dir + "/replicas", instance: instance}
+	os.MkdirAll(replicas.dir, 0777)
+
+	replicas.Heartbeat()
+	// si otra instancia se quedo con las sesiones mientras estabamos caidos ya
+	// las movio, se borra la marca para que nos puedan volver a tomar
+	os.Remove(replicas.takeoverPath(instance))
+
+	return replicas
+}
+
+func (r *Replicas) heartbeatPath(instance int) string {
+	return fmt.Sprintf("%s/%d.heartbeat", r.dir, instance)
+}
+
+func (r *Replicas) takeoverPath(instance int) string {
+	return fmt.Sprintf("%s/%d.takeover", r.dir, instance)
+}
+
+// Heartbeat escribe el timestamp actual en un temporal y lo renombra
+func (r *Replicas) Heartbeat() {
+	tmpFile, err := os.CreateTemp(r.dir, "heartbeat-*")
+	if err != nil {
+		log.Errorf("action: heartbeat | result: fail | error: %s", err)
+		return
+	}
+	defer tmpFile.Close()
+
+	if _, err := tmpFile.WriteString(strconv.FormatInt(time.Now().UnixNano(), 10)); err != nil {
+		log.Errorf("action: heartbeat | result: fail | error: %s", err)
+		return
+	}
+
+	if err := os.Rename(tmpFile.Name(), r.heartbeatPath(r.instance)); err != nil {
+		log.Errorf("action: heartbeat | result: fail | error: %s", err)
+	}
+}
+
+func (r *Replicas) Alive(instance int) bool {
+	data, err := os.ReadFile(r.heartbeatPath(instance))
+	if err != nil {
+		return false
+	}
+
+	timestamp, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return time.Since(time.Unix(0, timestamp)) < HEARTBEAT_TIMEOUT
+}
+
+// Dead devuelve las instancias con el heartbeat vencido que nadie tomo todavia
+func (r *Replicas) Dead() []int {
+	dentries, err := os.ReadDir(r.dir)
+	if err != nil {
+		log.Errorf("action: check_replicas | result: fail | error: %s", err)
+		return nil
+	}
+
+	dead := []int{}
+	for _, dentry := range dentries {
+		name, ok := strings.CutSuffix(dentry.Name(), ".heartbeat")
+		if !ok {
+			continue
+		}
+
+		instance, err := strconv.Atoi(name)
+		if err != nil || instance == r.instance || r.Alive(instance) {
+			continue
+		}
+
+		if _, err := os.Stat(r.takeoverPath(instance)); err == nil {
+			continue
+		}
+
+		dead = append(dead, instance)
+	}
+
+	return dead
+}
+
+// Claim marca que esta instancia se queda con las sesiones de otra. Devuelve
+// false si otra instancia la tomo primero o si revivio mientras tanto.
+func (r *Replicas) Claim(instance int) bool {
+	file, err := os.OpenFile(r.takeoverPath(instance), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0777)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	if r.Alive(instance) {
+		os.Remove(r.takeoverPath(instance))
+		return false
+	}
+
+	file.WriteString(strconv.Itoa(r.instance))
+	return true
+}
+
+// Claimed devuelve las instancias que esta instancia tomo, para volver a
+// consumir sus respuestas despues de un reinicio
+func (r *Replicas) Claimed() []int {
+	dentries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil
+	}
+
+	claimed := []int{}
+	for _, dentry := range dentries {
+		name, ok := strings.CutSuffix(dentry.Name(), ".takeover")
+		if !ok {
+			continue
+		}
+
+		instance, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+
+		owner, err := os.ReadFile(r.takeoverPath(instance))
+		if err == nil && string(owner) == strconv.Itoa(r.instance) {
+			claimed = append(claimed, instance)
+		}
+	}
+
+	return claimed
+}
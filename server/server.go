@@ -4,25 +4,52 @@ import (
 	"encoding/csv"
 	"errors"
 	"net"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"tp1-distribuidos/config"
 	"tp1-distribuidos/middleware"
 	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/logs"
 	"tp1-distribuidos/shared/protocol"
+	"tp1-distribuidos/shared/tracing"
 )
 
+const DEFAULT_SESSIONS_DIR = "database/sessions"
+
+// un batch de reviews que no se puede publicar se reintenta, esperando
+// REVIEW_BATCH_BACKOFF por intento, antes de cancelar la sesion
+const REVIEW_BATCH_ATTEMPTS = 3
+const REVIEW_BATCH_BACKOFF = 100 * time.Millisecond
+
 type Server struct {
-	serverSocket      *net.TCPListener
-	middleware        *middleware.Middleware
-	config            *config.Config
-	clients           []*Client
-	processedRespones map[int64]bool
-	clientsReceived   *shared.Processed
+	serverSocket    *net.TCPListener
+	middleware      *middleware.Middleware
+	config          *config.Config
+	instance        int
+	sessions        *Sessions
+	replicas        *Replicas
+	admission       *Admission
+	clientsReceived *shared.Processed // clientes aceptados por esta instancia
+	clientsDone     *shared.Processed // de esos, los que ya se terminaron
+	clientsLock     sync.Mutex
+	clientIds       *shared.ClientIdAllocator
+	cleanups        *Cleanups
+	consumers       sync.WaitGroup
 }
 
 func NewServer(config *config.Config) (*Server, error) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", config.Server.Address)
+	// todas las instancias comparten el nombre del address, cada una escucha
+	// en su propia ip
+	_, port, err := net.SplitHostPort(config.Server.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", ":"+port)
 	if err != nil {
 		return nil, err
 	}
@@ -32,56 +59,313 @@ func NewServer(config *config.Config) (*Server, error) {
 		return nil, err
 	}
 
+	os.MkdirAll("database", 0777)
+	clientIds, err := shared.NewClientIdAllocator("database/client-id-epoch.bin", config.Server.Instance)
+	if err != nil {
+		return nil, err
+	}
+
 	middleware, err := middleware.NewMiddleware(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Server{
-		serverSocket:      serverSocket,
-		middleware:        middleware,
-		config:            config,
-		clients:           make([]*Client, 0),
-		processedRespones: make(map[int64]bool),
-		clientsReceived:   shared.NewProcessed("database/clients_received.bin"),
-	}, nil
+	sessionsDir := config.Server.SessionsDir
+	if sessionsDir == "" {
+		sessionsDir = DEFAULT_SESSIONS_DIR
+	}
+
+	server := &Server{
+		serverSocket:    serverSocket,
+		middleware:      middleware,
+		config:          config,
+		instance:        config.Server.Instance,
+		sessions:        NewSessions(sessionsDir, config.Server.Instance),
+		replicas:        NewReplicas(sessionsDir, config.Server.Instance),
+		admission:       NewAdmission(config.Server.MaxSessions, config.Server.MaxInFlightBatches),
+		clientsReceived: shared.NewProcessed("database/clients_received.bin"),
+		clientsDone:     shared.NewProcessed("database/clients_done.bin"),
+		clientIds:       clientIds,
+	}
+	retryInterval := time.Duration(config.Cleanup.RetryInterval) * time.Second
+	server.admission.LimitStats(config.Server.MaxOutstandingStats, statsQueries(config), config.Sharding.Amount)
+	server.cleanups = NewCleanups(sessionsDir, config.Server.Instance, shared.CleanupNodes(config), retryInterval, config.Cleanup.MaxRetries, server.resendClientsFinished)
+
+	return server, nil
 }
 
-func (s *Server) Close() {
-	s.middleware.Close()
+// Drain deja de aceptar clientes y de consumir respuestas. Los clientes
+// conectados pierden la conexion y vuelven con Resume a otra replica.
+func (s *Server) Drain() error {
 	s.serverSocket.Close()
+	return s.middleware.StopConsuming()
 }
 
-func (s *Server) Run() {
-	defer s.Close()
+func (s *Server) Close() error {
+	return s.middleware.Close()
+}
 
-	s.finishLostClients()
+func (s *Server) Run() {
+	s.restoreSessions()
 
-	go s.handleResponses()
-	go s.consumeReviewsProcessed()
+	s.consumeInstance(s.instance)
+	for _, instance := range s.replicas.Claimed() {
+		s.consumeInstance(instance)
+	}
+	go s.monitorReplicas()
+	go s.cleanups.Run()
+	if s.config.Janitor.TTL > 0 {
+		go s.expireSessions()
+	}
 
 	for {
-		client, err := s.acceptNewConnection()
+		conn, err := s.acceptNewConnection()
 		if err != nil {
 			log.Errorf("action: accept_connections | result: fail | error: %s", err)
-			return
+			break
 		}
 
-		go client.handleConnection()
-		go client.handleGames()
-		go client.handleReviews()
+		go s.handleHandshake(conn)
 	}
 
+	// las respuestas que se estan mandando terminan antes de cerrar el canal
+	s.consumers.Wait()
 }
 
-func (s *Server) finishLostClients() {
+// restoreSessions termina los clientes que estaban subiendo datos cuando se
+// cayo el servidor (no hay forma de saber que llego) y deja vivas las sesiones
+// que esperaban resultados hasta que el cliente haga Resume
+//
+// Los clientes aceptados que no tienen sesion ni se terminaron se perdieron
+// antes de guardar la sesion y se terminan aca. Despues solo se guardan los
+// que siguen con sesion, los demas ya los sigue Cleanups.
+func (s *Server) restoreSessions() {
+	s.restore(s.sessions.All())
+
 	for client := range s.clientsReceived.Data() {
+		if s.clientsDone.Data()[client] {
+			continue
+		}
+		// puede seguir viva en otra instancia que la tomo
+		if _, ok := s.sessions.Owner(middleware.ClientId(client)); ok {
+			continue
+		}
 		log.Infof("action: finish_lost_clients | client: %d", client)
-		s.middleware.SendClientsFinished(int(client))
+		s.sendClientsFinished(middleware.ClientId(client))
+	}
+
+	err := s.clientsReceived.Retain(func(client int64) bool {
+		_, ok := s.sessions.Owner(middleware.ClientId(client))
+		return ok
+	})
+	if err == nil {
+		err = s.clientsDone.Retain(func(int64) bool { return false })
+	}
+	if err != nil {
+		log.Errorf("action: compact_clients_received | result: fail | error: %s", err)
+	}
+}
+
+// clientDone marca que el cliente se termino, su borrado queda en Cleanups y
+// no hace falta volver a terminarlo al reiniciar
+func (s *Server) clientDone(clientId middleware.ClientId) {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	s.clientsDone.Add(int64(clientId))
+}
+
+func (s *Server) restore(sessions []*Session) {
+	for _, session := range sessions {
+		if session.State == SessionCancelling {
+			// los nodos que no confirmaron los sigue Cleanups
+			log.Infof("action: restore_session | result: success | client_id: %s | state: %s", session.Id, session.State)
+			s.checkCancelled(session)
+			continue
+		}
+		if session.State != SessionAwaitingResults {
+			s.finishSession(session)
+			continue
+		}
+
+		log.Infof("action: restore_session | result: success | client_id: %s | state: %s", session.Id, session.State)
+		s.checkReviewsFinished(session)
+	}
+}
+
+// monitorReplicas mantiene el heartbeat de esta instancia y se queda con las
+// sesiones y la cola de respuestas de las instancias que se caen. Sus
+// clientes vuelven con Resume y el balanceo los termina trayendo aca.
+func (s *Server) monitorReplicas() {
+	ticker := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.replicas.Heartbeat()
+
+		for _, instance := range s.replicas.Dead() {
+			if !s.replicas.Claim(instance) {
+				continue
+			}
+
+			log.Infof("action: takeover | result: in_progress | instance: %d", instance)
+			s.restore(s.sessions.Claim(instance))
+			s.cleanups.Claim(instance)
+			s.consumeInstance(instance)
+			log.Infof("action: takeover | result: success | instance: %d", instance)
+		}
+	}
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	return time.Duration(s.config.Server.IdleTimeout) * time.Second
+}
+
+// expireSessions termina las sesiones que esperan un Resume hace mas de
+// janitor.ttl, el cliente no va a volver
+func (s *Server) expireSessions() {
+	ttl := time.Duration(s.config.Janitor.TTL) * time.Second
+	interval := time.Duration(s.config.Janitor.Interval) * time.Second
+	if interval <= 0 {
+		interval = shared.JANITOR_DEFAULT_INTERVAL
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, session := range s.sessions.All() {
+			expired := false
+			s.sessions.View(session, func(session *Session) {
+				expired = session.client == nil && time.Since(session.UpdatedAt) > ttl
+			})
+			if expired {
+				log.Infof("action: expire_session | result: success | client_id: %s | updated_at: %s", session.Id, session.UpdatedAt.Format(time.RFC3339))
+				s.finishSession(session)
+			}
+		}
+	}
+}
+
+// statsQueries son las queries habilitadas que consumen stats
+func statsQueries(config *config.Config) []int {
+	queries := []int{}
+	enabled := map[int]bool{3: config.Query.Query3, 4: config.Query.Query4, 5: config.Query.Query5}
+	for queryId := range middleware.StatsQueries {
+		if enabled[queryId] {
+			queries = append(queries, queryId)
+		}
+	}
+	return queries
+}
+
+// consumeInstance consume las colas ruteadas a una instancia del server
+func (s *Server) consumeInstance(instance int) {
+	s.consumers.Add(4)
+	go func() {
+		defer s.consumers.Done()
+		s.handleResponses(instance)
+	}()
+	go func() {
+		defer s.consumers.Done()
+		s.consumeReviewsProcessed(instance)
+	}()
+	go func() {
+		defer s.consumers.Done()
+		s.consumeCleanupDone(instance)
+	}()
+	go func() {
+		defer s.consumers.Done()
+		s.consumeStatsConsumed(instance)
+	}()
+}
+
+func (s *Server) finishSession(session *Session) {
+	log.Infof("action: finish_session | client_id: %s | state: %s", session.Id, session.State)
+	s.admission.Forget(session.Id)
+	s.sendClientsFinished(session.Id)
+	s.sessions.Remove(session)
+	s.clientDone(session.Id)
+}
+
+// sendClientsFinished avisa a todos los nodos que borren el estado del cliente
+// y espera sus CleanupDone. Se registra antes de publicar, asi si el server se
+// cae en el medio Cleanups lo reenvia.
+func (s *Server) sendClientsFinished(clientId middleware.ClientId) error {
+	s.cleanups.Start(clientId)
+	return s.middleware.SendClientsFinished(clientId, s.instance)
+}
+
+// resendClientsFinished es el reintento de Cleanups para un nodo que no
+// confirmo
+func (s *Server) resendClientsFinished(clientId middleware.ClientId, node string) error {
+	return s.middleware.SendClientsFinishedTo(clientId, s.instance, node)
+}
+
+// cancelSession termina la sesion a pedido del cliente. La sesion queda en
+// SessionCancelling hasta que todos los nodos confirman que borraron el estado
+// del cliente, recien ahi se le manda Cancelled.
+func (s *Server) cancelSession(session *Session) {
+	s.admission.Forget(session.Id)
+	s.sendClientsFinished(session.Id)
+
+	s.sessions.Update(session, func(session *Session) {
+		session.State = SessionCancelling
+		s.sessions.clearPending(session)
+	})
+	log.Infof("action: cancel_session | result: in_progress | client_id: %s", session.Id)
+
+	s.checkCancelled(session)
+}
+
+// checkCancelled cierra la sesion cancelada cuando Cleanups ya no espera a
+// ningun nodo
+func (s *Server) checkCancelled(session *Session) {
+	done := false
+	var client *Client
+	s.sessions.View(session, func(session *Session) {
+		done = session.State == SessionCancelling && !s.cleanups.Pending(session.Id)
+		client = session.client
+	})
+	if !done {
+		return
+	}
+
+	s.sessions.Remove(session)
+	s.clientDone(session.Id)
+	log.Infof("action: cancel_session | result: success | client_id: %s", session.Id)
+
+	if client != nil {
+		if err := client.send(&protocol.Cancelled{}); err != nil {
+			client.log.Errorf("action: cancel_session | result: fail | error: %s", err)
+		}
+		client.conn.Close()
+	}
+}
+
+func (s *Server) consumeCleanupDone(instance int) {
+	cleanupDoneQueue, err := s.middleware.ListenCleanupDone(instance)
+	if err != nil {
+		log.Errorf("Failed to listen cleanup done: %v", err)
+		return
 	}
+	cleanupDoneQueue.Consume(func(message *middleware.CleanupDoneMsg) error {
+		if !s.cleanups.Confirm(message.ClientId, message.Node) {
+			log.Warningf("action: cleanup_done | result: fail | client_id: %s | node: %s | error: nodo desconocido", message.ClientId, message.Node)
+			message.Ack()
+			return nil
+		}
+		log.Debugf("action: cleanup_done | result: success | client_id: %s | node: %s", message.ClientId, message.Node)
+
+		if session, ok := s.sessions.Get(message.ClientId); ok {
+			s.checkCancelled(session)
+		}
+
+		message.Ack()
+		return nil
+	})
 }
 
-func (s *Server) acceptNewConnection() (*Client, error) {
+func (s *Server) acceptNewConnection() (*net.TCPConn, error) {
 	log.Info("action: accept_connections | result: in_progress")
 
 	clientSocket, err := s.serverSocket.AcceptTCP()
@@ -95,31 +379,191 @@ func (s *Server) acceptNewConnection() (*Client, error) {
 		return nil, err
 	}
 
-	clientId := s.clientsReceived.Count() + 1001
+	return clientSocket, nil
+}
+
+func (s *Server) handleHandshake(conn *net.TCPConn) {
+	if s.idleTimeout() > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.idleTimeout()))
+	}
+	msg, err := protocol.Receive(conn)
+	if err != nil {
+		log.Errorf("action: handshake | result: fail | error: %s", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch msg.MessageType {
+	case protocol.MessageTypeHello:
+		hello := protocol.Hello{}
+		hello.Decode(msg.Data)
+		priority, err := middleware.ParsePriority(hello.Priority)
+		if err != nil {
+			log.Errorf("action: handshake | result: fail | error: prioridad invalida %s", hello.Priority)
+			protocol.Send(conn, &protocol.SessionInfo{})
+			conn.Close()
+			return
+		}
+		s.newSession(conn, priority)
+	case protocol.MessageTypeResume:
+		resume := protocol.Resume{}
+		resume.Decode(msg.Data)
+		clientId, err := middleware.ParseClientId(resume.ClientId)
+		if err != nil {
+			log.Errorf("action: resume_session | result: fail | error: %s", err)
+			protocol.Send(conn, &protocol.SessionInfo{})
+			conn.Close()
+			return
+		}
+		s.resumeSession(conn, clientId)
+	default:
+		log.Errorf("action: handshake | result: fail | error: mensaje no soportado %d", msg.MessageType)
+		conn.Close()
+	}
+}
+
+func (s *Server) newSession(conn *net.TCPConn, priority middleware.Priority) {
+	clientId, admitted := s.admission.AdmitNext(s.clientIds.Next)
+	if !admitted {
+		log.Infof("action: accept_connections | result: busy | retry_after: %d", s.config.Server.BusyRetryAfter)
+		protocol.Send(conn, &protocol.Busy{RetryAfter: s.config.Server.BusyRetryAfter})
+		conn.Close()
+		return
+	}
+	s.clientsLock.Lock()
 	s.clientsReceived.Add(int64(clientId))
-	client := NewClient(strconv.Itoa(clientId), clientSocket, s.middleware, s.config.Server.ReviewsBatchAmount)
-	s.clients = append(s.clients, client)
+	s.clientsLock.Unlock()
+
+	session := s.sessions.Create(clientId, priority)
+	client := NewClient(session, s, conn)
+	s.sessions.View(session, func(session *Session) {
+		session.client = client
+	})
+
+	if err := protocol.Send(conn, &protocol.SessionInfo{ClientId: session.Id.String()}); err != nil {
+		log.Errorf("action: handshake | result: fail | client_id: %s | error: %s", session.Id, err)
+	}
+
+	log.Infof("action: accept_connections | result: success | client_id: %s | priority: %d", client.id, priority)
+
+	go client.handleConnection()
+	go client.handleGames()
+	go client.handleReviews()
+}
+
+// resumeSession reconecta un cliente a su sesion. Las respuestas que llegaron
+// mientras no estaba conectado se mandan en orden antes de que las nuevas
+// vayan directo al cliente.
+func (s *Server) resumeSession(conn *net.TCPConn, clientId middleware.ClientId) {
+	session, ok := s.sessions.Get(clientId)
+	if !ok {
+		if owner, found := s.sessions.Owner(clientId); found {
+			// la atiende otra instancia, el cliente reintenta y el balanceo
+			// eventualmente lo lleva a ella
+			log.Infof("action: resume_session | result: fail | client_id: %s | owner: %d", clientId, owner)
+			protocol.Send(conn, &protocol.SessionInfo{})
+			conn.Close()
+			return
+		}
+	}
+
+	resumable := false
+	if ok {
+		s.sessions.View(session, func(session *Session) {
+			resumable = session.State >= SessionAwaitingResults && session.State != SessionCancelling && session.client == nil
+		})
+	}
+
+	if !resumable {
+		log.Infof("action: resume_session | result: fail | client_id: %s", clientId)
+		protocol.Send(conn, &protocol.SessionInfo{})
+		conn.Close()
+		return
+	}
 
-	log.Infof("action: accept_connections | result: success | client_id: %s", client.id)
+	client := NewClient(session, s, conn)
+	client.allSent = true
+	if err := protocol.Send(conn, &protocol.SessionInfo{ClientId: session.Id.String()}); err != nil {
+		log.Errorf("action: resume_session | result: fail | client_id: %s | error: %s", session.Id, err)
+		conn.Close()
+		return
+	}
+
+	// las pendientes quedan en pending.bin hasta que salen todas, si el
+	// cliente se vuelve a caer a mitad las ya mandadas se descartan por id
+	for {
+		var pending []*middleware.Result
+		s.sessions.View(session, func(session *Session) {
+			pending = session.pending
+			if len(pending) == 0 {
+				session.client = client
+				s.sessions.clearPending(session)
+			}
+		})
+		if len(pending) == 0 {
+			break
+		}
+
+		for _, response := range pending {
+			if !s.sendResponse(session, client, response) {
+				conn.Close()
+				return
+			}
+		}
+		s.sessions.View(session, func(session *Session) {
+			session.pending = session.pending[len(pending):]
+		})
+	}
 
-	return client, nil
+	log.Infof("action: resume_session | result: success | client_id: %s", session.Id)
+
+	go client.handleConnection()
 }
 
-func (s *Server) handleResponses() {
-	responseQueue, err := s.middleware.ListenResponses()
+// handleResponses consume las respuestas ruteadas a una instancia. Si la
+// sesion ya la atiende otra (porque la tomo cuando esta se cayo) se reenvia.
+func (s *Server) handleResponses(instance int) {
+	responseQueue, err := s.middleware.ListenResponses(instance)
 	if err != nil {
 		log.Errorf("Failed to listen responses: %v", err)
 		return
 	}
 
 	err = responseQueue.Consume(func(response *middleware.Result) error {
-		for _, client := range s.clients {
-			if client.id == response.ClientId {
-				if !s.processedRespones[response.Id] {
-					s.processedRespones[response.Id] = true
-					client.handleResponse(response)
+		session, ok := s.sessions.Get(response.ClientId)
+		if !ok {
+			if owner, found := s.sessions.Owner(response.ClientId); found && owner != s.instance {
+				if err := s.middleware.SendResponseTo(owner, response); err != nil {
+					response.Nack()
+					return err
 				}
 			}
+			response.Ack()
+			return nil
+		}
+
+		var client *Client
+		var pendingErr error
+		s.sessions.View(session, func(session *Session) {
+			if session.State == SessionCancelling {
+				// se descarta, el cliente ya no la espera
+				return
+			}
+			client = session.client
+			if client == nil {
+				// se guarda en la sesion hasta que el cliente haga Resume
+				pendingErr = s.sessions.AddPending(session, response)
+			}
+		})
+
+		if client != nil {
+			s.sendResponse(session, client, response)
+		} else if pendingErr != nil {
+			log.Errorf("action: save_pending_response | result: fail | client_id: %s | error: %s", session.Id, pendingErr)
+			response.Nack()
+		} else {
+			response.Ack()
 		}
 		return nil
 	})
@@ -128,16 +572,100 @@ func (s *Server) handleResponses() {
 	}
 }
 
-func (s *Server) consumeReviewsProcessed() {
-	reviewsProcessedQueue, err := s.middleware.ListenReviewsProcessed()
+// sendResponse manda una respuesta al cliente, devuelve false si no se pudo
+func (s *Server) sendResponse(session *Session, client *Client, response *middleware.Result) bool {
+	duplicated := false
+	s.sessions.View(session, func(session *Session) {
+		duplicated = session.responses.Contains(response.Id)
+	})
+	if duplicated {
+		response.Ack()
+		return true
+	}
+
+	if err := client.handleResponse(response); err != nil {
+		log.Errorf("action: send_response | result: fail | client_id: %s | error: %s", session.Id, err)
+		response.Nack()
+		return false
+	}
+
+	s.sessions.View(session, func(session *Session) {
+		session.responses.Add(response.Id)
+	})
+
+	if response.IsFinalMessage {
+		s.sessions.Update(session, func(session *Session) {
+			session.FinishedQueries |= 1 << (response.QueryId - 1)
+			if session.FinishedQueries == s.enabledQueries() {
+				session.State = SessionDone
+				log.Infof("action: session_done | client_id: %s", session.Id)
+			}
+		})
+	}
+
+	response.Ack()
+	return true
+}
+
+func (s *Server) enabledQueries() int {
+	enabled := 0
+	for i, query := range []bool{s.config.Query.Query1, s.config.Query.Query2, s.config.Query.Query3, s.config.Query.Query4, s.config.Query.Query5} {
+		if query {
+			enabled |= 1 << i
+		}
+	}
+	return enabled
+}
+
+func (s *Server) consumeReviewsProcessed(instance int) {
+	reviewsProcessedQueue, err := s.middleware.ListenReviewsProcessed(instance)
 	if err != nil {
 		log.Errorf("Failed to listen reviews processed: %v", err)
 		return
 	}
 	reviewsProcessedQueue.Consume(nil, func(message *middleware.ReviewsProcessedMsg) error {
-		for _, client := range s.clients {
-			if client.id == message.ClientId {
-				client.handleReviewsProcessed(message.BatchId)
+		if session, ok := s.sessions.Get(message.ClientId); ok {
+			duplicated := false
+			s.sessions.View(session, func(session *Session) {
+				duplicated = session.processedBatches.Contains(int64(message.BatchId))
+				if !duplicated {
+					s.sessions.AddStats(session, message.BatchId, message.Stats)
+				}
+				session.processedBatches.Add(int64(message.BatchId))
+			})
+			if !duplicated {
+				s.admission.PublishedStats(message.ClientId, message.Stats)
+				s.admission.ReleaseBatch(message.ClientId)
+			}
+			s.checkReviewsFinished(session)
+		} else if owner, found := s.sessions.Owner(message.ClientId); found && owner != s.instance {
+			if err := s.middleware.SendReviewsProcessedTo(owner, message); err != nil {
+				message.Nack()
+				return err
+			}
+		}
+
+		message.Ack()
+		return nil
+	})
+}
+
+// consumeStatsConsumed le pasa a Admission cuantos stats de cada cliente
+// recibieron las queries, con eso se destraba la subida de los clientes que
+// llegaron a su limite de stats sin consumir
+func (s *Server) consumeStatsConsumed(instance int) {
+	statsConsumedQueue, err := s.middleware.ListenStatsConsumed(instance)
+	if err != nil {
+		log.Errorf("Failed to listen stats consumed: %v", err)
+		return
+	}
+	statsConsumedQueue.Consume(func(message *middleware.StatsConsumedMsg) error {
+		if _, ok := s.sessions.Get(message.ClientId); ok {
+			s.admission.ConsumedStats(message.ClientId, message.QueryId, message.ShardId, message.Received)
+		} else if owner, found := s.sessions.Owner(message.ClientId); found && owner != s.instance {
+			// si se pierde no importa, el proximo reporte trae el acumulado
+			if err := s.middleware.SendStatsConsumedTo(owner, message); err != nil {
+				log.Errorf("action: forward_stats_consumed | result: fail | client_id: %s | error: %s", message.ClientId, err)
 			}
 		}
 
@@ -146,50 +674,119 @@ func (s *Server) consumeReviewsProcessed() {
 	})
 }
 
+// checkReviewsFinished avisa que terminaron las reviews cuando el cliente
+// termino de subirlas y se procesaron todos los batches. Puede llamarse desde
+// la subida o desde el consumo de reviewsProcessed, el que llegue ultimo.
+func (s *Server) checkReviewsFinished(session *Session) {
+	finished := func(session *Session) bool {
+		return session.State >= SessionAwaitingResults && session.State != SessionCancelling && !session.ReviewsFinishedSent && session.processedBatches.Count() == session.ReviewBatches
+	}
+
+	ready := false
+	s.sessions.View(session, func(session *Session) {
+		ready = finished(session)
+	})
+	if !ready {
+		return
+	}
+
+	s.sessions.Update(session, func(session *Session) {
+		if !finished(session) {
+			return
+		}
+		log.Infof("action: reviews_processed | result: success | client_id: %s | batches: %d", session.Id, session.ReviewBatches)
+		s.middleware.SendReviewsFinished(session.Id, session.Priority, session.ReviewBatches)
+		s.middleware.SendStatsFinished(session.Id, session.Priority, session.stats)
+		session.ReviewsFinishedSent = true
+	})
+}
+
 type Client struct {
-	id                 string
+	id                 middleware.ClientId
+	priority           middleware.Priority
+	session            *Session
+	server             *Server
 	conn               *net.TCPConn
 	middleware         *middleware.Middleware
 	games              chan protocol.ClientGame
 	gamesFinished      bool
+	allSent            bool
+	idleTimeout        time.Duration
 	reviews            chan protocol.ClientReview
-	reviewsFinished    bool
 	reviewsBatchAmount int
 	totalGames         int
+	shardGames         [][]int // games mandados a cada shard y particion de mappers, van en su Last
 	totalReviews       int
 	totalReviewBatches int
-	processedBatches   map[int]bool
+	sendReviews        func(partition int, batch *middleware.ReviewsMsg) error
+	cancelSession      func(session *Session)
+	cancelled          atomic.Bool // lo escribe handleCancel y lo leen handleGames y handleReviews
+	sendLock           sync.Mutex
+	log                *logs.Logger
 }
 
-func NewClient(id string, conn *net.TCPConn, m *middleware.Middleware, reviewsBatchAmount int) *Client {
-	log.Infof("action: new_client | result: success | id: %s", id)
+func NewClient(session *Session, server *Server, conn *net.TCPConn) *Client {
+	log.Infof("action: new_client | result: success | id: %s", session.Id)
 	return &Client{
-		id:                 id,
+		id:                 session.Id,
+		priority:           session.Priority,
+		session:            session,
+		server:             server,
 		conn:               conn,
-		middleware:         m,
+		middleware:         server.middleware,
 		games:              make(chan protocol.ClientGame),
 		gamesFinished:      false,
+		allSent:            false,
+		idleTimeout:        server.idleTimeout(),
 		reviews:            make(chan protocol.ClientReview),
-		reviewsFinished:    false,
-		reviewsBatchAmount: reviewsBatchAmount,
+		reviewsBatchAmount: server.config.Server.ReviewsBatchAmount,
 		totalGames:         0,
+		shardGames:         newShardGames(server.config),
 		totalReviews:       0,
 		totalReviewBatches: 0,
-		processedBatches:   make(map[int]bool),
+		sendReviews:        server.middleware.SendReviewBatch,
+		cancelSession:      server.cancelSession,
+		log:                log.With("client_id", session.Id),
+	}
+}
+
+// newShardGames arma los contadores de games por shard y particion, la 0 es la
+// de los mappers sin particionar
+func newShardGames(config *config.Config) [][]int {
+	shardGames := make([][]int, config.Sharding.Amount)
+	for shardId := range shardGames {
+		shardGames[shardId] = make([]int, config.Mappers.Amount+1)
 	}
+	return shardGames
 }
 
 func (c *Client) handleDisconnect() {
-	log.Infof("action: handle_disconnect | client: %s | EOF received", c.id)
-	clientId, _ := strconv.ParseInt(c.id, 10, 64)
-	c.middleware.SendClientsFinished(int(clientId))
+	c.log.Infof("action: handle_disconnect | EOF received")
+	c.server.finishSession(c.session)
 	c.conn.Close()
 }
 
 func (c *Client) handleConnection() {
 	for {
+		// mientras sube datos el cliente tiene que mandar algo cada
+		// idleTimeout, despues solo espera resultados y no manda nada
+		if c.idleTimeout > 0 && !c.allSent {
+			c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+
 		msg, err := protocol.Receive(c.conn)
 		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				c.log.Infof("action: idle_timeout | timeout: %s", c.idleTimeout)
+			}
+			// una sesion que el server cancelo la termina checkCancelled
+			if c.cancelled.Load() {
+				c.detach()
+				c.conn.Close()
+				return
+			}
 			c.handleDisconnect()
 			return
 		}
@@ -202,58 +799,154 @@ func (c *Client) handleConnection() {
 			c.games <- game
 
 		case protocol.MessageTypeReview:
-			if !c.gamesFinished {
-				log.Infof("action: receive_games | result: success | client_id: %s", c.id)
-				c.gamesFinished = true
-				close(c.games)
-			}
+			c.finishGames()
 			review := protocol.ClientReview{}
 			review.Decode(msg.Data)
 			c.reviews <- review
 
+		case protocol.MessageTypeCancel:
+			c.handleCancel()
+			c.waitCancelled()
+			return
+
 		case protocol.MessageTypeAllSent:
-			log.Infof("action: receive_reviews | result: success")
-			log.Infof("action: receive_all_sent | result: success")
+			c.allSent = true
+			c.finishGames()
+			c.log.Infof("action: receive_reviews | result: success")
+			c.log.Infof("action: receive_all_sent | result: success")
 			close(c.reviews)
 
 		default:
-			log.Errorf("action: handle_message | result: fail | error: mensaje no soportado %s", msg.MessageType)
+			c.log.Errorf("action: handle_message | result: fail | error: mensaje no soportado %v", msg.MessageType)
 			return
 		}
 	}
 }
 
+// handleCancel deja de leer del cliente y cancela la sesion. La conexion queda
+// abierta hasta mandar Cancelled.
+func (c *Client) handleCancel() {
+	c.log.Infof("action: cancel | result: in_progress")
+	// el server ya la pudo haber cancelado por un batch que no salio
+	alreadyCancelled := c.cancelled.Swap(true)
+	if !c.allSent {
+		c.allSent = true
+		c.finishGames()
+		close(c.reviews)
+	}
+
+	if err := c.send(&protocol.CancelAck{Nodes: len(c.server.cleanups.nodes)}); err != nil {
+		c.log.Errorf("action: cancel | result: fail | error: %s", err)
+	}
+	if !alreadyCancelled {
+		c.cancelSession(c.session)
+	}
+}
+
+// failSession cancela la sesion desde el server cuando no se puede seguir con
+// el cliente. Le llega Cancelled como si lo hubiera pedido.
+func (c *Client) failSession() {
+	if c.cancelled.Swap(true) {
+		return
+	}
+	c.log.Warningf("action: cancel | result: in_progress | reason: server")
+	c.cancelSession(c.session)
+}
+
+// waitCancelled descarta lo que el cliente mando despues del Cancel hasta que
+// se cierra la conexion. Si se va antes del Cancelled la sesion queda sin
+// cliente y la termina el janitor.
+func (c *Client) waitCancelled() {
+	c.conn.SetReadDeadline(time.Time{})
+	for {
+		if _, err := protocol.Receive(c.conn); err != nil {
+			break
+		}
+	}
+
+	c.detach()
+}
+
+// detach saca al cliente de la sesion, que sigue hasta que la cierre
+// checkCancelled
+func (c *Client) detach() {
+	c.server.sessions.View(c.session, func(session *Session) {
+		if session.client == c {
+			session.client = nil
+		}
+	})
+}
+
+// send serializa lo que se escribe en la conexion, las respuestas y la
+// confirmacion del cancel salen de goroutines distintas
+func (c *Client) send(message protocol.Message) error {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	return protocol.Send(c.conn, message)
+}
+
+func (c *Client) finishGames() {
+	if c.gamesFinished {
+		return
+	}
+	c.log.Infof("action: receive_games | result: success")
+	c.gamesFinished = true
+	close(c.games)
+	c.server.sessions.Update(c.session, func(session *Session) {
+		session.State = SessionUploadingReviews
+	})
+}
+
 func (c *Client) handleGames() {
+	span := tracing.Start("handle games", tracing.ClientTrace(uint64(c.id)), "client_id", c.id.String())
+	defer span.Finish()
+
 	for game := range c.games {
 		for _, line := range game.Lines {
 			reader := csv.NewReader(strings.NewReader(line))
 			record, err := reader.Read()
 			if err != nil {
-				log.Errorf("Failed to read game error: %v", err)
+				c.log.Errorf("Failed to read game error: %v", err)
 				continue
 			}
-			gameMsg := middleware.GameMsg{ClientId: c.id, Game: middleware.NewGame(record), Last: false}
+			gameMsg := middleware.GameMsg{Id: c.totalGames, ClientId: c.id, Priority: c.priority, Game: middleware.NewGame(record), Last: false}
 			if gameMsg.Game == nil {
 				continue
 			}
+			gameMsg.SetTrace(span.Context)
 			err = c.middleware.SendGameMsg(&gameMsg)
 			c.totalGames++
 			if err != nil {
-				log.Errorf("Failed to publish game message: %v", err)
+				c.log.Errorf("Failed to publish game message: %v", err)
+				continue
 			}
+			c.shardGames[gameMsg.ShardId][c.middleware.PartitionOf(gameMsg.Game.AppId)]++
 		}
 	}
 
-	err := c.middleware.SendGameFinished(c.id)
+	if c.cancelled.Load() {
+		return
+	}
+
+	err := c.middleware.SendGameFinished(c.id, c.priority, c.shardGames)
 	if err != nil {
-		log.Errorf("Failed to publish game finished message: %v", err)
+		c.log.Errorf("Failed to publish game finished message: %v", err)
 	}
 
-	log.Infof("All %d games received and sent to middleware", c.totalGames)
+	c.server.sessions.Update(c.session, func(session *Session) {
+		session.Games = c.totalGames
+	})
+
+	span.SetAttribute("games", strconv.Itoa(c.totalGames))
+	c.log.Infof("All %d games received and sent to middleware", c.totalGames)
 }
 
 func (c *Client) handleReviews() {
-	reviewBatch := make([]middleware.Review, 0)
+	span := tracing.Start("handle reviews", tracing.ClientTrace(uint64(c.id)), "client_id", c.id.String())
+	defer span.Finish()
+
+	// un batch armandose por particion de mappers, la 0 es la work queue
+	reviewBatches := make([][]middleware.Review, c.server.config.Mappers.Amount+1)
 
 	for msg := range c.reviews {
 		for _, line := range msg.Lines {
@@ -263,41 +956,89 @@ func (c *Client) handleReviews() {
 			record, err := reader.Read()
 			if err != nil {
 				reader.FieldsPerRecord = -1
-				log.Errorf("Failed to read review error: %v", err)
+				c.log.Errorf("Failed to read review error: %v", err)
 				continue
 			}
 			review := middleware.NewReview(record, c.totalReviews)
 			if review == nil {
 				continue
 			}
-			reviewBatch = append(reviewBatch, *review)
+			partition := c.middleware.ReviewPartitionOf(review.AppId)
+			reviewBatches[partition] = append(reviewBatches[partition], *review)
 			c.totalReviews++
-			if len(reviewBatch) == c.reviewsBatchAmount {
-				err := c.middleware.SendReviewBatch(&middleware.ReviewsMsg{Id: c.totalReviewBatches, ClientId: c.id, Reviews: reviewBatch})
-				c.totalReviewBatches++
-				if err != nil {
-					log.Errorf("Failed to publish review message: %v", err)
-				}
-				reviewBatch = make([]middleware.Review, 0)
+			if len(reviewBatches[partition]) == c.reviewsBatchAmount {
+				c.sendReviewBatch(span.Context, partition, reviewBatches[partition])
+				reviewBatches[partition] = nil
 			}
 		}
 	}
 
-	if len(reviewBatch) > 0 {
-		err := c.middleware.SendReviewBatch(&middleware.ReviewsMsg{Id: c.totalReviewBatches, ClientId: c.id, Reviews: reviewBatch})
-		c.totalReviewBatches++
-		if err != nil {
-			log.Errorf("Failed to publish review message: %v", err)
+	for partition, reviewBatch := range reviewBatches {
+		if len(reviewBatch) > 0 && !c.cancelled.Load() {
+			c.sendReviewBatch(span.Context, partition, reviewBatch)
 		}
 	}
+	c.server.admission.Leave(c.id)
+	if c.cancelled.Load() {
+		return
+	}
+
+	c.server.sessions.Update(c.session, func(session *Session) {
+		session.Reviews = c.totalReviews
+		session.ReviewBatches = c.totalReviewBatches
+		session.State = SessionAwaitingResults
+	})
+
+	span.SetAttribute("reviews", strconv.Itoa(c.totalReviews))
+	c.log.Infof("All %d reviews received and sent to middleware", c.totalReviews)
+
+	c.server.checkReviewsFinished(c.session)
+}
+
+// sendReviewBatch espera a que haya lugar para otro batch en vuelo, mientras
+// tanto no se leen mensajes del cliente y TCP lo frena. Solo se cuentan los
+// batches publicados: si uno no sale despues de REVIEW_BATCH_ATTEMPTS se
+// libera su lugar y se cancela la sesion, el server y los mappers esperarian
+// para siempre un batch que nunca llega.
+func (c *Client) sendReviewBatch(trace tracing.SpanContext, partition int, reviews []middleware.Review) {
+	// el cliente se olvido mientras esperaba lugar (se cancelo o se termino la
+	// sesion), el batch ya no se espera
+	if c.cancelled.Load() || !c.server.admission.AcquireBatch(c.id) {
+		return
+	}
 
-	c.reviewsFinished = true
+	batch := &middleware.ReviewsMsg{Id: c.totalReviewBatches, ClientId: c.id, Priority: c.priority, Reviews: reviews}
+	batch.SetTrace(trace)
+
+	var err error
+	for attempt := 1; attempt <= REVIEW_BATCH_ATTEMPTS; attempt++ {
+		if err = c.sendReviews(partition, batch); err == nil {
+			c.totalReviewBatches++
+			return
+		}
+		c.log.With("batch_id", batch.Id).Warningf("action: publish_review_batch | result: retry | attempt: %d | error: %v", attempt, err)
+		if attempt < REVIEW_BATCH_ATTEMPTS {
+			time.Sleep(REVIEW_BATCH_BACKOFF * time.Duration(attempt))
+		}
+	}
 
-	log.Infof("All %d reviews received and sent to middleware", c.totalReviews)
+	c.log.With("batch_id", batch.Id).Errorf("action: publish_review_batch | result: fail | error: %v", err)
+	c.server.admission.ReleaseBatch(c.id)
+	c.failSession()
 }
 
-func (c *Client) handleResponse(response *middleware.Result) {
-	log.Debugf("Received response from query %d", response.QueryId)
+// handleResponse manda la respuesta al cliente, el ack lo hace el servidor
+// despues de registrarla en la sesion
+func (c *Client) handleResponse(response *middleware.Result) error {
+	c.log.Debugf("Received response from query %d", response.QueryId)
+
+	span := tracing.Start("handle response", response.Trace(), "client_id", c.id.String(), "query", strconv.Itoa(response.QueryId))
+	defer span.Finish()
+
+	if approximate, ok := response.Payload.(middleware.ApproximateResult); ok {
+		return c.handleApproximateResponse(response.QueryId, approximate)
+	}
+
 	switch response.QueryId {
 	case 1:
 		response1 := protocol.ClientResponse1{
@@ -306,7 +1047,7 @@ func (c *Client) handleResponse(response *middleware.Result) {
 			Linux:   int(response.Payload.(middleware.Query1Result).Linux),
 			Last:    response.IsFinalMessage,
 		}
-		protocol.Send(c.conn, &response1)
+		return c.send(&response1)
 	case 2:
 		topGames := []protocol.Game{}
 		for _, game := range response.Payload.(middleware.Query2Result).TopGames {
@@ -315,7 +1056,7 @@ func (c *Client) handleResponse(response *middleware.Result) {
 		response2 := protocol.ClientResponse2{
 			TopGames: topGames,
 		}
-		protocol.Send(c.conn, &response2)
+		return c.send(&response2)
 	case 3:
 		topStats := []protocol.Game{}
 		for _, stat := range response.Payload.(middleware.Query3Result).TopStats {
@@ -323,14 +1064,15 @@ func (c *Client) handleResponse(response *middleware.Result) {
 		}
 		response3 := protocol.ClientResponse3{
 			TopStats: topStats,
+			Last:     response.IsFinalMessage,
 		}
-		protocol.Send(c.conn, &response3)
+		return c.send(&response3)
 	case 4:
 		response4 := protocol.ClientResponse4{
 			Game: protocol.Game{Name: response.Payload.(middleware.Query4Result).Game, Count: 0},
 			Last: response.IsFinalMessage,
 		}
-		protocol.Send(c.conn, &response4)
+		return c.send(&response4)
 	case 5:
 		topStats := []protocol.Game{}
 		for _, stat := range response.Payload.(middleware.Query5Result).Stats {
@@ -340,19 +1082,27 @@ func (c *Client) handleResponse(response *middleware.Result) {
 			Last:     response.IsFinalMessage,
 			TopStats: topStats,
 		}
-		protocol.Send(c.conn, &response5)
+		return c.send(&response5)
 	default:
-		log.Errorf("Unknown query id: %d", response.QueryId)
+		c.log.Errorf("Unknown query id: %d", response.QueryId)
 	}
 
-	response.Ack()
+	return nil
 }
 
-func (c *Client) handleReviewsProcessed(batchId int) {
-	c.processedBatches[batchId] = true
-	if c.reviewsFinished && len(c.processedBatches) == c.totalReviewBatches {
-		log.Infof("All reviews processed, closing reviews channel GOD HOLA")
-		c.middleware.SendReviewsFinished(c.id, 1)
-		c.middleware.SendStatsFinished(c.id)
+func (c *Client) handleApproximateResponse(queryId int, approximate middleware.ApproximateResult) error {
+	topStats := []protocol.Game{}
+	for _, stat := range approximate.Stats {
+		count := stat.Positives
+		if queryId == 5 {
+			count = stat.Negatives
+		}
+		topStats = append(topStats, protocol.Game{Id: strconv.Itoa(stat.AppId), Name: stat.Name, Count: count})
 	}
+
+	return c.send(&protocol.ClientApproximate{
+		QueryId:  queryId,
+		Cutoff:   approximate.Cutoff,
+		TopStats: topStats,
+	})
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"tp1-distribuidos/config"
+	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/protocol"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCancelServer(t *testing.T, nodes ...string) *Server {
+	dir := t.TempDir()
+	return &Server{
+		sessions:    NewSessions(dir, 1),
+		cleanups:    NewCleanups(dir, 1, nodes, 0, 0, func(middleware.ClientId, string) error { return nil }),
+		clientsDone: shared.NewProcessed(dir + "/clients_done.bin"),
+	}
+}
+
+func TestCancelledSessionWaitsForEveryNode(t *testing.T) {
+	server := newCancelServer(t, "finished-mapper-games.1", "finished-1.0")
+	session := server.sessions.Create(middleware.ClientId(42), middleware.PriorityHigh)
+	server.cleanups.Start(session.Id)
+	server.sessions.Update(session, func(session *Session) {
+		session.State = SessionCancelling
+	})
+
+	server.cleanups.Confirm(session.Id, "finished-mapper-games.1")
+	server.checkCancelled(session)
+	_, ok := server.sessions.Get(session.Id)
+	assert.True(t, ok)
+
+	server.cleanups.Confirm(session.Id, "finished-1.0")
+	server.checkCancelled(session)
+	_, ok = server.sessions.Get(session.Id)
+	assert.False(t, ok)
+	// al reiniciar no se lo vuelve a terminar
+	assert.True(t, server.clientsDone.Data()[int64(session.Id)])
+}
+
+func TestCheckCancelledIgnoresActiveSessions(t *testing.T) {
+	server := newCancelServer(t)
+	session := server.sessions.Create(middleware.ClientId(42), middleware.PriorityHigh)
+
+	server.checkCancelled(session)
+	_, ok := server.sessions.Get(session.Id)
+	assert.True(t, ok)
+}
+
+func TestHandleReviewsSplitsBatchesByPartition(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Mappers = config.MappersConfig{Amount: 2, Partitioned: true}
+	cfg.Server.ReviewsBatchAmount = 2
+
+	server := newCancelServer(t)
+	server.config = cfg
+	server.middleware = &middleware.Middleware{Config: cfg}
+	server.admission = NewAdmission(0, 0)
+	session := server.sessions.Create(middleware.ClientId(42), middleware.PriorityHigh)
+	server.admission.Admit(session.Id)
+
+	client := NewClient(session, server, nil)
+	sent := map[int]int{} // batch -> particion
+	client.sendReviews = func(partition int, batch *middleware.ReviewsMsg) error {
+		for _, review := range batch.Reviews {
+			assert.Equal(t, partition, server.middleware.ReviewPartitionOf(review.AppId))
+		}
+		sent[batch.Id] = partition
+		return nil
+	}
+
+	go func() {
+		// 10, 12 y 14 son del mapper 1; 11 y 13 del 2
+		client.reviews <- protocol.ClientReview{Lines: []string{
+			"10,a,good,1", "11,b,good,1", "12,c,bad,-1", "13,d,good,1", "14,e,good,1",
+		}}
+		close(client.reviews)
+	}()
+	client.handleReviews()
+
+	assert.Equal(t, map[int]int{0: 1, 1: 2, 2: 1}, sent)
+
+	// checkReviewsFinished espera un reviewsProcessed por cada batch mandado
+	assert.Equal(t, 3, session.ReviewBatches)
+	assert.Equal(t, 5, session.Reviews)
+	for batchId := range sent {
+		session.processedBatches.Add(int64(batchId))
+	}
+	assert.Equal(t, session.ReviewBatches, session.processedBatches.Count())
+}
+
+func TestHandleReviewsCancelsWhenABatchFailsToPublish(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.ReviewsBatchAmount = 2
+
+	server := newCancelServer(t)
+	server.config = cfg
+	server.middleware = &middleware.Middleware{Config: cfg}
+	server.admission = NewAdmission(0, 10)
+	session := server.sessions.Create(middleware.ClientId(42), middleware.PriorityHigh)
+	server.admission.Admit(session.Id)
+
+	client := NewClient(session, server, nil)
+	attempts := 0
+	client.sendReviews = func(partition int, batch *middleware.ReviewsMsg) error {
+		attempts++
+		return errors.New("channel closed")
+	}
+	cancelled := 0
+	client.cancelSession = func(session *Session) {
+		cancelled++
+	}
+
+	go func() {
+		client.reviews <- protocol.ClientReview{Lines: []string{
+			"10,a,good,1", "11,b,good,1", "12,c,bad,-1", "13,d,good,1",
+		}}
+		close(client.reviews)
+	}()
+	client.handleReviews()
+
+	// el primer batch se reintenta y cancela la sesion, el segundo ya no sale
+	assert.Equal(t, REVIEW_BATCH_ATTEMPTS, attempts)
+	assert.Equal(t, 1, cancelled)
+	assert.Equal(t, 0, client.totalReviewBatches)
+	assert.Equal(t, 0, session.ReviewBatches)
+	// el lugar del batch que no salio se libero
+	assert.Equal(t, 0, server.admission.inFlight[session.Id])
+	assert.Equal(t, 0, server.admission.total)
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared"
+)
+
+type SessionState int
+
+const (
+	SessionUploadingGames SessionState = iota
+	SessionUploadingReviews
+	SessionAwaitingResults
+	SessionDone
+	SessionCancelling // el cliente mando Cancel, se esperan los CleanupDone
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case SessionUploadingGames:
+		return "uploading_games"
+	case SessionUploadingReviews:
+		return "uploading_reviews"
+	case SessionAwaitingResults:
+		return "awaiting_results"
+	case SessionDone:
+		return "done"
+	case SessionCancelling:
+		return "cancelling"
+	}
+	return "unknown"
+}
+
+// Session es el estado de un cliente que sobrevive a un reinicio del
+// servidor. Se guarda en <sessionsDir>/<id>/ junto con las respuestas y
+// los batches de reviews ya procesados. El directorio es compartido por todas
+// las instancias del server, Owner es la instancia que atiende al cliente.
+type Session struct {
+	Id                  middleware.ClientId
+	Owner               int
+	Priority            middleware.Priority
+	State               SessionState
+	Games               int
+	Reviews             int
+	ReviewBatches       int
+	ReviewsFinishedSent bool
+	FinishedQueries     int // bit i = la query i+1 mando su resultado final
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+
+	client           *Client              // nil mientras el cliente no esta conectado
+	pending          []*middleware.Result // ya ackeadas, guardadas en pending.bin
+	responses        *shared.Processed
+	processedBatches *shared.Processed
+	stats            middleware.StatsCounts // stats publicados por shard y genero, van en los Last
+	statsBatches     map[int]bool
+	statsFile        *os.File
+}
+
+// Sessions es el registro de sesiones por id de cliente de esta instancia.
+// Todo acceso a los campos de una sesion se hace con el lock del registro
+// tomado.
+type Sessions struct {
+	dir      string
+	instance int
+	lock     sync.Mutex
+	sessions map[middleware.ClientId]*Session
+}
+
+func NewSessions(dir string, instance int) *Sessions {
+	os.MkdirAll(dir, 0777)
+
+	sessions := &Sessions{
+		dir:      dir,
+		instance: instance,
+		sessions: make(map[middleware.ClientId]*Session),
+	}
+
+	for _, session := range sessions.loadOwnedBy(instance) {
+		sessions.sessions[session.Id] = session
+	}
+
+	return sessions
+}
+
+// loadOwnedBy lee del disco las sesiones de una instancia
+func (s *Sessions) loadOwnedBy(instance int) []*Session {
+	dentries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Errorf("action: load_sessions | result: fail | error: %s", err)
+		return nil
+	}
+
+	owned := []*Session{}
+	for _, dentry := range dentries {
+		id, err := middleware.ParseClientId(dentry.Name())
+		if err != nil {
+			continue
+		}
+		record, err := s.read(id)
+		if err != nil {
+			log.Errorf("action: load_session | result: fail | client_id: %s | error: %s", dentry.Name(), err)
+			continue
+		}
+		session, err := s.parseSession(record)
+		if err != nil {
+			log.Errorf("action: load_session | result: fail | client_id: %s | error: %s", dentry.Name(), err)
+			os.RemoveAll(s.path(id))
+			continue
+		}
+		if session.Owner != instance {
+			continue
+		}
+		s.open(session)
+		owned = append(owned, session)
+	}
+
+	return owned
+}
+
+func (s *Sessions) path(id middleware.ClientId) string {
+	return fmt.Sprintf("%s/%s", s.dir, id)
+}
+
+func (s *Sessions) read(id middleware.ClientId) ([]string, error) {
+	file, err := os.Open(s.path(id) + "/session.csv")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return csv.NewReader(file).Read()
+}
+
+func (s *Sessions) parseSession(record []string) (*Session, error) {
+	if len(record) != 11 {
+		return nil, fmt.Errorf("invalid session record: %v", record)
+	}
+
+	values := make([]int64, 0, len(record)-1)
+	for _, field := range record[1:] {
+		value, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	id, err := middleware.ParseClientId(record[0])
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		Id:                  id,
+		Owner:               int(values[0]),
+		Priority:            middleware.Priority(values[1]),
+		State:               SessionState(values[2]),
+		Games:               int(values[3]),
+		Reviews:             int(values[4]),
+		ReviewBatches:       int(values[5]),
+		ReviewsFinishedSent: values[6] == 1,
+		FinishedQueries:     int(values[7]),
+		CreatedAt:           time.Unix(0, values[8]),
+		UpdatedAt:           time.Unix(0, values[9]),
+	}
+
+	return session, nil
+}
+
+func (s *Sessions) open(session *Session) {
+	session.responses = shared.NewProcessed(s.path(session.Id) + "/responses.bin")
+	session.processedBatches = shared.NewProcessed(s.path(session.Id) + "/batches.bin")
+	s.openStats(session)
+	s.openPending(session)
+}
+
+// openStats lee <id>/stats.csv, una linea por batch con el batch y los pares
+// clave,cantidad de sus StatsCounts. Una linea escrita a medias se descarta:
+// ese batch todavia no estaba en batches.bin y el mapper lo vuelve a avisar.
+func (s *Sessions) openStats(session *Session) {
+	session.stats = middleware.StatsCounts{}
+	session.statsBatches = make(map[int]bool)
+
+	path := s.path(session.Id) + "/stats.csv"
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("action: load_session_stats | result: fail | client_id: %s | error: %s", session.Id, err)
+	}
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	if complete < len(data) {
+		os.Truncate(path, int64(complete))
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data[:complete]))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		log.Errorf("action: load_session_stats | result: fail | client_id: %s | error: %s", session.Id, err)
+	}
+	for _, record := range records {
+		batchId, err := strconv.Atoi(record[0])
+		if err != nil || session.statsBatches[batchId] {
+			continue
+		}
+		session.statsBatches[batchId] = true
+		for i := 1; i+1 < len(record); i += 2 {
+			count, _ := strconv.Atoi(record[i+1])
+			session.stats[record[i]] += count
+		}
+	}
+
+	session.statsFile, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0777)
+	if err != nil {
+		log.Errorf("action: open_session_stats | result: fail | client_id: %s | error: %s", session.Id, err)
+	}
+}
+
+// AddStats suma los stats que publico el mapper para un batch. Se escribe
+// antes de marcar el batch en batches.bin, con el lock del registro tomado.
+func (s *Sessions) AddStats(session *Session, batchId int, counts middleware.StatsCounts) {
+	if session.statsBatches[batchId] {
+		return
+	}
+
+	record := []string{strconv.Itoa(batchId)}
+	for key, count := range counts {
+		record = append(record, key, strconv.Itoa(count))
+	}
+	writer := csv.NewWriter(session.statsFile)
+	writer.Write(record)
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Errorf("action: save_session_stats | result: fail | client_id: %s | batch_id: %d | error: %s", session.Id, batchId, err)
+	}
+
+	session.statsBatches[batchId] = true
+	session.stats.Merge(counts)
+}
+
+// openPending lee <id>/pending.bin, las respuestas que llegaron con el cliente
+// desconectado. Cada una es un gob precedido por su largo. Una escrita a
+// medias se descarta: todavia no se habia ackeado y el broker la redelivera.
+func (s *Sessions) openPending(session *Session) {
+	session.pending = nil
+
+	path := s.path(session.Id) + "/pending.bin"
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("action: load_session_pending | result: fail | client_id: %s | error: %s", session.Id, err)
+		}
+		return
+	}
+
+	complete := 0
+	for complete+4 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[complete:]))
+		if complete+4+size > len(data) {
+			break
+		}
+		response := &middleware.Result{}
+		if err := gob.NewDecoder(bytes.NewReader(data[complete+4 : complete+4+size])).Decode(response); err != nil {
+			log.Errorf("action: load_session_pending | result: fail | client_id: %s | error: %s", session.Id, err)
+			break
+		}
+		session.pending = append(session.pending, response)
+		complete += 4 + size
+	}
+	if complete < len(data) {
+		os.Truncate(path, int64(complete))
+	}
+}
+
+// AddPending guarda una respuesta para mandarla cuando el cliente vuelva, asi
+// se puede ackear y no ocupa el prefetch de la cola de respuestas de la
+// instancia. Con el lock del registro tomado. Si devuelve error la respuesta
+// no quedo guardada y no hay que ackearla.
+func (s *Sessions) AddPending(session *Session, response *middleware.Result) error {
+	var buffer bytes.Buffer
+	buffer.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&buffer).Encode(response); err != nil {
+		return err
+	}
+	record := buffer.Bytes()
+	binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+
+	file, err := os.OpenFile(s.path(session.Id)+"/pending.bin", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0777)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(record); err != nil {
+		return err
+	}
+
+	session.pending = append(session.pending, response)
+	return nil
+}
+
+// clearPending olvida las respuestas pendientes, ya se mandaron o la sesion
+// se cancelo. Con el lock del registro tomado.
+func (s *Sessions) clearPending(session *Session) {
+	session.pending = nil
+	if err := os.Remove(s.path(session.Id) + "/pending.bin"); err != nil && !os.IsNotExist(err) {
+		log.Errorf("action: clear_session_pending | result: fail | client_id: %s | error: %s", session.Id, err)
+	}
+}
+
+// Create registra una sesion nueva subiendo juegos
+func (s *Sessions) Create(id middleware.ClientId, priority middleware.Priority) *Session {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	os.MkdirAll(s.path(id), 0777)
+
+	now := time.Now()
+	session := &Session{
+		Id:        id,
+		Owner:     s.instance,
+		Priority:  priority,
+		State:     SessionUploadingGames,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	s.open(session)
+	s.sessions[id] = session
+	s.save(session)
+
+	return session
+}
+
+func (s *Sessions) Get(id middleware.ClientId) (*Session, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[id]
+	return session, ok
+}
+
+// Owner devuelve la instancia duenia de una sesion, aunque no sea esta
+func (s *Sessions) Owner(id middleware.ClientId) (int, bool) {
+	if _, ok := s.Get(id); ok {
+		return s.instance, true
+	}
+
+	record, err := s.read(id)
+	if err != nil {
+		return 0, false
+	}
+	session, err := s.parseSession(record)
+	if err != nil {
+		return 0, false
+	}
+	return session.Owner, true
+}
+
+// Claim pasa a esta instancia las sesiones de una instancia caida
+func (s *Sessions) Claim(instance int) []*Session {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	claimed := s.loadOwnedBy(instance)
+	for _, session := range claimed {
+		session.Owner = s.instance
+		s.sessions[session.Id] = session
+		s.save(session)
+		log.Infof("action: claim_session | result: success | client_id: %s | from: %d", session.Id, instance)
+	}
+
+	return claimed
+}
+
+func (s *Sessions) All() []*Session {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	all := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		all = append(all, session)
+	}
+	return all
+}
+
+// Update aplica fn a la sesion con el lock tomado y la persiste
+func (s *Sessions) Update(session *Session, fn func(session *Session)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fn(session)
+	session.UpdatedAt = time.Now()
+	s.save(session)
+}
+
+// View aplica fn a la sesion con el lock tomado sin persistirla
+func (s *Sessions) View(session *Session, fn func(session *Session)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fn(session)
+}
+
+// Remove borra la sesion del registro y del disco
+func (s *Sessions) Remove(session *Session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.sessions[session.Id]; !ok {
+		return
+	}
+
+	delete(s.sessions, session.Id)
+	session.pending = nil
+	session.responses.Close()
+	session.processedBatches.Close()
+	session.statsFile.Close()
+	if err := os.RemoveAll(s.path(session.Id)); err != nil {
+		log.Errorf("action: remove_session | result: fail | client_id: %s | error: %s", session.Id, err)
+	}
+}
+
+// save escribe la sesion en un archivo temporal y lo renombra, asi un crash
+// nunca deja un session.csv a medio escribir
+func (s *Sessions) save(session *Session) {
+	if _, ok := s.sessions[session.Id]; !ok {
+		return
+	}
+
+	tmpFile, err := os.CreateTemp(s.path(session.Id), "session-*.csv")
+	if err != nil {
+		log.Errorf("action: save_session | result: fail | client_id: %s | error: %s", session.Id, err)
+		return
+	}
+	defer tmpFile.Close()
+
+	reviewsFinishedSent := 0
+	if session.ReviewsFinishedSent {
+		reviewsFinishedSent = 1
+	}
+
+	writer := csv.NewWriter(tmpFile)
+	writer.Write([]string{
+		session.Id.String(),
+		strconv.Itoa(session.Owner),
+		strconv.Itoa(int(session.Priority)),
+		strconv.Itoa(int(session.State)),
+		strconv.Itoa(session.Games),
+		strconv.Itoa(session.Reviews),
+		strconv.Itoa(session.ReviewBatches),
+		strconv.Itoa(reviewsFinishedSent),
+		strconv.Itoa(session.FinishedQueries),
+		strconv.FormatInt(session.CreatedAt.UnixNano(), 10),
+		strconv.FormatInt(session.UpdatedAt.UnixNano(), 10),
+	})
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Errorf("action: save_session | result: fail | client_id: %s | error: %s", session.Id, err)
+		return
+	}
+
+	if err := os.Rename(tmpFile.Name(), s.path(session.Id)+"/session.csv"); err != nil {
+		log.Errorf("action: save_session | result: fail | client_id: %s | error: %s", session.Id, err)
+	}
+}
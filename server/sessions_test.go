@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"tp1-distribuidos/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionStatsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	sessions := NewSessions(dir, 1)
+	session := sessions.Create(middleware.ClientId(1001), middleware.Priority(0))
+
+	sessions.View(session, func(session *Session) {
+		sessions.AddStats(session, 0, middleware.StatsCounts{"0.Action": 2, "1.Indie": 1})
+		sessions.AddStats(session, 1, middleware.StatsCounts{"0.Action": 3})
+		// un reviewsProcessed repetido no se suma dos veces
+		sessions.AddStats(session, 1, middleware.StatsCounts{"0.Action": 3})
+	})
+	session.statsFile.Close()
+
+	// un crash a mitad de una linea la deja sin terminar
+	file, err := os.OpenFile(dir+"/1001/stats.csv", os.O_WRONLY|os.O_APPEND, 0777)
+	assert.Nil(t, err)
+	file.WriteString("2,0.Act")
+	file.Close()
+
+	restored, ok := NewSessions(dir, 1).Get(middleware.ClientId(1001))
+	assert.True(t, ok)
+	assert.Equal(t, 5, restored.stats.Get(0, "Action"))
+	assert.Equal(t, 1, restored.stats.Get(1, "Indie"))
+	assert.Equal(t, 0, restored.stats.Get(1, "Action"))
+	assert.False(t, restored.statsBatches[2])
+}
+
+func TestSessionPendingSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	sessions := NewSessions(dir, 1)
+	session := sessions.Create(middleware.ClientId(1002), middleware.Priority(0))
+
+	sessions.View(session, func(session *Session) {
+		assert.Nil(t, sessions.AddPending(session, &middleware.Result{Id: 1, ClientId: 1002, QueryId: 1, Payload: middleware.Query1Result{Windows: 3}}))
+		assert.Nil(t, sessions.AddPending(session, &middleware.Result{Id: 2, ClientId: 1002, QueryId: 2, IsFinalMessage: true}))
+	})
+
+	// un crash a mitad de una respuesta la deja sin terminar
+	file, err := os.OpenFile(dir+"/1002/pending.bin", os.O_WRONLY|os.O_APPEND, 0777)
+	assert.Nil(t, err)
+	file.Write([]byte{0, 0, 0, 50, 1, 2})
+	file.Close()
+
+	restarted := NewSessions(dir, 1)
+	restored, ok := restarted.Get(middleware.ClientId(1002))
+	assert.True(t, ok)
+	assert.Len(t, restored.pending, 2)
+	assert.Equal(t, int64(1), restored.pending[0].Id)
+	assert.Equal(t, middleware.Query1Result{Windows: 3}, restored.pending[0].Payload)
+	assert.True(t, restored.pending[1].IsFinalMessage)
+
+	restarted.View(restored, func(session *Session) {
+		restarted.clearPending(session)
+	})
+	restored, _ = NewSessions(dir, 1).Get(middleware.ClientId(1002))
+	assert.Empty(t, restored.pending)
+}
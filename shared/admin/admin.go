@@ -0,0 +1,132 @@
+package admin
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/logs"
+)
+
+var log = logs.Get("admin")
+
+// DEFAULT_IDS es cuantos ids de cada Processed se muestran si no se pide otro
+// limite, los archivos pueden tener millones
+const DEFAULT_IDS = 20
+
+// State es lo que un nodo tiene persistido en su directorio: los archivos de
+// Processed (*.bin) y el commit en curso. Sin cliente es el estado global del
+// nodo y la lista de clientes con directorio.
+type State struct {
+	Node      string                    `json:"node,omitempty"`
+	Client    string                    `json:"client,omitempty"`
+	Processed map[string]ProcessedState `json:"processed"`
+	Commit    [][]string                `json:"commit,omitempty"`
+	Clients   []string                  `json:"clients,omitempty"`
+}
+
+type ProcessedState struct {
+	Count int     `json:"count"`
+	Last  []int64 `json:"last"` // los ultimos agregados
+}
+
+// ReadState lee el estado sin tocar los archivos, el nodo puede estar
+// escribiendolos
+func ReadState(dir string, client string, ids int) (*State, error) {
+	path := dir
+	if client != "" {
+		if _, err := middleware.ParseClientId(client); err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, client)
+	}
+
+	dentries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &State{Client: client, Processed: make(map[string]ProcessedState)}
+	for _, dentry := range dentries {
+		name := dentry.Name()
+		switch {
+		case dentry.IsDir():
+			if _, err := middleware.ParseClientId(name); err == nil && client == "" {
+				state.Clients = append(state.Clients, name)
+			}
+		case strings.HasSuffix(name, ".bin"):
+			processed, err := shared.ReadProcessed(filepath.Join(path, name))
+			if err != nil {
+				return nil, err
+			}
+			state.Processed[name] = ProcessedState{Count: len(processed), Last: processed[max(len(processed)-ids, 0):]}
+		case name == "commit.csv":
+			commit, err := readCommit(filepath.Join(path, name))
+			if err != nil {
+				return nil, err
+			}
+			state.Commit = commit
+		}
+	}
+	sort.Strings(state.Clients)
+
+	return state, nil
+}
+
+func readCommit(path string) ([][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	return reader.ReadAll()
+}
+
+// StateHandler sirve GET /admin/state?client=<id>&ids=<n> con el estado del
+// directorio del nodo
+func StateHandler(node string, dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids := DEFAULT_IDS
+		if value := r.URL.Query().Get("ids"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				WriteError(w, http.StatusBadRequest, "invalid ids")
+				return
+			}
+			ids = parsed
+		}
+
+		state, err := ReadState(dir, r.URL.Query().Get("client"), ids)
+		if os.IsNotExist(err) {
+			WriteError(w, http.StatusNotFound, "no state for client")
+			return
+		}
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		state.Node = node
+		WriteJSON(w, http.StatusOK, state)
+	})
+}
+
+func WriteJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Errorf("action: admin_response | result: fail | error: %s", err)
+	}
+}
+
+func WriteError(w http.ResponseWriter, status int, message string) {
+	WriteJSON(w, status, map[string]string{"error": message})
+}
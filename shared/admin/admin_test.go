@@ -0,0 +1,57 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"tp1-distribuidos/shared"
+	"tp1-distribuidos/shared/tracing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadState(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "42"), 0777)
+
+	processed := shared.NewProcessed(filepath.Join(dir, "42", "processed.bin"))
+	for id := int64(1); id <= 5; id++ {
+		processed.Add(id)
+	}
+	processed.Close()
+
+	commit := shared.NewCommit(filepath.Join(dir, "42", "commit.csv"))
+	commit.Write(tracing.ClientTrace(42), [][]string{{"42", "7", "tmp", "real"}})
+	commit.Close()
+
+	state, err := ReadState(dir, "", DEFAULT_IDS)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"42"}, state.Clients)
+
+	state, err = ReadState(dir, "42", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, ProcessedState{Count: 5, Last: []int64{4, 5}}, state.Processed["processed.bin"])
+	assert.Equal(t, [][]string{{"42", "7", "tmp", "real"}, {"END"}}, state.Commit)
+
+	_, err = ReadState(dir, "../etc", DEFAULT_IDS)
+	assert.Error(t, err)
+}
+
+func TestStateHandler(t *testing.T) {
+	dir := t.TempDir()
+
+	recorder := httptest.NewRecorder()
+	StateHandler("query-1.0", dir).ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/state?client=7", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	StateHandler("query-1.0", dir).ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/state", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	state := State{}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &state))
+	assert.Equal(t, "query-1.0", state.Node)
+}
@@ -0,0 +1,71 @@
+package shared
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"tp1-distribuidos/middleware"
+)
+
+const clientIdCounterBits = 32
+const clientIdEpochBits = 16
+
+// ClientIdAllocator assigns client ids that are unique across server
+// instances and restarts: instance (16 bits) | epoch (16 bits) | counter
+// (32 bits). The epoch is incremented and persisted every time an allocator is
+// created, so the counter can start from zero again without repeating ids.
+type ClientIdAllocator struct {
+	lock    sync.Mutex
+	prefix  uint64
+	counter uint64
+}
+
+func NewClientIdAllocator(path string, instance int) (*ClientIdAllocator, error) {
+	epoch := uint64(0)
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) == 8 {
+		epoch = binary.BigEndian.Uint64(data) + 1
+	}
+
+	if err := storeEpoch(path, epoch); err != nil {
+		return nil, fmt.Errorf("failed to store client id epoch: %w", err)
+	}
+
+	epoch &= 1<<clientIdEpochBits - 1
+	return &ClientIdAllocator{
+		prefix: uint64(instance)<<(clientIdCounterBits+clientIdEpochBits) | epoch<<clientIdCounterBits,
+	}, nil
+}
+
+// storeEpoch writes the epoch to a temp file and renames it, a crash leaves
+// either the previous epoch or the new one
+func storeEpoch(path string, epoch uint64) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "epoch-*.bin")
+	if err != nil {
+		return err
+	}
+	defer tmpFile.Close()
+
+	if err := binary.Write(tmpFile, binary.BigEndian, epoch); err != nil {
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+func (a *ClientIdAllocator) Next() middleware.ClientId {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.counter++
+	return middleware.ClientId(a.prefix | a.counter&(1<<clientIdCounterBits-1))
+}
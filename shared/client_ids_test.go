@@ -0,0 +1,29 @@
+package shared
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"tp1-distribuidos/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIdsUniqueAcrossRestartsAndInstances(t *testing.T) {
+	dir := t.TempDir()
+	seen := make(map[middleware.ClientId]bool)
+
+	for restart := 0; restart < 3; restart++ {
+		for instance := 0; instance < 2; instance++ {
+			path := filepath.Join(dir, fmt.Sprintf("epoch-%d.bin", instance))
+			allocator, err := NewClientIdAllocator(path, instance)
+			assert.Nil(t, err)
+
+			for i := 0; i < 100; i++ {
+				id := allocator.Next()
+				assert.False(t, seen[id], "id %s repeated", id)
+				seen[id] = true
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package shared
+
+import (
+	"os"
+)
+
+// EndOfStream decide cuando termino el stream de un cliente en cada shard: el
+// Last trae el total de mensajes que se mandaron al shard y el shard termina
+// cuando se recibieron todos, llegue el Last antes o despues que el resto.
+// Los ids recibidos se guardan en <dir>/received.bin y los totales en
+// <dir>/totals.bin, los dos con el shard en los 32 bits altos, asi los
+// redeliveries no se cuentan dos veces y un reinicio no pierde el Last.
+type EndOfStream struct {
+	received *Processed
+	totals   *Processed
+	counts   map[int]int
+	expected map[int]int
+}
+
+func NewEndOfStream(dir string) *EndOfStream {
+	os.MkdirAll(dir, 0777)
+
+	eos := &EndOfStream{
+		received: NewProcessed(dir + "/received.bin"),
+		totals:   NewProcessed(dir + "/totals.bin"),
+		counts:   make(map[int]int),
+		expected: make(map[int]int),
+	}
+
+	for id := range eos.received.Data() {
+		eos.counts[int(id>>32)]++
+	}
+	for total := range eos.totals.Data() {
+		eos.expected[int(total>>32)] = int(total & 0xFFFFFFFF)
+	}
+
+	return eos
+}
+
+func eosKey(shardId int, value int) int64 {
+	return int64(shardId)<<32 | int64(value)
+}
+
+// Receive cuenta un mensaje del shard, devuelve false si ya se habia contado
+func (e *EndOfStream) Receive(shardId int, id int) bool {
+	key := eosKey(shardId, id)
+	if e.received.Contains(key) {
+		return false
+	}
+	e.received.Add(key)
+	e.counts[shardId]++
+	return true
+}
+
+// Expect registra el total que anuncio el Last del shard
+func (e *EndOfStream) Expect(shardId int, total int) {
+	if _, ok := e.expected[shardId]; ok {
+		return
+	}
+	e.totals.Add(eosKey(shardId, total))
+	e.expected[shardId] = total
+}
+
+// Done indica si llego el Last del shard y todos los mensajes que anuncio
+func (e *EndOfStream) Done(shardId int) bool {
+	total, ok := e.expected[shardId]
+	return ok && e.counts[shardId] >= total
+}
+
+// Finished indica si terminaron los shards 0..shards-1
+func (e *EndOfStream) Finished(shards int) bool {
+	for shardId := range shards {
+		if !e.Done(shardId) {
+			return false
+		}
+	}
+	return true
+}
+
+// Received devuelve cuantos mensajes distintos llegaron del shard
+func (e *EndOfStream) Received(shardId int) int {
+	return e.counts[shardId]
+}
+
+func (e *EndOfStream) Close() {
+	if e == nil {
+		return
+	}
+	e.received.Close()
+	e.totals.Close()
+}
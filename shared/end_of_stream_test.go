@@ -0,0 +1,51 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndOfStreamLastBeforeMessages(t *testing.T) {
+	eos := NewEndOfStream(t.TempDir())
+	defer eos.Close()
+
+	eos.Expect(0, 2)
+	eos.Expect(1, 0)
+	assert.False(t, eos.Done(0))
+	assert.True(t, eos.Done(1))
+
+	assert.True(t, eos.Receive(0, 10))
+	assert.False(t, eos.Receive(0, 10))
+	assert.False(t, eos.Finished(2))
+
+	// el mismo id en otro shard es otro mensaje
+	assert.True(t, eos.Receive(1, 11))
+	assert.False(t, eos.Done(0))
+
+	assert.True(t, eos.Receive(0, 11))
+	assert.True(t, eos.Finished(2))
+	assert.Equal(t, 2, eos.Received(0))
+}
+
+func TestEndOfStreamSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	eos := NewEndOfStream(dir)
+	eos.Receive(2, 1)
+	eos.Receive(2, 2)
+	eos.Expect(2, 3)
+	eos.Close()
+
+	reopened := NewEndOfStream(dir)
+	defer reopened.Close()
+
+	assert.Equal(t, 2, reopened.Received(2))
+	assert.False(t, reopened.Done(2))
+
+	// un Last redeliverado no pisa el total
+	reopened.Expect(2, 5)
+	assert.False(t, reopened.Receive(2, 2))
+	assert.True(t, reopened.Receive(2, 3))
+	assert.True(t, reopened.Done(2))
+}
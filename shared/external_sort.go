@@ -0,0 +1,200 @@
+package shared
+
+import (
+	"container/heap"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"tp1-distribuidos/middleware"
+)
+
+// StatsSorter sorts an arbitrary amount of stats using an external merge sort.
+// Stats are buffered in memory until chunkSize is reached, then the chunk is
+// sorted and spilled to disk as a run. Sort merges every run into a single
+// sorted csv file (appId,name,positives,negatives).
+type StatsSorter struct {
+	dir       string
+	chunkSize int
+	less      func(a *middleware.Stats, b *middleware.Stats) bool
+	chunk     []middleware.Stats
+	runs      []string
+}
+
+func NewStatsSorter(dir string, chunkSize int, less func(a *middleware.Stats, b *middleware.Stats) bool) *StatsSorter {
+	os.MkdirAll(dir, 0777)
+	return &StatsSorter{
+		dir:       dir,
+		chunkSize: chunkSize,
+		less:      less,
+		chunk:     make([]middleware.Stats, 0, chunkSize),
+		runs:      make([]string, 0),
+	}
+}
+
+// ByNegativesDesc orders stats by negatives (descending) breaking ties by
+// appId so the order is total and every shard sorts the same way.
+func ByNegativesDesc(a *middleware.Stats, b *middleware.Stats) bool {
+	if a.Negatives != b.Negatives {
+		return a.Negatives > b.Negatives
+	}
+	return a.AppId < b.AppId
+}
+
+func (s *StatsSorter) Add(stat middleware.Stats) error {
+	s.chunk = append(s.chunk, stat)
+	if len(s.chunk) >= s.chunkSize {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *StatsSorter) spill() error {
+	if len(s.chunk) == 0 {
+		return nil
+	}
+
+	sort.Slice(s.chunk, func(i, j int) bool {
+		return s.less(&s.chunk[i], &s.chunk[j])
+	})
+
+	run, err := os.CreateTemp(s.dir, "run-*.csv")
+	if err != nil {
+		return err
+	}
+	defer run.Close()
+
+	writer := csv.NewWriter(run)
+	for _, stat := range s.chunk {
+		if err := writer.Write(StatRecord(&stat)); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+
+	s.runs = append(s.runs, run.Name())
+	s.chunk = s.chunk[:0]
+	return nil
+}
+
+// Sort merges every run into outPath and removes the runs. The output is
+// written to a temp file and renamed so a crash never leaves a partial file.
+func (s *StatsSorter) Sort(outPath string) error {
+	if err := s.spill(); err != nil {
+		return err
+	}
+	defer s.removeRuns()
+
+	tmpFile, err := os.CreateTemp(s.dir, "sorted-*.csv")
+	if err != nil {
+		return err
+	}
+	defer tmpFile.Close()
+
+	writer := csv.NewWriter(tmpFile)
+
+	runsHeap := &statsRunHeap{less: s.less}
+	for _, runName := range s.runs {
+		run, err := os.Open(runName)
+		if err != nil {
+			return err
+		}
+		defer run.Close()
+
+		cursor := &statsRun{reader: csv.NewReader(run)}
+		ok, err := cursor.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			runsHeap.runs = append(runsHeap.runs, cursor)
+		}
+	}
+	heap.Init(runsHeap)
+
+	for runsHeap.Len() > 0 {
+		cursor := runsHeap.runs[0]
+		if err := writer.Write(StatRecord(cursor.current)); err != nil {
+			return err
+		}
+
+		ok, err := cursor.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(runsHeap, 0)
+		} else {
+			heap.Pop(runsHeap)
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), outPath)
+}
+
+// Discard removes the runs spilled so far without merging them, used when the
+// input could not be read completely.
+func (s *StatsSorter) Discard() {
+	s.chunk = s.chunk[:0]
+	s.removeRuns()
+}
+
+func (s *StatsSorter) removeRuns() {
+	for _, run := range s.runs {
+		os.Remove(run)
+	}
+	s.runs = s.runs[:0]
+}
+
+type statsRun struct {
+	reader  *csv.Reader
+	current *middleware.Stats
+}
+
+func (r *statsRun) next() (bool, error) {
+	record, err := r.reader.Read()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	stat, err := ParseStat(record)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse run record: %w", err)
+	}
+	r.current = stat
+	return true, nil
+}
+
+type statsRunHeap struct {
+	runs []*statsRun
+	less func(a *middleware.Stats, b *middleware.Stats) bool
+}
+
+func (h *statsRunHeap) Len() int { return len(h.runs) }
+func (h *statsRunHeap) Less(i, j int) bool {
+	return h.less(h.runs[i].current, h.runs[j].current)
+}
+func (h *statsRunHeap) Swap(i, j int) { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+func (h *statsRunHeap) Push(x any)    { h.runs = append(h.runs, x.(*statsRun)) }
+func (h *statsRunHeap) Pop() any {
+	last := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return last
+}
+
+func StatRecord(stat *middleware.Stats) []string {
+	return []string{strconv.Itoa(stat.AppId), stat.Name, strconv.Itoa(stat.Positives), strconv.Itoa(stat.Negatives)}
+}
@@ -0,0 +1,99 @@
+package shared
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"tp1-distribuidos/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func randomStats(r *rand.Rand, n int) []middleware.Stats {
+	stats := make([]middleware.Stats, 0, n)
+	for i := 0; i < n; i++ {
+		stats = append(stats, middleware.Stats{
+			AppId:     i + 1,
+			Name:      fmt.Sprintf("Game, %d", i+1),
+			Positives: r.Intn(50),
+			Negatives: r.Intn(30) + 1,
+		})
+	}
+	return stats
+}
+
+func readSorted(t *testing.T, path string) []middleware.Stats {
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	assert.Nil(t, err)
+
+	sorted := make([]middleware.Stats, 0, len(records))
+	for _, record := range records {
+		stat, err := ParseStat(record)
+		assert.Nil(t, err)
+		sorted = append(sorted, *stat)
+	}
+	return sorted
+}
+
+func TestStatsSorterMatchesBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(26))
+
+	for _, chunkSize := range []int{1, 7, 100, 5000} {
+		dir := t.TempDir()
+		stats := randomStats(r, 1000)
+
+		sorter := NewStatsSorter(filepath.Join(dir, "runs"), chunkSize, ByNegativesDesc)
+		for _, stat := range stats {
+			assert.Nil(t, sorter.Add(stat))
+		}
+
+		out := filepath.Join(dir, "sorted.csv")
+		assert.Nil(t, sorter.Sort(out))
+
+		expected := append([]middleware.Stats{}, stats...)
+		sort.Slice(expected, func(i, j int) bool {
+			return ByNegativesDesc(&expected[i], &expected[j])
+		})
+
+		assert.Equal(t, expected, readSorted(t, out), "chunk size %d", chunkSize)
+
+		runs, err := os.ReadDir(filepath.Join(dir, "runs"))
+		assert.Nil(t, err)
+		assert.Empty(t, runs, "runs should be removed after sorting")
+	}
+}
+
+func TestStatsSorterEmpty(t *testing.T) {
+	dir := t.TempDir()
+	sorter := NewStatsSorter(filepath.Join(dir, "runs"), 10, ByNegativesDesc)
+
+	out := filepath.Join(dir, "sorted.csv")
+	assert.Nil(t, sorter.Sort(out))
+	assert.Empty(t, readSorted(t, out))
+}
+
+func TestStatsSorterDiscardRemovesRuns(t *testing.T) {
+	dir := t.TempDir()
+	sorter := NewStatsSorter(filepath.Join(dir, "runs"), 2, ByNegativesDesc)
+	for _, stat := range randomStats(rand.New(rand.NewSource(5)), 5) {
+		assert.Nil(t, sorter.Add(stat))
+	}
+
+	sorter.Discard()
+
+	runs, err := os.ReadDir(filepath.Join(dir, "runs"))
+	assert.Nil(t, err)
+	assert.Empty(t, runs)
+
+	out := filepath.Join(dir, "sorted.csv")
+	assert.Nil(t, sorter.Sort(out))
+	assert.Empty(t, readSorted(t, out))
+}
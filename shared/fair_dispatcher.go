@@ -0,0 +1,175 @@
+package shared
+
+import (
+	"sync"
+	"tp1-distribuidos/middleware"
+)
+
+// FairDispatcher reparte el procesamiento entre clientes. Cada cliente tiene
+// su propia cola en memoria y se atienden en round-robin, quantum mensajes
+// por turno, asi un cliente grande no frena a uno chico que llego despues.
+// Los clientes de mayor prioridad se atienden antes que los de menor, el
+// round-robin es entre los clientes de la prioridad mas alta con mensajes.
+// Los mensajes de un mismo cliente se procesan en el orden en que llegaron.
+// No hay limite de mensajes en memoria, lo acota el prefetch del broker
+// porque nada se ackea antes de procesarse.
+type FairDispatcher[T any] struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	quantum int
+	queues  map[middleware.ClientId][]T
+	rings   map[middleware.Priority][]middleware.ClientId // clientes con mensajes pendientes
+	pending int                                           // cantidad de clientes en los rings
+	closed  bool
+}
+
+func NewFairDispatcher[T any](quantum int) *FairDispatcher[T] {
+	if quantum <= 0 {
+		quantum = 1
+	}
+
+	dispatcher := &FairDispatcher[T]{
+		quantum: quantum,
+		queues:  make(map[middleware.ClientId][]T),
+		rings:   make(map[middleware.Priority][]middleware.ClientId),
+	}
+	dispatcher.cond = sync.NewCond(&dispatcher.lock)
+	return dispatcher
+}
+
+// Push encola un mensaje del cliente. La prioridad es la del cliente, se toma
+// la del mensaje que lo agrega al ring.
+func (d *FairDispatcher[T]) Push(clientId middleware.ClientId, priority middleware.Priority, item T) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if len(d.queues[clientId]) == 0 {
+		d.rings[priority] = append(d.rings[priority], clientId)
+		d.pending++
+	}
+	d.queues[clientId] = append(d.queues[clientId], item)
+	d.cond.Signal()
+}
+
+// next devuelve el turno del primer cliente del ring de mayor prioridad y lo
+// manda al final si le quedan mensajes
+func (d *FairDispatcher[T]) next() ([]T, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for d.pending == 0 && !d.closed {
+		d.cond.Wait()
+	}
+	if d.pending == 0 {
+		return nil, false
+	}
+
+	priority := d.highest()
+	ring := d.rings[priority]
+	clientId := ring[0]
+	ring = ring[1:]
+
+	queue := d.queues[clientId]
+	turn := queue[:min(d.quantum, len(queue))]
+	if len(queue) == len(turn) {
+		delete(d.queues, clientId)
+		d.pending--
+	} else {
+		d.queues[clientId] = queue[len(turn):]
+		ring = append(ring, clientId)
+	}
+
+	if len(ring) == 0 {
+		delete(d.rings, priority)
+	} else {
+		d.rings[priority] = ring
+	}
+
+	return turn, true
+}
+
+func (d *FairDispatcher[T]) highest() middleware.Priority {
+	highest := middleware.Priority(0)
+	for priority := range d.rings {
+		if priority > highest {
+			highest = priority
+		}
+	}
+	return highest
+}
+
+// Run procesa los mensajes hasta que se cierra el dispatcher y se vacian las
+// colas
+func (d *FairDispatcher[T]) Run(handle func(item T)) {
+	for {
+		turn, ok := d.next()
+		if !ok {
+			return
+		}
+		for _, item := range turn {
+			handle(item)
+		}
+	}
+}
+
+// Drain vacia las colas y devuelve los mensajes que no se llegaron a procesar
+func (d *FairDispatcher[T]) Drain() []T {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	pending := []T{}
+	for _, ring := range d.rings {
+		for _, clientId := range ring {
+			pending = append(pending, d.queues[clientId]...)
+		}
+	}
+	d.queues = make(map[middleware.ClientId][]T)
+	d.rings = make(map[middleware.Priority][]middleware.ClientId)
+	d.pending = 0
+	return pending
+}
+
+func (d *FairDispatcher[T]) Close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.closed = true
+	d.cond.Broadcast()
+}
+
+type ClientMessage interface {
+	GetClientId() middleware.ClientId
+	GetPriority() middleware.Priority
+	Nack()
+}
+
+// ConsumeFair consume de una cola del broker y procesa los mensajes con un
+// FairDispatcher. Cuando se termina de consumir (se esta apagando el nodo)
+// los mensajes que quedaron en memoria se nackean, y devuelve cuando termina
+// el que se estaba procesando.
+func ConsumeFair[T ClientMessage](quantum int, consume func(callback func(message T) error) error, callback func(message T) error) error {
+	dispatcher := NewFairDispatcher[T](quantum)
+
+	done := make(chan struct{})
+	go func() {
+		dispatcher.Run(func(message T) {
+			if err := callback(message); err != nil {
+				log.Errorf("action: fair_dispatch | result: fail | client: %s | error: %s", message.GetClientId(), err)
+			}
+		})
+		close(done)
+	}()
+
+	err := consume(func(message T) error {
+		dispatcher.Push(message.GetClientId(), message.GetPriority(), message)
+		return nil
+	})
+
+	for _, message := range dispatcher.Drain() {
+		message.Nack()
+	}
+	dispatcher.Close()
+	<-done
+
+	return err
+}
@@ -0,0 +1,80 @@
+package shared
+
+import (
+	"testing"
+	"tp1-distribuidos/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type item struct {
+	client middleware.ClientId
+	id     int
+}
+
+func TestFairDispatcherRoundRobin(t *testing.T) {
+	dispatcher := NewFairDispatcher[item](2)
+
+	// el cliente grande llega primero con todos sus mensajes
+	for i := 0; i < 6; i++ {
+		dispatcher.Push(1, middleware.PriorityNormal, item{1, i})
+	}
+	for i := 0; i < 3; i++ {
+		dispatcher.Push(2, middleware.PriorityNormal, item{2, i})
+	}
+	dispatcher.Close()
+
+	processed := []item{}
+	dispatcher.Run(func(it item) {
+		processed = append(processed, it)
+	})
+
+	assert.Equal(t, []item{
+		{1, 0}, {1, 1},
+		{2, 0}, {2, 1},
+		{1, 2}, {1, 3},
+		{2, 2},
+		{1, 4}, {1, 5},
+	}, processed)
+}
+
+func TestFairDispatcherHighPriorityOvertakes(t *testing.T) {
+	dispatcher := NewFairDispatcher[item](1)
+
+	for i := 0; i < 3; i++ {
+		dispatcher.Push(1, middleware.PriorityLow, item{1, i})
+	}
+	for i := 0; i < 2; i++ {
+		dispatcher.Push(2, middleware.PriorityHigh, item{2, i})
+		dispatcher.Push(3, middleware.PriorityHigh, item{3, i})
+	}
+	dispatcher.Close()
+
+	processed := []item{}
+	dispatcher.Run(func(it item) {
+		processed = append(processed, it)
+	})
+
+	assert.Equal(t, []item{
+		{2, 0}, {3, 0},
+		{2, 1}, {3, 1},
+		{1, 0}, {1, 1}, {1, 2},
+	}, processed)
+}
+
+func TestFairDispatcherDrain(t *testing.T) {
+	dispatcher := NewFairDispatcher[item](1)
+
+	dispatcher.Push(1, middleware.PriorityNormal, item{1, 0})
+	dispatcher.Push(1, middleware.PriorityNormal, item{1, 1})
+	dispatcher.Push(2, middleware.PriorityHigh, item{2, 0})
+
+	assert.ElementsMatch(t, []item{{1, 0}, {1, 1}, {2, 0}}, dispatcher.Drain())
+
+	dispatcher.Close()
+	processed := []item{}
+	dispatcher.Run(func(it item) {
+		processed = append(processed, it)
+	})
+	assert.Empty(t, processed)
+}
@@ -0,0 +1,136 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"tp1-distribuidos/shared/logs"
+	"tp1-distribuidos/shared/metrics"
+)
+
+var log = logs.Get("health")
+
+// el ping UDP del reviver tambien usa el 8080, no se pisan
+const DEFAULT_PORT = 8080
+
+type Check func() error
+
+// Health sirve /healthz (el nodo esta vivo, si falla hay que reiniciarlo) y
+// /readyz (el nodo puede recibir trabajo). Cada endpoint corre sus chequeos
+// y responde 200 o 503 con una linea por chequeo. En el mismo puerto se
+// sirve /metrics.
+type Health struct {
+	lock      sync.Mutex
+	liveness  []namedCheck
+	readiness []namedCheck
+	handlers  map[string]http.Handler
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+func New() *Health {
+	return &Health{handlers: make(map[string]http.Handler)}
+}
+
+// Liveness registra un chequeo de /healthz, tambien se usa en /readyz
+func (h *Health) Liveness(name string, check Check) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.liveness = append(h.liveness, namedCheck{name, check})
+}
+
+// Readiness registra un chequeo que solo se usa en /readyz
+func (h *Health) Readiness(name string, check Check) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.readiness = append(h.readiness, namedCheck{name, check})
+}
+
+// Handle agrega un endpoint en el mismo puerto, por ejemplo los de admin. El
+// pattern es el de http.ServeMux.
+func (h *Health) Handle(pattern string, handler http.Handler) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.handlers[pattern] = handler
+}
+
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h.serve(w, h.checks(false))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.serve(w, h.checks(true))
+	})
+	mux.Handle("/metrics", metrics.Handler())
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for pattern, handler := range h.handlers {
+		mux.Handle(pattern, handler)
+	}
+	return mux
+}
+
+// ListenAndServe bloquea sirviendo los endpoints en el puerto
+func (h *Health) ListenAndServe(port int) error {
+	if port <= 0 {
+		port = DEFAULT_PORT
+	}
+	err := http.ListenAndServe(fmt.Sprintf(":%d", port), h.Handler())
+	log.Errorf("action: health_server | result: fail | port: %d | error: %s", port, err)
+	return err
+}
+
+func (h *Health) checks(readiness bool) []namedCheck {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	checks := append([]namedCheck{}, h.liveness...)
+	if readiness {
+		checks = append(checks, h.readiness...)
+	}
+	return checks
+}
+
+func (h *Health) serve(w http.ResponseWriter, checks []namedCheck) {
+	lines := []string{}
+	healthy := true
+	for _, check := range checks {
+		if err := check.check(); err != nil {
+			healthy = false
+			lines = append(lines, fmt.Sprintf("%s: fail: %s", check.name, err))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: ok", check.name))
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, strings.Join(lines, "\n"))
+}
+
+// Writable chequea que se pueda escribir en dir, donde el nodo guarda su
+// estado
+func Writable(dir string) Check {
+	return func() error {
+		file, err := os.CreateTemp(dir, ".health-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		if _, err := file.WriteString("ok"); err != nil {
+			return err
+		}
+		return file.Sync()
+	}
+}
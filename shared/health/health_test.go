@@ -0,0 +1,60 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	health := New()
+
+	ready := errors.New("draining")
+	health.Liveness("disk", Writable(t.TempDir()))
+	health.Readiness("lifecycle", func() error { return ready })
+
+	server := httptest.NewServer(health.Handler())
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/healthz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	response, err = http.Get(server.URL + "/readyz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+
+	ready = nil
+	response, err = http.Get(server.URL + "/readyz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func TestWritableFailsOnMissingDir(t *testing.T) {
+	assert.Error(t, Writable(t.TempDir()+"/missing")())
+}
+
+func TestProgressDetectsStalledConsumer(t *testing.T) {
+	progress := NewProgress(10 * time.Second)
+	now := time.Now()
+
+	// sin pendientes nunca esta trabado
+	assert.NoError(t, progress.check(now.Add(time.Minute)))
+
+	progress.Received()
+	progress.Received()
+	progress.Finished()
+	assert.NoError(t, progress.check(now.Add(time.Minute)))
+
+	// queda una pendiente pero todavia no paso el timeout
+	assert.NoError(t, progress.check(now.Add(time.Minute+5*time.Second)))
+	assert.Error(t, progress.check(now.Add(time.Minute+11*time.Second)))
+
+	// en cuanto termina una se recupera
+	progress.Finished()
+	assert.NoError(t, progress.check(now.Add(2*time.Minute)))
+}
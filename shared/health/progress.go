@@ -0,0 +1,64 @@
+package health
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_STALL_TIMEOUT = 60 * time.Second
+
+// Progress cuenta las deliveries que recibe un nodo y las que ya se
+// ackearon o nackearon. El consumidor esta trabado si tiene deliveries
+// pendientes y no termino ninguna desde el chequeo anterior por mas de
+// stallTimeout, el ping UDP no lo detecta porque lo contesta otra goroutine.
+type Progress struct {
+	received     atomic.Int64
+	finished     atomic.Int64
+	stallTimeout time.Duration
+	lock         sync.Mutex
+	checked      int64     // finished en el ultimo chequeo que vio progreso
+	checkedAt    time.Time // cuando fue ese chequeo
+}
+
+func NewProgress(stallTimeout time.Duration) *Progress {
+	if stallTimeout <= 0 {
+		stallTimeout = DEFAULT_STALL_TIMEOUT
+	}
+	return &Progress{stallTimeout: stallTimeout, checkedAt: time.Now()}
+}
+
+func (p *Progress) Received() {
+	p.received.Add(1)
+}
+
+func (p *Progress) Finished() {
+	p.finished.Add(1)
+}
+
+func (p *Progress) Pending() int64 {
+	return p.received.Load() - p.finished.Load()
+}
+
+func (p *Progress) Check() error {
+	return p.check(time.Now())
+}
+
+func (p *Progress) check(now time.Time) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	finished := p.finished.Load()
+	pending := p.received.Load() - finished
+	if finished != p.checked || pending == 0 {
+		p.checked = finished
+		p.checkedAt = now
+		return nil
+	}
+
+	if stalled := now.Sub(p.checkedAt); stalled > p.stallTimeout {
+		return fmt.Errorf("%d deliveries pending and none finished in %s", pending, stalled.Round(time.Second))
+	}
+	return nil
+}
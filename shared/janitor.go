@@ -0,0 +1,167 @@
+package shared
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared/metrics"
+)
+
+const JANITOR_DEFAULT_INTERVAL = 60 * time.Second
+
+// janitor borra el estado de los clientes abandonados cuyo ClientsFinished
+// nunca llego. Hay uno por proceso aunque el proceso tenga varios
+// FinishedClients, y cuando un cliente vence se lo marca terminado en todos
+// para ignorar lo que llegue despues. Un cliente vence cuando pasa el ttl sin
+// escribir en disco ni consumirse un mensaje suyo, asi los clientes lentos y
+// los que solo escriben al final (reducers) no se borran mientras siguen
+// llegando mensajes. Al arrancar todos los clientes cuentan como activos.
+type janitor struct {
+	lock     sync.Mutex
+	started  time.Time
+	lastSeen map[middleware.ClientId]time.Time
+	nodes    []*FinishedClients
+	once     sync.Once
+}
+
+var processJanitor = newJanitor(time.Now())
+
+func newJanitor(started time.Time) *janitor {
+	return &janitor{started: started, lastSeen: make(map[middleware.ClientId]time.Time)}
+}
+
+// register suma los FinishedClients del proceso y arranca el janitor la
+// primera vez
+func (j *janitor) register(fc *FinishedClients, dir string, ttl time.Duration, interval time.Duration) {
+	j.lock.Lock()
+	j.nodes = append(j.nodes, fc)
+	j.lock.Unlock()
+
+	j.once.Do(func() {
+		go j.run(dir, ttl, interval)
+	})
+}
+
+// touch registra que se consumio un mensaje del cliente
+func (j *janitor) touch(clientId middleware.ClientId, now time.Time) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.lastSeen[clientId] = now
+}
+
+func (j *janitor) forget(clientId middleware.ClientId) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	delete(j.lastSeen, clientId)
+}
+
+func (j *janitor) idle(clientId middleware.ClientId, ttl time.Duration, now time.Time) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	last := j.started
+	if seen, ok := j.lastSeen[clientId]; ok && seen.After(last) {
+		last = seen
+	}
+	return now.Sub(last) > ttl
+}
+
+func (j *janitor) run(dir string, ttl time.Duration, interval time.Duration) {
+	if interval <= 0 {
+		interval = JANITOR_DEFAULT_INTERVAL
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		j.collect(dir, ttl, time.Now())
+	}
+}
+
+// collect borra los clientes vencidos de dir y devuelve cuales borro. Se
+// toman los locks de todos los FinishedClients, en el orden en que se
+// registraron, y recien ahi se vuelve a mirar la actividad: con los locks
+// tomados no se puede consumir un mensaje del cliente en el medio.
+func (j *janitor) collect(dir string, ttl time.Duration, now time.Time) []middleware.ClientId {
+	j.lock.Lock()
+	nodes := slices.Clone(j.nodes)
+	j.lock.Unlock()
+
+	removed := []middleware.ClientId{}
+	for _, clientId := range IdleClients(dir, ttl, now) {
+		if !j.idle(clientId, ttl, now) {
+			continue
+		}
+
+		for _, fc := range nodes {
+			fc.lock.Lock()
+		}
+		if j.idle(clientId, ttl, now) {
+			for _, fc := range nodes {
+				fc.finished.Add(clientId, now)
+			}
+			metrics.Default.Forget("client", clientId.String())
+			if err := os.RemoveAll(filepath.Join(dir, clientId.String())); err != nil {
+				log.Errorf("action: janitor | result: fail | client: %s | error: %s", clientId, err)
+			} else {
+				log.Infof("action: janitor | result: success | client: %s | removed: %s", clientId, filepath.Join(dir, clientId.String()))
+				removed = append(removed, clientId)
+			}
+			j.forget(clientId)
+		}
+		for i := len(nodes) - 1; i >= 0; i-- {
+			nodes[i].lock.Unlock()
+		}
+	}
+
+	return removed
+}
+
+// IdleClients devuelve los clientes de dir cuyo archivo modificado mas
+// recientemente es anterior a now - ttl
+func IdleClients(dir string, ttl time.Duration, now time.Time) []middleware.ClientId {
+	dentries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	idle := []middleware.ClientId{}
+	for _, dentry := range dentries {
+		if !dentry.IsDir() {
+			continue
+		}
+		clientId, err := middleware.ParseClientId(dentry.Name())
+		if err != nil {
+			continue
+		}
+
+		if now.Sub(lastModified(filepath.Join(dir, dentry.Name()))) > ttl {
+			idle = append(idle, clientId)
+		}
+	}
+
+	return idle
+}
+
+func lastModified(path string) time.Time {
+	last := time.Time{}
+	filepath.WalkDir(path, func(_ string, dentry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := dentry.Info()
+		if err != nil {
+			return nil
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+		return nil
+	})
+	return last
+}
@@ -0,0 +1,72 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tp1-distribuidos/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdleClientsUsesNewestFile(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+
+	write := func(path string, modified time.Time) {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0777))
+		assert.Nil(t, os.WriteFile(path, []byte("x"), 0777))
+		assert.Nil(t, os.Chtimes(path, modified, modified))
+		for parent := filepath.Dir(path); parent != dir; parent = filepath.Dir(parent) {
+			assert.Nil(t, os.Chtimes(parent, old, old))
+		}
+	}
+
+	// todo viejo
+	write(filepath.Join(dir, "1001", "stats", "10.csv"), old)
+	// un archivo reciente en un subdirectorio mantiene vivo al cliente
+	write(filepath.Join(dir, "1002", "stats", "10.csv"), old)
+	write(filepath.Join(dir, "1002", "stats", "20.csv"), now)
+	// lo que no es un cliente no se toca
+	write(filepath.Join(dir, "commit.csv"), old)
+	write(filepath.Join(dir, "tmp", "a.csv"), old)
+
+	idle := IdleClients(dir, time.Hour, now)
+
+	assert.Equal(t, []middleware.ClientId{1001}, idle)
+}
+
+func TestJanitorKeepsClientsWithRecentMessages(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+
+	for _, clientId := range []string{"1001", "1002"} {
+		path := filepath.Join(dir, clientId, "result.csv")
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0777))
+		assert.Nil(t, os.WriteFile(path, []byte("x"), 0777))
+		assert.Nil(t, os.Chtimes(path, old, old))
+		assert.Nil(t, os.Chtimes(filepath.Dir(path), old, old))
+	}
+
+	games := &FinishedClients{name: "games", finished: openTombstones(t, filepath.Join(dir, "tombstones", "games.bin"))}
+	reviews := &FinishedClients{name: "reviews", finished: openTombstones(t, filepath.Join(dir, "tombstones", "reviews.bin"))}
+
+	janitor := newJanitor(old)
+	janitor.nodes = []*FinishedClients{games, reviews}
+	// el reducer de 1002 no escribe hasta el final pero le siguen llegando
+	// mensajes
+	janitor.touch(1002, now.Add(-time.Minute))
+
+	assert.Equal(t, []middleware.ClientId{1001}, janitor.collect(dir, time.Hour, now))
+	assert.True(t, games.Contains(1001))
+	assert.True(t, reviews.Contains(1001))
+	assert.False(t, reviews.Contains(1002))
+	_, err := os.Stat(filepath.Join(dir, "1002"))
+	assert.Nil(t, err)
+
+	// recien arrancado ningun cliente vence aunque sus archivos sean viejos
+	assert.Empty(t, newJanitor(now).collect(dir, time.Hour, now))
+}
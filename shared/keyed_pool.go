@@ -0,0 +1,55 @@
+package shared
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// KeyedPool runs tasks on a fixed amount of workers. Tasks with the same key
+// always go to the same worker, so they run in the order they were submitted.
+// Every worker has a bounded queue and Submit blocks while it is full, which
+// slows down the caller instead of piling up goroutines.
+type KeyedPool struct {
+	queues []chan func()
+	wg     sync.WaitGroup
+}
+
+func NewKeyedPool(workers int, queueSize int) *KeyedPool {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	pool := &KeyedPool{
+		queues: make([]chan func(), workers),
+	}
+
+	for i := range pool.queues {
+		pool.queues[i] = make(chan func(), queueSize)
+		pool.wg.Add(1)
+		go pool.work(pool.queues[i])
+	}
+
+	return pool
+}
+
+func (p *KeyedPool) work(queue chan func()) {
+	defer p.wg.Done()
+	for task := range queue {
+		task()
+	}
+}
+
+func (p *KeyedPool) Submit(key string, task func()) {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(key))
+	p.queues[hasher.Sum32()%uint32(len(p.queues))] <- task
+}
+
+// Close waits for every queued task to finish. Submit must not be called
+// after Close.
+func (p *KeyedPool) Close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
@@ -0,0 +1,120 @@
+package language
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"tp1-distribuidos/shared/metrics"
+
+	"github.com/rylans/getlang"
+)
+
+// LanguageDetector returns the name of the language a text is written in
+// (e.g. "English").
+type LanguageDetector interface {
+	Detect(text string) string
+}
+
+// New builds the detector configured by name, wrapped with a cache of
+// cacheSize entries if cacheSize is positive.
+func New(name string, cacheSize int) (LanguageDetector, error) {
+	var detector LanguageDetector
+
+	switch name {
+	case "", "getlang":
+		detector = GetlangDetector{}
+	default:
+		return nil, fmt.Errorf("unknown language detector: %s", name)
+	}
+
+	if cacheSize > 0 {
+		detector = NewCachedDetector(detector, cacheSize)
+	}
+
+	return detector, nil
+}
+
+type GetlangDetector struct{}
+
+func (GetlangDetector) Detect(text string) string {
+	return getlang.FromString(text).LanguageName()
+}
+
+var cacheRequests = metrics.NewCounter("language_cache_requests_total", "Language detections answered by the cache (hit) or the detector (miss).", "result")
+
+// CachedDetector remembers the language of the last size texts (by hash).
+// Short reviews like "Good game" repeat a lot, so most of them are not
+// detected again. Entries are evicted in insertion order.
+type CachedDetector struct {
+	detector LanguageDetector
+	lock     sync.Mutex
+	entries  map[uint64]string
+	order    []uint64
+	next     int
+}
+
+func NewCachedDetector(detector LanguageDetector, size int) *CachedDetector {
+	return &CachedDetector{
+		detector: detector,
+		entries:  make(map[uint64]string, size),
+		order:    make([]uint64, size),
+	}
+}
+
+func (c *CachedDetector) Detect(text string) string {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(text))
+	key := hasher.Sum64()
+
+	c.lock.Lock()
+	lang, ok := c.entries[key]
+	c.lock.Unlock()
+	if ok {
+		cacheRequests.With("hit").Inc()
+		return lang
+	}
+	cacheRequests.With("miss").Inc()
+
+	lang = c.detector.Detect(text)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return lang
+	}
+	if len(c.entries) == len(c.order) {
+		delete(c.entries, c.order[c.next])
+	}
+	c.entries[key] = lang
+	c.order[c.next] = key
+	c.next = (c.next + 1) % len(c.order)
+
+	return lang
+}
+
+// Filter tells whether a text (or an already detected language) is one of the
+// target languages.
+type Filter struct {
+	detector LanguageDetector
+	targets  map[string]bool
+}
+
+func NewFilter(detector LanguageDetector, targets []string) *Filter {
+	targetsSet := make(map[string]bool)
+	for _, target := range targets {
+		targetsSet[target] = true
+	}
+	if len(targetsSet) == 0 {
+		targetsSet["English"] = true
+	}
+
+	return &Filter{detector: detector, targets: targetsSet}
+}
+
+func (f *Filter) Matches(text string) bool {
+	return f.MatchesLanguage(f.detector.Detect(text))
+}
+
+func (f *Filter) MatchesLanguage(lang string) bool {
+	return f.targets[lang]
+}
@@ -0,0 +1,69 @@
+package language
+
+import "sync"
+
+// Pool runs detections with a fixed amount of workers. Submit blocks when
+// every worker is busy and the queue is full, so callers get backpressure
+// instead of spawning a goroutine per message.
+type Pool struct {
+	detector LanguageDetector
+	tasks    chan func()
+	wg       sync.WaitGroup
+}
+
+func NewPool(detector LanguageDetector, workers int) *Pool {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	pool := &Pool{
+		detector: detector,
+		tasks:    make(chan func(), workers),
+	}
+
+	for i := 0; i < workers; i++ {
+		pool.wg.Add(1)
+		go pool.work()
+	}
+
+	return pool
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+	for task := range p.tasks {
+		task()
+	}
+}
+
+func (p *Pool) Detector() LanguageDetector {
+	return p.detector
+}
+
+func (p *Pool) Submit(task func()) {
+	p.tasks <- task
+}
+
+// DetectBatch detects the language of every text using the pool workers and
+// returns them in the same order. It must not be called from a pool task.
+func (p *Pool) DetectBatch(texts []string) []string {
+	langs := make([]string, len(texts))
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(texts))
+	for i, text := range texts {
+		p.Submit(func() {
+			defer wg.Done()
+			langs[i] = p.detector.Detect(text)
+		})
+	}
+	wg.Wait()
+
+	return langs
+}
+
+// Close waits for the queued detections to finish
+func (p *Pool) Close() {
+	close(p.tasks)
+	p.wg.Wait()
+}
@@ -0,0 +1,172 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	"tp1-distribuidos/shared/logs"
+)
+
+var log = logs.Get("lifecycle")
+
+const (
+	EXIT_OK      = 0
+	EXIT_FAILED  = 1 // fallo algun paso o el nodo termino sin que se lo pidan
+	EXIT_TIMEOUT = 2 // no se termino de drenar a tiempo
+)
+
+const DEFAULT_DRAIN_TIMEOUT = 15 * time.Second
+
+// Lifecycle ordena el apagado de un nodo. Al recibir SIGTERM (o Stop) corre
+// los pasos de drain (dejar de consumir), espera a que termine el Run del
+// nodo (commits en curso, deliveries pendientes ackeadas o nackeadas) y
+// despues corre los pasos de close en orden inverso (publishers, archivos).
+// Todo tiene que entrar en el timeout, que tiene que ser menor al de
+// `docker compose stop -t` para que nunca se corte un commit a la mitad.
+type Lifecycle struct {
+	name     string
+	timeout  time.Duration
+	lock     sync.Mutex
+	drain    []step
+	close    []step
+	stopping chan struct{}
+	once     sync.Once
+}
+
+type step struct {
+	name string
+	run  func() error
+}
+
+func New(name string, timeout time.Duration) *Lifecycle {
+	if timeout <= 0 {
+		timeout = DEFAULT_DRAIN_TIMEOUT
+	}
+
+	return &Lifecycle{
+		name:     name,
+		timeout:  timeout,
+		stopping: make(chan struct{}),
+	}
+}
+
+// Notify llama a Stop cuando llega SIGINT o SIGTERM
+func (l *Lifecycle) Notify() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer stop()
+		<-ctx.Done()
+		log.Infof("action: shutdown | result: in_progress | node: %s", l.name)
+		l.Stop()
+	}()
+}
+
+// OnDrain registra un paso que corre apenas se pide el apagado, en el orden
+// en que se registraron
+func (l *Lifecycle) OnDrain(name string, run func() error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.drain = append(l.drain, step{name, run})
+}
+
+// OnClose registra un paso que corre cuando termino el Run, en orden inverso
+// al que se registraron
+func (l *Lifecycle) OnClose(name string, run func() error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.close = append(l.close, step{name, run})
+}
+
+// Stop pide el apagado, se puede llamar varias veces
+func (l *Lifecycle) Stop() {
+	l.once.Do(func() {
+		close(l.stopping)
+	})
+}
+
+// Stopping se cierra cuando se pide el apagado
+func (l *Lifecycle) Stopping() <-chan struct{} {
+	return l.stopping
+}
+
+// Check falla si se pidio el apagado, para el /readyz
+func (l *Lifecycle) Check() error {
+	select {
+	case <-l.stopping:
+		return errors.New("draining")
+	default:
+		return nil
+	}
+}
+
+// Run corre el nodo y lo apaga. Devuelve el codigo de salida del proceso.
+func (l *Lifecycle) Run(run func()) int {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run()
+	}()
+
+	select {
+	case <-done:
+	case <-l.stopping:
+	}
+
+	status := EXIT_OK
+	select {
+	case <-l.stopping:
+		if !l.runSteps("drain", l.steps(l.drain, false)) {
+			status = EXIT_FAILED
+		}
+
+		select {
+		case <-done:
+		case <-time.After(l.timeout):
+			log.Errorf("action: shutdown | result: fail | node: %s | error: drain timed out after %s", l.name, l.timeout)
+			return EXIT_TIMEOUT
+		}
+	default:
+		// termino solo, por ejemplo porque se cayo la conexion con rabbit
+		log.Errorf("action: shutdown | result: fail | node: %s | error: stopped without being asked", l.name)
+		status = EXIT_FAILED
+	}
+
+	if !l.runSteps("close", l.steps(l.close, true)) {
+		status = EXIT_FAILED
+	}
+
+	log.Infof("action: shutdown | result: success | node: %s | status: %d", l.name, status)
+	return status
+}
+
+func (l *Lifecycle) steps(steps []step, reverse bool) []step {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	ordered := make([]step, 0, len(steps))
+	for i := range steps {
+		if reverse {
+			ordered = append(ordered, steps[len(steps)-1-i])
+		} else {
+			ordered = append(ordered, steps[i])
+		}
+	}
+	return ordered
+}
+
+func (l *Lifecycle) runSteps(phase string, steps []step) bool {
+	ok := true
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			log.Errorf("action: shutdown_%s | result: fail | node: %s | step: %s | error: %s", phase, l.name, step.name, err)
+			ok = false
+			continue
+		}
+		log.Debugf("action: shutdown_%s | result: success | node: %s | step: %s", phase, l.name, step.name)
+	}
+	return ok
+}
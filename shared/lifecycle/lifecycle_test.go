@@ -0,0 +1,80 @@
+package lifecycle
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLifecycleDrainsThenCloses(t *testing.T) {
+	lifecycle := New("test", time.Second)
+
+	steps := []string{}
+	release := make(chan struct{})
+	lifecycle.OnDrain("stop consuming", func() error {
+		steps = append(steps, "stop consuming")
+		close(release)
+		return nil
+	})
+	lifecycle.OnClose("files", func() error {
+		steps = append(steps, "files")
+		return nil
+	})
+	lifecycle.OnClose("middleware", func() error {
+		steps = append(steps, "middleware")
+		return nil
+	})
+
+	lifecycle.Stop()
+	lifecycle.Stop()
+	status := lifecycle.Run(func() {
+		<-release
+		steps = append(steps, "run")
+	})
+
+	assert.Equal(t, EXIT_OK, status)
+	assert.Equal(t, []string{"stop consuming", "run", "middleware", "files"}, steps)
+}
+
+func TestLifecycleFailsWhenRunStopsByItself(t *testing.T) {
+	lifecycle := New("test", time.Second)
+
+	closed := false
+	lifecycle.OnClose("middleware", func() error {
+		closed = true
+		return nil
+	})
+
+	assert.Equal(t, EXIT_FAILED, lifecycle.Run(func() {}))
+	assert.True(t, closed)
+}
+
+func TestLifecycleFailedStep(t *testing.T) {
+	lifecycle := New("test", time.Second)
+	lifecycle.OnClose("middleware", func() error {
+		return errors.New("channel already closed")
+	})
+
+	lifecycle.Stop()
+	assert.Equal(t, EXIT_FAILED, lifecycle.Run(func() {}))
+}
+
+func TestLifecycleDrainTimeout(t *testing.T) {
+	lifecycle := New("test", 50*time.Millisecond)
+
+	closed := false
+	lifecycle.OnClose("middleware", func() error {
+		closed = true
+		return nil
+	})
+
+	lifecycle.Stop()
+	status := lifecycle.Run(func() {
+		select {}
+	})
+
+	assert.Equal(t, EXIT_TIMEOUT, status)
+	assert.False(t, closed)
+}
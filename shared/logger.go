@@ -1,29 +0,0 @@
-package shared
-
-import (
-	"os"
-
-	"github.com/op/go-logging"
-)
-
-// InitLogger Receives the log level to be set in go-logging as a string. This method
-// parses the string and set the level to the logger. If the level string is not
-// valid an error is returned
-func InitLogger(logLevel string) error {
-	baseBackend := logging.NewLogBackend(os.Stdout, "", 0)
-	format := logging.MustStringFormatter(
-		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
-	)
-	backendFormatter := logging.NewBackendFormatter(baseBackend, format)
-
-	backendLeveled := logging.AddModuleLevel(backendFormatter)
-	logLevelCode, err := logging.LogLevel(logLevel)
-	if err != nil {
-		return err
-	}
-	backendLeveled.SetLevel(logLevelCode, "")
-
-	// Set the backends to be used.
-	logging.SetBackend(backendLeveled)
-	return nil
-}
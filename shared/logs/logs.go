@@ -0,0 +1,256 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int
+
+const (
+	CRITICAL Level = iota
+	ERROR
+	WARNING
+	NOTICE
+	INFO
+	DEBUG
+)
+
+var levelNames = []string{"CRITICAL", "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel acepta los mismos nombres que go-logging, sin importar
+// mayusculas
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q", name)
+}
+
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+)
+
+// Options configura la salida de todos los loggers del proceso
+type Options struct {
+	Node    string // nombre del nodo, va en todas las lineas JSON
+	Level   string // nivel por defecto
+	Format  string // "text" (por defecto) o "json"
+	Modules string // niveles por modulo: "middleware=DEBUG,tracing=ERROR"
+	Fields  []Field
+	Output  io.Writer // stdout si es nil
+}
+
+type Field struct {
+	Key   string
+	Value any
+}
+
+type output struct {
+	lock    *sync.Mutex
+	writer  io.Writer
+	json    bool
+	node    string
+	level   Level
+	modules map[string]Level
+	fields  []Field
+}
+
+var current atomic.Pointer[output]
+
+func init() {
+	current.Store(&output{lock: &sync.Mutex{}, writer: os.Stdout, level: INFO})
+}
+
+// Init configura la salida. Los loggers se pueden pedir antes, lo que se
+// loguee hasta aca sale en texto con nivel INFO.
+func Init(options Options) error {
+	level, err := ParseLevel(options.Level)
+	if err != nil {
+		return err
+	}
+
+	modules := make(map[string]Level)
+	for _, entry := range strings.Split(options.Modules, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		module, name, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid module level %q, expected module=LEVEL", entry)
+		}
+		moduleLevel, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		modules[strings.TrimSpace(module)] = moduleLevel
+	}
+
+	json := false
+	switch options.Format {
+	case "", FORMAT_TEXT:
+	case FORMAT_JSON:
+		json = true
+	default:
+		return fmt.Errorf("invalid log format %q", options.Format)
+	}
+
+	writer := options.Output
+	if writer == nil {
+		writer = os.Stdout
+	}
+
+	current.Store(&output{
+		lock:    &sync.Mutex{},
+		writer:  writer,
+		json:    json,
+		node:    options.Node,
+		level:   level,
+		modules: modules,
+		fields:  options.Fields,
+	})
+	return nil
+}
+
+// Logger loguea con el modulo (el paquete que lo pide) y los campos que se le
+// agreguen con With. Los metodos son los de go-logging.
+type Logger struct {
+	module string
+	fields []Field
+}
+
+func Get(module string) *Logger {
+	return &Logger{module: module}
+}
+
+// With devuelve un logger con un campo mas, por ejemplo client_id o batch_id
+func (l *Logger) With(key string, value any) *Logger {
+	fields := make([]Field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{module: l.module, fields: append(fields, Field{key, value})}
+}
+
+func (l *Logger) IsEnabledFor(level Level) bool {
+	out := current.Load()
+	if moduleLevel, ok := out.modules[l.module]; ok {
+		return level <= moduleLevel
+	}
+	return level <= out.level
+}
+
+func (l *Logger) log(level Level, message string) {
+	if !l.IsEnabledFor(level) {
+		return
+	}
+	out := current.Load()
+
+	line := &bytes.Buffer{}
+	now := time.Now()
+	if out.json {
+		out.writeJSON(line, now, level, l.module, message, l.fields)
+	} else {
+		writeText(line, now, level, message, l.fields)
+	}
+
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	out.writer.Write(line.Bytes())
+}
+
+// writeText mantiene el formato de siempre, los campos del logger se agregan
+// al final con la misma convencion `key: value`
+func writeText(line *bytes.Buffer, now time.Time, level Level, message string, fields []Field) {
+	fmt.Fprintf(line, "%s %.5s     %s", now.Format("2006-01-02 15:04:05"), level, message)
+	for _, field := range fields {
+		fmt.Fprintf(line, " | %s: %s", field.Key, fmt.Sprint(field.Value))
+	}
+	line.WriteByte('\n')
+}
+
+// conventionKey son las claves de los mensajes `action: x | result: y`
+var conventionKey = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// writeJSON escribe una linea por mensaje. Ademas de los campos del nodo y
+// del logger, los pares `key: value` del mensaje se agregan como campos, asi
+// los logs que ya seguian la convencion se pueden filtrar sin cambiarlos.
+func (out *output) writeJSON(line *bytes.Buffer, now time.Time, level Level, module string, message string, fields []Field) {
+	seen := make(map[string]bool)
+	line.WriteByte('{')
+	writeJSONField(line, "time", now.Format(time.RFC3339Nano), seen)
+	writeJSONField(line, "level", level.String(), seen)
+	writeJSONField(line, "module", module, seen)
+	if out.node != "" {
+		writeJSONField(line, "node", out.node, seen)
+	}
+	writeJSONField(line, "msg", message, seen)
+
+	for _, field := range fields {
+		writeJSONField(line, field.Key, field.Value, seen)
+	}
+	for _, field := range out.fields {
+		writeJSONField(line, field.Key, field.Value, seen)
+	}
+	for _, segment := range strings.Split(message, " | ") {
+		key, value, ok := strings.Cut(segment, ": ")
+		if ok && conventionKey.MatchString(key) {
+			writeJSONField(line, key, value, seen)
+		}
+	}
+	line.WriteString("}\n")
+}
+
+func writeJSONField(line *bytes.Buffer, key string, value any, seen map[string]bool) {
+	if seen[key] {
+		return
+	}
+	seen[key] = true
+
+	if line.Len() > 1 {
+		line.WriteByte(',')
+	}
+	encodedKey, _ := json.Marshal(key)
+	line.Write(encodedKey)
+	line.WriteByte(':')
+
+	if stringer, ok := value.(fmt.Stringer); ok {
+		value = stringer.String()
+	}
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	line.Write(encoded)
+}
+
+func (l *Logger) Critical(args ...any) { l.log(CRITICAL, fmt.Sprint(args...)) }
+func (l *Logger) Error(args ...any)    { l.log(ERROR, fmt.Sprint(args...)) }
+func (l *Logger) Warning(args ...any)  { l.log(WARNING, fmt.Sprint(args...)) }
+func (l *Logger) Notice(args ...any)   { l.log(NOTICE, fmt.Sprint(args...)) }
+func (l *Logger) Info(args ...any)     { l.log(INFO, fmt.Sprint(args...)) }
+func (l *Logger) Debug(args ...any)    { l.log(DEBUG, fmt.Sprint(args...)) }
+
+func (l *Logger) Criticalf(format string, args ...any) { l.log(CRITICAL, fmt.Sprintf(format, args...)) }
+func (l *Logger) Errorf(format string, args ...any)    { l.log(ERROR, fmt.Sprintf(format, args...)) }
+func (l *Logger) Warningf(format string, args ...any)  { l.log(WARNING, fmt.Sprintf(format, args...)) }
+func (l *Logger) Noticef(format string, args ...any)   { l.log(NOTICE, fmt.Sprintf(format, args...)) }
+func (l *Logger) Infof(format string, args ...any)     { l.log(INFO, fmt.Sprintf(format, args...)) }
+func (l *Logger) Debugf(format string, args ...any)    { l.log(DEBUG, fmt.Sprintf(format, args...)) }
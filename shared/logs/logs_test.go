@@ -0,0 +1,58 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONFields(t *testing.T) {
+	output := &bytes.Buffer{}
+	assert.NoError(t, Init(Options{
+		Node:   "query-3.1",
+		Level:  "INFO",
+		Format: FORMAT_JSON,
+		Fields: []Field{{"query", 3}, {"shard", 1}},
+		Output: output,
+	}))
+
+	log := Get("queries").With("client_id", 42)
+	log.Infof("action: commit | result: success | batch_id: %d", 7)
+	log.Debugf("action: hidden")
+
+	line := map[string]any{}
+	assert.NoError(t, json.Unmarshal(output.Bytes(), &line))
+	assert.Equal(t, "INFO", line["level"])
+	assert.Equal(t, "queries", line["module"])
+	assert.Equal(t, "query-3.1", line["node"])
+	assert.Equal(t, float64(42), line["client_id"])
+	assert.Equal(t, float64(3), line["query"])
+	assert.Equal(t, float64(1), line["shard"])
+	assert.Equal(t, "commit", line["action"])
+	assert.Equal(t, "7", line["batch_id"])
+	assert.Equal(t, 1, strings.Count(output.String(), "\n"))
+}
+
+func TestModuleLevels(t *testing.T) {
+	output := &bytes.Buffer{}
+	assert.NoError(t, Init(Options{Level: "ERROR", Modules: "middleware=DEBUG", Output: output}))
+
+	Get("middleware").Debugf("action: consume | queue: %s", "games")
+	Get("mapper").Infof("action: hidden")
+	Get("mapper").With("client_id", 1).Error(errors.New("failed"))
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "DEBUG     action: consume | queue: games")
+	assert.Contains(t, lines[1], "ERROR     failed | client_id: 1")
+}
+
+func TestInitRejectsInvalidOptions(t *testing.T) {
+	assert.Error(t, Init(Options{Level: "LOUD"}))
+	assert.Error(t, Init(Options{Level: "INFO", Format: "xml"}))
+	assert.Error(t, Init(Options{Level: "INFO", Modules: "middleware"}))
+}
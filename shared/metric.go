@@ -1,39 +1,66 @@
 package shared
 
-import "time"
+import (
+	"time"
+	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared/metrics"
+)
 
+var (
+	processedTotal  = metrics.NewCounter("processed_total", "Items processed, per Metric.", "metric")
+	processedRate   = metrics.NewGauge("processed_rate", "Items per second in the last Metric interval.", "metric")
+	clientProcessed = metrics.NewCounter("client_processed_total", "Items processed per client, per Metric.", "metric", "client")
+)
+
+// Metric loguea cada interval items procesados y alimenta los contadores de
+// /metrics con el nombre name
 type Metric struct {
+	name     string
 	interval int
 	i        int
 	totalI   int
 	lastTs   time.Time
 	startTs  time.Time
 	msgFn    func(total int, elapsed time.Duration, rate float64) string
+	total    *metrics.Counter
+	rate     *metrics.Gauge
 }
 
-func NewMetric(interval int, msgFn func(total int, elapsed time.Duration, rate float64) string) *Metric {
+func NewMetric(name string, interval int, msgFn func(total int, elapsed time.Duration, rate float64) string) *Metric {
 	return &Metric{
+		name:     name,
 		interval: interval,
 		i:        0,
 		totalI:   0,
 		lastTs:   time.Now(),
 		startTs:  time.Now(),
 		msgFn:    msgFn,
+		total:    processedTotal.With(name),
+		rate:     processedRate.With(name),
 	}
 }
 
 func (m *Metric) Update(i int) {
 	m.i += i
 	m.totalI += i
+	m.total.Add(float64(i))
 	if m.i >= m.interval {
 		elapsed := time.Since(m.lastTs)
 		m.lastTs = time.Now()
-		msg := m.msgFn(m.totalI, elapsed, float64(m.i)/elapsed.Seconds())
+		rate := float64(m.i) / elapsed.Seconds()
+		m.rate.Set(rate)
+		msg := m.msgFn(m.totalI, elapsed, rate)
 		log.Infof(msg)
 		m.i = 0
 	}
 }
 
+// UpdateClient es Update y ademas cuenta el progreso del cliente
+func (m *Metric) UpdateClient(clientId middleware.ClientId, i int) {
+	clientProcessed.With(m.name, clientId.String()).Add(float64(i))
+	m.Update(i)
+}
+
 func (m *Metric) Finalize(msgFn func(total int, elapsed time.Duration, rate float64) string) {
 	elapsed := time.Since(m.startTs)
 	msg := msgFn(m.totalI, elapsed, float64(m.totalI)/elapsed.Seconds())
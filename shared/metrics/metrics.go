@@ -0,0 +1,316 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// DEFAULT_BUCKETS sirve para latencias en segundos, de 1ms a 10s
+var DEFAULT_BUCKETS = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry guarda las metricas de un nodo y las escribe en el formato de
+// texto de Prometheus. Registrar dos veces el mismo nombre devuelve la misma
+// familia, asi cada paquete registra las suyas donde las usa.
+type Registry struct {
+	lock     sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Default es el registry que usan los nodos y el que sirve Handler
+var Default = NewRegistry()
+
+type family struct {
+	lock    sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	lock   sync.Mutex
+	values []string
+	value  float64  // counter y gauge
+	counts []uint64 // histogram, uno por bucket
+	count  uint64
+	sum    float64
+}
+
+func (r *Registry) family(name string, help string, kind string, labels []string, buckets []float64) *family {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if f, ok := r.families[name]; ok {
+		if f.kind != kind || !slices.Equal(f.labels, labels) {
+			panic(fmt.Sprintf("metric %s registered twice with different kind or labels", name))
+		}
+		return f
+	}
+
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.families[name] = f
+	return f
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: slices.Clone(values)}
+		if f.kind == kindHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) delete(label string, value string) {
+	index := slices.Index(f.labels, label)
+	if index < 0 {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for key, s := range f.series {
+		if s.values[index] == value {
+			delete(f.series, key)
+		}
+	}
+}
+
+// Forget borra las series de todas las familias con label = value, para no
+// acumular series de clientes que ya terminaron
+func (r *Registry) Forget(label string, value string) {
+	r.lock.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.lock.Unlock()
+
+	for _, f := range families {
+		f.delete(label, value)
+	}
+}
+
+type CounterVec struct{ family *family }
+type GaugeVec struct{ family *family }
+type HistogramVec struct{ family *family }
+
+type Counter struct{ series *series }
+type Gauge struct{ series *series }
+type Histogram struct {
+	series  *series
+	buckets []float64
+}
+
+func (r *Registry) Counter(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.family(name, help, kindCounter, labels, nil)}
+}
+
+func (r *Registry) Gauge(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.family(name, help, kindGauge, labels, nil)}
+}
+
+// Histogram usa DEFAULT_BUCKETS si buckets es nil
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DEFAULT_BUCKETS
+	}
+	return &HistogramVec{r.family(name, help, kindHistogram, labels, buckets)}
+}
+
+func NewCounter(name string, help string, labels ...string) *CounterVec {
+	return Default.Counter(name, help, labels...)
+}
+
+func NewGauge(name string, help string, labels ...string) *GaugeVec {
+	return Default.Gauge(name, help, labels...)
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.Histogram(name, help, buckets, labels...)
+}
+
+func (c *CounterVec) With(values ...string) *Counter {
+	return &Counter{c.family.with(values)}
+}
+
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{g.family.with(values)}
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{h.family.with(values), h.family.buckets}
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add suma v, un counter nunca baja asi que v negativo se ignora
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.series.lock.Lock()
+	defer c.series.lock.Unlock()
+	c.series.value += v
+}
+
+func (g *Gauge) Set(v float64) {
+	g.series.lock.Lock()
+	defer g.series.lock.Unlock()
+	g.series.value = v
+}
+
+func (g *Gauge) Add(v float64) {
+	g.series.lock.Lock()
+	defer g.series.lock.Unlock()
+	g.series.value += v
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.series.lock.Lock()
+	defer h.series.lock.Unlock()
+
+	for i, bucket := range h.buckets {
+		if v <= bucket {
+			h.series.counts[i]++
+		}
+	}
+	h.series.count++
+	h.series.sum += v
+}
+
+// WriteTo escribe todas las metricas en el formato de texto de Prometheus,
+// ordenadas por nombre y labels
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.lock.Unlock()
+	sort.Strings(names)
+
+	builder := &strings.Builder{}
+	for _, name := range names {
+		r.lock.Lock()
+		f := r.families[name]
+		r.lock.Unlock()
+		f.write(builder)
+	}
+
+	n, err := io.WriteString(w, builder.String())
+	return int64(n), err
+}
+
+func (f *family) write(builder *strings.Builder) {
+	f.lock.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.lock.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		return slices.Compare(all[i].values, all[j].values) < 0
+	})
+
+	fmt.Fprintf(builder, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(builder, "# TYPE %s %s\n", f.name, f.kind)
+
+	for _, s := range all {
+		s.lock.Lock()
+		labels := f.labelPairs(s.values)
+		switch f.kind {
+		case kindHistogram:
+			for i, bucket := range f.buckets {
+				fmt.Fprintf(builder, "%s_bucket%s %d\n", f.name, withLabel(labels, "le", formatFloat(bucket)), s.counts[i])
+			}
+			fmt.Fprintf(builder, "%s_bucket%s %d\n", f.name, withLabel(labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(builder, "%s_sum%s %s\n", f.name, braces(labels), formatFloat(s.sum))
+			fmt.Fprintf(builder, "%s_count%s %d\n", f.name, braces(labels), s.count)
+		default:
+			fmt.Fprintf(builder, "%s%s %s\n", f.name, braces(labels), formatFloat(s.value))
+		}
+		s.lock.Unlock()
+	}
+}
+
+func (f *family) labelPairs(values []string) []string {
+	pairs := make([]string, len(values))
+	for i, value := range values {
+		pairs[i] = f.labels[i] + "=" + quote(value)
+	}
+	return pairs
+}
+
+func withLabel(pairs []string, label string, value string) string {
+	return braces(append(slices.Clone(pairs), label+"="+quote(value)))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quote(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func braces(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler sirve el registry Default en /metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Default.WriteTo(w)
+	})
+}
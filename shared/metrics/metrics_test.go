@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryTextFormat(t *testing.T) {
+	registry := NewRegistry()
+
+	messages := registry.Counter("messages_in_total", "Deliveries received.", "queue")
+	messages.With("games").Inc()
+	messages.With("games").Add(2)
+	messages.With(`re"views`).Inc()
+
+	// registrar de nuevo devuelve la misma familia
+	registry.Counter("messages_in_total", "Deliveries received.", "queue").With("games").Inc()
+
+	registry.Gauge("clients", "Active clients.").With().Set(3)
+
+	latency := registry.Histogram("commit_duration_seconds", "Commit latency.", []float64{0.1, 1})
+	latency.With().Observe(0.05)
+	latency.With().Observe(0.5)
+	latency.With().Observe(5)
+
+	output := &strings.Builder{}
+	registry.WriteTo(output)
+
+	assert.Equal(t, `# HELP clients Active clients.
+# TYPE clients gauge
+clients 3
+# HELP commit_duration_seconds Commit latency.
+# TYPE commit_duration_seconds histogram
+commit_duration_seconds_bucket{le="0.1"} 1
+commit_duration_seconds_bucket{le="1"} 2
+commit_duration_seconds_bucket{le="+Inf"} 3
+commit_duration_seconds_sum 5.55
+commit_duration_seconds_count 3
+# HELP messages_in_total Deliveries received.
+# TYPE messages_in_total counter
+messages_in_total{queue="games"} 4
+messages_in_total{queue="re\"views"} 1
+`, output.String())
+}
+
+func TestRegistryForget(t *testing.T) {
+	registry := NewRegistry()
+
+	progress := registry.Counter("client_processed_total", "Messages processed per client.", "metric", "client")
+	progress.With("stats", "1").Inc()
+	progress.With("stats", "2").Inc()
+
+	registry.Forget("client", "1")
+
+	output := &strings.Builder{}
+	registry.WriteTo(output)
+	assert.NotContains(t, output.String(), `client="1"`)
+	assert.Contains(t, output.String(), `client_processed_total{metric="stats",client="2"} 1`)
+}
+
+func TestRegistryRejectsDifferentLabels(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("messages_in_total", "Deliveries received.", "queue")
+
+	assert.Panics(t, func() {
+		registry.Counter("messages_in_total", "Deliveries received.", "exchange")
+	})
+}
+
+func TestHandler(t *testing.T) {
+	NewCounter("handler_test_total", "Test counter.").With().Inc()
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, 200, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "handler_test_total 1")
+}
@@ -17,6 +17,14 @@ const (
 	MessageTypeClientResponse3
 	MessageTypeClientResponse4
 	MessageTypeClientResponse5
+	MessageTypeClientApproximate
+	MessageTypeHello
+	MessageTypeResume
+	MessageTypeSessionInfo
+	MessageTypeBusy
+	MessageTypeCancel
+	MessageTypeCancelAck
+	MessageTypeCancelled
 )
 
 // Protocolo de comunicacion entre cliente y servidor
@@ -176,6 +184,7 @@ func (m *ClientResponse2) Decode(data string) error {
 
 type ClientResponse3 struct {
 	TopStats []Game
+	Last     bool
 }
 
 func (m *ClientResponse3) GetMessageType() MessageType {
@@ -186,11 +195,22 @@ func (m *ClientResponse3) Encode() string {
 	for _, game := range m.TopStats {
 		games = append(games, game.Encode())
 	}
-	return strings.Join(games, "\n")
+	if m.Last {
+		return strings.Join(games, "\n") + ";True"
+	}
+	return strings.Join(games, "\n") + ";False"
 }
 
 func (m *ClientResponse3) Decode(data string) error {
-	parts := strings.Split(data, "\n")
+	separator := strings.LastIndex(data, ";")
+	if separator == -1 {
+		return fmt.Errorf("invalid response 3 data: %s", data)
+	}
+	m.Last = data[separator+1:] == "True"
+	if separator == 0 {
+		return nil
+	}
+	parts := strings.Split(data[:separator], "\n")
 	for _, part := range parts {
 		game := Game{}
 		err := game.Decode(part)
@@ -263,3 +283,192 @@ func (m *ClientResponse5) Decode(data string) error {
 	}
 	return nil
 }
+
+// ClientApproximate es una respuesta parcial aproximada (modo approximate) de
+// las queries 3 y 5, el resultado exacto llega despues con su mensaje normal
+type ClientApproximate struct {
+	QueryId  int
+	Cutoff   int
+	TopStats []Game
+}
+
+func (m *ClientApproximate) GetMessageType() MessageType {
+	return MessageTypeClientApproximate
+}
+
+func (m *ClientApproximate) Encode() string {
+	games := []string{}
+	for _, game := range m.TopStats {
+		games = append(games, game.Encode())
+	}
+	return fmt.Sprintf("%d;%d;%s", m.QueryId, m.Cutoff, strings.Join(games, "\n"))
+}
+
+func (m *ClientApproximate) Decode(data string) error {
+	parts := strings.SplitN(data, ";", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid approximate data: %s", data)
+	}
+
+	queryId, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return err
+	}
+	cutoff, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return err
+	}
+
+	m.QueryId = queryId
+	m.Cutoff = cutoff
+
+	if parts[2] == "" {
+		return nil
+	}
+
+	for _, part := range strings.Split(parts[2], "\n") {
+		game := Game{}
+		if err := game.Decode(part); err != nil {
+			return err
+		}
+		m.TopStats = append(m.TopStats, game)
+	}
+	return nil
+}
+
+// Hello es el primer mensaje de un cliente nuevo, el servidor responde con
+// SessionInfo con el id asignado. Priority es "low", "normal", "high" o un
+// numero del 0 al 9, vacio es normal.
+type Hello struct {
+	Priority string
+}
+
+func (m *Hello) GetMessageType() MessageType {
+	return MessageTypeHello
+}
+
+func (m *Hello) Encode() string {
+	return m.Priority
+}
+
+func (m *Hello) Decode(data string) error {
+	m.Priority = data
+	return nil
+}
+
+// Resume lo manda un cliente que perdio la conexion (por ejemplo porque se
+// reinicio el servidor) para seguir recibiendo los resultados de su sesion
+type Resume struct {
+	ClientId string
+}
+
+func (m *Resume) GetMessageType() MessageType {
+	return MessageTypeResume
+}
+
+func (m *Resume) Encode() string {
+	return m.ClientId
+}
+
+func (m *Resume) Decode(data string) error {
+	m.ClientId = data
+	return nil
+}
+
+// SessionInfo es la respuesta a Hello y Resume. Un ClientId vacio significa
+// que la sesion no se puede retomar.
+type SessionInfo struct {
+	ClientId string
+}
+
+func (m *SessionInfo) GetMessageType() MessageType {
+	return MessageTypeSessionInfo
+}
+
+func (m *SessionInfo) Encode() string {
+	return m.ClientId
+}
+
+func (m *SessionInfo) Decode(data string) error {
+	m.ClientId = data
+	return nil
+}
+
+// Busy es la respuesta a Hello cuando el servidor no admite mas clientes. El
+// cliente vuelve a intentar despues de RetryAfter segundos.
+type Busy struct {
+	RetryAfter int
+}
+
+func (m *Busy) GetMessageType() MessageType {
+	return MessageTypeBusy
+}
+
+func (m *Busy) Encode() string {
+	return strconv.Itoa(m.RetryAfter)
+}
+
+func (m *Busy) Decode(data string) error {
+	retryAfter, err := strconv.Atoi(data)
+	if err != nil {
+		return err
+	}
+	m.RetryAfter = retryAfter
+	return nil
+}
+
+// Cancel lo manda el cliente para abortar su sesion en cualquier momento, el
+// servidor contesta CancelAck y, cuando ningun nodo tiene estado del cliente,
+// Cancelled
+type Cancel struct{}
+
+func (m *Cancel) GetMessageType() MessageType {
+	return MessageTypeCancel
+}
+
+func (m *Cancel) Encode() string {
+	return ""
+}
+
+func (m *Cancel) Decode(data string) error {
+	return nil
+}
+
+// CancelAck confirma que el servidor recibio el Cancel. Nodes es cuantos nodos
+// tienen que confirmar que borraron el estado del cliente.
+type CancelAck struct {
+	Nodes int
+}
+
+func (m *CancelAck) GetMessageType() MessageType {
+	return MessageTypeCancelAck
+}
+
+func (m *CancelAck) Encode() string {
+	return strconv.Itoa(m.Nodes)
+}
+
+func (m *CancelAck) Decode(data string) error {
+	nodes, err := strconv.Atoi(data)
+	if err != nil {
+		return err
+	}
+	m.Nodes = nodes
+	return nil
+}
+
+// Cancelled es la confirmacion final del Cancel, despues el servidor cierra
+// la conexion
+type Cancelled struct{}
+
+func (m *Cancelled) GetMessageType() MessageType {
+	return MessageTypeCancelled
+}
+
+func (m *Cancelled) Encode() string {
+	return ""
+}
+
+func (m *Cancelled) Decode(data string) error {
+	return nil
+}
@@ -0,0 +1,111 @@
+package sketch
+
+import (
+	"math"
+	"sort"
+)
+
+// Quantiles is a relative-error quantile sketch (DDSketch style): values are
+// counted in logarithmic buckets, so any quantile is returned with a relative
+// error of at most Alpha. Buckets are plain counters, which makes the sketch
+// mergeable and lets a value be removed when a game's count changes.
+type Quantiles struct {
+	Alpha   float64
+	Buckets map[int]int
+	Zeros   int
+	Count   int
+}
+
+func NewQuantiles(alpha float64) *Quantiles {
+	return &Quantiles{
+		Alpha:   alpha,
+		Buckets: make(map[int]int),
+	}
+}
+
+func (q *Quantiles) gamma() float64 {
+	return (1 + q.Alpha) / (1 - q.Alpha)
+}
+
+func (q *Quantiles) key(value float64) int {
+	return int(math.Ceil(math.Log(value) / math.Log(q.gamma())))
+}
+
+func (q *Quantiles) Add(value float64) {
+	q.Count++
+	if value <= 0 {
+		q.Zeros++
+		return
+	}
+	q.Buckets[q.key(value)]++
+}
+
+func (q *Quantiles) Remove(value float64) {
+	if value <= 0 {
+		if q.Zeros > 0 {
+			q.Zeros--
+			q.Count--
+		}
+		return
+	}
+
+	key := q.key(value)
+	if q.Buckets[key] == 0 {
+		return
+	}
+
+	q.Count--
+	q.Buckets[key]--
+	if q.Buckets[key] == 0 {
+		delete(q.Buckets, key)
+	}
+}
+
+// Update moves a value that changed from old to new (e.g. a game that got
+// one more negative review).
+func (q *Quantiles) Update(old float64, new float64) {
+	if old > 0 {
+		q.Remove(old)
+	}
+	q.Add(new)
+}
+
+func (q *Quantiles) Merge(other *Quantiles) {
+	if other == nil {
+		return
+	}
+
+	for key, count := range other.Buckets {
+		q.Buckets[key] += count
+	}
+	q.Zeros += other.Zeros
+	q.Count += other.Count
+}
+
+// Quantile returns an estimation of the value at quantile p (0 <= p <= 1).
+func (q *Quantiles) Quantile(p float64) float64 {
+	if q.Count == 0 {
+		return 0
+	}
+
+	rank := int(p * float64(q.Count-1))
+	if rank < q.Zeros {
+		return 0
+	}
+
+	keys := make([]int, 0, len(q.Buckets))
+	for key := range q.Buckets {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+
+	seen := q.Zeros
+	for _, key := range keys {
+		seen += q.Buckets[key]
+		if seen > rank {
+			return 2 * math.Pow(q.gamma(), float64(key)) / (q.gamma() + 1)
+		}
+	}
+
+	return 2 * math.Pow(q.gamma(), float64(keys[len(keys)-1])) / (q.gamma() + 1)
+}
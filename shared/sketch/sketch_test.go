@@ -0,0 +1,135 @@
+package sketch
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopKMergeOfDisjointShardsIsExact(t *testing.T) {
+	r := rand.New(rand.NewSource(27))
+
+	counts := make(map[int]int)
+	shards := []*TopK{NewTopK(50), NewTopK(50)}
+	for i := 0; i < 20000; i++ {
+		// skewed distribution so there are clear heavy hitters
+		appId := int(math.Floor(math.Pow(r.Float64(), 3) * 500))
+		counts[appId]++
+		shards[appId%2].Offer(appId, "game", 1)
+	}
+
+	merged := NewTopK(50)
+	for _, shard := range shards {
+		merged.Merge(shard)
+	}
+
+	expected := make([]int, 0, len(counts))
+	for appId := range counts {
+		expected = append(expected, appId)
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		if counts[expected[i]] != counts[expected[j]] {
+			return counts[expected[i]] > counts[expected[j]]
+		}
+		return expected[i] < expected[j]
+	})
+
+	top := merged.Top(5)
+	for i, item := range top {
+		assert.Equal(t, expected[i], item.AppId)
+		assert.LessOrEqual(t, counts[item.AppId], item.Count)
+		assert.LessOrEqual(t, item.Count-item.Error, counts[item.AppId])
+	}
+}
+
+func TestTopKSetAtCapacityIsExact(t *testing.T) {
+	topK := NewTopK(3)
+	topK.Set(1, "a", 10)
+	topK.Set(2, "b", 5)
+	topK.Set(3, "c", 7)
+
+	// the minimum is evicted without adding its count to the new item
+	topK.Set(4, "d", 8)
+	assert.Equal(t, []Item{
+		{AppId: 1, Name: "a", Count: 10},
+		{AppId: 4, Name: "d", Count: 8},
+		{AppId: 3, Name: "c", Count: 7},
+	}, topK.Top(3))
+
+	// a count that does not beat the minimum is left out
+	topK.Set(5, "e", 2)
+	_, ok := topK.Items[5]
+	assert.False(t, ok)
+	assert.Len(t, topK.Items, 3)
+}
+
+func TestTopKMergeOfOverlappingShardsAtCapacity(t *testing.T) {
+	r := rand.New(rand.NewSource(28))
+
+	counts := make(map[int]int)
+	shards := []*TopK{NewTopK(20), NewTopK(20), NewTopK(20)}
+	for i := 0; i < 30000; i++ {
+		appId := int(math.Floor(math.Pow(r.Float64(), 3) * 400))
+		counts[appId]++
+		// the same appId can reach any shard
+		shards[r.Intn(len(shards))].Offer(appId, "game", 1)
+	}
+	for _, shard := range shards {
+		assert.Len(t, shard.Items, 20)
+	}
+
+	merged := NewTopK(20)
+	for _, shard := range shards {
+		merged.Merge(shard)
+	}
+	assert.Len(t, merged.Items, 20)
+
+	for _, item := range merged.Top(20) {
+		assert.LessOrEqual(t, counts[item.AppId], item.Count, "app %d", item.AppId)
+		assert.LessOrEqual(t, item.Count-item.Error, counts[item.AppId], "app %d", item.AppId)
+	}
+
+	heaviest := 0
+	for appId := range counts {
+		if counts[appId] > counts[heaviest] {
+			heaviest = appId
+		}
+	}
+	assert.Equal(t, heaviest, merged.Top(1)[0].AppId)
+}
+
+func TestQuantilesRelativeError(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+
+	values := make([]float64, 0)
+	shards := []*Quantiles{NewQuantiles(0.01), NewQuantiles(0.01), NewQuantiles(0.01)}
+	for i := 0; i < 10000; i++ {
+		value := float64(r.Intn(2000) + 1)
+		values = append(values, value)
+		shards[i%3].Add(value)
+	}
+
+	merged := NewQuantiles(0.01)
+	for _, shard := range shards {
+		merged.Merge(shard)
+	}
+	sort.Float64s(values)
+
+	for _, p := range []float64{0.5, 0.9, 0.99} {
+		exact := values[int(p*float64(len(values)-1))]
+		assert.InEpsilon(t, exact, merged.Quantile(p), 0.011, "quantile %v", p)
+	}
+}
+
+func TestQuantilesUpdate(t *testing.T) {
+	q := NewQuantiles(0.01)
+	q.Add(1)
+	q.Update(1, 2)
+	q.Update(2, 3)
+
+	assert.Equal(t, 1, q.Count)
+	assert.InEpsilon(t, 3.0, q.Quantile(0.5), 0.011)
+}
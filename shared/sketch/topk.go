@@ -0,0 +1,141 @@
+package sketch
+
+import "sort"
+
+// TopK is a Space-Saving summary: it keeps at most Capacity counters and,
+// when full, replaces the smallest one. Counts are overestimated by at most
+// Error. Two summaries can be merged, so each shard keeps its own and the
+// reducer merges them.
+type TopK struct {
+	Capacity int
+	Items    map[int]*Item
+}
+
+type Item struct {
+	AppId int
+	Name  string
+	Count int
+	Error int
+}
+
+func NewTopK(capacity int) *TopK {
+	return &TopK{
+		Capacity: capacity,
+		Items:    make(map[int]*Item),
+	}
+}
+
+func (s *TopK) Offer(appId int, name string, inc int) {
+	if item, ok := s.Items[appId]; ok {
+		item.Count += inc
+		return
+	}
+
+	if len(s.Items) < s.Capacity {
+		s.Items[appId] = &Item{AppId: appId, Name: name, Count: inc}
+		return
+	}
+
+	min := s.min()
+	delete(s.Items, min.AppId)
+	s.Items[appId] = &Item{AppId: appId, Name: name, Count: min.Count + inc, Error: min.Count}
+}
+
+// Set replaces the count of appId with an exact value (used when restoring
+// the summary from the stats stored on disk). When the summary is full the
+// minimum is evicted without inheriting its count, and a count that does not
+// beat the minimum is left out, as Space-Saving already bounds it by the
+// minimum.
+func (s *TopK) Set(appId int, name string, count int) {
+	if item, ok := s.Items[appId]; ok {
+		item.Count = count
+		item.Error = 0
+		return
+	}
+
+	if len(s.Items) >= s.Capacity {
+		min := s.min()
+		if min == nil || count <= min.Count {
+			return
+		}
+		delete(s.Items, min.AppId)
+	}
+	s.Items[appId] = &Item{AppId: appId, Name: name, Count: count}
+}
+
+// Merge adds other into s. An item missing from a full summary may still have
+// been counted up to that summary's minimum, so it gets that minimum as both
+// count and error, keeping Count an upper bound and Count-Error a lower bound.
+func (s *TopK) Merge(other *TopK) {
+	if other == nil {
+		return
+	}
+
+	floor, otherFloor := s.floor(), other.floor()
+
+	for appId, item := range s.Items {
+		if _, ok := other.Items[appId]; !ok {
+			item.Count += otherFloor
+			item.Error += otherFloor
+		}
+	}
+
+	for appId, item := range other.Items {
+		if current, ok := s.Items[appId]; ok {
+			current.Count += item.Count
+			current.Error += item.Error
+			continue
+		}
+		copied := *item
+		copied.Count += floor
+		copied.Error += floor
+		s.Items[appId] = &copied
+	}
+
+	if len(s.Items) <= s.Capacity {
+		return
+	}
+
+	for _, item := range s.Top(len(s.Items))[s.Capacity:] {
+		delete(s.Items, item.AppId)
+	}
+}
+
+// Top returns the n items with the biggest counts, ties broken by appId.
+func (s *TopK) Top(n int) []Item {
+	items := make([]Item, 0, len(s.Items))
+	for _, item := range s.Items {
+		items = append(items, *item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].AppId < items[j].AppId
+	})
+
+	if n < len(items) {
+		items = items[:n]
+	}
+	return items
+}
+
+// floor is the most an item outside the summary can have been counted: the
+// minimum when the summary is full, 0 otherwise.
+func (s *TopK) floor() int {
+	if len(s.Items) == 0 || len(s.Items) < s.Capacity {
+		return 0
+	}
+	return s.min().Count
+}
+
+func (s *TopK) min() *Item {
+	var min *Item
+	for _, item := range s.Items {
+		if min == nil || item.Count < min.Count || (item.Count == min.Count && item.AppId > min.AppId) {
+			min = item
+		}
+	}
+	return min
+}
@@ -5,16 +5,14 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"sort"
 	"strconv"
 	"tp1-distribuidos/middleware"
-
-	"github.com/op/go-logging"
+	"tp1-distribuidos/shared/logs"
 )
 
-var log = logging.MustGetLogger("log")
+var log = logs.Get("shared")
 
-func GetStat(clientId string, appId int) *middleware.Stats {
+func GetStat(clientId middleware.ClientId, appId int) *middleware.Stats {
 	file, err := os.OpenFile(fmt.Sprintf("./database/%s/stats/%d.csv", clientId, appId), os.O_RDWR|os.O_CREATE, 0777)
 	if err != nil {
 		log.Errorf("failed to open file: %v", err)
@@ -39,7 +37,7 @@ func GetStat(clientId string, appId int) *middleware.Stats {
 	return stat
 }
 
-func UpdateStat(clientId string, stat *middleware.Stats, tmpFile *os.File, cache *Cache[*middleware.Stats]) *middleware.Stats {
+func UpdateStat(clientId middleware.ClientId, stat *middleware.Stats, tmpFile *os.File, cache *Cache[*middleware.Stats]) *middleware.Stats {
 	if cached, ok := cache.Get(int32(stat.AppId)); ok {
 		stat.Negatives += cached.Negatives
 		stat.Positives += cached.Positives
@@ -87,12 +85,12 @@ func UpdateStat(clientId string, stat *middleware.Stats, tmpFile *os.File, cache
 	return stat
 }
 
-func GetTopStatsFS(clientId string, cant int, compare func(a *middleware.Stats, b *middleware.Stats) bool) []middleware.Stats {
-	top := make([]middleware.Stats, 0)
-
+// ForEachStatFS calls fn with every stat stored for the client.
+func ForEachStatFS(clientId middleware.ClientId, fn func(stat *middleware.Stats)) {
 	dentries, err := os.ReadDir(fmt.Sprintf("./database/%s/stats", clientId))
 	if err != nil {
 		log.Errorf("failed to read directory: %v", err)
+		return
 	}
 
 	for _, dentry := range dentries {
@@ -100,44 +98,25 @@ func GetTopStatsFS(clientId string, cant int, compare func(a *middleware.Stats,
 			file, err := os.Open(fmt.Sprintf("./database/%s/stats/%s", clientId, dentry.Name()))
 			if err != nil {
 				log.Errorf("failed to open file: %v", err)
+				return
 			}
-
 			defer file.Close()
 
-			reader := csv.NewReader(file)
-
-			record, err := reader.Read()
-			if err != nil && err != io.EOF {
+			record, err := csv.NewReader(file).Read()
+			if err != nil {
 				log.Errorf("failed to read line: %v", err)
+				return
 			}
 
-			newStat, err := ParseStat(record)
+			stat, err := ParseStat(record)
 			if err != nil {
 				log.Errorf("Error parsing stat: %s", err)
 				return
 			}
 
-			place := -1
-			for i, topStat := range top {
-				if compare(newStat, &topStat) {
-					place = i
-					break
-				}
-			}
-
-			if len(top) < cant {
-				top = append(top, *newStat)
-			} else if place != -1 {
-				top[cant-1] = *newStat
-			}
-
-			sort.Slice(top, func(i, j int) bool {
-				return compare(&top[i], &top[j])
-			})
+			fn(stat)
 		}()
 	}
-
-	return top
 }
 
 func ParseStat(record []string) (*middleware.Stats, error) {
@@ -6,16 +6,27 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
+	"tp1-distribuidos/config"
 	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared/metrics"
+	"tp1-distribuidos/shared/tracing"
 
 	"math/rand"
 )
 
 var DEBUG_TOLERANCE = false
 
+var (
+	duplicatesSkipped = metrics.NewCounter("duplicates_skipped_total", "Ids found already processed by Processed.Contains.")
+	commitDuration    = metrics.NewHistogram("commit_duration_seconds", "Time between writing a commit and ending it.", nil)
+)
+
 type Processed struct {
+	path      string
 	file      *os.File
 	processed map[int64]bool
 }
@@ -38,7 +49,7 @@ func NewProcessed(path string) *Processed {
 		processed[current] = true
 	}
 
-	return &Processed{file: file, processed: processed}
+	return &Processed{path: path, file: file, processed: processed}
 }
 
 func (p *Processed) Add(id int64) {
@@ -56,7 +67,11 @@ func (p *Processed) Add(id int64) {
 }
 
 func (p *Processed) Contains(id int64) bool {
-	return p.processed[id]
+	if p.processed[id] {
+		duplicatesSkipped.With().Inc()
+		return true
+	}
+	return false
 }
 
 func (p *Processed) Count() int {
@@ -64,6 +79,9 @@ func (p *Processed) Count() int {
 }
 
 func (p *Processed) Close() {
+	if p == nil {
+		return
+	}
 	p.file.Close()
 }
 
@@ -71,10 +89,76 @@ func (p *Processed) Data() map[int64]bool {
 	return p.processed
 }
 
+// Retain se queda solo con los ids para los que keep devuelve true. El archivo
+// se reescribe en un temporal y se renombra, un crash en el medio deja el
+// archivo anterior entero.
+func (p *Processed) Retain(keep func(id int64) bool) error {
+	kept := make(map[int64]bool)
+	for id := range p.processed {
+		if keep(id) {
+			kept[id] = true
+		}
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	for id := range kept {
+		if err := binary.Write(tmpFile, binary.BigEndian, id); err != nil {
+			tmpFile.Close()
+			return err
+		}
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), p.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
+	if err != nil {
+		return err
+	}
+	p.file.Close()
+	p.file = file
+	p.processed = kept
+	return nil
+}
+
+// ReadProcessed lee los ids de un archivo de Processed sin abrirlo para
+// escribir, en el orden en que se agregaron. Un id escrito a medias al final
+// se ignora.
+func ReadProcessed(path string) ([]int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ids := []int64{}
+	var current int64
+	for {
+		err := binary.Read(file, binary.BigEndian, &current)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ids, nil
+		}
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, current)
+	}
+}
+
 type Commit struct {
-	commit *os.File
-	writer *csv.Writer
-	Data   [][]string
+	commit  *os.File
+	writer  *csv.Writer
+	Data    [][]string
+	started time.Time
+	span    *tracing.Span
 }
 
 // data: [[filename, tmpFilename],[filename, tmpFilename],[key,value]]
@@ -96,12 +180,16 @@ func NewCommit(path string) *Commit {
 	return &Commit{commit: commit, writer: writer}
 }
 
-func (c *Commit) Write(data [][]string) {
+// Write escribe el commit. trace es el mensaje que lo origino, el span de
+// commit dura hasta End.
+func (c *Commit) Write(trace tracing.SpanContext, data [][]string) {
 	if c.Data != nil {
 		log.Infof("Last commit was not ended, last: %v, new: %v", c.Data, data)
 	}
 
 	c.Data = data
+	c.started = time.Now()
+	c.span = tracing.Start("commit", trace)
 	c.commit.Truncate(0)
 	c.writer.WriteAll(data)
 	c.writer.Write([]string{"END"})
@@ -111,6 +199,23 @@ func (c *Commit) Write(data [][]string) {
 func (c *Commit) End() {
 	c.commit.Truncate(0)
 	c.Data = nil
+	if !c.started.IsZero() {
+		commitDuration.With().Observe(time.Since(c.started).Seconds())
+		c.started = time.Time{}
+	}
+	if c.span != nil {
+		c.span.Finish()
+		c.span = nil
+	}
+}
+
+// Close cierra el archivo de commit, se llama al apagar el nodo cuando ya no
+// hay commits en curso
+func (c *Commit) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.commit.Close()
 }
 
 func RestoreCommit(path string, onCommit func(commit *Commit)) {
@@ -178,18 +283,39 @@ func TestTolerance(n int, in int, msg string) {
 	}
 }
 
+// FinishedClients borra el estado de los clientes terminados y los recuerda
+// en database/tombstones/<name>.bin para ignorar lo que llegue despues. Cada
+// instancia tiene su archivo aunque corran varias en el mismo nodo.
 type FinishedClients struct {
 	name       string
 	lock       sync.Mutex
-	finished   *Processed
+	finished   *Tombstones
 	middleware *middleware.Middleware
 }
 
+// NewFinishedClients abre los tombstones de la instancia. La primera vez que
+// arranca despues de la actualizacion les migra los clientes de
+// LEGACY_FINISHED_CLIENTS.
 func NewFinishedClients(name string, m *middleware.Middleware) *FinishedClients {
+	path := fmt.Sprintf("%s/%s.bin", TOMBSTONES_DIR, name)
+	_, statErr := os.Stat(path)
+
+	finished, err := NewTombstones(path, TombstoneRetention(m.Config))
+	if err != nil {
+		log.Errorf("action: open_tombstones | result: fail | node: %s | path: %s | error: %s, se recuerdan solo en memoria", name, path, err)
+	} else if os.IsNotExist(statErr) {
+		migrated, err := finished.Migrate(LEGACY_FINISHED_CLIENTS, time.Now())
+		if err != nil {
+			log.Errorf("action: migrate_tombstones | result: fail | node: %s | error: %s", name, err)
+		} else if migrated > 0 {
+			log.Infof("action: migrate_tombstones | result: success | node: %s | clients: %d", name, migrated)
+		}
+	}
+
 	return &FinishedClients{
 		name:       name,
 		lock:       sync.Mutex{},
-		finished:   NewProcessed("database/finished-clients.bin"),
+		finished:   finished,
 		middleware: m,
 	}
 }
@@ -201,18 +327,58 @@ func (fc *FinishedClients) Consume() error {
 	}
 
 	go clientsFinishedQueue.Consume(func(message *middleware.ClientsFinishedMsg) error {
-		log.Infof("action: handle_clients_finished | client: %d", message.ClientId)
+		log.Infof("action: handle_clients_finished | client: %s", message.ClientId)
 		fc.lock.Lock()
-		fc.finished.Add(int64(message.ClientId))
-		os.RemoveAll(fmt.Sprintf("./database/%d", message.ClientId))
+		fc.finished.Add(message.ClientId, time.Now())
+		os.RemoveAll(fmt.Sprintf("./database/%s", message.ClientId))
+		processJanitor.forget(message.ClientId)
+		metrics.Default.Forget("client", message.ClientId.String())
+
+		// el server que mando el ClientsFinished espera la confirmacion de
+		// todos los nodos y le reenvia el mensaje a los que no contestan
+		done := &middleware.CleanupDoneMsg{ClientId: message.ClientId, Node: fc.name}
+		done.SetTrace(message.Trace())
+		if err := fc.middleware.SendCleanupDoneTo(message.ReplyTo, done); err != nil {
+			log.Errorf("action: cleanup_done | result: fail | node: %s | client: %s | error: %s", fc.name, message.ClientId, err)
+		}
+
 		message.Ack()
 		fc.lock.Unlock()
 		return nil
 	})
 
+	go fc.expireTombstones(time.Duration(fc.middleware.Config.Tombstones.CompactInterval) * time.Second)
+
+	if janitor := fc.middleware.Config.Janitor; janitor.TTL > 0 {
+		processJanitor.register(fc, "./database", time.Duration(janitor.TTL)*time.Second, time.Duration(janitor.Interval)*time.Second)
+	}
+
 	return nil
 }
 
+// CleanupNodes son los nombres de todos los FinishedClients del sistema, los
+// que tienen que mandar CleanupDone para dar por borrado a un cliente. Tienen
+// que coincidir con los nombres que usan el mapper, las queries y los reducers.
+func CleanupNodes(config *config.Config) []string {
+	nodes := []string{}
+	for id := 1; id <= config.Mappers.Amount; id++ {
+		nodes = append(nodes, "finished-mapper-games."+strconv.Itoa(id), "finished-mapper-reviews."+strconv.Itoa(id))
+	}
+
+	enabled := []bool{config.Query.Query1, config.Query.Query2, config.Query.Query3, config.Query.Query4, config.Query.Query5}
+	for i, query := range enabled {
+		if !query {
+			continue
+		}
+		for shard := range config.Sharding.Amount {
+			nodes = append(nodes, fmt.Sprintf("finished-%d.%d", i+1, shard))
+		}
+		nodes = append(nodes, "finished-reducer-"+strconv.Itoa(i+1))
+	}
+
+	return nodes
+}
+
 func (fc *FinishedClients) Lock() {
 	fc.lock.Lock()
 }
@@ -221,11 +387,35 @@ func (fc *FinishedClients) Unlock() {
 	fc.lock.Unlock()
 }
 
-func (fc *FinishedClients) Contains(clientId string) bool {
-	clientIdInt, err := strconv.Atoi(clientId)
-	if err != nil {
-		log.Errorf("Error converting client id to int: %s", err)
-		return false
+// Contains indica si el cliente termino. Se llama por cada mensaje consumido,
+// si el cliente sigue vivo cuenta como actividad para el janitor.
+func (fc *FinishedClients) Contains(clientId middleware.ClientId) bool {
+	if fc.finished.Contains(clientId) {
+		return true
+	}
+	processJanitor.touch(clientId, time.Now())
+	return false
+}
+
+// expireTombstones olvida cada interval los clientes que terminaron hace mas
+// de la retencion
+func (fc *FinishedClients) expireTombstones(interval time.Duration) {
+	if interval <= 0 {
+		interval = TOMBSTONES_DEFAULT_COMPACT_INTERVAL
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fc.lock.Lock()
+		expired := fc.finished.Expire(time.Now())
+		count := fc.finished.Count()
+		fc.lock.Unlock()
+
+		tombstonesCount.With(fc.name).Set(float64(count))
+		if expired > 0 {
+			log.Infof("action: expire_tombstones | result: success | node: %s | expired: %d | remaining: %d", fc.name, expired, count)
+		}
 	}
-	return fc.finished.Contains(int64(clientIdInt))
 }
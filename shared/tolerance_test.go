@@ -0,0 +1,23 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessedRetainCompactsFile(t *testing.T) {
+	path := t.TempDir() + "/processed.bin"
+
+	processed := NewProcessed(path)
+	for id := range int64(5) {
+		processed.Add(id)
+	}
+	assert.Nil(t, processed.Retain(func(id int64) bool { return id%2 == 0 }))
+	processed.Add(7)
+	processed.Close()
+
+	ids, err := ReadProcessed(path)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []int64{0, 2, 4, 7}, ids)
+}
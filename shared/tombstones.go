@@ -0,0 +1,210 @@
+package shared
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+	"tp1-distribuidos/config"
+	"tp1-distribuidos/middleware"
+	"tp1-distribuidos/shared/metrics"
+)
+
+const CLEANUP_DEFAULT_RETRY_INTERVAL = 30 * time.Second
+const CLEANUP_DEFAULT_MAX_RETRIES = 5
+const TOMBSTONES_DEFAULT_RETENTION = 24 * time.Hour
+const TOMBSTONES_DEFAULT_COMPACT_INTERVAL = 10 * time.Minute
+const TOMBSTONES_DIR = "database/tombstones"
+
+// LEGACY_FINISHED_CLIENTS es donde todos los FinishedClients de un nodo
+// guardaban los clientes terminados antes de los tombstones por instancia
+const LEGACY_FINISHED_CLIENTS = "database/finished-clients.bin"
+
+// un registro es el id del cliente y cuando termino, en nanosegundos
+const tombstoneSize = 16
+
+var tombstonesCount = metrics.NewGauge("tombstones", "Finished clients remembered to ignore their late messages.", "node")
+
+// RedeliveryWindow es cuanto despues del primer ClientsFinished puede llegarle
+// a un nodo el ultimo reintento del server (cleanup.retryInterval por
+// cleanup.maxRetries). Mensajes del cliente que sigan en vuelo llegan antes.
+func RedeliveryWindow(config *config.Config) time.Duration {
+	interval := time.Duration(config.Cleanup.RetryInterval) * time.Second
+	if interval <= 0 {
+		interval = CLEANUP_DEFAULT_RETRY_INTERVAL
+	}
+	retries := config.Cleanup.MaxRetries
+	if retries <= 0 {
+		retries = CLEANUP_DEFAULT_MAX_RETRIES
+	}
+	return interval * time.Duration(retries+1)
+}
+
+// TombstoneRetention es tombstones.retention, nunca menor a la ventana de
+// redelivery. Si despues llega algo de un cliente olvidado lo borra el janitor.
+func TombstoneRetention(config *config.Config) time.Duration {
+	retention := time.Duration(config.Tombstones.Retention) * time.Second
+	if retention <= 0 {
+		retention = TOMBSTONES_DEFAULT_RETENTION
+	}
+	if window := RedeliveryWindow(config); retention < window {
+		log.Warningf("action: tombstone_retention | result: fail | retention: %s | window: %s | error: se usa la ventana de redelivery", retention, window)
+		retention = window
+	}
+	return retention
+}
+
+// Tombstones son los clientes terminados de un FinishedClients con el momento
+// en que terminaron. El archivo es append-only, Expire olvida los que pasaron
+// retention y lo reescribe con los que quedan.
+type Tombstones struct {
+	path      string
+	file      *os.File
+	retention time.Duration
+	finished  map[middleware.ClientId]time.Time
+	records   int // registros en el archivo, incluidos los que ya vencieron
+}
+
+// NewTombstones abre los tombstones de path. Si no se puede abrir el archivo
+// devuelve el error junto con tombstones vacios que solo viven en memoria.
+func NewTombstones(path string, retention time.Duration) (*Tombstones, error) {
+	tombstones := &Tombstones{path: path, retention: retention, finished: make(map[middleware.ClientId]time.Time)}
+
+	os.MkdirAll(filepath.Dir(path), 0777)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
+	if err != nil {
+		return tombstones, err
+	}
+	tombstones.file = file
+
+	record := make([]byte, tombstoneSize)
+	for {
+		if _, err := io.ReadFull(file, record); err != nil {
+			// un registro escrito a medias se descarta para que el proximo
+			// quede alineado
+			if err == io.ErrUnexpectedEOF {
+				file.Truncate(int64(tombstones.records * tombstoneSize))
+			}
+			break
+		}
+		clientId := middleware.ClientId(binary.BigEndian.Uint64(record[:8]))
+		tombstones.finished[clientId] = time.Unix(0, int64(binary.BigEndian.Uint64(record[8:])))
+		tombstones.records++
+	}
+
+	return tombstones, nil
+}
+
+// Migrate agrega los clientes del archivo compartido que se usaba antes de los
+// tombstones por instancia (ids de Processed, sin el momento en que
+// terminaron). Se toman como terminados en now, asi se recuerdan la retencion
+// completa. Un archivo que no existe no tiene nada para migrar.
+func (t *Tombstones) Migrate(legacy string, now time.Time) (int, error) {
+	ids, err := ReadProcessed(legacy)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		t.Add(middleware.ClientId(id), now)
+	}
+	return len(ids), nil
+}
+
+func (t *Tombstones) Add(clientId middleware.ClientId, now time.Time) {
+	if _, ok := t.finished[clientId]; ok {
+		return
+	}
+
+	t.finished[clientId] = now
+	if t.file == nil {
+		return
+	}
+	if err := t.write(t.file, clientId, now); err != nil {
+		log.Errorf("action: add_tombstone | result: fail | client: %s | error: %s", clientId, err)
+		return
+	}
+	t.records++
+}
+
+func (t *Tombstones) write(file *os.File, clientId middleware.ClientId, finishedAt time.Time) error {
+	record := make([]byte, tombstoneSize)
+	binary.BigEndian.PutUint64(record[:8], uint64(clientId))
+	binary.BigEndian.PutUint64(record[8:], uint64(finishedAt.UnixNano()))
+	_, err := file.Write(record)
+	return err
+}
+
+func (t *Tombstones) Contains(clientId middleware.ClientId) bool {
+	if _, ok := t.finished[clientId]; ok {
+		duplicatesSkipped.With().Inc()
+		return true
+	}
+	return false
+}
+
+func (t *Tombstones) Count() int {
+	return len(t.finished)
+}
+
+// Expire olvida los clientes que terminaron hace mas de retention y compacta
+// el archivo si quedaron registros viejos. Devuelve cuantos olvido.
+func (t *Tombstones) Expire(now time.Time) int {
+	expired := 0
+	for clientId, finishedAt := range t.finished {
+		if now.Sub(finishedAt) > t.retention {
+			delete(t.finished, clientId)
+			expired++
+		}
+	}
+
+	if t.records > len(t.finished) {
+		if err := t.compact(); err != nil {
+			log.Errorf("action: compact_tombstones | result: fail | path: %s | error: %s", t.path, err)
+		}
+	}
+	return expired
+}
+
+// compact escribe los registros vigentes en un temporal y lo renombra, un
+// crash en el medio deja el archivo anterior entero
+func (t *Tombstones) compact() error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(t.path), filepath.Base(t.path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	for clientId, finishedAt := range t.finished {
+		if err := t.write(tmpFile, clientId, finishedAt); err != nil {
+			tmpFile.Close()
+			return err
+		}
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), t.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(t.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
+	if err != nil {
+		return err
+	}
+	t.file.Close()
+	t.file = file
+	t.records = len(t.finished)
+	return nil
+}
+
+func (t *Tombstones) Close() {
+	if t == nil {
+		return
+	}
+	t.file.Close()
+}
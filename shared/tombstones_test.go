@@ -0,0 +1,127 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tp1-distribuidos/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTombstonesExpireAndCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tombstones", "finished-1.0.bin")
+	now := time.Now()
+
+	tombstones := openTombstones(t, path)
+	tombstones.Add(1001, now.Add(-2*time.Hour))
+	tombstones.Add(1002, now.Add(-30*time.Minute))
+	tombstones.Add(1003, now)
+	tombstones.Add(1003, now)
+
+	assert.True(t, tombstones.Contains(1001))
+	assert.Equal(t, 3, tombstones.Count())
+
+	assert.Equal(t, 1, tombstones.Expire(now))
+	assert.False(t, tombstones.Contains(1001))
+	assert.True(t, tombstones.Contains(1002))
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2*tombstoneSize), info.Size())
+
+	// lo que se agrega despues de compactar sigue en el mismo archivo
+	tombstones.Add(1004, now)
+	tombstones.Close()
+
+	reopened := openTombstones(t, path)
+	assert.Equal(t, 3, reopened.Count())
+	assert.False(t, reopened.Contains(1001))
+	assert.True(t, reopened.Contains(1004))
+}
+
+func TestTombstonesDiscardPartialRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "finished.bin")
+	now := time.Now()
+
+	tombstones := openTombstones(t, path)
+	tombstones.Add(1001, now)
+	tombstones.Close()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0777)
+	assert.Nil(t, err)
+	file.Write([]byte{0, 0, 0})
+	file.Close()
+
+	reopened := openTombstones(t, path)
+	reopened.Add(1002, now)
+	reopened.Close()
+
+	assert.ElementsMatch(t, []int{1001, 1002}, tombstoneIds(openTombstones(t, path)))
+}
+
+func TestTombstoneRetentionCoversRedeliveryWindow(t *testing.T) {
+	cfg := &config.Config{}
+	assert.Equal(t, TOMBSTONES_DEFAULT_RETENTION, TombstoneRetention(cfg))
+
+	cfg.Cleanup = config.CleanupConfig{RetryInterval: 60, MaxRetries: 9}
+	cfg.Tombstones.Retention = 300
+	assert.Equal(t, 10*time.Minute, TombstoneRetention(cfg))
+
+	cfg.Tombstones.Retention = 3600
+	assert.Equal(t, time.Hour, TombstoneRetention(cfg))
+}
+
+func tombstoneIds(tombstones *Tombstones) []int {
+	ids := []int{}
+	for clientId := range tombstones.finished {
+		ids = append(ids, int(clientId))
+	}
+	return ids
+}
+
+func TestTombstonesMigrateLegacyFile(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	legacy := NewProcessed(filepath.Join(dir, "finished-clients.bin"))
+	legacy.Add(1001)
+	legacy.Add(1002)
+	legacy.Close()
+
+	path := filepath.Join(dir, "tombstones", "finished-1.0.bin")
+	tombstones := openTombstones(t, path)
+	migrated, err := tombstones.Migrate(filepath.Join(dir, "finished-clients.bin"), now)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, migrated)
+	tombstones.Close()
+
+	// se recuerdan la retencion completa desde la migracion
+	reopened := openTombstones(t, path)
+	assert.ElementsMatch(t, []int{1001, 1002}, tombstoneIds(reopened))
+	assert.Equal(t, 0, reopened.Expire(now.Add(30*time.Minute)))
+
+	migrated, err = reopened.Migrate(filepath.Join(dir, "missing.bin"), now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, migrated)
+}
+
+func TestTombstonesInMemoryWhenFileFails(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "tombstones"), []byte("x"), 0777))
+
+	tombstones, err := NewTombstones(filepath.Join(dir, "tombstones", "finished-1.0.bin"), time.Hour)
+	assert.NotNil(t, err)
+
+	tombstones.Add(1001, time.Now())
+	assert.True(t, tombstones.Contains(1001))
+	tombstones.Expire(time.Now())
+	tombstones.Close()
+}
+
+func openTombstones(t *testing.T, path string) *Tombstones {
+	tombstones, err := NewTombstones(path, time.Hour)
+	assert.Nil(t, err)
+	return tombstones
+}
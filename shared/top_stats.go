@@ -0,0 +1,114 @@
+package shared
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"sort"
+	"tp1-distribuidos/middleware"
+)
+
+// TopStats keeps the top size stats of a client ordered by less. It relies on
+// the counts only growing: a game outside the top can only get in when its own
+// stat is updated, so checking the updated stat against the top is enough and
+// the files of the other games never have to be read again.
+type TopStats struct {
+	size  int
+	less  func(a *middleware.Stats, b *middleware.Stats) bool
+	Stats []middleware.Stats
+}
+
+func NewTopStats(size int, less func(a *middleware.Stats, b *middleware.Stats) bool) *TopStats {
+	return &TopStats{
+		size:  size,
+		less:  less,
+		Stats: make([]middleware.Stats, 0, size+1),
+	}
+}
+
+// LoadTopStats reads a top stored with Store. A missing file is an empty top.
+func LoadTopStats(path string, size int, less func(a *middleware.Stats, b *middleware.Stats) bool) (*TopStats, error) {
+	top := NewTopStats(size, less)
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return top, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return top, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		stat, err := ParseStat(record)
+		if err != nil {
+			return nil, err
+		}
+		top.Stats = append(top.Stats, *stat)
+	}
+}
+
+// Clone returns a copy of the top that can be updated without touching t
+func (t *TopStats) Clone() *TopStats {
+	clone := NewTopStats(t.size, t.less)
+	clone.Stats = append(clone.Stats, t.Stats...)
+	return clone
+}
+
+// Update registers the new value of stat and returns true if the top changed
+func (t *TopStats) Update(stat *middleware.Stats) bool {
+	index := -1
+	for i := range t.Stats {
+		if t.Stats[i].AppId == stat.AppId {
+			index = i
+			break
+		}
+	}
+
+	if index == -1 {
+		if len(t.Stats) == t.size && !t.less(stat, &t.Stats[len(t.Stats)-1]) {
+			return false
+		}
+		t.Stats = append(t.Stats, *stat)
+	} else {
+		t.Stats[index] = *stat
+	}
+
+	sort.SliceStable(t.Stats, func(i, j int) bool {
+		return t.less(&t.Stats[i], &t.Stats[j])
+	})
+	if len(t.Stats) > t.size {
+		t.Stats = t.Stats[:t.size]
+	}
+
+	return true
+}
+
+// Store writes the top to file (appId,name,positives,negatives)
+func (t *TopStats) Store(file *os.File) error {
+	writer := csv.NewWriter(file)
+	for _, stat := range t.Stats {
+		if err := writer.Write(StatRecord(&stat)); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// ByPositivesDesc orders stats by positives (descending) breaking ties by appId
+func ByPositivesDesc(a *middleware.Stats, b *middleware.Stats) bool {
+	if a.Positives != b.Positives {
+		return a.Positives > b.Positives
+	}
+	return a.AppId < b.AppId
+}
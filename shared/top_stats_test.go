@@ -0,0 +1,62 @@
+package shared
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"tp1-distribuidos/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopStatsMatchesFullSort(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	path := filepath.Join(t.TempDir(), "top.csv")
+
+	games := make(map[int]*middleware.Stats)
+	for i := 0; i < 5000; i++ {
+		appId := r.Intn(300)
+		stat, ok := games[appId]
+		if !ok {
+			stat = &middleware.Stats{AppId: appId, Name: "game"}
+			games[appId] = stat
+		}
+		stat.Positives++
+
+		// se recarga del disco cada tanto como haria un reinicio
+		top, err := LoadTopStats(path, 5, ByPositivesDesc)
+		assert.Nil(t, err)
+		if top.Update(stat) {
+			file, err := os.Create(path)
+			assert.Nil(t, err)
+			assert.Nil(t, top.Store(file))
+			file.Close()
+		}
+	}
+
+	all := make([]middleware.Stats, 0, len(games))
+	for _, stat := range games {
+		all = append(all, *stat)
+	}
+	sort.Slice(all, func(i, j int) bool { return ByPositivesDesc(&all[i], &all[j]) })
+
+	top, err := LoadTopStats(path, 5, ByPositivesDesc)
+	assert.Nil(t, err)
+	assert.Equal(t, all[:5], top.Stats)
+}
+
+func TestTopStatsCloneLeavesOriginal(t *testing.T) {
+	top := NewTopStats(2, ByPositivesDesc)
+	top.Update(&middleware.Stats{AppId: 1, Positives: 5})
+	top.Update(&middleware.Stats{AppId: 2, Positives: 3})
+
+	clone := top.Clone()
+	assert.True(t, clone.Update(&middleware.Stats{AppId: 2, Positives: 9}))
+	assert.True(t, clone.Update(&middleware.Stats{AppId: 3, Positives: 7}))
+
+	assert.Equal(t, []int{2, 3}, []int{clone.Stats[0].AppId, clone.Stats[1].AppId})
+	assert.Equal(t, 1, top.Stats[0].AppId)
+	assert.Equal(t, 3, top.Stats[1].Positives)
+}
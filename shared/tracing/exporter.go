@@ -0,0 +1,267 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BATCH_SIZE     = 256
+	FLUSH_INTERVAL = time.Second
+	QUEUE_SIZE     = 4096 // si el exporter no da abasto se descartan spans
+)
+
+// Exporter manda un batch de spans terminados a algun lado
+type Exporter interface {
+	Export(service string, spans []*Span) error
+}
+
+type tracer struct {
+	service  string
+	exporter Exporter
+	spans    chan *Span
+	done     sync.WaitGroup
+	dropped  atomic.Int64
+}
+
+var current atomic.Pointer[tracer]
+
+// Init configura el exporter del nodo: "stdout" escribe un JSON por linea,
+// "otlp" postea a endpoint (OTLP/HTTP con JSON, por ejemplo
+// http://collector:4318/v1/traces) y "" o "none" no exporta, aunque el
+// contexto se sigue propagando.
+func Init(service string, exporter string, endpoint string) error {
+	var e Exporter
+	switch exporter {
+	case "", "none":
+		current.Store(nil)
+		return nil
+	case "stdout":
+		e = NewJSONExporter(os.Stdout)
+	case "otlp":
+		if endpoint == "" {
+			return fmt.Errorf("tracing exporter otlp needs an endpoint")
+		}
+		e = NewOTLPExporter(endpoint)
+	default:
+		return fmt.Errorf("unknown tracing exporter %s", exporter)
+	}
+
+	t := &tracer{service: service, exporter: e, spans: make(chan *Span, QUEUE_SIZE)}
+	t.done.Add(1)
+	go t.run()
+	current.Store(t)
+	return nil
+}
+
+// Shutdown exporta los spans pendientes, se registra como paso de close del
+// lifecycle
+func Shutdown() error {
+	t := current.Swap(nil)
+	if t == nil {
+		return nil
+	}
+	close(t.spans)
+	t.done.Wait()
+	if dropped := t.dropped.Load(); dropped > 0 {
+		log.Infof("action: tracing_shutdown | result: success | dropped_spans: %d", dropped)
+	}
+	return nil
+}
+
+func (t *tracer) export(span *Span) {
+	select {
+	case t.spans <- span:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (t *tracer) run() {
+	defer t.done.Done()
+
+	ticker := time.NewTicker(FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, BATCH_SIZE)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(t.service, batch); err != nil {
+			log.Errorf("action: tracing_export | result: fail | spans: %d | error: %s", len(batch), err)
+		}
+		batch = make([]*Span, 0, BATCH_SIZE)
+	}
+
+	for {
+		select {
+		case span, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) == BATCH_SIZE {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func exportSpan(span *Span) {
+	if t := current.Load(); t != nil {
+		t.export(span)
+	}
+}
+
+// JSONExporter escribe un span por linea, para ver las trazas sin collector
+// (por ejemplo con `docker compose logs | grep trace_id`)
+type JSONExporter struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+func NewJSONExporter(writer io.Writer) *JSONExporter {
+	return &JSONExporter{writer: writer}
+}
+
+type jsonSpan struct {
+	Service    string            `json:"service"`
+	TraceId    string            `json:"trace_id"`
+	SpanId     string            `json:"span_id"`
+	ParentId   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Start      time.Time         `json:"start"`
+	DurationMs float64           `json:"duration_ms"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func (e *JSONExporter) Export(service string, spans []*Span) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	encoder := json.NewEncoder(e.writer)
+	for _, span := range spans {
+		line := jsonSpan{
+			Service:    service,
+			TraceId:    hex.EncodeToString(span.Context.TraceId[:]),
+			SpanId:     hex.EncodeToString(span.Context.SpanId[:]),
+			Name:       span.Name,
+			Start:      span.Start,
+			DurationMs: float64(span.End.Sub(span.Start).Microseconds()) / 1000,
+			Attributes: span.Attributes,
+		}
+		if span.Parent != [8]byte{} {
+			line.ParentId = hex.EncodeToString(span.Parent[:])
+		}
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OTLPExporter postea los spans con OTLP/HTTP en JSON, lo acepta el
+// OpenTelemetry Collector y la mayoria de los backends (Jaeger, Tempo)
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{endpoint: endpoint, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+const otlpSpanKindInternal = 1
+
+func (e *OTLPExporter) Export(service string, spans []*Span) error {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "tp1-distribuidos"
+	for _, span := range spans {
+		converted := otlpSpan{
+			TraceId:           hex.EncodeToString(span.Context.TraceId[:]),
+			SpanId:            hex.EncodeToString(span.Context.SpanId[:]),
+			Name:              span.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if span.Parent != [8]byte{} {
+			converted.ParentSpanId = hex.EncodeToString(span.Parent[:])
+		}
+		for key, value := range span.Attributes {
+			converted.Attributes = append(converted.Attributes, otlpAttribute{key, otlpValue{value}})
+		}
+		scope.Spans = append(scope.Spans, converted)
+	}
+
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = []otlpAttribute{{"service.name", otlpValue{service}}}
+
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{resource}})
+	if err != nil {
+		return err
+	}
+
+	response, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"tp1-distribuidos/shared/logs"
+)
+
+var log = logs.Get("tracing")
+
+// HEADER es el header AMQP con el contexto, en el formato de W3C Trace Context
+const HEADER = "traceparent"
+
+// SpanContext identifica un span dentro de una traza. Es lo unico que viaja
+// entre nodos.
+type SpanContext struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceId != [16]byte{}
+}
+
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(sc.TraceId[:]), hex.EncodeToString(sc.SpanId[:]))
+}
+
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return SpanContext{}, false
+	}
+
+	sc := SpanContext{}
+	if _, err := hex.Decode(sc.TraceId[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanId[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	return sc, sc.IsValid()
+}
+
+// ClientTrace es la raiz de la traza de un cliente. El trace id sale del id
+// del cliente, asi todo lo del cliente queda en la misma traza aunque algun
+// mensaje se publique sin contexto, y se puede buscar por cliente.
+func ClientTrace(clientId uint64) SpanContext {
+	sc := SpanContext{}
+	copy(sc.TraceId[:4], "tp1c")
+	binary.BigEndian.PutUint64(sc.TraceId[8:], clientId)
+	return sc
+}
+
+type Span struct {
+	Name       string
+	Context    SpanContext
+	Parent     [8]byte
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	lock       sync.Mutex
+	ended      bool
+}
+
+// Start abre un span hijo de parent. Si parent no es valido empieza una
+// traza nueva.
+func Start(name string, parent SpanContext, attributes ...string) *Span {
+	span := &Span{
+		Name:       name,
+		Context:    SpanContext{TraceId: parent.TraceId},
+		Parent:     parent.SpanId,
+		Start:      time.Now(),
+		Attributes: make(map[string]string, len(attributes)/2),
+	}
+	if !parent.IsValid() {
+		rand.Read(span.Context.TraceId[:])
+	}
+	rand.Read(span.Context.SpanId[:])
+
+	for i := 0; i+1 < len(attributes); i += 2 {
+		span.Attributes[attributes[i]] = attributes[i+1]
+	}
+	return span
+}
+
+func (s *Span) SetAttribute(key string, value string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Attributes[key] = value
+}
+
+// Finish cierra el span y lo manda al exporter, solo la primera vez
+func (s *Span) Finish() {
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.lock.Unlock()
+
+	exportSpan(s)
+}
@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	span := Start("consume games", ClientTrace(42))
+
+	parsed, ok := ParseTraceparent(span.Context.Traceparent())
+	assert.True(t, ok)
+	assert.Equal(t, span.Context, parsed)
+	assert.Equal(t, ClientTrace(42).TraceId, parsed.TraceId)
+
+	_, ok = ParseTraceparent("00-nothex-00f067aa0ba902b7-01")
+	assert.False(t, ok)
+	_, ok = ParseTraceparent("00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	assert.False(t, ok)
+}
+
+func TestStartWithoutParentStartsNewTrace(t *testing.T) {
+	first := Start("a", SpanContext{})
+	second := Start("b", SpanContext{})
+
+	assert.True(t, first.Context.IsValid())
+	assert.NotEqual(t, first.Context.TraceId, second.Context.TraceId)
+	assert.Equal(t, [8]byte{}, first.Parent)
+}
+
+func TestJSONExporter(t *testing.T) {
+	output := &bytes.Buffer{}
+	parent := Start("handle games", ClientTrace(7))
+	child := Start("commit", parent.Context, "query", "1")
+	child.Finish()
+
+	assert.NoError(t, NewJSONExporter(output).Export("query1", []*Span{child}))
+
+	line := map[string]any{}
+	assert.NoError(t, json.Unmarshal(output.Bytes(), &line))
+	assert.Equal(t, "query1", line["service"])
+	assert.Equal(t, "commit", line["name"])
+	assert.Equal(t, "1", line["attributes"].(map[string]any)["query"])
+	assert.Equal(t, parent.Context.Traceparent()[36:52], line["parent_id"])
+}
+
+func TestInitExportsFinishedSpansOnShutdown(t *testing.T) {
+	received := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- body
+	}))
+	defer collector.Close()
+
+	assert.NoError(t, Init("mapper", "otlp", collector.URL))
+	Start("publish reviews", ClientTrace(1)).Finish()
+	assert.NoError(t, Shutdown())
+
+	body := <-received
+	assert.Contains(t, string(body), `"service.name"`)
+	assert.Contains(t, string(body), `"name":"publish reviews"`)
+}
+
+func TestInitRejectsUnknownExporter(t *testing.T) {
+	assert.Error(t, Init("mapper", "zipkin", ""))
+	assert.Error(t, Init("mapper", "otlp", ""))
+	assert.NoError(t, Init("mapper", "none", ""))
+}
@@ -48,14 +48,14 @@ func handleConnection(conn *net.UDPConn) {
 	for {
 		n, remoteAddr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
-			fmt.Printf("Error reading from UDP: %v\n", err)
+			log.Errorf("Error reading from UDP: %v", err)
 			continue
 		}
 
 		var msg ResurrecterMessage
 		decoder := gob.NewDecoder(bytes.NewReader(buffer[:n]))
 		if err := decoder.Decode(&msg); err != nil {
-			fmt.Printf("Error decoding message: %v\n", err)
+			log.Errorf("Error decoding message: %v", err)
 			continue
 		}
 
@@ -69,13 +69,13 @@ func handleConnection(conn *net.UDPConn) {
 			var buf bytes.Buffer
 			encoder := gob.NewEncoder(&buf)
 			if err := encoder.Encode(response); err != nil {
-				fmt.Printf("Error encoding message: %v\n", err)
+				log.Errorf("Error encoding message: %v", err)
 				continue
 			}
 
 			_, err = conn.WriteToUDP(buf.Bytes(), remoteAddr)
 			if err != nil {
-				fmt.Printf("Error sending response: %v\n", err)
+				log.Errorf("Error sending response: %v", err)
 			}
 		}
 	}